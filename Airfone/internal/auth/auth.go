@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"path"
+	"strings"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+	"Airfone/internal/engine"
+)
+
+// 认证与授权
+//
+//	任何能访问注册中心的调用方都可以猜测 topic 与递增的 id 注销别人的服务，或者以任意主题注册恶意的提供者
+//	思路: server 中的中间件从 authorization 头中取出 API 令牌或 JWT，认证后将身份放入 ctx，
+//	service 在将 topic 转换为限定名之后按身份的策略检查，策略中的主题为模式:
+//	1. register: 允许注册为的主题，注册与更新时检查
+//	2. depend: 允许依赖的主题，注册、更新时检查声明的依赖，监听、查询与事件只返回允许的主题
+//	3. admin: 允许管理的主题，管理接口检查
+//	注册的 service 绑定到注册它的身份(engine.Service.Owner)，更新、注销、心跳、确认与会话只允许该身份操作
+//	开启认证之前注册的 service 没有所有者，绑定到第一个操作它的身份
+//	未配置任何身份与 JWT 密钥时不开启，ctx 中没有身份，全部放行，与之前的行为一致
+
+// 策略中的操作
+type Action uint8
+
+const (
+	ACTION_REGISTER Action = iota // 注册为该主题
+	ACTION_DEPEND                 // 依赖、监听与查询该主题
+	ACTION_ADMIN                  // 管理该主题
+)
+
+func (a Action) String() string {
+	switch a {
+	case ACTION_REGISTER:
+		return "register"
+	case ACTION_DEPEND:
+		return "depend"
+	}
+	return "admin"
+}
+
+// 身份
+//
+//	主题模式形如 命名空间/topic，两部分都可以使用通配(如 staging/*、*/log)，
+//	不带命名空间时属于默认命名空间，单独的 * 匹配全部主题
+type Identity struct {
+	Name     string   // 身份名
+	Register []string // 允许注册为的主题
+	Depend   []string // 允许依赖、监听与查询的主题
+	Admin    []string // 允许管理的主题
+}
+
+// 是否允许对主题(限定名)执行操作
+func (i *Identity) Allowed(action Action, topic string) bool {
+	ns, name := engine.SplitTopic(topic)
+	for _, p := range i.patterns(action) {
+		if match(p, ns, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否允许对全部主题执行操作，即策略中有 * 或 */*
+//
+//	无法按主题过滤的接口(如 /metrics)使用
+func (i *Identity) AllowedAll(action Action) bool {
+	for _, p := range i.patterns(action) {
+		if p == "*" || p == "*"+engine.NAMESPACE_SEPARATOR+"*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Identity) patterns(action Action) []string {
+	switch action {
+	case ACTION_REGISTER:
+		return i.Register
+	case ACTION_DEPEND:
+		return i.Depend
+	}
+	return i.Admin
+}
+
+// 主题是否匹配模式
+func match(pattern, namespace, topic string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if !strings.Contains(pattern, engine.NAMESPACE_SEPARATOR) {
+		pattern = engine.NAMESPACE_DEFAULT + engine.NAMESPACE_SEPARATOR + pattern
+	}
+	ok, _ := path.Match(pattern, namespace+engine.NAMESPACE_SEPARATOR+topic)
+	return ok
+}
+
+// 检查 ctx 中的身份是否允许对这些主题(限定名)执行操作，ctx 中没有身份(未开启认证)时放行
+func Authorize(ctx context.Context, action Action, topics ...string) error {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	for _, t := range topics {
+		if !id.Allowed(action, t) {
+			return errorpb.ErrorForbidden("identity %s is not allowed to %s topic %s", id.Name, action, t)
+		}
+	}
+	return nil
+}
+
+// 认证器
+type Authenticator struct {
+	tokens map[[sha256.Size]byte]*Identity // 按令牌的摘要索引，避免比较令牌时泄露时间信息
+	names  map[string]*Identity            // 按身份名索引，客户端证书认证时使用
+	secret []byte                          // JWT 的密钥
+}
+
+// 根据配置创建认证器，未配置任何身份与 JWT 密钥时返回 nil，表示不开启
+func New(c *conf.Server_Auth) *Authenticator {
+	if len(c.GetIdentities()) == 0 && c.GetJwtSecret() == "" {
+		return nil
+	}
+	a := &Authenticator{
+		tokens: make(map[[sha256.Size]byte]*Identity, len(c.Identities)),
+		names:  make(map[string]*Identity, len(c.Identities)),
+		secret: []byte(c.JwtSecret),
+	}
+	for _, i := range c.Identities {
+		// 没有名字的身份无法绑定服务
+		if i.Name == "" {
+			continue
+		}
+		id := &Identity{
+			Name:     i.Name,
+			Register: i.Register,
+			Depend:   i.Depend,
+			Admin:    i.Admin,
+		}
+		a.names[i.Name] = id
+		// 没有令牌的身份只能通过客户端证书认证
+		if i.Token != "" {
+			a.tokens[sha256.Sum256([]byte(i.Token))] = id
+		}
+	}
+	return a
+}
+
+// 认证 authorization 头，形如 Bearer <token>，令牌中带有两个 . 时视为 JWT
+func (a *Authenticator) Authenticate(header string) (*Identity, error) {
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if token == "" {
+		return nil, errorpb.ErrorUnauthorized("missing credential")
+	}
+	if id, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+		return id, nil
+	}
+	if len(a.secret) > 0 && strings.Count(token, ".") == 2 {
+		return a.verify(token)
+	}
+	return nil, errorpb.ErrorUnauthorized("invalid credential")
+}
+
+// 按身份名获取配置中的身份，集群节点转发以客户端证书认证的请求时使用(见 Nodes)
+func (a *Authenticator) Lookup(name string) (*Identity, error) {
+	if id, ok := a.names[name]; ok {
+		return id, nil
+	}
+	return nil, errorpb.ErrorUnauthorized("unknown forwarded identity %q", name)
+}
+
+type identityKey struct{}
+
+// 将身份放入 ctx
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// 获取 ctx 中的身份，未开启认证时返回 false
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+)
+
+// 策略中的主题模式
+func TestAllowed(t *testing.T) {
+	id := &Identity{
+		Name:     "logsvc",
+		Register: []string{"log", "staging/*"},
+		Depend:   []string{"*/common"},
+		Admin:    []string{"*"},
+	}
+	tests := []struct {
+		action Action
+		topic  string
+		want   bool
+	}{
+		{ACTION_REGISTER, "default/log", true},
+		{ACTION_REGISTER, "prod/log", false},
+		{ACTION_REGISTER, "default/logs", false},
+		{ACTION_REGISTER, "staging/log", true},
+		{ACTION_REGISTER, "staging/audit", true},
+		{ACTION_REGISTER, "default/audit", false},
+		{ACTION_DEPEND, "default/common", true},
+		{ACTION_DEPEND, "prod/common", true},
+		{ACTION_DEPEND, "default/log", false},
+		{ACTION_ADMIN, "prod/anything", true},
+	}
+	for _, tt := range tests {
+		if got := id.Allowed(tt.action, tt.topic); got != tt.want {
+			t.Errorf("Allowed(%s, %s) = %v, want %v", tt.action, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// 只有 * 与 */* 允许全部主题
+func TestAllowedAll(t *testing.T) {
+	tests := []struct {
+		depend []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"log"}, false},
+		{[]string{"default/*"}, false},
+		{[]string{"*/log"}, false},
+		{[]string{"log", "*"}, true},
+		{[]string{"*/*"}, true},
+	}
+	for _, tt := range tests {
+		id := &Identity{Name: "ops", Depend: tt.depend}
+		if got := id.AllowedAll(ACTION_DEPEND); got != tt.want {
+			t.Errorf("AllowedAll(depend %v) = %v, want %v", tt.depend, got, tt.want)
+		}
+	}
+}
+
+// ctx 中没有身份时放行，有身份时每个主题都要允许
+func TestAuthorize(t *testing.T) {
+	ctx := NewContext(context.Background(), &Identity{Name: "logsvc", Depend: []string{"log"}})
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		topics  []string
+		wantErr bool
+	}{
+		{"no identity", context.Background(), []string{"default/common"}, false},
+		{"allowed", ctx, []string{"default/log"}, false},
+		{"one topic denied", ctx, []string{"default/log", "default/common"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Authorize(tt.ctx, ACTION_DEPEND, tt.topics...)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("Authorize = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errorpb.IsForbidden(err) {
+				t.Errorf("Authorize = %v, want FORBIDDEN", err)
+			}
+		})
+	}
+}
+
+// API 令牌的认证，未配置身份与密钥时不开启
+func TestAuthenticate(t *testing.T) {
+	if a := New(&conf.Server_Auth{}); a != nil {
+		t.Fatal("authenticator created without identities and jwt secret")
+	}
+	a := New(&conf.Server_Auth{Identities: []*conf.Server_Auth_Identity{
+		{Name: "logsvc", Token: "log-token", Register: []string{"log"}},
+		{Token: "anonymous-token"},
+	}})
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"bearer token", "Bearer log-token", "logsvc"},
+		{"bare token", "log-token", "logsvc"},
+		{"missing", "", ""},
+		{"bearer without token", "Bearer ", ""},
+		{"unknown token", "Bearer nope", ""},
+		{"identity without name", "Bearer anonymous-token", ""},
+		{"jwt without secret", "Bearer a.b.c", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.Authenticate(tt.header)
+			if tt.want == "" {
+				if !errorpb.IsUnauthorized(err) {
+					t.Errorf("Authenticate = %v, %v, want UNAUTHORIZED", id, err)
+				}
+				return
+			}
+			if err != nil || id.Name != tt.want {
+				t.Errorf("Authenticate = %v, %v, want %s", id, err, tt.want)
+			}
+		})
+	}
+}
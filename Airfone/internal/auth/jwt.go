@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"Airfone/api/errorpb"
+)
+
+// JWT
+//
+//	只接受 HS256 签名的令牌，由签发方与注册中心共享密钥(server.auth.jwt_secret)
+//	sub 为身份名，策略与 API 令牌的身份相同，放在 register、depend 与 admin 中；
+//	带有 exp、nbf 时检查有效期
+
+// JWT 的头部
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// JWT 的声明
+type jwtClaims struct {
+	Sub      string   `json:"sub"`
+	Exp      int64    `json:"exp,omitempty"`
+	Nbf      int64    `json:"nbf,omitempty"`
+	Register []string `json:"register,omitempty"`
+	Depend   []string `json:"depend,omitempty"`
+	Admin    []string `json:"admin,omitempty"`
+}
+
+// 校验 JWT 的签名与有效期，返回其中的身份
+func (a *Authenticator) verify(token string) (*Identity, error) {
+	var (
+		parts  = strings.Split(token, ".")
+		header jwtHeader
+		claims jwtClaims
+	)
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errorpb.ErrorUnauthorized("invalid jwt header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errorpb.ErrorUnauthorized("invalid jwt signature")
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errorpb.ErrorUnauthorized("invalid jwt signature")
+	}
+	if err = decodeSegment(parts[1], &claims); err != nil || claims.Sub == "" {
+		return nil, errorpb.ErrorUnauthorized("invalid jwt claims")
+	}
+	now := time.Now().Unix()
+	if claims.Exp != 0 && now >= claims.Exp {
+		return nil, errorpb.ErrorUnauthorized("jwt expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return nil, errorpb.ErrorUnauthorized("jwt not valid yet")
+	}
+	return &Identity{
+		Name:     claims.Sub,
+		Register: claims.Register,
+		Depend:   claims.Depend,
+		Admin:    claims.Admin,
+	}, nil
+}
+
+// 解码 JWT 中 base64url 编码的 json
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+)
+
+// 以 secret 签名，header 与 claims 原样编码
+func signJWT(t *testing.T, secret string, header, claims interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := encode(header) + "." + encode(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// HS256 的签名、算法与有效期
+func TestVerifyJWT(t *testing.T) {
+	var (
+		a      = New(&conf.Server_Auth{JwtSecret: "secret"})
+		now    = time.Now().Unix()
+		hs256  = jwtHeader{Alg: "HS256"}
+		claims = jwtClaims{Sub: "logsvc", Register: []string{"log"}, Depend: []string{"common"}}
+	)
+	var (
+		valid  = signJWT(t, "secret", hs256, claims)
+		parts  = strings.Split(valid, ".")
+		forged = strings.Split(signJWT(t, "other", hs256, jwtClaims{Sub: "admin", Admin: []string{"*"}}), ".")
+	)
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"within validity", signJWT(t, "secret", hs256, jwtClaims{Sub: "logsvc", Exp: now + 60, Nbf: now - 60}), true},
+		{"bad signature", signJWT(t, "other", hs256, claims), false},
+		{"tampered claims", parts[0] + "." + forged[1] + "." + parts[2], false},
+		{"signature not base64", parts[0] + "." + parts[1] + ".!!", false},
+		{"expired", signJWT(t, "secret", hs256, jwtClaims{Sub: "logsvc", Exp: now - 1}), false},
+		{"not valid yet", signJWT(t, "secret", hs256, jwtClaims{Sub: "logsvc", Nbf: now + 60}), false},
+		{"alg none", signJWT(t, "secret", jwtHeader{Alg: "none"}, claims), false},
+		{"alg HS512", signJWT(t, "secret", jwtHeader{Alg: "HS512"}, claims), false},
+		{"without sub", signJWT(t, "secret", hs256, jwtClaims{Register: []string{"log"}}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.Authenticate("Bearer " + tt.token)
+			if !tt.ok {
+				if !errorpb.IsUnauthorized(err) {
+					t.Errorf("Authenticate = %v, %v, want UNAUTHORIZED", id, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Name != "logsvc" {
+				t.Errorf("identity = %s, want logsvc", id.Name)
+			}
+		})
+	}
+
+	// 策略取自声明
+	id, err := a.Authenticate("Bearer " + valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Allowed(ACTION_REGISTER, "default/log") || id.Allowed(ACTION_REGISTER, "default/common") ||
+		!id.Allowed(ACTION_DEPEND, "default/common") || id.Allowed(ACTION_ADMIN, "default/log") {
+		t.Errorf("policy of jwt identity = %+v", id)
+	}
+}
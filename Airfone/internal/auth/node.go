@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net"
+
+	"Airfone/internal/conf"
+)
+
+// 转发时携带的头，只接受来自集群节点的请求
+const (
+	FORWARDED_KEY = "x-airfone-forwarded" // 转发标记，被转发的请求不会再次转发
+	IDENTITY_KEY  = "x-airfone-identity"  // 以客户端证书认证的调用方的身份名
+)
+
+// 集群节点的识别
+//
+//	follower 以本节点的证书转发请求，leader 看到的证书是节点的，而不是调用方的
+//	思路: 调用方携带 authorization 头时原样转发，由 leader 重新认证；以客户端证书认证时，
+//	follower 将认证出的身份名放入 IDENTITY_KEY，leader 只在对方出示的证书属于集群节点时接受
+//	1. 开启 TLS 时，通过校验的客户端证书包含某个节点 grpc_addr 中的 ip 或域名即为节点(与 leader 出示的服务端证书要求相同)
+//	2. 没有客户端证书时比较对方的 ip 与节点 grpc_addr 解析出的 ip，只用于转发标记，不接受身份名
+//	其他调用方携带这两个头时由 server 丢弃(见 server/auth.go)
+type Nodes struct {
+	hosts []string // 节点 grpc_addr 中的 ip 或域名
+}
+
+// 根据集群配置创建，未开启集群时不识别任何节点
+func NewNodes(c *conf.Data) *Nodes {
+	n := &Nodes{}
+	for _, p := range c.GetCluster().GetPeers() {
+		host, _, err := net.SplitHostPort(p.GetGrpcAddr())
+		if err != nil || host == "" {
+			continue
+		}
+		n.hosts = append(n.hosts, host)
+	}
+	return n
+}
+
+// 通过校验的客户端证书是否属于集群节点
+func (n *Nodes) Cert(cert *x509.Certificate) bool {
+	if n == nil || cert == nil {
+		return false
+	}
+	for _, host := range n.hosts {
+		if cert.VerifyHostname(host) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 对方的地址是否属于集群节点
+func (n *Nodes) Addr(addr net.Addr) bool {
+	if n == nil || addr == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, h := range n.hosts {
+		if other := net.ParseIP(h); other != nil {
+			if other.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		ips, err := net.LookupIP(h)
+		if err != nil {
+			continue
+		}
+		for _, other := range ips {
+			if other.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+)
+
+// 集群节点以证书或地址识别
+func TestNodes(t *testing.T) {
+	nodes := NewNodes(&conf.Data{Cluster: &conf.Data_Cluster{Peers: []*conf.Data_Cluster_Peer{
+		{Id: "node0", GrpcAddr: "10.0.0.1:9000"},
+		{Id: "node1", GrpcAddr: "node1.airfone.local:9000"},
+		{Id: "node2", GrpcAddr: "bad-addr"},
+	}}})
+	certs := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{"node dns", &x509.Certificate{DNSNames: []string{"node1.airfone.local"}}, true},
+		{"node ip", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, true},
+		{"wildcard", &x509.Certificate{DNSNames: []string{"*.airfone.local"}}, true},
+		{"client", &x509.Certificate{DNSNames: []string{"logsvc"}}, false},
+		{"other ip", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.9")}}, false},
+		{"none", nil, false},
+	}
+	for _, tt := range certs {
+		if got := nodes.Cert(tt.cert); got != tt.want {
+			t.Errorf("Cert(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	addrs := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.9"), Port: 40000}, false},
+		{nil, false},
+	}
+	for _, tt := range addrs {
+		if got := nodes.Addr(tt.addr); got != tt.want {
+			t.Errorf("Addr(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// 未开启集群时不识别任何节点
+	none := NewNodes(&conf.Data{})
+	if none.Cert(certs[0].cert) || none.Addr(addrs[0].addr) {
+		t.Error("node recognized without cluster")
+	}
+}
+
+// 节点转发的身份名只对应配置中的身份，JWT 中的身份与未知的名字不被接受
+func TestLookupForwarded(t *testing.T) {
+	a := New(&conf.Server_Auth{
+		JwtSecret: "secret",
+		Identities: []*conf.Server_Auth_Identity{
+			{Name: "logsvc", Register: []string{"log"}},
+		},
+	})
+	id, err := a.Lookup("logsvc")
+	if err != nil || id.Name != "logsvc" || !id.Allowed(ACTION_REGISTER, "default/log") {
+		t.Fatalf("Lookup(logsvc) = %+v, %v", id, err)
+	}
+	for _, name := range []string{"", "admin", "jwt-subject"} {
+		if _, err = a.Lookup(name); !errorpb.IsUnauthorized(err) {
+			t.Errorf("Lookup(%q) = %v, want UNAUTHORIZED", name, err)
+		}
+	}
+
+	// 客户端证书按 SAN 对应同名的身份
+	if id, err = a.AuthenticateCert(&x509.Certificate{DNSNames: []string{"other", "logsvc"}}); err != nil || id.Name != "logsvc" {
+		t.Errorf("AuthenticateCert = %+v, %v, want logsvc", id, err)
+	}
+	if _, err = a.AuthenticateCert(&x509.Certificate{DNSNames: []string{"stray"}}); !errorpb.IsUnauthorized(err) {
+		t.Errorf("AuthenticateCert(stray) = %v, want UNAUTHORIZED", err)
+	}
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+)
+
+// TLS
+//
+//	对外的 grpc 与 http 服务使用同一份证书，配置了 client_ca_file 时校验客户端证书，
+//	require_client_cert 为 true 时要求客户端出示证书(mTLS)，否则客户端可以不出示
+//	集群中 follower 转发给 leader 时作为客户端，出示本节点的证书，并以 client_ca_file 校验 leader 的证书，
+//	节点的证书需要同时可以用于服务端与客户端认证
+//	客户端证书通过校验后，其中的 SAN(dns、uri、email)可以作为身份，对应 identities 中同名的身份，
+//	请求没有携带 authorization 头时使用(见 Authenticator.Authenticate)
+type TLS struct {
+	Server *tls.Config // 对外服务的配置，未开启时为 nil
+	Client *tls.Config // 转发给 leader 时的配置，未开启时为 nil
+}
+
+// 根据配置加载证书，未配置 cert_file 时不开启
+func NewTLS(c *conf.Server) (*TLS, error) {
+	t := c.GetTls()
+	if t.GetCertFile() == "" {
+		return &TLS{}, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate: %w", err)
+	}
+	var (
+		server = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		client = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	)
+	if t.ClientCaFile != "" {
+		pool, err := loadPool(t.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		server.ClientCAs = pool
+		server.ClientAuth = tls.VerifyClientCertIfGiven
+		client.RootCAs = pool
+	}
+	if t.RequireClientCert {
+		if t.ClientCaFile == "" {
+			return nil, fmt.Errorf("require_client_cert needs client_ca_file")
+		}
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &TLS{Server: server, Client: client}, nil
+}
+
+// 读取 PEM 格式的 CA 证书
+func loadPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("load ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("load ca: no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+// 证书中可以作为身份名的 SAN
+func certNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, len(cert.DNSNames)+len(cert.URIs)+len(cert.EmailAddresses))
+	names = append(names, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return append(names, cert.EmailAddresses...)
+}
+
+// 认证已经通过校验的客户端证书，按顺序取第一个与身份名相同的 SAN
+func (a *Authenticator) AuthenticateCert(cert *x509.Certificate) (*Identity, error) {
+	for _, name := range certNames(cert) {
+		if id, ok := a.names[name]; ok {
+			return id, nil
+		}
+	}
+	return nil, errorpb.ErrorUnauthorized("no identity for client certificate %s", cert.Subject)
+}
@@ -0,0 +1,55 @@
+package biz
+
+import (
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+	"context"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type AdminUsecase struct {
+	repo irepo.AdminRepo
+	log  *log.Helper
+}
+
+func NewAdminUsecase(repo irepo.AdminRepo, logger *log.Helper) *AdminUsecase {
+	return &AdminUsecase{
+		repo: repo,
+		log:  logger,
+	}
+}
+
+func (uc *AdminUsecase) Topics(ctx context.Context) ([]*irepo.TopicInfo, error) {
+	return uc.repo.Topics(ctx)
+}
+
+func (uc *AdminUsecase) Graph(ctx context.Context) ([]*irepo.TopicEdge, error) {
+	return uc.repo.Graph(ctx)
+}
+
+func (uc *AdminUsecase) Describe(ctx context.Context, topic string, id int64) (*irepo.Instance, int32, error) {
+	return uc.repo.Describe(ctx, topic, id)
+}
+
+func (uc *AdminUsecase) Evict(ctx context.Context, topic string, id int64) error {
+	var (
+		now = time.Now()
+	)
+	return uc.repo.Evict(ctx, now.UnixNano(), topic, id)
+}
+
+func (uc *AdminUsecase) Move(ctx context.Context, topic string, id int64, status engine.HeartBeatType) error {
+	var (
+		now = time.Now()
+	)
+	return uc.repo.Move(ctx, now.UnixNano(), topic, id, status)
+}
+
+func (uc *AdminUsecase) Flush(ctx context.Context, topic string) (int, error) {
+	var (
+		now = time.Now()
+	)
+	return uc.repo.Flush(ctx, now.UnixNano(), topic)
+}
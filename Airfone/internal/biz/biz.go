@@ -6,4 +6,9 @@ import "github.com/google/wire"
 var ProviderSet = wire.NewSet(
 	NewRegisterUsecase,
 	NewKeepAliveUsecase,
+	NewClusterUsecase,
+	NewWatchUsecase,
+	NewDiscoverUsecase,
+	NewAdminUsecase,
+	NewEventUsecase,
 )
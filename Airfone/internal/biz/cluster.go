@@ -0,0 +1,24 @@
+package biz
+
+import (
+	"Airfone/internal/biz/irepo"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type ClusterUsecase struct {
+	repo irepo.ClusterRepo
+	log  *log.Helper
+}
+
+func NewClusterUsecase(repo irepo.ClusterRepo, logger *log.Helper) *ClusterUsecase {
+	return &ClusterUsecase{
+		repo: repo,
+		log:  logger,
+	}
+}
+
+func (uc *ClusterUsecase) Leader(ctx context.Context) (string, bool) {
+	return uc.repo.Leader(ctx)
+}
@@ -0,0 +1,27 @@
+package biz
+
+import (
+	"Airfone/internal/biz/irepo"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type DiscoverUsecase struct {
+	repo irepo.DiscoverRepo
+	log  *log.Helper
+}
+
+func NewDiscoverUsecase(repo irepo.DiscoverRepo, logger *log.Helper) *DiscoverUsecase {
+	return &DiscoverUsecase{
+		repo: repo,
+		log:  logger,
+	}
+}
+
+// 查询
+//
+//	只读，不要求调用方是已注册的服务
+func (uc *DiscoverUsecase) Discover(ctx context.Context, topics []string, filter *irepo.DiscoverFilter) ([]*irepo.Instance, error) {
+	return uc.repo.Discover(ctx, topics, filter)
+}
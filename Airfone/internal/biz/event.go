@@ -0,0 +1,27 @@
+package biz
+
+import (
+	"Airfone/internal/biz/irepo"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type EventUsecase struct {
+	repo irepo.EventRepo
+	log  *log.Helper
+}
+
+func NewEventUsecase(repo irepo.EventRepo, logger *log.Helper) *EventUsecase {
+	return &EventUsecase{
+		repo: repo,
+		log:  logger,
+	}
+}
+
+// 查询状态变化的事件
+//
+//	事件只记录在做出状态变化的 leader 上
+func (uc *EventUsecase) ListEvents(ctx context.Context, filter *irepo.EventFilter) ([]*irepo.Event, error) {
+	return uc.repo.ListEvents(ctx, filter)
+}
@@ -0,0 +1,43 @@
+package irepo
+
+import (
+	"context"
+
+	pb "Airfone/api/airfone"
+	"Airfone/internal/engine"
+)
+
+// 主题概况
+type TopicInfo struct {
+	*engine.TopicInfo
+}
+
+func (t *TopicInfo) ToProto() *pb.TopicInfo {
+	return &pb.TopicInfo{
+		Name:     t.Name,
+		Implicit: t.Implicit,
+		Selector: t.Selector,
+		Running:  int32(t.Running),
+		Changed:  int32(t.Changed),
+		Pending:  int32(t.Pending),
+	}
+}
+
+// 主题之间的依赖
+type TopicEdge struct {
+	*engine.TopicEdge
+}
+
+// 将请求中的状态转换为 engine 中的状态
+func StatusFromProto(status pb.HeartBeatType) engine.HeartBeatType {
+	return statusHeartBeatToEngine[status]
+}
+
+type AdminRepo interface {
+	Topics(ctx context.Context) ([]*TopicInfo, error)                                               // 列出全部主题
+	Graph(ctx context.Context) ([]*TopicEdge, error)                                                // 主题之间的依赖关系
+	Describe(ctx context.Context, topic string, id int64) (*Instance, int32, error)                 // 查看一个服务
+	Evict(ctx context.Context, now int64, topic string, id int64) error                             // 驱逐一个服务
+	Move(ctx context.Context, now int64, topic string, id int64, status engine.HeartBeatType) error // 移动一个服务
+	Flush(ctx context.Context, now int64, topic string) (int, error)                                // 清空主题
+}
@@ -0,0 +1,7 @@
+package irepo
+
+import "context"
+
+type ClusterRepo interface {
+	Leader(ctx context.Context) (string, bool) // 获取 leader 的 grpc 地址，以及当前节点是否就是 leader
+}
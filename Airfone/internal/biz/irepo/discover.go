@@ -0,0 +1,46 @@
+package irepo
+
+import (
+	"context"
+
+	pb "Airfone/api/airfone"
+	"Airfone/internal/engine"
+)
+
+// 查询条件
+type DiscoverFilter struct {
+	*engine.LookupFilter
+}
+
+func DiscoverFilterFromProto(req *pb.DiscoverRequest) *DiscoverFilter {
+	filter := &DiscoverFilter{
+		LookupFilter: &engine.LookupFilter{
+			Status: make([]engine.HeartBeatType, len(req.Status)),
+			Schema: make(map[string]string, len(req.Schema)),
+		},
+	}
+	for i, s := range req.Status {
+		filter.Status[i] = statusHeartBeatToEngine[s]
+	}
+	for _, s := range req.Schema {
+		filter.Schema[s.Title] = s.Content
+	}
+	return filter
+}
+
+// 查询结果
+type Instance struct {
+	*engine.Instance
+}
+
+// now 为当前时间(纳秒)，用于计算距最后一次心跳的时间
+func (i *Instance) ToProto(now int64) *pb.Discover {
+	return &pb.Discover{
+		Service: (&Service{Service: i.Service, Topic: i.Topic}).ToProto(),
+		Age:     (now - i.Keepalive) / 1e6,
+	}
+}
+
+type DiscoverRepo interface {
+	Discover(ctx context.Context, topics []string, filter *DiscoverFilter) ([]*Instance, error) // 查询主题中的服务
+}
@@ -0,0 +1,55 @@
+package irepo
+
+import (
+	"context"
+	"time"
+
+	pb "Airfone/api/airfone"
+	"Airfone/internal/engine"
+)
+
+// 事件的查询条件
+type EventFilter struct {
+	*engine.EventFilter
+}
+
+// 请求中的时间为 unix 毫秒
+func EventFilterFromProto(req *pb.ListEventsRequest) *EventFilter {
+	filter := &EventFilter{
+		EventFilter: &engine.EventFilter{
+			Topic:    req.Topic,
+			ID:       req.Id,
+			Instance: req.Instance,
+			Limit:    int(req.Limit),
+		},
+	}
+	if req.Since != 0 {
+		filter.Since = req.Since * int64(time.Millisecond)
+	}
+	if req.Until != 0 {
+		filter.Until = req.Until * int64(time.Millisecond)
+	}
+	return filter
+}
+
+// 状态变化的事件
+type Event struct {
+	*engine.Event
+}
+
+func (e *Event) ToProto() *pb.Event {
+	return &pb.Event{
+		Time:     e.Time / int64(time.Millisecond),
+		Topic:    e.Topic,
+		Id:       e.ID,
+		Instance: e.Instance,
+		From:     statusHeartBeatToProto[e.From],
+		To:       statusHeartBeatToProto[e.To],
+		Reason:   string(e.Reason),
+		Detail:   e.Detail,
+	}
+}
+
+type EventRepo interface {
+	ListEvents(ctx context.Context, filter *EventFilter) ([]*Event, error) // 查询状态变化的事件
+}
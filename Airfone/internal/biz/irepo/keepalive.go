@@ -25,28 +25,30 @@ var (
 // KeepAlive
 type HeartBeat struct {
 	*engine.HeartBeat
+	Session int64 // 会话的编号，只在会话中使用，见 engine.Data.Connect
 }
 
 func (hb *HeartBeat) ToProto() *pb.Keepalive {
 	var (
-		relies    = make([]*pb.Rely, len(hb.Rely))
-		keepalive = &pb.Keepalive{
+		namespace, _ = engine.SplitTopic(hb.Topic)
+		relies       = make([]*pb.Rely, len(hb.Rely))
+		keepalive    = &pb.Keepalive{
 			Status: statusHeartBeatToProto[hb.Status],
 		}
 	)
 	for i, r := range hb.Rely {
-		relies[i] = &pb.Rely{
-			Topic: r.Topic,
-			Ip:   r.IP,
-			Port:  int32(r.Port),
-			Id:    r.ID,
-		}
+		relies[i] = RelyToProto(namespace, r, hb.Instances)
 	}
 	keepalive.Relies = relies
+	keepalive.Unresolved = relativeKeys(namespace, hb.Unresolved)
 	return keepalive
 }
 
 type KeepAliveRepo interface {
 	KeepAlive(ctx context.Context, now int64, hb *HeartBeat) (*HeartBeat, error)
 	Conform(ctx context.Context, now int64, hb *HeartBeat) error //在检测到依赖修改后，需要发送 conform 保证自己的服务可用
+	Connect(ctx context.Context, hb *HeartBeat) int64               // 会话建立，返回会话的编号
+	Disconnect(ctx context.Context, now int64, hb *HeartBeat) error // 会话断开，仍是当前的会话时立即将服务置为 pending
+	Endpoints(ctx context.Context, now int64, hb *HeartBeat) (*HeartBeat, bool) // 全量模式下当前的依赖与全部提供者，不刷新心跳时间
+	State(ctx context.Context, now int64, hb *HeartBeat) *HeartBeat             // 当前的状态与依赖，不刷新心跳时间，也不改变状态
 }
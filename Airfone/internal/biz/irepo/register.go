@@ -2,6 +2,7 @@ package irepo
 
 import (
 	"context"
+	"time"
 
 	pb "Airfone/api/airfone"
 	"Airfone/internal/engine"
@@ -9,28 +10,41 @@ import (
 
 type Service struct {
 	*engine.Service
-	Topic string
+	Topic      string                        // 主题的限定名，见 engine/namespace.go
+	Unresolved map[string]string             // 没有找到提供者的依赖及原因，只在返回给客户端时使用
+	Instances  map[string][]*engine.Endpoint // 全量模式下各依赖 topic 中全部可用的提供者，只在返回给客户端时使用
 }
 
 func (s *Service) ToProto() *pb.Service {
 	var (
-		relies  = make([]*pb.Rely, len(s.Rely))
-		schema  = make([]*pb.Schema, len(s.Schema))
-		service = &pb.Service{
-			Topic:  s.Topic,
-			Ip:     s.IP,
-			Prot:   s.ID,
-			Id:     s.ID,
-			Status: statusHeartBeatToProto[s.Status],
+		namespace, topic = engine.SplitTopic(s.Topic)
+		relies           = make([]*pb.Rely, len(s.Rely))
+		schema           = make([]*pb.Schema, len(s.Schema))
+		service          = &pb.Service{
+			Topic:     topic,
+			Namespace: namespace,
+			Ip:        s.IP,
+			Prot:      int32(s.Port),
+			Id:        s.ID,
+			Status:    statusHeartBeatToProto[s.Status],
+			Selector:  s.Selector,
+			Weight:    int32(s.Weight),
+			Region:    s.Region,
+			Zone:      s.Zone,
+			Rack:      s.Rack,
+			Instance:  s.Instance,
+			Labels:    s.Labels,
+			Version:   s.Version,
+			Lease: &pb.Lease{
+				Heartbeat: s.Lease.Heartbeat.Milliseconds(),
+				Valid:     s.Lease.Valid.Milliseconds(),
+				Pending:   s.Lease.Pending.Milliseconds(),
+				Dropped:   s.Lease.Dropped.Milliseconds(),
+			},
 		}
 	)
 	for i, r := range s.Rely {
-		relies[i] = &pb.Rely{
-			Topic: r.Topic,
-			Ip:    r.IP,
-			Port:  int32(r.Port),
-			Id:    r.ID,
-		}
+		relies[i] = RelyToProto(namespace, r, s.Instances)
 	}
 	for i, s2 := range s.Schema {
 		schema[i] = &pb.Schema{
@@ -40,12 +54,94 @@ func (s *Service) ToProto() *pb.Service {
 	}
 	service.Relies = relies
 	service.Schema = schema
+	service.Health = HealthCheckToProto(s.Health)
+	service.Unresolved = relativeKeys(namespace, s.Unresolved)
 	return service
 }
 
+// 依赖转换为 proto，全量模式下附带该 topic 中全部可用的提供者
+//
+//	依赖的主题转换为相对于消费者命名空间的名称
+func RelyToProto(namespace string, r *engine.Rely, instances map[string][]*engine.Endpoint) *pb.Rely {
+	rely := &pb.Rely{
+		Topic: engine.Relative(namespace, r.Topic),
+		Ip:    r.IP,
+		Port:  int32(r.Port),
+		Id:    r.ID,
+	}
+	for _, e := range instances[r.Topic] {
+		rely.Instances = append(rely.Instances, &pb.Endpoint{
+			Id:     e.ID,
+			Ip:     e.IP,
+			Port:   int32(e.Port),
+			Weight: int32(e.Weight),
+			Region: e.Region,
+			Zone:   e.Zone,
+			Rack:   e.Rack,
+		})
+	}
+	return rely
+}
+
+// 以主题限定名为 key 的 map 转换为以相对于命名空间的名称为 key
+func relativeKeys(namespace string, m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]string, len(m))
+	for name, v := range m {
+		res[engine.Relative(namespace, name)] = v
+	}
+	return res
+}
+
+// 将请求中的租约(毫秒)转换为 engine 中的租约
+func LeaseFromProto(l *pb.Lease) engine.Lease {
+	return engine.Lease{
+		Heartbeat: time.Duration(l.GetHeartbeat()) * time.Millisecond,
+		Valid:     time.Duration(l.GetValid()) * time.Millisecond,
+		Pending:   time.Duration(l.GetPending()) * time.Millisecond,
+		Dropped:   time.Duration(l.GetDropped()) * time.Millisecond,
+	}
+}
+
+// 将请求中的健康检查(毫秒)转换为 engine 中的健康检查，未声明时返回空
+func HealthCheckFromProto(h *pb.HealthCheck) *engine.HealthCheck {
+	if h.GetType() == pb.HealthCheckType_HealthCheck_NONE {
+		return nil
+	}
+	return &engine.HealthCheck{
+		Type:     engine.HealthCheckType(h.Type),
+		Port:     uint16(h.Port),
+		Path:     h.Path,
+		Status:   int(h.Status),
+		Service:  h.Service,
+		Interval: time.Duration(h.Interval) * time.Millisecond,
+		Timeout:  time.Duration(h.Timeout) * time.Millisecond,
+		Failures: int(h.Failures),
+	}
+}
+
+func HealthCheckToProto(h *engine.HealthCheck) *pb.HealthCheck {
+	if h == nil {
+		return nil
+	}
+	return &pb.HealthCheck{
+		Type:     pb.HealthCheckType(h.Type),
+		Port:     int32(h.Port),
+		Path:     h.Path,
+		Status:   int32(h.Status),
+		Service:  h.Service,
+		Interval: h.Interval.Milliseconds(),
+		Timeout:  h.Timeout.Milliseconds(),
+		Failures: int32(h.Failures),
+	}
+}
+
 type RegisterRepo interface {
-	Register(ctx context.Context, now int64, service *Service) (*Service, error)                  // 服务注册
-	Update(ctx context.Context, now int64, service *Service) (*Service, error)                    // 服务更新
+	Register(ctx context.Context, now int64, service *Service, relies []string) (*Service, error) // 发现依赖并注册
+	Update(ctx context.Context, now int64, service *Service, relies []string) (*Service, error)   // 服务更新，relies 不为 nil 时先重新发现依赖
 	Logout(ctx context.Context, now int64, service *Service) error                                // 服务注销
-	Discover(ctx context.Context, now int64, service *Service, relies []string) (*Service, error) // 服务发现
+	Registered(ctx context.Context, service *Service) (*Service, bool)                            // 获取同一实例的同一次注册(幂等令牌相同)
+	CheckOwner(ctx context.Context, service *Service) error                                       // 检查服务是否属于 service.Owner
 }
@@ -0,0 +1,65 @@
+package irepo
+
+import (
+	"context"
+
+	pb "Airfone/api/airfone"
+	"Airfone/api/errorpb"
+	"Airfone/internal/engine"
+)
+
+var (
+	watchEventTypeToProto = map[engine.WatchEventType]pb.WatchEventType{
+		engine.WATCH_PUT:    pb.WatchEventType_WATCH_PUT,
+		engine.WATCH_DELETE: pb.WatchEventType_WATCH_DELETE,
+		engine.WATCH_STATUS: pb.WatchEventType_WATCH_STATUS,
+		engine.WATCH_RESET:  pb.WatchEventType_WATCH_RESET,
+		engine.WATCH_SYNCED: pb.WatchEventType_WATCH_SYNCED,
+	}
+)
+
+// 监听事件
+type WatchEvent struct {
+	*engine.WatchEvent
+}
+
+// 主题转换为相对于监听的命名空间的名称
+func (ev *WatchEvent) ToProto(namespace string) *pb.WatchEvent {
+	event := &pb.WatchEvent{
+		Revision: ev.Revision,
+		Type:     watchEventTypeToProto[ev.Type],
+		Topic:    engine.Relative(namespace, ev.Topic),
+		Id:       ev.ID,
+		Status:   statusHeartBeatToProto[ev.Status],
+	}
+	if ev.Service != nil {
+		event.Service = (&Service{Service: ev.Service, Topic: ev.Topic}).ToProto()
+	}
+	return event
+}
+
+// 监听者
+type Watcher struct {
+	*engine.Watcher
+}
+
+// 获取下一个事件
+//
+//	ctx 结束时返回 nil, nil
+//	watcher 被服务端断开时返回 WATCH_LAGGED，客户端需要从最后收到的 revision 重新监听
+func (w *Watcher) Next(ctx context.Context) (*WatchEvent, error) {
+	select {
+	case ev, ok := <-w.Events():
+		if !ok {
+			return nil, errorpb.ErrorWatchLagged("watcher disconnected, watch again from the last revision")
+		}
+		return &WatchEvent{WatchEvent: ev}, nil
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+type WatchRepo interface {
+	Watch(ctx context.Context, topics []string, revision int64) *Watcher        // 监听一组主题
+	History(ctx context.Context, after int64, limit int) ([]*WatchEvent, int64) // 历史事件
+}
@@ -33,3 +33,32 @@ func (uc *KeepAliveUsecase) Conform(ctx context.Context, hb *irepo.HeartBeat) er
 	)
 	return uc.repo.Conform(ctx, now.UnixNano(), hb)
 }
+
+// 会话建立，返回会话的编号
+func (uc *KeepAliveUsecase) Connect(ctx context.Context, hb *irepo.HeartBeat) int64 {
+	return uc.repo.Connect(ctx, hb)
+}
+
+// 会话断开，只处理当前的会话
+func (uc *KeepAliveUsecase) Disconnect(ctx context.Context, hb *irepo.HeartBeat) error {
+	var (
+		now = time.Now()
+	)
+	return uc.repo.Disconnect(ctx, now.UnixNano(), hb)
+}
+
+// 当前的状态与依赖，不刷新心跳时间，也不改变状态
+func (uc *KeepAliveUsecase) State(ctx context.Context, hb *irepo.HeartBeat) *irepo.HeartBeat {
+	var (
+		now = time.Now()
+	)
+	return uc.repo.State(ctx, now.UnixNano(), hb)
+}
+
+// 全量模式下当前的依赖与全部提供者，不是全量模式时返回 false
+func (uc *KeepAliveUsecase) Endpoints(ctx context.Context, hb *irepo.HeartBeat) (*irepo.HeartBeat, bool) {
+	var (
+		now = time.Now()
+	)
+	return uc.repo.Endpoints(ctx, now.UnixNano(), hb)
+}
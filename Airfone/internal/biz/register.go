@@ -22,33 +22,26 @@ func NewRegisterUsecase(repo irepo.RegisterRepo, logger *log.Helper) *RegisterUs
 
 // 服务注册
 //
-//	思路: 先进行服务发现，找到他所有的依赖，然后再调用 repo 层的注册方法完成注册
+//	思路: 先进行服务发现，找到他所有的依赖，然后再完成注册，两步在 repo 层的同一次写操作中完成
+//	客户端重试同一次注册(幂等令牌相同)时，直接返回已有的服务
 func (uc *RegisterUsecase) Register(ctx context.Context, serv *irepo.Service, relies []string) (*irepo.Service, error) {
 	var (
 		now = time.Now()
-		err error
 	)
-	if serv, err = uc.repo.Discover(ctx, now.UnixNano(), serv, relies); err != nil {
-		return nil, err
+	if s, ok := uc.repo.Registered(ctx, serv); ok {
+		return s, nil
 	}
-	return uc.repo.Register(ctx, now.UnixNano(), serv)
+	return uc.repo.Register(ctx, now.UnixNano(), serv, relies)
 }
 
 // 服务更新
 //
-//	思路: 先看是否有依赖更新，有则先进行服务发现
-//	再调用 repo update 函数进行更新
+//	思路: 先看是否有依赖更新，有则先进行服务发现，再进行更新，两步在 repo 层的同一次写操作中完成
 func (uc *RegisterUsecase) Update(ctx context.Context, serv *irepo.Service, relies []string) (*irepo.Service, error) {
 	var (
 		now = time.Now()
-		err error
 	)
-	if relies != nil {
-		if serv, err = uc.repo.Discover(ctx, now.UnixNano(), serv, relies); err != nil {
-			return nil, err
-		}
-	}
-	return uc.repo.Update(ctx, now.UnixNano(), serv)
+	return uc.repo.Update(ctx, now.UnixNano(), serv, relies)
 }
 
 func (uc *RegisterUsecase) Logout(ctx context.Context, serv *irepo.Service) error {
@@ -57,3 +50,8 @@ func (uc *RegisterUsecase) Logout(ctx context.Context, serv *irepo.Service) erro
 	)
 	return uc.repo.Logout(ctx, now.UnixNano(), serv)
 }
+
+// 检查服务是否属于 serv.Owner，开启认证时更新、注销、心跳与确认之前调用
+func (uc *RegisterUsecase) CheckOwner(ctx context.Context, serv *irepo.Service) error {
+	return uc.repo.CheckOwner(ctx, serv)
+}
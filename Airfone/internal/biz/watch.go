@@ -0,0 +1,34 @@
+package biz
+
+import (
+	"Airfone/internal/biz/irepo"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type WatchUsecase struct {
+	repo irepo.WatchRepo
+	log  *log.Helper
+}
+
+func NewWatchUsecase(repo irepo.WatchRepo, logger *log.Helper) *WatchUsecase {
+	return &WatchUsecase{
+		repo: repo,
+		log:  logger,
+	}
+}
+
+// 监听
+//
+//	调用方结束监听后需要调用 Close
+func (uc *WatchUsecase) Watch(ctx context.Context, topics []string, revision int64) *irepo.Watcher {
+	return uc.repo.Watch(ctx, topics, revision)
+}
+
+// 历史事件
+//
+//	返回 revision 大于 after 的事件(最多 limit 个)，以及当前的 revision
+func (uc *WatchUsecase) History(ctx context.Context, after int64, limit int) ([]*irepo.WatchEvent, int64) {
+	return uc.repo.History(ctx, after, limit)
+}
@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"Airfone/api/errorpb"
+	"sort"
+	"sync/atomic"
+)
+
+// 运维
+//
+//	供管理接口查看与修改 data 中的状态，普通客户端无法调用(见 server/admin.go)
+//	思路: 查看与 Lookup 一致，只持有读锁拷贝状态；修改复用客户端操作的路径，
+//	同样写 wal 记录并向消费者传播，与客户端注销、心跳超时的效果一致
+//	1. 驱逐: 与注销一致，客户端下次心跳收到 dropped 后重新注册，得到新的 id
+//	2. 移动: 在 running 与 pending 之间移动，移入 pending 的 service 被管理员保持(held)，
+//	   心跳、确认、依赖恢复与健康检查都不会使其恢复，直到管理员将其移回 running；
+//	   仍在等待依赖或心跳已经超时的 service 不能移回 running
+//	3. 清空: 驱逐主题中的全部 service，主题本身保留
+
+// 主题概况
+type TopicInfo struct {
+	Name     string // 主题名
+	Implicit bool   // 是否为隐式创建
+	Selector string // 主题配置的负载均衡策略
+	Running  int    // running 的 service 数
+	Changed  int    // 依赖已变化、等待确认的 service 数
+	Pending  int    // pending 的 service 数
+}
+
+// 列出全部主题
+//
+//	结果按主题名排序
+func (data *Data) Topics() []*TopicInfo {
+	var res = make([]*TopicInfo, 0)
+	data.RLock()
+	for name, t := range data.topics {
+		t.RLock()
+		info := &TopicInfo{Name: name, Implicit: t.implicit}
+		if t.attr != nil {
+			info.Selector = t.attr.Selector
+		}
+		for _, m := range []*ServiceMap{t.running, t.pending} {
+			m.RLock()
+			for _, s := range m.services {
+				switch s.Status {
+				case HeartBeat_RUNNING:
+					info.Running++
+				case HeartBeat_CHANGED:
+					info.Changed++
+				case HeartBeat_PENDING:
+					info.Pending++
+				}
+			}
+			m.RUnlock()
+		}
+		t.RUnlock()
+		res = append(res, info)
+	}
+	data.RUnlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// 主题之间的依赖
+type TopicEdge struct {
+	From  string // 消费者所在的主题
+	To    string // 依赖的主题
+	Count int    // 声明了该依赖的 service 数
+	Bound int    // 已经找到提供者的 service 数
+}
+
+// 主题之间的依赖关系
+//
+//	由 service 声明的依赖汇总而来，结果按 From、To 排序
+func (data *Data) Graph() []*TopicEdge {
+	type key struct{ from, to string }
+	var edges = make(map[key]*TopicEdge)
+	data.RLock()
+	for name, t := range data.topics {
+		t.RLock()
+		for _, m := range []*ServiceMap{t.running, t.pending} {
+			m.RLock()
+			for _, s := range m.services {
+				for _, depend := range s.Depends {
+					e, ok := edges[key{name, depend}]
+					if !ok {
+						e = &TopicEdge{From: name, To: depend}
+						edges[key{name, depend}] = e
+					}
+					e.Count++
+				}
+				for _, r := range s.Rely {
+					if e, ok := edges[key{name, r.Topic}]; ok {
+						e.Bound++
+					}
+				}
+			}
+			m.RUnlock()
+		}
+		t.RUnlock()
+	}
+	data.RUnlock()
+	var res = make([]*TopicEdge, 0, len(edges))
+	for _, e := range edges {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].From != res[j].From {
+			return res[i].From < res[j].From
+		}
+		return res[i].To < res[j].To
+	})
+	return res
+}
+
+// 查看一个 service
+//
+//	返回 service 的拷贝，以及有多少消费者选择了它
+func (data *Data) Describe(topicName string, id int64) (*Instance, int32, error) {
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return nil, 0, err
+	}
+	t.RLock()
+	defer t.RUnlock()
+	for _, m := range []*ServiceMap{t.running, t.pending} {
+		m.RLock()
+		if s, ok := m.services[id]; ok {
+			instance := &Instance{
+				Topic:     topicName,
+				Service:   s.copy(),
+				Keepalive: s.keepalive,
+			}
+			m.RUnlock()
+			return instance, atomic.LoadInt32(&s.load), nil
+		}
+		m.RUnlock()
+	}
+	return nil, 0, errorpb.ErrorSearchInvalid("service %s id: %d is not exist", topicName, id)
+}
+
+// 驱逐一个 service
+func (data *Data) Evict(now int64, topicName string, id int64) error {
+	if _, err := data.remove(topicName, now, id, REASON_ADMIN); err != nil {
+		return err
+	}
+	data.log.Infof("service %s id: %d evicted", topicName, id)
+	return nil
+}
+
+// 在 running 与 pending 之间移动一个 service
+//
+//	移入 pending 的 service 被管理员保持(held)，之后的心跳、确认、依赖恢复与健康检查都不会使其回到 running，
+//	直到管理员将其移回 running；已经因超时或断开处于 pending 时同样保持
+//	移回 running 时清除健康检查的不健康标记，仍在等待依赖或心跳已经超时的 service 不能移回
+//	移动不改变心跳时间，service 已经处于目标状态时不做任何操作
+func (data *Data) Move(now int64, topicName string, id int64, status HeartBeatType) error {
+	if status != HeartBeat_RUNNING && status != HeartBeat_PENDING {
+		return errorpb.ErrorDefault("can only move a service to running or pending")
+	}
+	defer data.hold()()
+	if err := data.writable(); err != nil {
+		return err
+	}
+	topic, err := data.getTopic(topicName)
+	if err != nil {
+		return err
+	}
+	serv, err := topic.GetService(id)
+	if err != nil {
+		return err
+	}
+	previous := serv.Status
+	_, err = topic.GetRunningService(id)
+	running := err == nil
+	if status == HeartBeat_PENDING {
+		if serv.held {
+			return nil
+		}
+		hold := &walRecord{Op: WAL_STATUS, Topic: topicName, ID: id, Status: HeartBeat_PENDING, Held: true}
+		if !running {
+			serv.held = true
+			data.log.Infof("service %s id: %d held in pending", topicName, id)
+			return data.journal(hold)
+		}
+		// 与会话断开一致保留原本的心跳时间
+		if err = topic.Demote(id); err != nil {
+			return err
+		}
+		serv.held = true
+		data.log.Infof("service %s id: %d moved to pending", topicName, id)
+		data.transit(now, topicName, serv, previous, HeartBeat_PENDING, REASON_ADMIN)
+		err = data.journal(hold)
+		data.propagateFailure(now, topicName, id)
+		return err
+	}
+	if running {
+		return nil
+	}
+	// 与依赖恢复的条件一致(见 propagateRecovery)，否则消费者会选中一个依赖不可用或已经停止心跳的提供者
+	if data.isWaiting(id, serv.Depends) {
+		return errorpb.ErrorUpdateInvalid("service %s id: %d is waiting for its dependencies", topicName, id)
+	}
+	if serv.keepalive < now-int64(serv.Lease.Pending) {
+		return errorpb.ErrorUpdateInvalid("service %s id: %d has no heartbeat within its lease", topicName, id)
+	}
+	// 管理员确认可用，清除健康检查的不健康标记，之后探测再失败时重新置为 pending
+	atomic.StoreInt32(&serv.unhealthy, 0)
+	atomic.StoreInt32(&serv.failures, 0)
+	// 保留原本的心跳时间，移回 running 不为 service 续期
+	if _, err = topic.Promote(id); err != nil {
+		return err
+	}
+	serv.held = false
+	data.log.Infof("service %s id: %d moved to running", topicName, id)
+	data.transit(now, topicName, serv, previous, serv.Status, REASON_ADMIN)
+	err = data.journalStatus(topicName, id, HeartBeat_RUNNING)
+	data.propagateRecovery(now, topicName)
+	return err
+}
+
+// 清空主题
+//
+//	驱逐主题中的全部 service，返回驱逐的数量
+func (data *Data) Flush(now int64, topicName string) (int, error) {
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return 0, err
+	}
+	var ids = make([]int64, 0)
+	t.RLock()
+	for _, m := range []*ServiceMap{t.running, t.pending} {
+		m.RLock()
+		for id := range m.services {
+			ids = append(ids, id)
+		}
+		m.RUnlock()
+	}
+	t.RUnlock()
+	var n int
+	for _, id := range ids {
+		// 期间被注销或超时删除的 service 直接跳过
+		if _, err = data.remove(topicName, now, id, REASON_ADMIN); err != nil {
+			if errorpb.IsNotLeader(err) {
+				return n, err
+			}
+			continue
+		}
+		n++
+	}
+	data.log.Infof("topic %s flushed, %d services evicted", topicName, n)
+	return n, nil
+}
@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+)
+
+// 管理员置为 pending 的 service 不会被之后的心跳移回 running
+func TestMoveHeld(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+		s    = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	)
+	if err := data.Move(now, "log", s.ID, HeartBeat_PENDING); err != nil {
+		t.Fatal(err)
+	}
+	hb, err := data.Check(now+1, &HeartBeat{Topic: "log", ID: s.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hb.Status != HeartBeat_PENDING {
+		t.Errorf("heartbeat = %v, want pending", hb.Status)
+	}
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_PENDING {
+		t.Fatalf("status after heartbeat = %v, want pending", got)
+	}
+	if _, err = data.UpdateService("log", now+2, &Service{ID: s.ID, Status: HeartBeat_RUNNING, Weight: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_PENDING {
+		t.Fatalf("status after update = %v, want pending", got)
+	}
+
+	if err = data.Move(now+3, "log", s.ID, HeartBeat_RUNNING); err != nil {
+		t.Fatal(err)
+	}
+	if hb, err = data.Check(now+4, &HeartBeat{Topic: "log", ID: s.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if hb.Status != HeartBeat_RUNNING {
+		t.Errorf("heartbeat after move back = %v, want running", hb.Status)
+	}
+}
+
+// 移回 running 不为 service 续期，仍在等待依赖或心跳已经超时时拒绝，不健康的标记被清除
+func TestMoveRunning(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		provider = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+		waiting  = register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80}, "nope")
+		expired  = register(t, data, "audit", now, &Service{IP: "10.0.2.1", Port: 80})
+	)
+	if err := data.Move(now, "common", waiting.ID, HeartBeat_PENDING); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Move(now+1, "common", waiting.ID, HeartBeat_RUNNING); !errorpb.IsUpdateInvalid(err) {
+		t.Errorf("move waiting consumer = %v, want UPDATE_INVALID", err)
+	}
+	if err := data.Move(now, "audit", expired.ID, HeartBeat_PENDING); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Move(now+int64(expired.Lease.Pending)+1, "audit", expired.ID, HeartBeat_RUNNING); !errorpb.IsUpdateInvalid(err) {
+		t.Errorf("move expired service = %v, want UPDATE_INVALID", err)
+	}
+	if statusOf(data, "common", waiting.ID) != HeartBeat_PENDING || statusOf(data, "audit", expired.ID) != HeartBeat_PENDING {
+		t.Error("refused move changed the status")
+	}
+
+	if err := data.Move(now, "log", provider.ID, HeartBeat_PENDING); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&provider.unhealthy, 1)
+	if err := data.Move(now+1, "log", provider.ID, HeartBeat_RUNNING); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(data, "log", provider.ID); got != HeartBeat_RUNNING {
+		t.Errorf("status after move = %v, want running", got)
+	}
+	if atomic.LoadInt32(&provider.unhealthy) != 0 {
+		t.Error("unhealthy mark kept after move to running")
+	}
+	if provider.keepalive != now {
+		t.Errorf("keepalive = %d, want the last heartbeat %d", provider.keepalive, now)
+	}
+}
+
+// 已经处于 pending 的 service 同样被保持，重启后依旧保持
+func TestMoveHeldRestart(t *testing.T) {
+	dir := t.TempDir()
+	data, cleanup := openTestData(t, dir)
+	now := time.Now().UnixNano()
+	s, err := data.AddService("log", now, &Service{IP: "10.0.0.1", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = data.Disconnect(now, "log", s.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = data.Move(now, "log", s.ID, HeartBeat_PENDING); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+
+	data, cleanup = openTestData(t, dir)
+	defer cleanup()
+	hb, err := data.Check(time.Now().UnixNano(), &HeartBeat{Topic: "log", ID: s.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hb.Status != HeartBeat_PENDING {
+		t.Errorf("heartbeat after restart = %v, want pending", hb.Status)
+	}
+}
@@ -0,0 +1,328 @@
+package engine
+
+import "sync/atomic"
+
+// 依赖传播
+//
+//	Data 中维护了两份索引:
+//	1. 反向依赖索引 deps: 提供者 id -> 选择了它的消费者
+//	2. 等待索引 waiting: topic -> 因该 topic 没有可用提供者而缺少依赖的消费者，以及没有找到提供者的原因
+//
+//	当提供者进入 pending 或被删除时，沿着反向依赖一次性地为所有消费者重新选择依赖，
+//	没有替代者的消费者被置为 pending，并继续向它自己的消费者传播
+//	当 topic 中出现可用的提供者时，沿着等待索引一次性地恢复所有等待的消费者，
+//	恢复后的消费者同样可以继续恢复等待它的消费者
+//	这样故障和恢复都能在一次心跳间隔内完成，而不需要多轮心跳
+
+// 反向依赖索引中的消费者
+type dependent struct {
+	topicName string // 消费者所在的 topic
+	count     int32  // 绑定次数，更换依赖时可能先绑定新依赖再释放旧依赖，两者可能是同一个提供者
+}
+
+// 绑定依赖
+//
+//	消费者选择了 provider，被依赖数加一，并记录到反向依赖索引
+func (data *Data) bind(topicName string, consumerID int64, provider *Service) {
+	atomic.AddInt32(&provider.load, 1)
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	consumers, ok := data.deps[provider.ID]
+	if !ok {
+		consumers = make(map[int64]*dependent)
+		data.deps[provider.ID] = consumers
+	}
+	if d, ok := consumers[consumerID]; ok {
+		d.count++
+	} else {
+		consumers[consumerID] = &dependent{topicName: topicName, count: 1}
+	}
+}
+
+// 释放依赖
+//
+//	消费者不再使用这些依赖时(依赖更换，服务注销，服务被删除)调用，
+//	被依赖数减一，并从反向依赖索引中移除
+func (data *Data) release(consumerID int64, relies []*Rely) {
+	for _, r := range relies {
+		if r.Load != nil {
+			atomic.AddInt32(r.Load, -1)
+		}
+	}
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	for _, r := range relies {
+		consumers, ok := data.deps[r.ID]
+		if !ok {
+			continue
+		}
+		if d, ok := consumers[consumerID]; ok {
+			if d.count--; d.count <= 0 {
+				delete(consumers, consumerID)
+			}
+		}
+		if len(consumers) == 0 {
+			delete(data.deps, r.ID)
+		}
+	}
+}
+
+// 等待索引中的消费者
+type waiter struct {
+	topicName string // 消费者所在的 topic
+	reason    string // 没有找到提供者的原因
+}
+
+// 记录消费者在等待 relyTopic 中出现可用的提供者
+func (data *Data) wait(relyTopic string, topicName string, consumerID int64, reason string) {
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	consumers, ok := data.waiting[relyTopic]
+	if !ok {
+		consumers = make(map[int64]*waiter)
+		data.waiting[relyTopic] = consumers
+	}
+	consumers[consumerID] = &waiter{topicName: topicName, reason: reason}
+}
+
+// 消费者不再等待这些 topic
+func (data *Data) unwait(consumerID int64, relyTopics ...string) {
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	for _, name := range relyTopics {
+		if consumers, ok := data.waiting[name]; ok {
+			delete(consumers, consumerID)
+			if len(consumers) == 0 {
+				delete(data.waiting, name)
+			}
+		}
+	}
+}
+
+// 消费者是否还在等待这些 topic 中的任意一个
+func (data *Data) isWaiting(consumerID int64, relyTopics []string) bool {
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	for _, name := range relyTopics {
+		if _, ok := data.waiting[name][consumerID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 消费者在这些 topic 中没有找到提供者的原因 map[topic]原因
+func (data *Data) Unresolved(consumerID int64, relyTopics []string) map[string]string {
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	var unresolved map[string]string
+	for _, name := range relyTopics {
+		if w, ok := data.waiting[name][consumerID]; ok {
+			if unresolved == nil {
+				unresolved = make(map[string]string)
+			}
+			unresolved[name] = w.reason
+		}
+	}
+	return unresolved
+}
+
+// 获取依赖该提供者的所有消费者(副本)
+func (data *Data) dependents(providerID int64) map[int64]string {
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	consumers := make(map[int64]string, len(data.deps[providerID]))
+	for id, d := range data.deps[providerID] {
+		consumers[id] = d.topicName
+	}
+	return consumers
+}
+
+// 获取等待该 topic 的所有消费者(副本)
+func (data *Data) waiters(relyTopic string) map[int64]string {
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	consumers := make(map[int64]string, len(data.waiting[relyTopic]))
+	for id, w := range data.waiting[relyTopic] {
+		consumers[id] = w.topicName
+	}
+	return consumers
+}
+
+// 清理一个已被删除的服务在索引中的全部记录
+func (data *Data) forget(serv *Service) {
+	data.release(serv.ID, serv.Rely)
+	data.unwait(serv.ID, serv.Depends...)
+	data.depLock.Lock()
+	defer data.depLock.Unlock()
+	delete(data.deps, serv.ID)
+}
+
+// 撤销服务发现中的绑定
+//
+//	注册或更新在加入主题之前失败时调用，Discover 已经为 service 绑定了依赖并记录了等待的 topic
+//	同一实例重新注册、或者更新时原有的 service 仍在主题中，只撤销这次新增的等待；
+//	否则全部撤销，unindex 时同时删除 Discover 为新实例分配的 id
+func (data *Data) abandon(topicName string, s *Service, unindex bool) {
+	var old *Service
+	if t, err := data.getTopic(topicName); err == nil {
+		old, _ = t.GetService(s.ID)
+	}
+	data.release(s.ID, s.Rely)
+	if old != nil {
+		data.unwait(s.ID, subtract(s.Depends, old.Depends)...)
+		return
+	}
+	data.unwait(s.ID, s.Depends...)
+	if unindex {
+		data.unindexInstance(topicName, s.ID)
+	}
+}
+
+// 过期处理
+//
+//	调度器将心跳超时的 service 移入 pending，或将 pending 中超时的 service 删除之后调用
+func (data *Data) expire(now int64, topicName string, pended, dropped []*Service) {
+	ids := make([]int64, 0, len(pended))
+	for _, s := range pended {
+		ids = append(ids, s.ID)
+	}
+	data.propagateFailure(now, topicName, ids...)
+	for _, s := range dropped {
+		data.forget(s)
+	}
+}
+
+// 替换消费者在 r.Topic 上的依赖，原本没有该 topic 的依赖则追加
+func (data *Data) replaceRely(consumer *Service, r *Rely) {
+	for i, old := range consumer.Rely {
+		if old.Topic == r.Topic {
+			data.release(consumer.ID, consumer.Rely[i:i+1])
+			consumer.Rely[i] = r
+			return
+		}
+	}
+	consumer.Rely = append(consumer.Rely, r)
+}
+
+// 故障传播
+//
+//	topicName 中的 ids 已经不可用(进入 pending 或被删除)
+//	思路: 广度优先遍历反向依赖，为每个消费者在该 topic 中重新选择依赖，
+//	选到则替换依赖并标记 changed，等待下次心跳通知客户端
+//	选不到则将消费者置为 pending (discover 中已记录到等待索引)，
+//	此时消费者自身也不可用了，将其加入队列继续向下传播
+func (data *Data) propagateFailure(now int64, topicName string, ids ...int64) {
+	type failed struct {
+		topicName string
+		id        int64
+	}
+	var queue = make([]failed, 0, len(ids))
+	for _, id := range ids {
+		queue = append(queue, failed{topicName: topicName, id: id})
+	}
+	for len(queue) > 0 {
+		f := queue[0]
+		queue = queue[1:]
+		data.RLock()
+		provider := &innerTopic{topicName: f.topicName, Topic: data.topics[f.topicName]}
+		data.RUnlock()
+		for cid, ctopic := range data.dependents(f.id) {
+			t, err := data.getTopic(ctopic)
+			if err != nil {
+				continue
+			}
+			c, err := t.GetService(cid)
+			if err != nil {
+				continue
+			}
+			relyMap, _ := data.discover(now, ctopic, c, []*innerTopic{provider})
+			if r, ok := relyMap[f.topicName]; ok {
+				data.replaceRely(c, r)
+				data.relyChanged(now, ctopic, c, r)
+				c.changed = true
+				data.journalService(ctopic, c)
+				continue
+			}
+			// 没有替代者，已经是 pending 的消费者不需要重复传播
+			if c.Status == HeartBeat_PENDING {
+				continue
+			}
+			previous := c.Status
+			if err = t.Demote(cid); err != nil {
+				data.log.Errorf("propagate failure: %s", err.Error())
+				continue
+			}
+			data.transit(now, ctopic, c, previous, HeartBeat_PENDING, REASON_DEPENDENCY)
+			data.journalStatus(ctopic, cid, HeartBeat_PENDING)
+			queue = append(queue, failed{topicName: ctopic, id: cid})
+		}
+	}
+}
+
+// 恢复传播
+//
+//	topicName 中出现了可用的提供者
+//	思路: 广度优先遍历等待索引，为每个等待该 topic 的消费者重新选择依赖，
+//	选到则替换依赖并标记 changed，若消费者已不再等待其他 topic，
+//	且自身心跳正常，则将其从 pending 恢复到 running，
+//	此时消费者所在的 topic 也有了可用的提供者，将其加入队列继续传播
+func (data *Data) propagateRecovery(now int64, topicName string) {
+	var queue = []string{topicName}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		data.RLock()
+		provider := &innerTopic{topicName: name, Topic: data.topics[name]}
+		data.RUnlock()
+		for cid, ctopic := range data.waiters(name) {
+			t, err := data.getTopic(ctopic)
+			if err != nil {
+				data.unwait(cid, name)
+				continue
+			}
+			c, err := t.GetService(cid)
+			if err != nil {
+				data.unwait(cid, name)
+				continue
+			}
+			relyMap, _ := data.discover(now, ctopic, c, []*innerTopic{provider})
+			r, ok := relyMap[name]
+			if !ok {
+				continue
+			}
+			data.replaceRely(c, r)
+			data.relyChanged(now, ctopic, c, r)
+			c.changed = true
+			data.journalService(ctopic, c)
+			if c.Status != HeartBeat_PENDING || atomic.LoadInt32(&c.unhealthy) == 1 || c.held || data.isWaiting(cid, c.Depends) ||
+				c.keepalive < now-int64(c.Lease.Pending) {
+				continue
+			}
+			if _, err = t.Promote(cid); err != nil {
+				data.log.Errorf("propagate recovery: %s", err.Error())
+				continue
+			}
+			data.transit(now, ctopic, c, HeartBeat_PENDING, c.Status, REASON_DEPENDENCY)
+			data.journalStatus(ctopic, cid, HeartBeat_RUNNING)
+			queue = append(queue, ctopic)
+		}
+	}
+}
+
+// 返回在 a 中但不在 b 中的 topic
+func subtract(a, b []string) []string {
+	var (
+		set  = make(map[string]struct{}, len(b))
+		diff = make([]string, 0, len(a))
+	)
+	for _, name := range b {
+		set[name] = struct{}{}
+	}
+	for _, name := range a {
+		if _, ok := set[name]; !ok {
+			diff = append(diff, name)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// 消费者的心跳与提供者的注销、重新注册同时进行
+//
+//	传播会替换消费者的依赖并标记 changed，需要与消费者自身的心跳互斥，以 -race 运行
+func TestCascadeConcurrentHeartbeat(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		provider = register(t, data, "provider", now, &Service{IP: "10.0.0.1", Port: 80})
+		consumer = register(t, data, "consumer", now, &Service{IP: "10.0.0.2", Port: 80}, "provider")
+		done     = make(chan struct{})
+		wg       sync.WaitGroup
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := data.Check(time.Now().UnixNano(), &HeartBeat{Topic: "consumer", ID: consumer.ID}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			now := time.Now().UnixNano()
+			if _, err := data.RemoveService("provider", now, provider.ID); err != nil {
+				t.Error(err)
+				return
+			}
+			provider = register(t, data, "provider", now, &Service{IP: "10.0.0.1", Port: 80})
+		}
+	}()
+	wg.Wait()
+}
+
+// 提供者被删除时，消费者立即换到另一个提供者，下次心跳报告 changed
+func TestCascadeFailover(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		a        = register(t, data, "provider", now, &Service{IP: "10.0.0.1", Port: 80})
+		b        = register(t, data, "provider", now, &Service{IP: "10.0.0.2", Port: 80})
+		consumer = register(t, data, "consumer", now, &Service{IP: "10.0.0.3", Port: 80}, "provider")
+	)
+	bound, other := a, b
+	if consumer.Rely[0].ID == b.ID {
+		bound, other = b, a
+	}
+	if _, err := data.RemoveService("provider", now, bound.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := consumer.Rely[0].ID; got != other.ID {
+		t.Fatalf("consumer rely = %d, want %d", got, other.ID)
+	}
+	if other.load != 1 {
+		t.Errorf("load of the replacement = %d, want 1", other.load)
+	}
+	if _, ok := data.deps[bound.ID]; ok {
+		t.Errorf("removed provider %d still indexed", bound.ID)
+	}
+	hb, err := data.Check(now, &HeartBeat{Topic: "consumer", ID: consumer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hb.Status != HeartBeat_CHANGED || len(hb.Rely) != 1 || hb.Rely[0].ID != other.ID {
+		t.Errorf("heartbeat = %v %+v, want changed with provider %d", hb.Status, hb.Rely, other.ID)
+	}
+	if hb, _ = data.Check(now, &HeartBeat{Topic: "consumer", ID: consumer.ID}); hb.Status != HeartBeat_RUNNING {
+		t.Errorf("second heartbeat = %v, want running", hb.Status)
+	}
+}
+
+// 没有替代者时沿依赖链置为 pending，提供者恢复后沿等待索引一次恢复，不需要等待心跳
+func TestCascadeChain(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+		c    = register(t, data, "c", now, &Service{IP: "10.0.0.1", Port: 80})
+		b    = register(t, data, "b", now, &Service{IP: "10.0.0.2", Port: 80}, "c")
+		a    = register(t, data, "a", now, &Service{IP: "10.0.0.3", Port: 80}, "b")
+	)
+	if _, err := data.RemoveService("c", now, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []struct {
+		topic string
+		id    int64
+	}{{"b", b.ID}, {"a", a.ID}} {
+		if got := statusOf(data, s.topic, s.id); got != HeartBeat_PENDING {
+			t.Errorf("%s after provider removed = %v, want pending", s.topic, got)
+		}
+	}
+	if _, ok := data.Unresolved(b.ID, b.Depends)["c"]; !ok {
+		t.Errorf("unresolved of b = %v, want c", data.Unresolved(b.ID, b.Depends))
+	}
+
+	register(t, data, "c", now, &Service{IP: "10.0.0.4", Port: 80})
+	for _, s := range []struct {
+		topic string
+		id    int64
+	}{{"b", b.ID}, {"a", a.ID}} {
+		if got := statusOf(data, s.topic, s.id); got != HeartBeat_RUNNING {
+			t.Errorf("%s after provider recovered = %v, want running", s.topic, got)
+		}
+	}
+	if len(data.Unresolved(b.ID, b.Depends)) != 0 {
+		t.Errorf("b still unresolved: %v", data.Unresolved(b.ID, b.Depends))
+	}
+}
@@ -0,0 +1,505 @@
+package engine
+
+import (
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// 集群
+//
+//	多个 Airfone 节点通过 raft 复制 data 的状态
+//	思路: 写操作(注册，更新，注销，心跳，确认，过期)只在 leader 上执行，
+//	执行后产生的 wal 记录(见 store.go)作为 raft 日志复制到所有节点，
+//	follower 按顺序重放这些记录，得到与 leader 相同的 service 与依赖关系
+//	读操作由各个节点在本地完成，写操作由 service 层转发给 leader
+//
+//	写操作之间互斥(见 hold)，每条记录提交之后才通知监听者，
+//	所有节点(包括 leader)都在 fsm.Apply 中按日志顺序维护已提交的状态(committed)，快照也由它生成
+//	记录提交失败(如失去 leader 身份)时，leader 按已提交的状态回滚记录涉及的 service 或主题，
+//	回滚后该记录仍可能被新的 leader 提交，届时在 fsm.Apply 中重新应用
+//
+//	只有 leader 处理心跳超时，follower 的调度器任务到期后直接丢弃
+//	心跳本身不写日志，新的 leader 上任时，将所有 service 的租约延长一个宽限期，
+//	客户端的心跳转发到新的 leader 之后即可继续
+//
+//	wal 记录都是对单个 service 或主题的完整赋值，重复重放是幂等的，
+//	因此快照与日志之间即使有重叠也不影响最终状态
+
+// 集群中的节点
+type Peer struct {
+	ID       string // raft 节点 id
+	RaftAddr string // raft 通信地址
+	GRPCAddr string // grpc 服务地址，follower 将写操作转发到 leader 的该地址
+}
+
+// 集群配置
+//
+//	存储与通信方式由调用方提供，测试时可以使用 raft.NewInmemTransport 在一个进程内启动多个节点
+type ClusterConfig struct {
+	ID           string             // 本节点 id，需要出现在 Peers 中
+	Peers        []Peer             // 集群中的全部节点
+	Bootstrap    bool               // 是否使用 Peers 初始化集群，只需要在第一次启动时由一个节点执行
+	Transport    raft.Transport     // raft 通信
+	Logs         raft.LogStore      // raft 日志
+	Stable       raft.StableStore   // raft 任期与投票信息
+	Snapshots    raft.SnapshotStore // raft 快照
+	ApplyTimeout time.Duration      // 写入日志的超时时间，默认 5s
+	Grace        time.Duration      // 成为 leader 后为所有 service 延长的租约宽限期，默认 10s
+	Logger       hclog.Logger       // raft 日志输出，默认只输出 warn 以上
+	Raft         func(*raft.Config) // 修改 raft 的默认配置，可以为空
+}
+
+// 获取全部节点
+func (data *Data) Peers() []Peer {
+	if data.cluster == nil {
+		return nil
+	}
+	peers := make([]Peer, 0, len(data.cluster.peers))
+	for _, p := range data.cluster.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+type cluster struct {
+	raft      *raft.Raft
+	id        string              // 本节点 id
+	origin    string              // 本进程写入的日志的来源标识，用于跳过自己已经执行过的记录
+	seq       uint64              // 本进程写入的日志的序号
+	abandoned map[uint64]struct{} // 提交失败并已回滚的日志序号，由 applyLock 保护
+	peers     map[string]Peer     // map[id]节点
+	timeout   time.Duration       // 写入日志的超时时间
+	grace     time.Duration       // 租约宽限期
+	ready     int32               // leader 是否已经追上全部日志并延长了租约，可以处理写操作
+	restoring int32               // 是否正在从快照恢复，恢复时产生的记录不写入日志
+	stores    io.Closer           // 根据配置文件打开的 raft 存储，关闭集群时关闭
+	end       chan struct{}       // 关闭 leader 监听协程
+}
+
+// raft 日志
+type clusterEntry struct {
+	Origin string     `json:"origin"`
+	Seq    uint64     `json:"seq,omitempty"`
+	Record *walRecord `json:"record"`
+}
+
+// 启动集群
+//
+//	需要在 NewData 之后，对外提供服务之前调用
+func (data *Data) StartCluster(cfg *ClusterConfig) error {
+	var (
+		notify = make(chan bool, 8)
+		rc     = raft.DefaultConfig()
+		c      = &cluster{
+			id:        cfg.ID,
+			origin:    fmt.Sprintf("%s/%d", cfg.ID, time.Now().UnixNano()),
+			abandoned: make(map[uint64]struct{}),
+			peers:     make(map[string]Peer, len(cfg.Peers)),
+			timeout:   cfg.ApplyTimeout,
+			grace:     cfg.Grace,
+			end:       make(chan struct{}),
+		}
+		err error
+	)
+	if c.timeout <= 0 {
+		c.timeout = 5 * time.Second
+	}
+	if c.grace <= 0 {
+		c.grace = 10 * time.Second
+	}
+	for _, p := range cfg.Peers {
+		c.peers[p.ID] = p
+	}
+	rc.LocalID = raft.ServerID(cfg.ID)
+	rc.NotifyCh = notify
+	rc.Logger = cfg.Logger
+	if rc.Logger == nil {
+		rc.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn})
+	}
+	if cfg.Raft != nil {
+		cfg.Raft(rc)
+	}
+	// fsm 在 NewRaft 中就可能被调用，先挂载集群
+	// 配置文件中的主题不在日志中，各个节点各自创建，作为已提交状态的初始值
+	data.committed = newStoreState(data.dump())
+	data.cluster = c
+	if c.raft, err = raft.NewRaft(rc, (*fsm)(data), cfg.Logs, cfg.Stable, cfg.Snapshots, cfg.Transport); err != nil {
+		data.cluster = nil
+		return err
+	}
+	if cfg.Bootstrap {
+		var servers = make([]raft.Server, 0, len(cfg.Peers))
+		for _, p := range cfg.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.RaftAddr)})
+		}
+		err = c.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			return err
+		}
+	}
+	go data.watchLeader(notify)
+	return nil
+}
+
+// 根据配置文件加入集群
+//
+//	raft 日志与任期、投票信息保存在 dir 中(见 raftstore.go)，快照同样保存在 dir 中，
+//	节点重启后从快照以及本地的日志中恢复，不会丢失任期与投票，也不会重新初始化集群
+//	未配置 dir 时拒绝启动
+func (data *Data) startClusterFromConf(c *conf.Data_Cluster) error {
+	var (
+		cfg = &ClusterConfig{
+			ID:           c.GetId(),
+			Bootstrap:    c.GetBootstrap(),
+			ApplyTimeout: c.GetApplyTimeout().AsDuration(),
+			Grace:        c.GetGrace().AsDuration(),
+		}
+		bind = c.GetRaftAddr()
+		err  error
+	)
+	if c.GetDir() == "" {
+		return fmt.Errorf("data.cluster.dir is required to keep the raft log")
+	}
+	for _, p := range c.GetPeers() {
+		cfg.Peers = append(cfg.Peers, Peer{ID: p.GetId(), RaftAddr: p.GetRaftAddr(), GRPCAddr: p.GetGrpcAddr()})
+		if p.GetId() == c.GetId() && bind == "" {
+			bind = p.GetRaftAddr()
+		}
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", bind)
+	if err != nil {
+		return err
+	}
+	if cfg.Snapshots, err = raft.NewFileSnapshotStore(c.GetDir(), 2, os.Stderr); err != nil {
+		return err
+	}
+	stores, err := openRaftStore(c.GetDir())
+	if err != nil {
+		return err
+	}
+	cfg.Logs, cfg.Stable = stores, stores
+	if cfg.Transport, err = raft.NewTCPTransport(bind, advertise, 3, 10*time.Second, os.Stderr); err != nil {
+		stores.Close()
+		return err
+	}
+	if err = data.StartCluster(cfg); err != nil {
+		stores.Close()
+		return err
+	}
+	data.cluster.stores = stores
+	return nil
+}
+
+// 关闭集群
+func (data *Data) stopCluster() error {
+	if data.cluster == nil {
+		return nil
+	}
+	close(data.cluster.end)
+	err := data.cluster.raft.Shutdown().Error()
+	if data.cluster.stores != nil {
+		if cerr := data.cluster.stores.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// 监听 leader 变化
+//
+//	成为 leader 后，先等待之前的日志全部应用，再延长所有 service 的租约，之后才开始处理写操作
+func (data *Data) watchLeader(notify <-chan bool) {
+	c := data.cluster
+	for {
+		select {
+		case isLeader := <-notify:
+			if !isLeader {
+				atomic.StoreInt32(&c.ready, 0)
+				data.log.Infof("cluster: lost leadership")
+				continue
+			}
+			if err := c.raft.Barrier(c.timeout).Error(); err != nil {
+				data.log.Errorf("cluster: barrier: %s", err.Error())
+				continue
+			}
+			now := time.Now()
+			data.promote(now.UnixNano(), int64(c.grace))
+			data.log.Infof("cluster: new epoch %d", data.newEpoch(now))
+			atomic.StoreInt32(&c.ready, 1)
+			data.log.Infof("cluster: became leader")
+		case <-c.end:
+			return
+		}
+	}
+}
+
+// 新的 leader 上任
+//
+//	follower 上的心跳时间是过期的，将所有 service 的心跳时间设置为 now + grace，并重新设置延时任务
+func (data *Data) promote(now int64, grace int64) {
+	data.RLock()
+	defer data.RUnlock()
+	for _, t := range data.topics {
+		for _, m := range []*ServiceMap{t.running, t.pending} {
+			m.RLock()
+			for _, s := range m.services {
+				s.keepalive = now + grace
+				t.schedule(s)
+			}
+			m.RUnlock()
+		}
+	}
+}
+
+// 当前节点能否处理写操作
+//
+//	未开启集群时总是可以，开启集群时只有 leader 可以
+func (data *Data) writable() error {
+	c := data.cluster
+	if c == nil {
+		return nil
+	}
+	if c.raft.State() == raft.Leader && atomic.LoadInt32(&c.ready) == 1 {
+		return nil
+	}
+	return c.notLeader()
+}
+
+// 当前节点不是 leader，错误中携带 leader 的 grpc 地址
+func (c *cluster) notLeader() error {
+	_, id := c.raft.LeaderWithID()
+	addr := c.peers[string(id)].GRPCAddr
+	return errorpb.ErrorNotLeader("this node is not the leader, leader: %q", addr).
+		WithMetadata(map[string]string{"leader": addr})
+}
+
+// 获取 leader 的 grpc 地址
+//
+//	第二个返回值表示当前节点是否就是 leader，未开启集群时总是 true
+//	没有 leader 时(选举中)返回空地址
+func (data *Data) Leader() (string, bool) {
+	c := data.cluster
+	if c == nil {
+		return "", true
+	}
+	if c.raft.State() == raft.Leader && atomic.LoadInt32(&c.ready) == 1 {
+		return c.peers[c.id].GRPCAddr, true
+	}
+	_, id := c.raft.LeaderWithID()
+	return c.peers[string(id)].GRPCAddr, false
+}
+
+// 将记录写入 raft 日志，等待提交，返回日志的序号
+//
+//	当前节点不是 leader 时返回 NOT_LEADER
+func (c *cluster) replicate(rec *walRecord) (uint64, error) {
+	if c.raft.State() != raft.Leader {
+		return 0, c.notLeader()
+	}
+	seq := atomic.AddUint64(&c.seq, 1)
+	b, err := json.Marshal(&clusterEntry{Origin: c.origin, Seq: seq, Record: rec})
+	if err != nil {
+		return 0, err
+	}
+	if err = c.raft.Apply(b, c.timeout).Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return seq, c.notLeader()
+		}
+		return seq, err
+	}
+	return seq, nil
+}
+
+// raft 状态机
+type fsm Data
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var (
+		data  = (*Data)(f)
+		entry clusterEntry
+	)
+	if err := json.Unmarshal(l.Data, &entry); err != nil {
+		data.log.Errorf("cluster: broken entry at %d: %s", l.Index, err.Error())
+		return nil
+	}
+	if entry.Record == nil {
+		return nil
+	}
+	data.applyLock.Lock()
+	defer data.applyLock.Unlock()
+	data.committed.apply(entry.Record)
+	// 自己写入的记录在写入前已经执行过了，提交失败并回滚过的除外
+	if entry.Origin == data.cluster.origin {
+		if _, ok := data.cluster.abandoned[entry.Seq]; !ok {
+			return nil
+		}
+		delete(data.cluster.abandoned, entry.Seq)
+	}
+	data.replay(time.Now().UnixNano(), entry.Record)
+	data.notify(entry.Record)
+	return nil
+}
+
+// 由已提交的状态生成快照，不包含 leader 上正在写入的记录
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	data := (*Data)(f)
+	data.applyLock.Lock()
+	defer data.applyLock.Unlock()
+	return &fsmSnapshot{snap: data.committed.snapshot()}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var (
+		data = (*Data)(f)
+		snap snapshot
+	)
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+	data.applyLock.Lock()
+	defer data.applyLock.Unlock()
+	atomic.StoreInt32(&data.cluster.restoring, 1)
+	defer atomic.StoreInt32(&data.cluster.restoring, 0)
+	data.committed = newStoreState(&snap)
+	data.cluster.abandoned = make(map[uint64]struct{})
+	data.reset()
+	data.restore(time.Now().UnixNano(), newStoreState(&snap), int64(data.cluster.grace))
+	data.watch.reset()
+	return nil
+}
+
+type fsmSnapshot struct {
+	snap *snapshot
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.snap); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
+
+// 清空 data 中的全部状态
+//
+//	原有的主题被标记为 removed，正在向其添加 service 的协程会重新获取主题
+func (data *Data) reset() {
+	data.Lock()
+	for _, t := range data.topics {
+		t.Lock()
+		t.removed = true
+		t.Unlock()
+	}
+	data.topics = make(map[string]*Topic)
+	data.Unlock()
+	data.instLock.Lock()
+	data.instances = make(map[string]map[string]int64)
+	data.instLock.Unlock()
+	data.depLock.Lock()
+	data.deps = make(map[int64]map[int64]*dependent)
+	data.waiting = make(map[string]map[int64]*waiter)
+	data.depLock.Unlock()
+}
+
+// 重放一条记录
+//
+//	follower 应用 leader 复制过来的记录时调用，不做依赖传播，传播的结果同样会以记录的形式复制过来
+//	不通知监听者，由调用方决定
+func (data *Data) replay(now int64, rec *walRecord) {
+	switch rec.Op {
+	case WAL_PUT:
+		if rec.Service != nil {
+			data.replayService(now, rec.Service)
+		}
+	case WAL_STATUS:
+		t, err := data.getTopic(rec.Topic)
+		if err != nil {
+			return
+		}
+		s, err := t.GetService(rec.ID)
+		if err != nil {
+			return
+		}
+		s.held = rec.Held
+		if rec.Status == HeartBeat_PENDING {
+			t.PendX(now, rec.ID)
+		} else {
+			s.Status = rec.Status
+			t.ResurrectX(now, rec.ID)
+		}
+	case WAL_DELETE:
+		t, err := data.getTopic(rec.Topic)
+		if err != nil {
+			return
+		}
+		if s, err := t.RemoveService(now, rec.ID); err == nil {
+			data.forget(s)
+		}
+		data.unindexInstance(rec.Topic, rec.ID)
+	case WAL_TOPIC:
+		if _, err := data.addTopic(rec.Topic, rec.Attr); err != nil {
+			if t, err := data.getTopic(rec.Topic); err == nil {
+				t.Lock()
+				t.attr = rec.Attr
+				t.Unlock()
+			}
+		}
+	case WAL_REMOVE_TOPIC:
+		data.removeTopic(rec.Topic, false)
+	}
+}
+
+// 重放 service 的完整状态
+func (data *Data) replayService(now int64, r *serviceRecord) {
+	data.observeID(r.ID)
+	t, _ := data.getXTopic(r.Topic)
+	s, err := t.GetService(r.ID)
+	if err != nil {
+		s = r.service()
+		if s.Status == HeartBeat_PENDING {
+			t.AddPendingService(now, s)
+		} else {
+			t.AddRunningService(now, s)
+		}
+		data.indexInstance(r.Topic, s)
+	} else {
+		s.Schema = r.Schema
+		s.Labels = r.Labels
+		s.Version = r.Version
+		s.Depends = r.Depends
+		s.Requires = r.Requires
+		s.Lease = r.Lease
+		s.Selector = r.Selector
+		s.Region = r.Region
+		s.Zone = r.Zone
+		s.Rack = r.Rack
+		s.IP = r.IP
+		s.Token = r.Token
+		s.Owner = r.Owner
+		s.Weight = r.Weight
+		s.Port = r.Port
+		s.Health = r.Health
+		s.AllInstances = r.AllInstances
+		s.held = r.Held
+		if r.Status == HeartBeat_PENDING {
+			t.PendX(now, r.ID)
+		} else {
+			s.Status = r.Status
+			t.ResurrectX(now, r.ID)
+		}
+	}
+	data.rebind(r.Topic, s, r.Relies)
+}
@@ -0,0 +1,275 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// 进程内的测试节点
+type testNode struct {
+	data      *Data
+	cleanup   func()
+	transport *raft.InmemTransport
+}
+
+// 缩短选举与心跳的超时，加快测试
+func fastRaft(c *raft.Config) {
+	c.HeartbeatTimeout = 50 * time.Millisecond
+	c.ElectionTimeout = 50 * time.Millisecond
+	c.LeaderLeaseTimeout = 50 * time.Millisecond
+	c.CommitTimeout = 5 * time.Millisecond
+}
+
+// 在一个进程内启动 n 个节点，通过 raft.NewInmemTransport 通信
+func startTestCluster(t *testing.T, n int) []*testNode {
+	t.Helper()
+	var (
+		nodes = make([]*testNode, n)
+		peers = make([]Peer, n)
+	)
+	for i := range nodes {
+		addr, transport := raft.NewInmemTransport("")
+		nodes[i] = &testNode{transport: transport}
+		peers[i] = Peer{ID: fmt.Sprintf("node%d", i), RaftAddr: string(addr), GRPCAddr: fmt.Sprintf("127.0.0.1:%d", 9000+i)}
+	}
+	for i, a := range nodes {
+		for j, b := range nodes {
+			if i != j {
+				a.transport.Connect(raft.ServerAddress(peers[j].RaftAddr), b.transport)
+			}
+		}
+	}
+	for i, node := range nodes {
+		data, cleanup, err := NewData(&conf.Data{}, log.NewHelper(log.DefaultLogger))
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.data, node.cleanup = data, cleanup
+		t.Cleanup(cleanup)
+		err = data.StartCluster(&ClusterConfig{
+			ID:        peers[i].ID,
+			Peers:     peers,
+			Bootstrap: i == 0,
+			Transport: node.transport,
+			Logs:      raft.NewInmemStore(),
+			Stable:    raft.NewInmemStore(),
+			Snapshots: raft.NewInmemSnapshotStore(),
+			Grace:     time.Minute,
+			Logger:    hclog.NewNullLogger(),
+			Raft:      fastRaft,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+// 等待存活的节点中出现可以处理写操作的 leader
+func waitLeader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	var deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, node := range nodes {
+			if node.data.writable() == nil {
+				return node
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+// 等待节点上的 service 满足条件
+//
+//	持有 applyLock 检查，与 fsm.Apply 互斥
+func waitService(t *testing.T, node *testNode, topicName string, id int64, cond func(s *Service) bool) {
+	t.Helper()
+	var deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		node.data.applyLock.Lock()
+		ok := false
+		if topic, err := node.data.getTopic(topicName); err == nil {
+			if s, err := topic.GetService(id); err == nil {
+				ok = cond == nil || cond(s)
+			}
+		}
+		node.data.applyLock.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("service %s %d not replicated to %s", topicName, id, node.data.cluster.id)
+}
+
+func followers(nodes []*testNode, leader *testNode) []*testNode {
+	var list = make([]*testNode, 0, len(nodes))
+	for _, node := range nodes {
+		if node != leader {
+			list = append(list, node)
+		}
+	}
+	return list
+}
+
+func TestClusterFailover(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	leader := waitLeader(t, nodes)
+
+	// 注册一个提供者与依赖它的消费者，复制到所有节点
+	now := time.Now().UnixNano()
+	provider, err := leader.data.AddService("provider", now, &Service{IP: "10.0.0.1", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := leader.data.Discover(now, "consumer", &Service{IP: "10.0.0.2", Port: 80}, []string{"provider"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumer, err = leader.data.AddService("consumer", now, consumer); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range followers(nodes, leader) {
+		waitService(t, node, "provider", provider.ID, nil)
+		waitService(t, node, "consumer", consumer.ID, func(c *Service) bool {
+			return len(c.Rely) == 1 && c.Rely[0].ID == provider.ID
+		})
+	}
+
+	// follower 拒绝写操作
+	for _, node := range followers(nodes, leader) {
+		if _, err = node.data.AddService("provider", now, &Service{IP: "10.0.0.3", Port: 80}); !errorpb.IsNotLeader(err) {
+			t.Fatalf("write on follower %s: got %v, want NOT_LEADER", node.data.cluster.id, err)
+		}
+		if _, err = node.data.cluster.replicate(&walRecord{Op: WAL_TOPIC, Topic: "x"}); !errorpb.IsNotLeader(err) {
+			t.Fatalf("replicate on follower %s: got %v, want NOT_LEADER", node.data.cluster.id, err)
+		}
+	}
+
+	// 停掉 leader，剩下的节点选出新的 leader 并继续处理写操作
+	if err = leader.data.cluster.raft.Shutdown().Error(); err != nil {
+		t.Fatal(err)
+	}
+	leader.transport.DisconnectAll()
+	survivors := followers(nodes, leader)
+	for _, node := range survivors {
+		node.transport.Disconnect(raft.ServerAddress(leader.transport.LocalAddr()))
+	}
+	next := waitLeader(t, survivors)
+	waitService(t, next, "consumer", consumer.ID, nil)
+	added, err := next.data.AddService("provider", time.Now().UnixNano(), &Service{IP: "10.0.0.4", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.ID == provider.ID {
+		t.Fatalf("new leader reused id %d", added.ID)
+	}
+	for _, node := range followers(survivors, next) {
+		waitService(t, node, "provider", added.ID, nil)
+		waitService(t, node, "provider", provider.ID, nil)
+	}
+}
+
+// 记录提交失败时 leader 回滚到已提交的状态
+func TestClusterRollback(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	now := time.Now().UnixNano()
+	s, err := leader.data.AddService("provider", now, &Service{IP: "10.0.0.1", Port: 80, Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 与其他节点断开，记录无法提交
+	leader.data.cluster.timeout = 100 * time.Millisecond
+	leader.transport.DisconnectAll()
+	if _, err = leader.data.UpdateService("provider", now, &Service{ID: s.ID, IP: "10.0.0.1", Port: 80, Weight: 9}); err == nil {
+		t.Fatal("update without quorum succeeded")
+	}
+	if _, err = leader.data.AddService("provider", now, &Service{IP: "10.0.0.2", Port: 80}); err == nil {
+		t.Fatal("register without quorum succeeded")
+	}
+	topic, err := leader.data.getTopic("provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := topic.GetService(s.ID); err != nil || got.Weight != 1 {
+		t.Fatalf("service after rollback: %+v %v, want weight 1", got, err)
+	}
+	if n := len(topic.running.services) + len(topic.pending.services); n != 1 {
+		t.Fatalf("%d services after rollback, want 1", n)
+	}
+}
+
+// 节点重启后从本地的 raft 日志中恢复
+func TestClusterRestart(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		id  int64
+	)
+	for round := 0; round < 2; round++ {
+		data, cleanup, err := NewData(&conf.Data{}, log.NewHelper(log.DefaultLogger))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores, err := openRaftStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots, err := raft.NewFileSnapshotStore(dir, 2, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, transport := raft.NewInmemTransport("")
+		err = data.StartCluster(&ClusterConfig{
+			ID:        "node0",
+			Peers:     []Peer{{ID: "node0", RaftAddr: string(addr)}},
+			Bootstrap: true,
+			Transport: transport,
+			Logs:      stores,
+			Stable:    stores,
+			Snapshots: snapshots,
+			Logger:    hclog.NewNullLogger(),
+			Raft:      fastRaft,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &testNode{data: data, transport: transport}
+		waitLeader(t, []*testNode{node})
+		if round == 0 {
+			s, err := data.AddService("provider", time.Now().UnixNano(), &Service{IP: "10.0.0.1", Port: 80})
+			if err != nil {
+				t.Fatal(err)
+			}
+			id = s.ID
+		} else {
+			waitService(t, node, "provider", id, nil)
+		}
+		cleanup()
+		if err = stores.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClusterRequiresDir(t *testing.T) {
+	data, cleanup, err := NewData(&conf.Data{}, log.NewHelper(log.DefaultLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if err = data.startClusterFromConf(&conf.Data_Cluster{Id: "node0", RaftAddr: "127.0.0.1:0"}); err == nil {
+		t.Fatal("cluster started without dir")
+	}
+}
@@ -3,12 +3,14 @@ package engine
 import (
 	"Airfone/api/errorpb"
 	"Airfone/internal/conf"
-	"math/rand"
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/google/wire"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ProviderSet is data services.
@@ -21,37 +23,128 @@ func NewHelper(logger log.Logger) *log.Helper {
 // Data .
 type Data struct {
 	// TODO wrapped database client
-	sync.RWMutex
-	idMaker int32
-	topics  map[string]*Topic // 生产者列表
-	log     *log.Helper
-}
+	dataLock                    // 读写锁，记录等待时间，见 metrics.go
+	idMaker   int64             // 最后分配的 id，见 id.go
+	epoch     int64             // 当前纪元
+	topics    map[string]*Topic // 生产者列表
+	selector  string            // 默认的负载均衡策略
+	selectors map[string]string // 单独配置了负载均衡策略的 topic, map[topic_name]selector
+	locality  []string          // 就近分配的回退层级
+	scheduler *Scheduler        // 延时任务调度器，处理心跳超时、pending 超时与空闲主题回收
+	prober    *Scheduler        // 健康检查的调度器，见 health.go
+	log       *log.Helper
 
-// 获取 ID
-//
-//	初次连接时用于创建唯一标识 ID
-func (data *Data) getID() int32 {
-	return atomic.AddInt32(&data.idMaker, 1)
+	idleTimeout time.Duration // 隐式创建的主题变空之后，经过该时间仍为空则被回收
+	lease       Lease         // 默认租约
+	leaseLimit  LeaseLimit    // 租约上下限，客户端请求的租约会被裁剪到该范围内
+	store       *store        // 持久化存储，未配置存储目录时为空
+	cluster     *cluster      // raft 集群，未开启集群时为空
+	writeLock   sync.Mutex    // 串行化写操作，见 store.go hold
+	applyLock   sync.Mutex    // 保护 committed，串行化已提交记录的应用与失败记录的回滚
+	committed   *storeState   // 已经写入 wal 或 raft 日志的状态，记录写入失败时据此回滚
+	watch       *watchHub     // 监听，见 watch.go
+	eventLog    *eventLog     // 状态变化的事件日志，见 events.go
+	sessions    int64         // 已经建立的会话数，用于为会话编号，见 Connect
+
+	instLock  sync.Mutex                  // 实例索引锁
+	instances map[string]map[string]int64 // 实例索引 map[topic]map[instance]id，见 instance.go
+
+	depLock sync.Mutex                     // 依赖索引锁，只保护下面两个索引
+	deps    map[int64]map[int64]*dependent // 反向依赖索引 map[提供者id]map[消费者id]消费者
+	waiting map[string]map[int64]*waiter   // 等待索引 map[依赖的topic]map[消费者id]消费者
 }
 
 // 添加一个 service
 //
-//	思路: 先去拿 topic，拿不到则创建 topic
-//	之后将 service 塞入 topic，注意锁的使用
+//	思路: 先去拿 topic，拿不到则隐式创建 topic
+//	之后在 topic 读锁下将 service 塞入 topic，
+//	若拿到的 topic 恰好被回收(removed)，则重新获取
+//	同一实例重新注册时(id 已经在主题中)，刷新原有的 service，见 instance.go
 func (data *Data) AddService(topicName string, now int64, service *Service) (*Service, error) {
-	t, err := data.getXTopic(topicName)
+	defer data.hold()()
+	return data.add(topicName, now, service)
+}
+
+// 发现依赖并注册
+//
+//	Discover 与 AddService 在同一次写操作中完成: 分开调用时，两者之间的故障与恢复传播找不到尚未加入主题的消费者，
+//	消费者可能带着已经失效的依赖加入主题
+func (data *Data) Register(now int64, topicName string, service *Service, relies []string) (*Service, error) {
+	defer data.hold()()
+	service, err := data.resolve(now, topicName, service, relies)
 	if err != nil {
 		return nil, err
 	}
-	service.ID = data.getID()
-	switch service.Status {
-	default:
-		return t.AddRunningService(now, service)
-	case HeartBeat_PENDING:
-		return t.AddPendingService(now, service)
-	case HeartBeat_DROPPED:
+	return data.add(topicName, now, service)
+}
+
+// 添加一个 service，调用方持有 hold
+//
+//	加入主题之前失败时撤销服务发现中的绑定(见 abandon)；写入记录失败时由 journal 回滚
+func (data *Data) add(topicName string, now int64, service *Service) (*Service, error) {
+	if err := data.writable(); err != nil {
+		data.abandon(topicName, service, true)
+		return nil, err
+	}
+	if service.Status == HeartBeat_DROPPED {
+		data.abandon(topicName, service, true)
 		return nil, errorpb.ErrorInsertAlreadyExist("service has been dropped status")
 	}
+	if service.ID == 0 {
+		service.ID = data.claimID(topicName, service)
+	}
+	for {
+		t, err := data.getXTopic(topicName)
+		if err != nil {
+			data.abandon(topicName, service, true)
+			return nil, err
+		}
+		lease := data.grantLease(t, service.Lease)
+		t.RLock()
+		if t.removed {
+			t.RUnlock()
+			continue
+		}
+		service.Lease = lease
+		previous := HeartBeat_DROPPED // 原有的 service 的状态，不存在则为 dropped
+		if old, e := t.GetService(service.ID); e == nil {
+			previous = old.Status
+		}
+		var added *Service
+		switch {
+		case previous != HeartBeat_DROPPED:
+			// 同一实例重新注册，刷新原有的 service
+			added, err = data.refresh(now, t, service)
+		case service.Status == HeartBeat_PENDING:
+			added, err = t.AddPendingService(now, service)
+		default:
+			added, err = t.AddRunningService(now, service)
+		}
+		t.RUnlock()
+		if err != nil {
+			data.abandon(topicName, service, true)
+			// 为这次注册隐式创建的主题可能仍然为空，同样需要回收
+			data.idle(now, t)
+			return nil, err
+		}
+		service = added
+		// 分配 id 之后主题可能恰好被回收，索引随之删除，这里重新加入
+		data.indexInstance(topicName, service)
+		if err = data.journalService(topicName, service); err != nil {
+			return nil, err
+		}
+		data.transit(now, topicName, service, previous, service.Status, REASON_REGISTER)
+		switch service.Status {
+		case HeartBeat_RUNNING:
+			// 服务注册后直接可用，恢复等待该 topic 的消费者
+			data.propagateRecovery(now, topicName)
+		case HeartBeat_PENDING:
+			if previous != HeartBeat_PENDING && previous != HeartBeat_DROPPED {
+				data.propagateFailure(now, topicName, service.ID)
+			}
+		}
+		return service, nil
+	}
 }
 
 // 移除一个 service
@@ -59,41 +152,114 @@ func (data *Data) AddService(topicName string, now int64, service *Service) (*Se
 //	思路：先去拿 topic，拿不到则 报错
 //	之后从 topic 中查询 id 在 pending 还是 running 队列
 //	若都不存在则报错
-func (data *Data) RemoveService(topicName string, now int64, id int32) (*Service, error) {
+func (data *Data) RemoveService(topicName string, now int64, id int64) (*Service, error) {
+	return data.remove(topicName, now, id, REASON_LOGOUT)
+}
+
+// 移除一个 service，并记录移除的原因
+func (data *Data) remove(topicName string, now int64, id int64, reason TransitionReason) (*Service, error) {
+	defer data.hold()()
+	if err := data.writable(); err != nil {
+		return nil, err
+	}
 	t, err := data.getTopic(topicName)
 	if err != nil {
-		return nil, err
+		return nil, data.staleID(id, err)
 	}
-	if _, err = t.GetRunningService(id); err == nil {
-		return t.RemoveRunningService(now, id)
+	var (
+		serv     *Service
+		previous HeartBeatType
+	)
+	if serv, err = t.GetRunningService(id); err == nil {
+		previous = serv.Status
+		serv, err = t.RemoveRunningService(now, id)
+	} else if serv, err = t.GetPendingService(id); err == nil {
+		previous = serv.Status
+		serv, err = t.RemovePendingService(now, id)
+	} else {
+		return nil, data.staleID(id, errorpb.ErrorDeleteInvalid("this service is not exist, remove faild"))
 	}
-	if _, err = t.GetPendingService(id); err == nil {
-		return t.RemovePendingService(now, id)
+	if err != nil {
+		return nil, err
+	}
+	data.transit(now, topicName, serv, previous, HeartBeat_DROPPED, reason)
+	err = data.journal(&walRecord{Op: WAL_DELETE, Topic: topicName, ID: id})
+	// 先为依赖它的消费者重新选择依赖，再清理索引
+	data.propagateFailure(now, topicName, id)
+	data.forget(serv)
+	data.unindexInstance(topicName, id)
+	data.idle(now, t)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errorpb.ErrorDeleteInvalid("this service is not exist, remove faild")
+	return serv, nil
 }
 
 // 更新一个 service
 //
-//	这个方法可以修改除 id, topic 以外的其他全部属性
+//	这个方法可以修改除 id, topic, status 以外的其他全部属性
 //	思路：获取 topic，未获取到报错
 //	从 topic 移除并得到该 service，然后修改他的属性，再塞入
+//	状态不取自参数: 未更新依赖时保持原本的状态，更新依赖时按新的依赖是否都找到了提供者决定 running 或 pending
 func (data *Data) UpdateService(topicName string, now int64, serv *Service) (*Service, error) {
+	defer data.hold()()
+	return data.update(topicName, now, serv)
+}
+
+// 更新一个 service，relies 不为 nil 时先重新发现依赖，与 Register 一样在同一次写操作中完成
+func (data *Data) Update(now int64, topicName string, service *Service, relies []string) (*Service, error) {
+	defer data.hold()()
+	if relies != nil {
+		var err error
+		if service, err = data.resolve(now, topicName, service, relies); err != nil {
+			return nil, err
+		}
+	}
+	return data.update(topicName, now, service)
+}
+
+// 更新一个 service，调用方持有 hold
+//
+//	塞回主题之前失败时撤销服务发现中的绑定(见 abandon)
+func (data *Data) update(topicName string, now int64, serv *Service) (*Service, error) {
 	var (
-		topic   *Topic
-		service *Service
-		err     error
+		topic    *Topic
+		service  *Service
+		previous HeartBeatType
+		err      error
 	)
+	if err = data.writable(); err != nil {
+		data.abandon(topicName, serv, false)
+		return nil, err
+	}
+	if err = checkLabels(serv.Labels); err != nil {
+		data.abandon(topicName, serv, false)
+		return nil, err
+	}
+	if serv.Version != "" {
+		if _, err = parseVersion(serv.Version); err != nil {
+			data.abandon(topicName, serv, false)
+			return nil, err
+		}
+	}
 	topic, err = data.getTopic(topicName)
 	if err != nil {
-		return nil, err
+		data.abandon(topicName, serv, false)
+		return nil, data.staleID(serv.ID, err)
 	}
+	// 移除与重新塞入之间主题为空，持有主题读锁，避免主题被回收
+	topic.RLock()
 	// 移除并获取到该服务
+	if service, err = topic.GetService(serv.ID); err == nil {
+		previous = service.Status
+	}
 	if service, err = topic.RemoveService(now, serv.ID); err != nil {
-		return nil, err
+		topic.RUnlock()
+		data.abandon(topicName, serv, false)
+		return nil, data.staleID(serv.ID, err)
 	}
-	// 服务数据更新
-	service.Status = serv.Status
+	// 移除时状态被置为 dropped，恢复原本的状态
+	service.Status = previous
 	if serv.IP != "" {
 		service.IP = serv.IP
 	}
@@ -103,8 +269,44 @@ func (data *Data) UpdateService(topicName string, now int64, serv *Service) (*Se
 	if serv.Schema != nil {
 		service.Schema = serv.Schema
 	}
+	if serv.Labels != nil {
+		// 不再满足条件的消费者在下次心跳时重新选择
+		service.Labels = serv.Labels
+	}
+	if serv.Version != "" {
+		service.Version = serv.Version
+	}
+	if serv.Selector != "" {
+		service.Selector = serv.Selector
+	}
+	if serv.Weight != 0 {
+		service.Weight = serv.Weight
+	}
+	if serv.Region != "" {
+		service.Region = serv.Region
+	}
+	if serv.Zone != "" {
+		service.Zone = serv.Zone
+	}
+	if serv.Rack != "" {
+		service.Rack = serv.Rack
+	}
 	if serv.Rely != nil {
+		// 新的依赖在服务发现时已经绑定，这里释放旧的依赖，并清理不再依赖的 topic
+		data.release(service.ID, service.Rely)
+		data.unwait(service.ID, subtract(service.Depends, serv.Depends)...)
 		service.Rely = serv.Rely
+		service.Depends = serv.Depends
+		service.Requires = serv.Requires
+		// 依赖变化后按新的依赖是否都找到了提供者决定状态，新的依赖已在响应中返回，不需要确认
+		service.Status = HeartBeat_RUNNING
+		if data.isWaiting(service.ID, service.Depends) {
+			service.Status = HeartBeat_PENDING
+		}
+	}
+	// 未更新依赖时保持原本的状态；被管理员置为 pending 或健康检查失败时保持 pending
+	if service.held || atomic.LoadInt32(&service.unhealthy) == 1 {
+		service.Status = HeartBeat_PENDING
 	}
 	// 根据状态重新返还到列表中
 	switch service.Status {
@@ -113,6 +315,20 @@ func (data *Data) UpdateService(topicName string, now int64, serv *Service) (*Se
 	case HeartBeat_CHANGED, HeartBeat_RUNNING:
 		topic.AddRunningService(now, service)
 	}
+	topic.RUnlock()
+	data.transit(now, topicName, service, previous, service.Status, REASON_UPDATE)
+	err = data.journalService(topicName, service)
+	// 只在可用性真正变化时传播；仍然可用但标签、版本或位置变化时，等待的消费者可能因此满足条件
+	switch wasPending, isPending := previous == HeartBeat_PENDING, service.Status == HeartBeat_PENDING; {
+	case isPending && !wasPending:
+		data.propagateFailure(now, topicName, service.ID)
+	case !isPending && (wasPending || serv.Labels != nil || serv.Version != "" ||
+		serv.Region != "" || serv.Zone != "" || serv.Rack != ""):
+		data.propagateRecovery(now, topicName)
+	}
+	if err != nil {
+		return nil, err
+	}
 	return service, nil
 }
 
@@ -124,28 +340,80 @@ type innerTopic struct {
 
 // 服务发现
 //
-//	这个方法可能修改服务的 status，rely 两个属性
+//	这个方法可能修改服务的 id，status，rely，depends，requires 五个属性
+//	relies 中的依赖可以带有版本约束与标签选择器，见 relies.go
 //	思路: data上读锁, 挨个读取所有依赖的topic
-//	running列表上读锁，再从 topic 中随机选取一个 running 节点
+//	running列表上读锁，按依赖的条件与就近原则筛选后，再通过负载均衡策略从 topic 中选取一个 running 节点
 //	如果该 running 中为空，则将(discover方法传入的)服务 status 置为 pending
 //	将所有的 rely 塞入 service, 然后返回
-func (data *Data) Discover(now int64, service *Service, relies []string) (*Service, error) {
+//
+//	新注册的服务在这里就分配 id，因为一致性哈希需要以消费者 id 为 key
+func (data *Data) Discover(now int64, topicName string, service *Service, relies []string) (*Service, error) {
+	defer data.hold()()
+	return data.resolve(now, topicName, service, relies)
+}
+
+// 服务发现，调用方持有 hold
+func (data *Data) resolve(now int64, topicName string, service *Service, relies []string) (*Service, error) {
 	var (
 		topics  = make([]*innerTopic, 0, len(relies))
 		status  = HeartBeat_RUNNING
 		relyMap map[string]*Rely
 		rely    []*Rely
+		depends []string
+		err     error
 	)
+	// id 只能由 leader 分配
+	if err = data.writable(); err != nil {
+		return nil, err
+	}
+	if service.Selector != "" {
+		if _, ok := GetSelector(service.Selector); !ok {
+			return nil, errorpb.ErrorSelectorInvalid("no such a selector: %s", service.Selector)
+		}
+	}
+	if service.Health != nil {
+		if err = service.Health.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if err = checkLabels(service.Labels); err != nil {
+		return nil, err
+	}
+	if service.Version != "" {
+		if _, err = parseVersion(service.Version); err != nil {
+			return nil, err
+		}
+	}
+	namespace, _ := SplitTopic(topicName)
+	if depends, service.Requires, err = parseRelies(namespace, relies); err != nil {
+		return nil, err
+	}
+	if service.ID == 0 {
+		service.ID = data.claimID(topicName, service)
+		// 同一实例重新注册时沿用原来的 id，只允许原来的身份；没有所有者时由这次注册绑定
+		if _, err = data.checkOwner(topicName, service.ID, service.Owner); err != nil {
+			return nil, err
+		}
+	} else if service.Selector == "" {
+		// 更新时未指定策略，则沿用原有的策略
+		if t, err := data.getTopic(topicName); err == nil {
+			if s, err := t.GetService(service.ID); err == nil {
+				service.Selector = s.Selector
+			}
+		}
+	}
+	service.Depends = depends
 	// 不需要依赖的话直接跳过
-	if len(relies) == 0 {
-		service.Rely = rely
+	if len(depends) == 0 {
+		service.Rely = make([]*Rely, 0)
 		service.Status = status
 		return service, nil
 	}
 
 	// 读取所有 topic
 	data.RLock()
-	for _, t := range relies {
+	for _, t := range depends {
 		topics = append(topics, &innerTopic{
 			Topic:     data.topics[t],
 			topicName: t,
@@ -153,7 +421,7 @@ func (data *Data) Discover(now int64, service *Service, relies []string) (*Servi
 	}
 	data.RUnlock()
 
-	relyMap, status = data.discover(now, topics)
+	relyMap, status = data.discover(now, topicName, service, topics)
 	rely = make([]*Rely, 0, len(relyMap))
 	for _, r := range relyMap {
 		rely = append(rely, r)
@@ -168,11 +436,14 @@ func (data *Data) Discover(now int64, service *Service, relies []string) (*Servi
 // 心跳检查
 //
 //	思路：先获取 topic,再获取 service，
-//	若未获取到 service 则认为 service 因延迟被删除，需要重新注册
-//	再通过 service rely 来检测是否有依赖出故障
+//	若未获取到 service 则认为 service 因延迟被删除，需要重新注册，
+//	id 属于之前的纪元时返回 STALE_ID
+//	再通过 service rely 来检测是否有依赖出故障，以及是否有还未找到提供者的依赖
+//	若依赖已在传播时被服务端替换，则通知客户端重新拉取全部依赖
 //	最终还需要修改服务状态:
 //	若当前状态为 running, changed 则放置于 running 队列中
 //	若当前状态为 pending 则放置于 pending 队列中
+//	状态在 running 与 pending 之间变化时，向依赖它的消费者传播
 func (data *Data) Check(now int64, hb *HeartBeat) (*HeartBeat, error) {
 	var (
 		status    = HeartBeat_RUNNING // 心跳状态
@@ -180,35 +451,53 @@ func (data *Data) Check(now int64, hb *HeartBeat) (*HeartBeat, error) {
 		relies    []*Rely             // 需要改变的依赖
 		topic     *Topic              // 心跳的主题
 		serv      *Service            // 心跳的service
+		previous  HeartBeatType       // 心跳前的状态
 		err       error
 	)
-	// 获取 topic
-	if topic, err = data.getTopic(hb.Topic); err != nil {
+	defer data.hold()()
+	if err = data.writable(); err != nil {
 		return nil, err
 	}
-	// 获取 service
-	if serv, err = topic.GetService(hb.ID); err != nil {
+	// 获取 topic 与 service，主题已被回收同样视为 service 被删除
+	if topic, err = data.getTopic(hb.Topic); err == nil {
+		serv, err = topic.GetService(hb.ID)
+	}
+	if err != nil {
+		if err = data.staleID(hb.ID, err); errorpb.IsStaleId(err) {
+			return nil, err
+		}
 		status = HeartBeat_DROPPED
 		hb.Status = status
 		return hb, nil
 	}
 	// 获取到serv 后将其更新时间置为当前时间
 	serv.keepalive = now
+	previous = serv.Status
 
-	// 探测过期的依赖
+	// 探测过期的依赖、已不再满足条件的依赖，以及还没有可用提供者的依赖
 	// 若他原本没有依赖，则直接返回
-	if len(serv.Rely) != 0 {
-		repyTopic = make([]*innerTopic, 0, len(serv.Rely))
+	if len(serv.Depends) != 0 {
+		var found = make(map[string]bool, len(serv.Rely))
+		repyTopic = make([]*innerTopic, 0, len(serv.Depends))
 		data.RLock()
-		limit := now - int64(DURATION_PENDING)
 		for _, r := range serv.Rely {
-			if *r.Keepalive < limit || *r.Status != HeartBeat_RUNNING {
+			found[r.Topic] = true
+			if *r.Keepalive < now-int64(r.Lease.Pending) || *r.Status != HeartBeat_RUNNING ||
+				!serv.Requires[r.Topic].Matches(*r.Labels, *r.Version) {
 				repyTopic = append(repyTopic, &innerTopic{
 					Topic:     data.topics[r.Topic],
 					topicName: r.Topic,
 				})
 			}
 		}
+		for _, name := range serv.Depends {
+			if !found[name] {
+				repyTopic = append(repyTopic, &innerTopic{
+					Topic:     data.topics[name],
+					topicName: name,
+				})
+			}
+		}
 		data.RUnlock()
 
 		// 若所有依赖均正常,状态为running，则直接返回
@@ -216,55 +505,154 @@ func (data *Data) Check(now int64, hb *HeartBeat) (*HeartBeat, error) {
 		// 若服务发现后 serv 状态为pending，则状态修改为 pending
 		if len(repyTopic) != 0 {
 			var relyMap map[string]*Rely
-			relyMap, status = data.discover(now, repyTopic)
-			relies = make([]*Rely, len(relyMap))
-			// 更新服务的依赖
-			for i := 0; i < len(serv.Rely); i++ {
-				if r, ok := relyMap[serv.Rely[i].Topic]; ok {
-					serv.Rely[i] = r
-				}
-			}
-			// 将 map 转换为 list,返回给前端
+			relyMap, status = data.discover(now, hb.Topic, serv, repyTopic)
+			relies = make([]*Rely, 0, len(relyMap))
+			// 更新服务的依赖，并将 map 转换为 list,返回给前端
 			for _, r := range relyMap {
+				data.replaceRely(serv, r)
 				relies = append(relies, r)
 			}
 		}
 	}
 
+	// 健康检查失败的 service 保持 pending，直到探测成功；被管理员置为 pending 的 service 保持 pending，直到管理员移回 running
+	if atomic.LoadInt32(&serv.unhealthy) == 1 || serv.held {
+		status = HeartBeat_PENDING
+	}
+
 	// 赋值返回
 	hb.Rely = relies
 	hb.Status = status
+	if status == HeartBeat_PENDING {
+		hb.Unresolved = data.Unresolved(serv.ID, serv.Depends)
+	}
+
+	// 依赖已在传播时被服务端替换，服务本身仍然可用，只需要通知客户端拉取全部依赖
+	if serv.changed {
+		serv.changed = false
+		hb.Rely = append(make([]*Rely, 0, len(serv.Rely)), serv.Rely...)
+		if status == HeartBeat_RUNNING {
+			hb.Status = HeartBeat_CHANGED
+		}
+	}
+
+	// 全量模式每次心跳都返回全部依赖，以及各依赖中全部可用的提供者
+	if serv.AllInstances {
+		hb.Rely = append(make([]*Rely, 0, len(serv.Rely)), serv.Rely...)
+		hb.Instances = data.endpointsOf(now, serv)
+	}
 
 	// 服务状态变更
 	switch status {
 	case HeartBeat_RUNNING, HeartBeat_CHANGED:
 		serv.Status = status
 		topic.ResurrectX(now, hb.ID)
+		if status == HeartBeat_RUNNING && previous == HeartBeat_PENDING {
+			data.propagateRecovery(now, hb.Topic)
+		}
 	case HeartBeat_PENDING:
 		serv.Status = status
 		topic.PendX(now, hb.ID)
+		if previous != HeartBeat_PENDING {
+			data.propagateFailure(now, hb.Topic, hb.ID)
+		}
+	}
+	data.transit(now, hb.Topic, serv, previous, serv.Status, REASON_HEARTBEAT)
+	if len(relies) > 0 {
+		err = data.journalService(hb.Topic, serv)
+	} else if (previous == HeartBeat_PENDING) != (serv.Status == HeartBeat_PENDING) {
+		err = data.journalStatus(hb.Topic, hb.ID, serv.Status)
+	}
+	if err != nil {
+		return nil, err
 	}
-
 	return hb, nil
 }
 
-func (data *Data) Conform(now int64, topicName string, id int32) error {
+func (data *Data) Conform(now int64, topicName string, id int64) error {
 	var (
 		topic *Topic
+		serv  *Service
 		err   error
 	)
+	defer data.hold()()
+	if err = data.writable(); err != nil {
+		return err
+	}
 	if topic, err = data.getTopic(topicName); err != nil {
+		return data.staleID(id, err)
+	}
+	if serv, err = topic.GetService(id); err != nil {
+		return data.staleID(id, err)
+	}
+	previous := serv.Status
+	if err = topic.Conform(now, id); err != nil {
+		return data.staleID(id, err)
+	}
+	data.transit(now, topicName, serv, previous, HeartBeat_RUNNING, REASON_CONFORM)
+	err = data.journalStatus(topicName, id, HeartBeat_RUNNING)
+	// 确认后服务可用，恢复等待该 topic 的消费者
+	data.propagateRecovery(now, topicName)
+	return err
+}
+
+// 会话建立
+//
+//	为会话分配编号并记录为 service 当前的会话，返回编号；service 不存在时返回 0
+//	客户端重连后旧的会话可能稍后才被发现断开，断开时只处理当前的会话(见 Disconnect)
+func (data *Data) Connect(topicName string, id int64) int64 {
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return 0
+	}
+	data.writeLock.Lock()
+	defer data.writeLock.Unlock()
+	s, err := t.GetService(id)
+	if err != nil {
+		return 0
+	}
+	data.sessions++
+	s.session = data.sessions
+	return s.session
+}
+
+// 会话断开
+//
+//	客户端的会话流(Session)断开时调用，不必等到心跳超时，立即将 service 置为 pending 并向下传播
+//	session 为 Connect 返回的编号，已经不是 service 当前的会话时(客户端已经重连)不做任何操作
+//	service 已经是 pending 或已被删除时同样不做任何操作
+func (data *Data) Disconnect(now int64, topicName string, id int64, session int64) error {
+	defer data.hold()()
+	if err := data.writable(); err != nil {
 		return err
 	}
-	return topic.Conform(now, id)
+	topic, err := data.getTopic(topicName)
+	if err != nil {
+		return data.staleID(id, err)
+	}
+	serv, err := topic.GetRunningService(id)
+	if err != nil || serv.session != session {
+		return nil
+	}
+	previous := serv.Status
+	// 与心跳超时一致，保留原本的心跳时间，pending 超时从最后一次心跳开始计算
+	if err = topic.Demote(id); err != nil {
+		return err
+	}
+	data.log.Infof("service %s id: %d session closed, turn to pending", topicName, id)
+	data.transit(now, topicName, serv, previous, HeartBeat_PENDING, REASON_DISCONNECT)
+	err = data.journalStatus(topicName, id, HeartBeat_PENDING)
+	data.propagateFailure(now, topicName, id)
+	return err
 }
 
 // 内部服务发现
 //
+//	topicName 与 consumer 是发起服务发现的消费者，用于按条件筛选、就近筛选以及选择负载均衡策略
 //	最终返回的状态可能是
 //	当所有主题都能正常找到新依赖时，返回changed
 //	当有主题中没有可用依赖时，返回pending
-func (data *Data) discover(now int64, topics []*innerTopic) (map[string]*Rely, HeartBeatType) {
+func (data *Data) discover(now int64, topicName string, consumer *Service, topics []*innerTopic) (map[string]*Rely, HeartBeatType) {
 	var (
 		rely   = make(map[string]*Rely)
 		status = HeartBeat_CHANGED
@@ -272,42 +660,287 @@ func (data *Data) discover(now int64, topics []*innerTopic) (map[string]*Rely, H
 	// 遍历 topic，取出其中心跳正常的 service
 	for _, t := range topics {
 		var (
-			list []*Service
-			serv *Service
+			list   []*Service
+			serv   *Service
+			reason string
 		)
-		list = t.GetAllRunningService(now)
-		// 如果该 topic 没有 service 在正常心跳范围
-		// 则将当前传入的 service 状态置为 pending
+		// 依赖的 topic 可能还未创建
+		if t.Topic != nil {
+			list = t.GetAllRunningService(now)
+		}
+		list, reason = filterByRequirement(consumer.Requires[t.topicName], list)
+		// 就近筛选，未配置 global 时可能筛选掉全部的 service
 		if len(list) > 0 {
-			serv = list[rand.Intn(len(list))]
-			rely[t.topicName] = &Rely{
-				Keepalive: &serv.keepalive,
-				Status:    &serv.Status,
-				Topic:     t.topicName,
-				IP:        serv.IP,
-				ID:        serv.ID,
-				Port:      serv.Port,
+			if list = filterByLocality(data.locality, consumer, list); len(list) == 0 {
+				reason = "no provider in allowed locality tiers"
 			}
+		}
+		// 如果该 topic 没有满足条件的 service 在正常心跳范围
+		// 则将当前传入的 service 状态置为 pending，并记录原因
+		if len(list) > 0 {
+			serv = data.getSelector(consumer.Selector, t.topicName).Select(&SelectInfo{
+				Topic:    t.topicName,
+				Consumer: topicName,
+				ID:       consumer.ID,
+			}, list)
+			data.bind(topicName, consumer.ID, serv)
+			data.unwait(consumer.ID, t.topicName)
+			rely[t.topicName] = newRely(t.topicName, serv)
 		} else {
+			data.wait(t.topicName, topicName, consumer.ID, reason)
 			status = HeartBeat_PENDING
 		}
 	}
+	observeDiscover(topicName, status)
 	return rely, status
 }
 
+// 引用提供者，生成依赖
+func newRely(topicName string, provider *Service) *Rely {
+	return &Rely{
+		Keepalive: &provider.keepalive,
+		Status:    &provider.Status,
+		Load:      &provider.load,
+		Lease:     &provider.Lease,
+		Labels:    &provider.Labels,
+		Version:   &provider.Version,
+		Topic:     topicName,
+		IP:        provider.IP,
+		ID:        provider.ID,
+		Port:      provider.Port,
+	}
+}
+
+// 获取负载均衡选择器
+//
+//	优先级: 消费者指定 > topic 属性 > topic 配置 > 全局默认 > 随机
+func (data *Data) getSelector(prefer, topicName string) Selector {
+	var attr string
+	data.RLock()
+	if t, ok := data.topics[topicName]; ok {
+		attr = t.Attr().Selector
+	}
+	data.RUnlock()
+	for _, name := range []string{prefer, attr, data.selectors[topicName], data.selector} {
+		if s, ok := GetSelector(name); ok {
+			return s
+		}
+	}
+	s, _ := GetSelector(SELECTOR_RANDOM)
+	return s
+}
+
+// 处理到期的延时任务
+//
+//	由调度器协程调用，将状态变化传播给依赖它的消费者
+func (data *Data) timeout(now int64, task *Task) {
+	defer data.hold()()
+	// 集群中只有 leader 处理过期，结果通过日志复制到其他节点
+	if data.writable() != nil {
+		return
+	}
+	topic, err := data.getTopic(task.Topic)
+	if err != nil {
+		return
+	}
+	switch task.Action {
+	case TURN_TO_PENDING:
+		if s, ok := topic.Expire(now, task.ID); ok {
+			data.log.Infof("service %s id: %d heartbeat timeout, turn to pending", task.Topic, task.ID)
+			data.transit(now, task.Topic, s, HeartBeat_RUNNING, HeartBeat_PENDING, REASON_TIMEOUT)
+			data.journalStatus(task.Topic, task.ID, HeartBeat_PENDING)
+			data.expire(now, task.Topic, []*Service{s}, nil)
+		}
+	case DROP_AFTER_PENDING:
+		if s, ok := topic.Drop(now, task.ID); ok {
+			data.log.Infof("service %s id: %d pending timeout, dropped", task.Topic, task.ID)
+			data.transit(now, task.Topic, s, HeartBeat_PENDING, HeartBeat_DROPPED, REASON_TIMEOUT)
+			data.journal(&walRecord{Op: WAL_DELETE, Topic: task.Topic, ID: task.ID})
+			data.expire(now, task.Topic, nil, []*Service{s})
+			data.idle(now, topic)
+			// 保留实例索引，客户端重新注册时沿用原来的 id
+			data.scheduler.Reset(task.Topic, task.ID, now+int64(s.Lease.Dropped), FORGET_INSTANCE)
+		}
+	case REMOVE_IDLE_TOPIC:
+		data.reapTopic(task.Topic)
+	case FORGET_INSTANCE:
+		if _, err = topic.GetService(task.ID); err != nil {
+			data.unindexInstance(task.Topic, task.ID)
+		}
+	}
+}
+
+// 显式创建主题
+//
+//	显式创建的主题不会因为空闲被回收，若主题已被隐式创建，则转为显式主题
+func (data *Data) CreateTopic(name string, attr *TopicAttr) (*Topic, error) {
+	if name == "" {
+		return nil, errorpb.ErrorDefault("topic name can not be empty")
+	}
+	if attr != nil && attr.Selector != "" {
+		if _, ok := GetSelector(attr.Selector); !ok {
+			return nil, errorpb.ErrorSelectorInvalid("no such a selector: %s", attr.Selector)
+		}
+	}
+	defer data.hold()()
+	if err := data.writable(); err != nil {
+		return nil, err
+	}
+	topic, err := data.addTopic(name, attr)
+	if err != nil {
+		return nil, err
+	}
+	if err = data.journal(&walRecord{Op: WAL_TOPIC, Topic: name, Attr: attr}); err != nil {
+		return nil, err
+	}
+	return topic, nil
+}
+
+// 移除主题
+//
+//	只有主题中没有任何 service 时才能移除
+func (data *Data) RemoveTopic(name string) error {
+	defer data.hold()()
+	if err := data.writable(); err != nil {
+		return err
+	}
+	if err := data.removeTopic(name, false); err != nil {
+		return err
+	}
+	return data.journal(&walRecord{Op: WAL_REMOVE_TOPIC, Topic: name})
+}
+
 // NewData .
 func NewData(c *conf.Data, logger *log.Helper) (*Data, func(), error) {
 	var (
 		data    *Data                 // data
 		endSign = make(chan struct{}) // 用于控制异步调度任务的关闭
+		done    sync.WaitGroup        // 等待调度协程与快照协程退出
+		err     error
 	)
 	cleanup := func() {
 		log.Info("closing the data resources")
 		close(endSign)
+		done.Wait()
+		if err := data.stopCluster(); err != nil {
+			logger.Errorf("stop cluster: %s", err.Error())
+		}
+		if err := data.eventLog.close(); err != nil {
+			logger.Errorf("close event log: %s", err.Error())
+		}
+		if data.store != nil {
+			// 关闭前生成一次快照，下次启动时不需要重放 wal
+			if err := data.snapshot(); err != nil {
+				logger.Errorf("write snapshot: %s", err.Error())
+			}
+			data.store.close()
+		}
 	}
 	data = &Data{
-		topics: make(map[string]*Topic),
-		log:    logger,
+		topics:    make(map[string]*Topic),
+		instances: make(map[string]map[string]int64),
+		watch:     newWatchHub(time.Now()),
+		deps:      make(map[int64]map[int64]*dependent),
+		waiting:   make(map[string]map[int64]*waiter),
+		selector:  c.GetSelector().GetDefault(),
+		selectors: c.GetSelector().GetTopics(),
+		log:       logger,
+
+		idleTimeout: time.Minute,
+		lease:       leaseFromConf(c.GetLease()).fill(),
+		leaseLimit: LeaseLimit{
+			Min: leaseFromConf(c.GetLeaseMin()),
+			Max: leaseFromConf(c.GetLeaseMax()),
+		},
+	}
+	if c.GetTopicIdleTimeout() != nil {
+		data.idleTimeout = c.GetTopicIdleTimeout().AsDuration()
+	}
+	if data.locality, err = checkLocalityTiers(c.GetLocalityTiers()); err != nil {
+		return nil, nil, err
+	}
+	if data.eventLog, err = newEventLog(int(c.GetEvents().GetSize()), c.GetEvents().GetFile()); err != nil {
+		return nil, nil, err
+	}
+	data.scheduler = NewScheduler(data.timeout)
+	data.prober = NewScheduler(data.probe)
+	if data.selectors == nil {
+		data.selectors = make(map[string]string)
+	}
+	for topic, name := range data.selectors {
+		if _, ok := GetSelector(name); !ok {
+			logger.Warnf("unknown selector %q for topic %q, fall back to default", name, topic)
+		}
+	}
+	// 预先创建配置文件中的主题
+	for _, t := range c.GetTopics() {
+		attr := &TopicAttr{Selector: t.GetSelector()}
+		if t.GetLease() != nil {
+			lease := leaseFromConf(t.GetLease())
+			attr.Lease = &lease
+		}
+		if _, err = data.CreateTopic(t.GetName(), attr); err != nil {
+			return nil, nil, err
+		}
+	}
+	// 从存储目录中恢复
+	if dir := c.GetStore().GetDir(); dir != "" {
+		var (
+			state    *storeState
+			grace    = 10 * time.Second
+			interval = 5 * time.Minute
+		)
+		if c.GetStore().GetRestoreGrace() != nil {
+			grace = c.GetStore().GetRestoreGrace().AsDuration()
+		}
+		if c.GetStore().GetSnapshotInterval() != nil {
+			interval = c.GetStore().GetSnapshotInterval().AsDuration()
+		}
+		if data.store, state, err = openStore(dir, c.GetStore().GetSync()); err != nil {
+			return nil, nil, err
+		}
+		data.committed = state
+		data.restore(time.Now().UnixNano(), state, int64(grace))
+		data.newEpoch(time.Now())
+		// 恢复后立即生成快照，压缩 wal
+		if err = data.snapshot(); err != nil {
+			return nil, nil, err
+		}
+		// 关闭时等待正在进行的快照完成，再生成最后一次快照
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			data.snapshotLoop(interval, endSign)
+		}()
+	} else {
+		data.newEpoch(time.Now())
+	}
+	// 加入集群
+	if cc := c.GetCluster(); cc.GetId() != "" {
+		if data.store != nil {
+			return nil, nil, fmt.Errorf("data.store and data.cluster can not be used together")
+		}
+		if err = data.startClusterFromConf(cc); err != nil {
+			return nil, nil, err
+		}
+	}
+	// 开启调度协程
+	done.Add(2)
+	go func() {
+		defer done.Done()
+		data.scheduler.Run(endSign)
+	}()
+	go func() {
+		defer done.Done()
+		data.prober.Run(endSign)
+	}()
+	// 采集各主题的 service 数，见 metrics.go
+	collector := &instanceCollector{data: data}
+	if err = prometheus.Register(collector); err != nil {
+		logger.Warnf("register metrics: %s", err.Error())
 	}
-	return data, cleanup, nil
+	return data, func() {
+		prometheus.Unregister(collector)
+		cleanup()
+	}, nil
 }
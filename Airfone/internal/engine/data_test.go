@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"Airfone/internal/conf"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+// 创建只在内存中的 data，测试结束时关闭
+func newTestData(t *testing.T, c *conf.Data) *Data {
+	t.Helper()
+	if c == nil {
+		c = &conf.Data{}
+	}
+	data, cleanup, err := NewData(c, log.NewHelper(log.DefaultLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	return data
+}
+
+// 与 service 层相同，发现依赖并注册
+func register(t *testing.T, data *Data, topicName string, now int64, s *Service, relies ...string) *Service {
+	t.Helper()
+	s, err := data.Register(now, topicName, s, relies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// service 当前的状态，不存在时为 dropped
+func statusOf(data *Data, topicName string, id int64) HeartBeatType {
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return HeartBeat_DROPPED
+	}
+	s, err := t.GetService(id)
+	if err != nil {
+		return HeartBeat_DROPPED
+	}
+	return s.Status
+}
+
+// 会话断开立即移入 pending 并传播，不延长租约: pending 超时仍从最后一次心跳开始计算
+func TestDisconnect(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		provider = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+		consumer = register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80}, "log")
+		closed   = now + int64(provider.Lease.Pending)/2
+	)
+	// 客户端重连之后，旧的会话断开不做任何操作
+	stale := data.Connect("log", provider.ID)
+	session := data.Connect("log", provider.ID)
+	if err := data.Disconnect(closed, "log", provider.ID, stale); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(data, "log", provider.ID); got != HeartBeat_RUNNING {
+		t.Fatalf("status after the stale session closed = %v, want running", got)
+	}
+	if err := data.Disconnect(closed, "log", provider.ID, session); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(data, "log", provider.ID); got != HeartBeat_PENDING {
+		t.Fatalf("status after disconnect = %v, want pending", got)
+	}
+	if got := statusOf(data, "common", consumer.ID); got != HeartBeat_PENDING {
+		t.Errorf("consumer status after disconnect = %v, want pending", got)
+	}
+	if provider.keepalive != now {
+		t.Errorf("keepalive = %d, want the last heartbeat %d", provider.keepalive, now)
+	}
+	// 已经是 pending 时不做任何操作
+	if err := data.Disconnect(closed+1, "log", provider.ID, session); err != nil {
+		t.Fatal(err)
+	}
+	data.timeout(now+int64(provider.Lease.Dropped)+1, &Task{Topic: "log", ID: provider.ID, Action: DROP_AFTER_PENDING})
+	if got := statusOf(data, "log", provider.ID); got != HeartBeat_DROPPED {
+		t.Errorf("status after pending timeout = %v, want dropped", got)
+	}
+}
+
+// 与 service 层相同，更新依赖时先发现依赖再更新
+func update(t *testing.T, data *Data, topicName string, now int64, s *Service, relies ...string) *Service {
+	t.Helper()
+	s, err := data.Update(now, topicName, s, relies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// 未更新依赖时保持原本的状态，更新依赖时按是否找到提供者决定状态，只在状态变化时传播
+func TestUpdateService(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		provider = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+		waiting  = register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80}, "nope")
+		consumer = register(t, data, "audit", now, &Service{IP: "10.0.2.1", Port: 80}, "log")
+		downward = register(t, data, "report", now, &Service{IP: "10.0.3.1", Port: 80}, "audit")
+	)
+	if got := statusOf(data, "common", waiting.ID); got != HeartBeat_PENDING {
+		t.Fatalf("status of waiting consumer = %v, want pending", got)
+	}
+	// 不带依赖的更新中状态为零值 running，不能据此恢复等待中的消费者
+	update(t, data, "common", now, &Service{ID: waiting.ID, Weight: 3})
+	if got := statusOf(data, "common", waiting.ID); got != HeartBeat_PENDING {
+		t.Errorf("status after update without relies = %v, want pending", got)
+	}
+	update(t, data, "common", now, &Service{ID: waiting.ID}, "log")
+	if got := statusOf(data, "common", waiting.ID); got != HeartBeat_RUNNING {
+		t.Errorf("status after resolving relies = %v, want running", got)
+	}
+
+	// 运行中的提供者更新不改变状态，也不记录事件
+	update(t, data, "log", now, &Service{ID: provider.ID, Weight: 5})
+	if got := statusOf(data, "log", provider.ID); got != HeartBeat_RUNNING {
+		t.Errorf("status of provider after update = %v, want running", got)
+	}
+	if events := data.Events(&EventFilter{Reason: REASON_UPDATE}); len(events) != 1 || events[0].ID != waiting.ID {
+		t.Errorf("update events = %+v, want only the resolved consumer", events)
+	}
+
+	// 更新为找不到提供者的依赖时移入 pending，并传播给下游
+	update(t, data, "audit", now, &Service{ID: consumer.ID}, "nope")
+	if got := statusOf(data, "audit", consumer.ID); got != HeartBeat_PENDING {
+		t.Errorf("status after unresolved relies = %v, want pending", got)
+	}
+	if got := statusOf(data, "report", downward.ID); got != HeartBeat_PENDING {
+		t.Errorf("downstream status = %v, want pending", got)
+	}
+	update(t, data, "audit", now, &Service{ID: consumer.ID}, "log")
+	if got := statusOf(data, "report", downward.ID); got != HeartBeat_RUNNING {
+		t.Errorf("downstream status after recovery = %v, want running", got)
+	}
+}
+
+// 更新失败时撤销这次服务发现的绑定，原有的依赖不受影响
+func TestUpdateAbandon(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		provider = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+		consumer = register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80}, "log")
+	)
+	tests := []struct {
+		name      string
+		topicName string
+		service   *Service
+		load      int32 // 失败之后 provider 的被依赖数
+	}{
+		{"invalid labels", "common", &Service{ID: consumer.ID, Labels: map[string]string{"env": "a=b"}}, 1},
+		{"stale id", "common", &Service{ID: consumer.ID + 1}, 1},
+		{"missing topic", "audit", &Service{ID: consumer.ID + 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := data.Update(now, tt.topicName, tt.service, []string{"log", "nope"}); err == nil {
+				t.Fatal("update succeeded, want error")
+			}
+			if got := atomic.LoadInt32(&provider.load); got != tt.load {
+				t.Errorf("provider load = %d, want %d", got, tt.load)
+			}
+			if got := data.dependents(provider.ID); len(got) != 1 || got[consumer.ID] == "" {
+				t.Errorf("dependents of provider = %v, want only id: %d", got, consumer.ID)
+			}
+			if got := data.waiters("nope"); len(got) != 0 {
+				t.Errorf("waiters of nope = %v, want none", got)
+			}
+		})
+	}
+	if got := statusOf(data, "common", consumer.ID); got == HeartBeat_PENDING || got == HeartBeat_DROPPED {
+		t.Errorf("consumer status = %v, want running", got)
+	}
+}
@@ -0,0 +1,118 @@
+package engine
+
+import "sort"
+
+// 全量依赖
+//
+//	默认每个依赖只分配一个提供者，消费者无法分摊负载，提供者故障时也只能等下一次心跳才能换到别的提供者
+//	service 注册时可以开启全量模式(AllInstances)，除了分配的依赖，还会得到每个依赖 topic 中全部可用的提供者，
+//	由客户端自己做负载均衡，并在调用失败时在本地剔除故障的提供者
+//	思路: 分配的依赖(Rely)、反向依赖索引与传播保持不变，全部提供者只在返回时按依赖的条件从 running 列表中筛选
+//	1. 注册、更新的结果中携带全部提供者
+//	2. 每次心跳都返回全部依赖与全部提供者，而不只是在 changed 时返回变化的依赖
+//	3. 会话(Session)同时监听依赖的主题，依赖的主题发生变化时立即推送
+//	全部提供者不做就近筛选，携带地域、可用区与机架，由客户端决定是否优先选择就近的提供者
+
+// 提供者的地址
+type Endpoint struct {
+	ID     int64  // 唯一标识符
+	IP     string // ip
+	Port   uint16 // 端口
+	Weight uint32 // 权重，0 视为 1
+	Region string // 地域
+	Zone   string // 可用区(机房)
+	Rack   string // 机架
+}
+
+// 依赖 topic 中全部满足条件的可用提供者，按 id 排序
+func (data *Data) endpoints(now int64, consumer *Service, topicName string) []*Endpoint {
+	var list []*Service
+	if t, err := data.getTopic(topicName); err == nil {
+		list = t.GetAllRunningService(now)
+	}
+	list, _ = filterByRequirement(consumer.Requires[topicName], list)
+	res := make([]*Endpoint, 0, len(list))
+	for _, s := range list {
+		res = append(res, &Endpoint{
+			ID:     s.ID,
+			IP:     s.IP,
+			Port:   s.Port,
+			Weight: s.Weight,
+			Region: s.Region,
+			Zone:   s.Zone,
+			Rack:   s.Rack,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// 全量模式下各依赖 topic 中全部可用的提供者 map[topic]提供者，不是全量模式时返回空
+func (data *Data) endpointsOf(now int64, consumer *Service) map[string][]*Endpoint {
+	if !consumer.AllInstances {
+		return nil
+	}
+	res := make(map[string][]*Endpoint, len(consumer.Depends))
+	for _, name := range consumer.Depends {
+		res[name] = data.endpoints(now, consumer, name)
+	}
+	return res
+}
+
+// 全量模式下 service 当前的依赖与全部提供者
+//
+//	只读，不刷新心跳时间，供会话在依赖的主题变化时推送；不是全量模式或 service 不存在时返回空
+func (data *Data) Endpoints(now int64, topicName string, id int64) *HeartBeat {
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return nil
+	}
+	data.writeLock.Lock()
+	defer data.writeLock.Unlock()
+	s, err := t.GetService(id)
+	if err != nil || !s.AllInstances {
+		return nil
+	}
+	hb := &HeartBeat{
+		Rely:      append(make([]*Rely, 0, len(s.Rely)), s.Rely...),
+		Topic:     topicName,
+		ID:        id,
+		Status:    s.Status,
+		Instances: data.endpointsOf(now, s),
+	}
+	if hb.Status == HeartBeat_PENDING {
+		hb.Unresolved = data.Unresolved(id, s.Depends)
+	}
+	return hb
+}
+
+// service 当前的状态与依赖
+//
+//	只读，不刷新心跳时间也不移动 service，供会话在 service 自身被修改时推送，只有客户端的心跳才会续期
+//	依赖已在传播时被替换时返回全部依赖，running 报告为 changed，changed 标记留给下一次心跳清除
+//	service 不存在时状态为 dropped；依赖可能正被传播修改，与写操作互斥地读取
+func (data *Data) State(now int64, topicName string, id int64) *HeartBeat {
+	hb := &HeartBeat{Topic: topicName, ID: id, Status: HeartBeat_DROPPED}
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return hb
+	}
+	data.writeLock.Lock()
+	defer data.writeLock.Unlock()
+	s, err := t.GetService(id)
+	if err != nil {
+		return hb
+	}
+	hb.Status = s.Status
+	if s.changed || s.AllInstances {
+		hb.Rely = append(make([]*Rely, 0, len(s.Rely)), s.Rely...)
+	}
+	if s.changed && hb.Status == HeartBeat_RUNNING {
+		hb.Status = HeartBeat_CHANGED
+	}
+	if hb.Status == HeartBeat_PENDING {
+		hb.Unresolved = data.Unresolved(id, s.Depends)
+	}
+	hb.Instances = data.endpointsOf(now, s)
+	return hb
+}
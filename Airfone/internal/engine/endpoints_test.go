@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// 会话推送读取的状态不刷新心跳时间，也不撤销 pending
+func TestStateReadOnly(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+		s    = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	)
+	if err := data.Disconnect(now, "log", s.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	later := now + int64(time.Minute)
+	if hb := data.State(later, "log", s.ID); hb.Status != HeartBeat_PENDING {
+		t.Errorf("state = %v, want pending", hb.Status)
+	}
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_PENDING {
+		t.Errorf("status after state = %v, want pending", got)
+	}
+	topic, _ := data.getTopic("log")
+	if serv, _ := topic.GetService(s.ID); serv.keepalive != now {
+		t.Errorf("keepalive = %d, want %d", serv.keepalive, now)
+	}
+	if hb := data.State(later, "log", s.ID+100); hb.Status != HeartBeat_DROPPED {
+		t.Errorf("state of a missing service = %v, want dropped", hb.Status)
+	}
+}
+
+// 依赖在传播时被替换后报告 changed，changed 标记留给下一次心跳
+func TestStateChanged(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		provider = register(t, data, "provider", now, &Service{IP: "10.0.0.1", Port: 80})
+		_        = register(t, data, "provider", now, &Service{IP: "10.0.0.2", Port: 80})
+		consumer = register(t, data, "consumer", now, &Service{IP: "10.0.0.3", Port: 80}, "provider")
+	)
+	topic, _ := data.getTopic("consumer")
+	serv, _ := topic.GetService(consumer.ID)
+	if serv.Rely[0].ID != provider.ID {
+		// 负载均衡选中了另一个提供者，注销它
+		provider = &Service{ID: serv.Rely[0].ID}
+	}
+	if _, err := data.RemoveService("provider", now, provider.ID); err != nil {
+		t.Fatal(err)
+	}
+	hb := data.State(now, "consumer", consumer.ID)
+	if hb.Status != HeartBeat_CHANGED || len(hb.Rely) != 1 || hb.Rely[0].ID == provider.ID {
+		t.Fatalf("state = %v %+v, want changed with the replacement", hb.Status, hb.Rely)
+	}
+	res, err := data.Check(now, &HeartBeat{Topic: "consumer", ID: consumer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != HeartBeat_CHANGED {
+		t.Errorf("heartbeat after state = %v, want changed", res.Status)
+	}
+}
+
+// 全量模式返回依赖 topic 中全部满足条件的可用提供者，按 id 排序
+func TestEndpoints(t *testing.T) {
+	var (
+		data  = newTestData(t, nil)
+		now   = time.Now().UnixNano()
+		prod  = map[string]string{"env": "prod"}
+		a     = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80, Labels: prod, Weight: 3, Zone: "a"})
+		b     = register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80, Labels: prod})
+		_     = register(t, data, "log", now, &Service{IP: "10.0.0.3", Port: 80, Labels: map[string]string{"env": "test"}})
+		down  = register(t, data, "log", now, &Service{IP: "10.0.0.4", Port: 80, Labels: prod})
+		all   = register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80, AllInstances: true}, "log{env=prod}")
+		plain = register(t, data, "common", now, &Service{IP: "10.0.1.2", Port: 80}, "log{env=prod}")
+	)
+	if err := data.Disconnect(now, "log", down.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	hb := data.Endpoints(now, "common", all.ID)
+	if hb == nil {
+		t.Fatal("no endpoints in all instances mode")
+	}
+	got := hb.Instances["log"]
+	if len(got) != 2 || got[0].ID != a.ID || got[1].ID != b.ID {
+		t.Fatalf("instances = %+v, want %d and %d", got, a.ID, b.ID)
+	}
+	if got[0].Weight != 3 || got[0].Zone != "a" || got[0].IP != "10.0.0.1" {
+		t.Errorf("endpoint %+v", got[0])
+	}
+	if len(hb.Rely) != 1 {
+		t.Errorf("relies = %+v, want the assigned one", hb.Rely)
+	}
+	res, err := data.Check(now, &HeartBeat{Topic: "common", ID: all.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Instances["log"]) != 2 || len(res.Rely) != 1 {
+		t.Errorf("heartbeat instances %+v relies %+v, want every heartbeat to carry them", res.Instances, res.Rely)
+	}
+
+	if data.Endpoints(now, "common", plain.ID) != nil {
+		t.Error("endpoints returned without all instances mode")
+	}
+	if res, _ = data.Check(now, &HeartBeat{Topic: "common", ID: plain.ID}); res.Instances != nil {
+		t.Errorf("heartbeat without all instances mode carries %+v", res.Instances)
+	}
+}
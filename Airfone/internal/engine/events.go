@@ -0,0 +1,232 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 事件日志
+//
+//	service 抖动时，只靠日志很难还原它经历了什么，这里把每一次状态变化都记录为结构化的事件，
+//	包括谁(主题、id、实例)、从什么状态到什么状态、原因以及发生时间，供 ListEvents 按主题、实例与时间范围查询
+//	思路: 与监听的历史记录一致，事件放在固定大小的环形缓冲中，只保留最近的事件
+//	在状态变化的地方(transit)记录，依赖被替换但状态不变时同样记录一条 rely 事件
+//	配置了文件时每个事件追加一行 json，启动时读取文件中最近的事件；
+//	追加的行数达到缓冲大小时用缓冲中的事件重写文件，文件最多保留两倍缓冲大小的事件
+//	集群中只有 leader 做出状态变化，follower 重放 wal 时不记录事件
+const EVENT_LOG_SIZE = 4096 // 默认保留的事件数
+
+// 状态变化的事件
+type Event struct {
+	Time     int64            `json:"time"`             // 发生时间(纳秒)
+	Topic    string           `json:"topic"`            // 主题
+	ID       int64            `json:"id"`               // service id
+	Instance string           `json:"instance"`         // 实例标识
+	From     HeartBeatType    `json:"from"`             // 原状态，新注册的 service 为 dropped
+	To       HeartBeatType    `json:"to"`               // 新状态
+	Reason   TransitionReason `json:"reason"`           // 原因
+	Detail   string           `json:"detail,omitempty"` // 补充说明，如 rely 事件中新的提供者
+}
+
+// 事件的查询条件，为空的条件不过滤
+type EventFilter struct {
+	Topic    string           // 主题
+	ID       int64            // service id
+	Instance string           // 实例标识
+	Reason   TransitionReason // 原因
+	Since    int64            // 起始时间(纳秒，包含)
+	Until    int64            // 结束时间(纳秒，不包含)
+	Limit    int              // 最多返回最近的多少条
+}
+
+func (f *EventFilter) match(ev *Event) bool {
+	return (f.Topic == "" || f.Topic == ev.Topic) &&
+		(f.ID == 0 || f.ID == ev.ID) &&
+		(f.Instance == "" || f.Instance == ev.Instance) &&
+		(f.Reason == "" || f.Reason == ev.Reason) &&
+		(f.Since == 0 || ev.Time >= f.Since) &&
+		(f.Until == 0 || ev.Time < f.Until)
+}
+
+type eventLog struct {
+	sync.Mutex
+	size    int      // 缓冲大小
+	events  []*Event // 环形缓冲
+	next    int      // 下一个事件在 events 中的位置
+	path    string   // 持久化文件，为空则只保存在内存中
+	file    *os.File
+	written int // 上次重写文件之后追加的行数
+}
+
+// 新建事件日志，path 不为空时读取其中最近的事件
+func newEventLog(size int, path string) (*eventLog, error) {
+	if size <= 0 {
+		size = EVENT_LOG_SIZE
+	}
+	l := &eventLog{
+		size:   size,
+		events: make([]*Event, 0, size),
+		path:   path,
+	}
+	if path == "" {
+		return l, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, l.rewrite()
+}
+
+// 读取文件中的事件，无法解析的行(写入一半时宕机)直接跳过
+func (l *eventLog) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev Event
+		if json.Unmarshal(scanner.Bytes(), &ev) == nil {
+			l.push(&ev)
+		}
+	}
+	return scanner.Err()
+}
+
+// 用缓冲中的事件重写文件
+//
+//	先写临时文件再重命名，之后的事件追加到新文件
+func (l *eventLog) rewrite() error {
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, ev := range l.list(&EventFilter{}) {
+		b, _ := json.Marshal(ev)
+		w.Write(append(b, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, l.written = f, 0
+	return nil
+}
+
+// 放入缓冲
+func (l *eventLog) push(ev *Event) {
+	if len(l.events) < l.size {
+		l.events = append(l.events, ev)
+	} else {
+		l.events[l.next] = ev
+		l.next = (l.next + 1) % l.size
+	}
+}
+
+// 按时间顺序返回符合条件的事件，调用方持有锁
+func (l *eventLog) list(filter *EventFilter) []*Event {
+	var res = make([]*Event, 0)
+	for i := 0; i < len(l.events); i++ {
+		if ev := l.events[(l.next+i)%len(l.events)]; filter.match(ev) {
+			res = append(res, ev)
+		}
+	}
+	if filter.Limit > 0 && len(res) > filter.Limit {
+		res = res[len(res)-filter.Limit:]
+	}
+	return res
+}
+
+// 记录一个事件
+func (l *eventLog) append(ev *Event) error {
+	l.Lock()
+	defer l.Unlock()
+	l.push(ev)
+	if l.file == nil {
+		return nil
+	}
+	if l.written++; l.written >= l.size {
+		return l.rewrite()
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(b, '\n'))
+	return err
+}
+
+func (l *eventLog) close() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// 记录状态变化
+//
+//	状态未变化时不记录；状态在 running(含 changed)、pending 与 dropped 之间变化时同时计入监控指标
+func (data *Data) transit(now int64, topicName string, s *Service, from, to HeartBeatType, reason TransitionReason) {
+	if from == to {
+		return
+	}
+	observeTransition(from, to, reason)
+	data.record(&Event{
+		Time:     now,
+		Topic:    topicName,
+		ID:       s.ID,
+		Instance: instanceOf(s),
+		From:     from,
+		To:       to,
+		Reason:   reason,
+	})
+}
+
+// 记录依赖被替换，service 自身的状态不变
+func (data *Data) relyChanged(now int64, topicName string, s *Service, r *Rely) {
+	data.record(&Event{
+		Time:     now,
+		Topic:    topicName,
+		ID:       s.ID,
+		Instance: instanceOf(s),
+		From:     s.Status,
+		To:       s.Status,
+		Reason:   REASON_RELY,
+		Detail:   fmt.Sprintf("%s -> %s:%d id: %d", r.Topic, r.IP, r.Port, r.ID),
+	})
+}
+
+func (data *Data) record(ev *Event) {
+	if err := data.eventLog.append(ev); err != nil {
+		data.log.Errorf("record event: %s", err.Error())
+	}
+}
+
+// 查询事件
+//
+//	按时间顺序返回符合条件的最近的事件
+func (data *Data) Events(filter *EventFilter) []*Event {
+	data.eventLog.Lock()
+	defer data.eventLog.Unlock()
+	return data.eventLog.list(filter)
+}
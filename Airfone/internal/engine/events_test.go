@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 事件的 id，按返回的顺序
+func eventIDs(events []*Event) []int64 {
+	ids := make([]int64, len(events))
+	for i, ev := range events {
+		ids[i] = ev.ID
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 缓冲满后覆盖最早的事件，仍按时间顺序返回
+func TestEventLogRing(t *testing.T) {
+	l, err := newEventLog(3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		n    int
+		want []int64
+	}{
+		{2, []int64{1, 2}},
+		{3, []int64{1, 2, 3}},
+		{4, []int64{2, 3, 4}},
+		{8, []int64{6, 7, 8}},
+	}
+	var next int64
+	for _, tt := range tests {
+		for ; next < int64(tt.n); next++ {
+			if err = l.append(&Event{Time: next + 1, ID: next + 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := eventIDs(l.list(&EventFilter{})); !equalIDs(got, tt.want) {
+			t.Errorf("after %d events got %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+// 按主题、id、实例、原因与时间范围过滤，limit 只保留最近的事件
+func TestEventLogFilter(t *testing.T) {
+	l, err := newEventLog(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range []*Event{
+		{Time: 10, Topic: "log", ID: 1, Instance: "10.0.0.1:80", Reason: REASON_REGISTER},
+		{Time: 20, Topic: "common", ID: 2, Instance: "10.0.0.2:80", Reason: REASON_REGISTER},
+		{Time: 30, Topic: "log", ID: 1, Instance: "10.0.0.1:80", Reason: REASON_TIMEOUT},
+		{Time: 40, Topic: "log", ID: 3, Instance: "10.0.0.1:80", Reason: REASON_REGISTER},
+		{Time: 50, Topic: "common", ID: 2, Instance: "10.0.0.2:80", Reason: REASON_LOGOUT},
+	} {
+		if err = l.append(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		filter EventFilter
+		want   []int64
+	}{
+		{"no filter", EventFilter{}, []int64{1, 2, 1, 3, 2}},
+		{"topic", EventFilter{Topic: "log"}, []int64{1, 1, 3}},
+		{"id", EventFilter{ID: 2}, []int64{2, 2}},
+		{"instance", EventFilter{Instance: "10.0.0.1:80"}, []int64{1, 1, 3}},
+		{"topic and id", EventFilter{Topic: "log", ID: 3}, []int64{3}},
+		{"reason", EventFilter{Reason: REASON_REGISTER}, []int64{1, 2, 3}},
+		{"topic and reason", EventFilter{Topic: "common", Reason: REASON_LOGOUT}, []int64{2}},
+		{"since is inclusive", EventFilter{Since: 30}, []int64{1, 3, 2}},
+		{"until is exclusive", EventFilter{Until: 30}, []int64{1, 2}},
+		{"time range", EventFilter{Since: 20, Until: 50}, []int64{2, 1, 3}},
+		{"limit keeps the latest", EventFilter{Limit: 2}, []int64{3, 2}},
+		{"limit after filter", EventFilter{Topic: "log", Limit: 2}, []int64{1, 3}},
+		{"limit above count", EventFilter{ID: 2, Limit: 10}, []int64{2, 2}},
+		{"no match", EventFilter{Topic: "nope"}, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventIDs(l.list(&tt.filter)); !equalIDs(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 持久化的事件在重新打开后读回，文件重写后只保留缓冲中的事件，写入一半的行被跳过
+func TestEventLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events", "events.log")
+	l, err := newEventLog(3, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= 5; id++ {
+		if err = l.append(&Event{Time: id, Topic: "log", ID: id, Reason: REASON_REGISTER}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = l.close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":6,"topic":"log","id":`)
+	f.Close()
+
+	if l, err = newEventLog(3, path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	got := l.list(&EventFilter{})
+	if !equalIDs(eventIDs(got), []int64{3, 4, 5}) {
+		t.Fatalf("reloaded %v, want [3 4 5]", eventIDs(got))
+	}
+	if got[0].Topic != "log" || got[0].Reason != REASON_REGISTER || got[0].Time != 3 {
+		t.Errorf("reloaded event %+v", got[0])
+	}
+}
+
+// 状态变化按发生顺序记录原因，状态不变的心跳不记录
+func TestTransitionEvents(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+		s    = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	)
+	if _, err := data.Check(now+1, &HeartBeat{Topic: "log", ID: s.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Disconnect(now+2, "log", s.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Check(now+3, &HeartBeat{Topic: "log", ID: s.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.RemoveService("log", now+4, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		from, to HeartBeatType
+		reason   TransitionReason
+	}{
+		{HeartBeat_DROPPED, HeartBeat_RUNNING, REASON_REGISTER},
+		{HeartBeat_RUNNING, HeartBeat_PENDING, REASON_DISCONNECT},
+		{HeartBeat_PENDING, HeartBeat_RUNNING, REASON_HEARTBEAT},
+		{HeartBeat_RUNNING, HeartBeat_DROPPED, REASON_LOGOUT},
+	}
+	events := data.Events(&EventFilter{Topic: "log", ID: s.ID})
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, ev := range events {
+		if ev.From != want[i].from || ev.To != want[i].to || ev.Reason != want[i].reason || ev.Instance != "10.0.0.1:80" {
+			t.Errorf("event %d = %s %v -> %v (%s), want %s %v -> %v", i, ev.Reason, ev.From, ev.To, ev.Instance, want[i].reason, want[i].from, want[i].to)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"Airfone/api/errorpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// 主动健康检查
+//
+//	心跳只能说明客户端的心跳协程还活着，进程本身(比如 http 服务)可能已经卡死
+//	service 注册时可以声明健康检查，由服务端定期探测: tcp 连接、http GET 或 grpc 健康检查协议
+//	思路: 与心跳超时一致，探测也交给调度器，但使用单独的调度器(prober)，
+//	因为每个 service 在一个调度器中至多只有一个任务，而心跳超时的任务在每次心跳时都会被重置
+//	1. service 进入列表时(Topic.schedule)若还没有探测任务则添加，到期后立即安排下一次探测，
+//	   探测本身在单独的协程中进行，不阻塞调度器
+//	2. 连续失败 Failures 次后将 service 标记为不健康，与会话断开一致通过 Topic.Demote 移入 pending(保留原本的心跳时间)并向消费者传播；
+//	   不健康期间心跳同样返回 pending，依赖恢复也不会让它回到 running
+//	3. 探测成功后清除标记，若心跳正常且不再等待依赖，则立即恢复到 running
+//	集群中只有 leader 探测，follower 只保留探测任务，成为 leader 后直接开始探测
+//	不健康的标记不做持久化，重启或切换 leader 后重新探测
+//	探测的目标由客户端声明，为避免注册中心被用作代理访问其他地址: 只探测 service 注册的 ip，
+//	http 的路径只能是本机的绝对路径(不能带有 scheme、host)，不跟随重定向，不使用环境变量中的代理
+
+// 健康检查方式
+type HealthCheckType uint8
+
+const (
+	HEALTH_NONE HealthCheckType = iota // 不检查
+	HEALTH_TCP                         // tcp 连接
+	HEALTH_HTTP                        // http GET
+	HEALTH_GRPC                        // grpc 健康检查协议(grpc.health.v1.Health/Check)
+)
+
+// 健康检查的默认值与下限
+const (
+	HEALTH_INTERVAL     = 10 * time.Second // 默认探测间隔
+	HEALTH_INTERVAL_MIN = time.Second      // 探测间隔下限
+	HEALTH_TIMEOUT      = 2 * time.Second  // 默认探测超时，不超过探测间隔
+	HEALTH_FAILURES     = 3                // 默认连续失败多少次后置为 pending
+)
+
+// 健康检查
+type HealthCheck struct {
+	Type     HealthCheckType `json:"type"`
+	Port     uint16          `json:"port,omitempty"`    // 探测的端口，为 0 则使用 service 的端口
+	Path     string          `json:"path,omitempty"`    // http 探测的路径
+	Status   int             `json:"status,omitempty"`  // http 探测期望的状态码
+	Service  string          `json:"service,omitempty"` // grpc 探测的服务名，为空表示整个服务器
+	Interval time.Duration   `json:"interval"`          // 探测间隔
+	Timeout  time.Duration   `json:"timeout"`           // 探测超时
+	Failures int             `json:"failures"`          // 连续失败多少次后置为 pending
+}
+
+// 校验检查方式，并为空的字段填充默认值
+func (h *HealthCheck) fill() error {
+	if h.Type > HEALTH_GRPC {
+		return errorpb.ErrorHealthCheckInvalid("no such a health check type: %d", h.Type)
+	}
+	if h.Type == HEALTH_HTTP {
+		if h.Path == "" {
+			h.Path = "/"
+		}
+		if u, err := url.ParseRequestURI(h.Path); err != nil || !strings.HasPrefix(h.Path, "/") ||
+			strings.HasPrefix(h.Path, "//") || u.Scheme != "" || u.Host != "" || u.User != nil {
+			return errorpb.ErrorHealthCheckInvalid("invalid http health check path: %q", h.Path)
+		}
+		if h.Status == 0 {
+			h.Status = http.StatusOK
+		}
+	}
+	if h.Interval == 0 {
+		h.Interval = HEALTH_INTERVAL
+	}
+	h.Interval = clampDuration(h.Interval, HEALTH_INTERVAL_MIN, 0)
+	if h.Timeout == 0 {
+		h.Timeout = HEALTH_TIMEOUT
+	}
+	h.Timeout = clampDuration(h.Timeout, 0, h.Interval)
+	if h.Failures <= 0 {
+		h.Failures = HEALTH_FAILURES
+	}
+	return nil
+}
+
+// http 探测使用的连接，不使用代理，也不复用连接
+var healthTransport = &http.Transport{
+	Proxy:             nil,
+	DisableKeepAlives: true,
+}
+
+// 探测一次，返回 nil 表示健康
+func (h *HealthCheck) probe(ip string, port uint16) error {
+	if h.Port != 0 {
+		port = h.Port
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	switch h.Type {
+	case HEALTH_TCP:
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case HEALTH_HTTP:
+		// 路径在注册时已经校验，这里只取路径与参数，host 固定为注册的地址
+		path, err := url.ParseRequestURI(h.Path)
+		if err != nil {
+			return err
+		}
+		target := &url.URL{Scheme: "http", Host: addr, Path: path.Path, RawQuery: path.RawQuery}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+		if err != nil {
+			return err
+		}
+		res, err := (&http.Client{
+			Transport: healthTransport,
+			Timeout:   h.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}).Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != h.Status {
+			return fmt.Errorf("unexpected status %d, want %d", res.StatusCode, h.Status)
+		}
+		return nil
+	case HEALTH_GRPC:
+		conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: h.Service})
+		if err != nil {
+			return err
+		}
+		if res.Status != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("serving status %s", res.Status)
+		}
+		return nil
+	}
+	return nil
+}
+
+// 处理到期的探测任务
+//
+//	由 prober 的调度协程调用，先安排下一次探测，再在单独的协程中探测
+func (data *Data) probe(now int64, task *Task) {
+	t, err := data.getTopic(task.Topic)
+	if err != nil {
+		return
+	}
+	s, err := t.GetService(task.ID)
+	if err != nil || s.Health == nil {
+		// service 已被删除，或重新注册时去掉了健康检查
+		return
+	}
+	check := *s.Health
+	data.prober.Reset(task.Topic, task.ID, now+int64(check.Interval), HEALTH_CHECK)
+	if data.writable() != nil {
+		return
+	}
+	go func(ip string, port uint16) {
+		err := check.probe(ip, port)
+		data.probed(time.Now().UnixNano(), task.Topic, task.ID, err)
+	}(s.IP, s.Port)
+}
+
+// 处理探测结果
+func (data *Data) probed(now int64, topicName string, id int64, result error) {
+	defer data.hold()()
+	if data.writable() != nil {
+		return
+	}
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return
+	}
+	s, err := t.GetService(id)
+	if err != nil || s.Health == nil {
+		return
+	}
+	if result == nil {
+		atomic.StoreInt32(&s.failures, 0)
+		if !atomic.CompareAndSwapInt32(&s.unhealthy, 1, 0) {
+			return
+		}
+		data.log.Infof("service %s id: %d health check passed", topicName, id)
+		// 心跳已超时或仍在等待依赖时，交给之后的心跳恢复；被管理员置为 pending 时保持 pending
+		if s.Status != HeartBeat_PENDING || s.held || data.isWaiting(id, s.Depends) ||
+			s.keepalive < now-int64(s.Lease.Pending) {
+			return
+		}
+		// 探测成功不代表客户端仍在心跳，保留原本的心跳时间，不为 service 续期
+		if _, err = t.Promote(id); err != nil {
+			return
+		}
+		data.transit(now, topicName, s, HeartBeat_PENDING, s.Status, REASON_HEALTH)
+		data.journalStatus(topicName, id, HeartBeat_RUNNING)
+		data.propagateRecovery(now, topicName)
+		return
+	}
+	failures := atomic.AddInt32(&s.failures, 1)
+	if int(failures) < s.Health.Failures || !atomic.CompareAndSwapInt32(&s.unhealthy, 0, 1) {
+		return
+	}
+	data.log.Warnf("service %s id: %d health check failed %d times: %s, turn to pending", topicName, id, failures, result.Error())
+	if _, err = t.GetRunningService(id); err != nil {
+		// 已经是 pending
+		return
+	}
+	previous := s.Status
+	// 与心跳超时、会话断开一致保留原本的心跳时间，pending 超时从最后一次心跳开始计算
+	if err = t.Demote(id); err != nil {
+		return
+	}
+	data.transit(now, topicName, s, previous, HeartBeat_PENDING, REASON_HEALTH)
+	data.journalStatus(topicName, id, HeartBeat_PENDING)
+	data.propagateFailure(now, topicName, id)
+}
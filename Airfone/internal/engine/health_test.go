@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// 监听地址的 ip 与端口
+func hostPort(t *testing.T, addr string) (string, uint16) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, uint16(p)
+}
+
+func TestHealthCheckFill(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   HealthCheck
+		wantErr bool
+	}{
+		{"tcp", HealthCheck{Type: HEALTH_TCP}, false},
+		{"http default path", HealthCheck{Type: HEALTH_HTTP}, false},
+		{"http path with query", HealthCheck{Type: HEALTH_HTTP, Path: "/healthz?full=1"}, false},
+		{"http absolute url", HealthCheck{Type: HEALTH_HTTP, Path: "http://10.0.0.9/healthz"}, true},
+		{"http other host", HealthCheck{Type: HEALTH_HTTP, Path: "//10.0.0.9/healthz"}, true},
+		{"unknown type", HealthCheck{Type: HEALTH_GRPC + 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.check.fill()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fill() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errorpb.IsHealthCheckInvalid(err) {
+				t.Errorf("fill() error = %v, want HEALTH_CHECK_INVALID", err)
+			}
+		})
+	}
+	h := &HealthCheck{Type: HEALTH_HTTP, Interval: time.Millisecond, Timeout: time.Minute}
+	if err := h.fill(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Path != "/" || h.Status != http.StatusOK || h.Interval != HEALTH_INTERVAL_MIN || h.Timeout != HEALTH_INTERVAL_MIN || h.Failures != HEALTH_FAILURES {
+		t.Errorf("filled %+v", h)
+	}
+}
+
+// 对本地的监听分别以 tcp、http、grpc 探测
+func TestHealthProbe(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.WriteHeader(http.StatusOK)
+		case "/moved":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer web.Close()
+
+	hs := health.NewServer()
+	hs.SetServingStatus("log", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("common", healthpb.HealthCheckResponse_NOT_SERVING)
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, hs)
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	var (
+		ip, tcpPort = hostPort(t, lis.Addr().String())
+		_, downPort = hostPort(t, closed.Addr().String())
+		_, webPort  = hostPort(t, web.Listener.Addr().String())
+	)
+	tests := []struct {
+		name    string
+		check   HealthCheck
+		port    uint16
+		wantErr bool
+	}{
+		{"tcp", HealthCheck{Type: HEALTH_TCP}, tcpPort, false},
+		{"tcp closed", HealthCheck{Type: HEALTH_TCP}, downPort, true},
+		{"tcp check port", HealthCheck{Type: HEALTH_TCP, Port: tcpPort}, downPort, false},
+		{"http", HealthCheck{Type: HEALTH_HTTP, Path: "/healthz"}, webPort, false},
+		{"http unexpected status", HealthCheck{Type: HEALTH_HTTP, Path: "/ready"}, webPort, true},
+		{"http expected status", HealthCheck{Type: HEALTH_HTTP, Path: "/ready", Status: http.StatusServiceUnavailable}, webPort, false},
+		{"http redirect not followed", HealthCheck{Type: HEALTH_HTTP, Path: "/moved"}, webPort, true},
+		{"http closed", HealthCheck{Type: HEALTH_HTTP}, downPort, true},
+		{"grpc server", HealthCheck{Type: HEALTH_GRPC}, tcpPort, false},
+		{"grpc serving", HealthCheck{Type: HEALTH_GRPC, Service: "log"}, tcpPort, false},
+		{"grpc not serving", HealthCheck{Type: HEALTH_GRPC, Service: "common"}, tcpPort, true},
+		{"grpc unknown service", HealthCheck{Type: HEALTH_GRPC, Service: "nope"}, tcpPort, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := tt.check
+			if err := check.fill(); err != nil {
+				t.Fatal(err)
+			}
+			if err := check.probe(ip, tt.port); (err != nil) != tt.wantErr {
+				t.Errorf("probe() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 连续失败达到阈值后移入 pending 并传播给消费者，探测成功后恢复
+func TestHealthFailover(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		refused  = errors.New("connection refused")
+		provider = register(t, data, "log", now, &Service{IP: "127.0.0.1", Port: 80, Health: &HealthCheck{Type: HEALTH_TCP, Failures: 2}})
+		consumer = register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80}, "log")
+	)
+	data.probed(now, "log", provider.ID, refused)
+	if got := statusOf(data, "log", provider.ID); got != HeartBeat_RUNNING {
+		t.Fatalf("status after 1 failure = %v, want running", got)
+	}
+	data.probed(now, "log", provider.ID, refused)
+	if got := statusOf(data, "log", provider.ID); got != HeartBeat_PENDING {
+		t.Fatalf("status after 2 failures = %v, want pending", got)
+	}
+	if got := statusOf(data, "common", consumer.ID); got != HeartBeat_PENDING {
+		t.Errorf("consumer status = %v, want pending", got)
+	}
+	// 不健康期间心跳不会恢复
+	if res, err := data.Check(now, &HeartBeat{Topic: "log", ID: provider.ID}); err != nil || res.Status != HeartBeat_PENDING {
+		t.Errorf("heartbeat while unhealthy = %v, %v, want pending", res, err)
+	}
+
+	data.probed(now, "log", provider.ID, nil)
+	if got := statusOf(data, "log", provider.ID); got != HeartBeat_RUNNING {
+		t.Fatalf("status after recovery = %v, want running", got)
+	}
+	if got := statusOf(data, "common", consumer.ID); got != HeartBeat_RUNNING {
+		t.Errorf("consumer status after recovery = %v, want running", got)
+	}
+	health := data.Events(&EventFilter{Topic: "log", ID: provider.ID, Reason: REASON_HEALTH})
+	if len(health) != 2 || health[0].To != HeartBeat_PENDING || health[1].To != HeartBeat_RUNNING {
+		t.Errorf("health events = %+v", health)
+	}
+}
+
+// 探测成功时心跳已经超时，交给之后的心跳恢复
+func TestHealthRecoveryAfterLease(t *testing.T) {
+	var (
+		data    = newTestData(t, nil)
+		now     = time.Now().UnixNano()
+		refused = errors.New("connection refused")
+		s       = register(t, data, "log", now, &Service{IP: "127.0.0.1", Port: 80, Health: &HealthCheck{Type: HEALTH_TCP, Failures: 1}})
+	)
+	data.probed(now, "log", s.ID, refused)
+	later := now + int64(s.Lease.Pending) + 1
+	data.probed(later, "log", s.ID, nil)
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_PENDING {
+		t.Fatalf("status = %v, want pending until the next heartbeat", got)
+	}
+	if res, err := data.Check(later, &HeartBeat{Topic: "log", ID: s.ID}); err != nil || res.Status != HeartBeat_RUNNING {
+		t.Errorf("heartbeat after recovery = %v, %v, want running", res, err)
+	}
+}
+
+// 探测的结果不改变心跳时间，pending 超时仍从最后一次心跳开始计算
+func TestHealthKeepsDeadline(t *testing.T) {
+	var (
+		data    = newTestData(t, nil)
+		now     = time.Now().UnixNano()
+		refused = errors.New("connection refused")
+		s       = register(t, data, "log", now, &Service{IP: "127.0.0.1", Port: 80, Health: &HealthCheck{Type: HEALTH_TCP, Failures: 1}})
+		probed  = now + int64(s.Lease.Pending)/2
+	)
+	data.probed(probed, "log", s.ID, refused)
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_PENDING {
+		t.Fatalf("status after failure = %v, want pending", got)
+	}
+	if s.keepalive != now {
+		t.Errorf("keepalive after failure = %d, want the last heartbeat %d", s.keepalive, now)
+	}
+	data.probed(probed+1, "log", s.ID, nil)
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_RUNNING {
+		t.Fatalf("status after recovery = %v, want running", got)
+	}
+	if s.keepalive != now {
+		t.Errorf("keepalive after recovery = %d, want the last heartbeat %d", s.keepalive, now)
+	}
+
+	// 再次失败后在原本的期限被删除
+	data.probed(probed+2, "log", s.ID, refused)
+	data.timeout(now+int64(s.Lease.Dropped)+1, &Task{Topic: "log", ID: s.ID, Action: DROP_AFTER_PENDING})
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_DROPPED {
+		t.Errorf("status after the original drop deadline = %v, want dropped", got)
+	}
+}
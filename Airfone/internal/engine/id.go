@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"Airfone/api/errorpb"
+	"sync/atomic"
+	"time"
+)
+
+// service id
+//
+//	id 为 64 位整数(最高位恒为 0): 中间 41 位为注册中心的纪元(epoch)，低 22 位为纪元内的序号
+//	纪元是注册中心的"化身"编号，每次启动以及集群中每次更换 leader 时开启新的纪元:
+//	新纪元 = max(已分配过的最大纪元 + 1, 当前时间距 ID_EPOCH_BASE 的毫秒数)
+//	即使没有开启持久化，重启后的纪元也一定大于之前的纪元，新分配的 id 不会与重启前的 id 重复
+//	序号用尽时进位到纪元上，相当于预支了之后的 1ms，除非每毫秒注册超过 400 万次，否则不会追上时钟
+//
+//	从快照中恢复的 service 保留原来的 id，即使它属于之前的纪元也依然有效
+//	携带之前纪元 id 的请求若找不到对应的 service，返回 STALE_ID，
+//	客户端需要重新注册，而不是作用到其他 service 上
+const ID_SEQ_BITS = 22
+
+// 纪元的起点
+var ID_EPOCH_BASE = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// id 所属的纪元
+func epochOf(id int64) int64 {
+	return id >> ID_SEQ_BITS
+}
+
+// 获取 ID
+//
+//	初次连接时用于创建唯一标识 ID
+func (data *Data) getID() int64 {
+	return atomic.AddInt64(&data.idMaker, 1)
+}
+
+// 记录一个已经分配过的 id，保证之后分配的 id 都比它大
+func (data *Data) observeID(id int64) {
+	for {
+		if last := atomic.LoadInt64(&data.idMaker); id <= last || atomic.CompareAndSwapInt64(&data.idMaker, last, id) {
+			return
+		}
+	}
+}
+
+// 开启新的纪元
+//
+//	启动时(从存储中恢复之后)以及成为 leader 时调用，此时不会有并发的 getID
+func (data *Data) newEpoch(now time.Time) int64 {
+	epoch := epochOf(atomic.LoadInt64(&data.idMaker)) + 1
+	if clock := int64(now.Sub(ID_EPOCH_BASE) / time.Millisecond); clock > epoch {
+		epoch = clock
+	}
+	atomic.StoreInt64(&data.epoch, epoch)
+	atomic.StoreInt64(&data.idMaker, epoch<<ID_SEQ_BITS)
+	return epoch
+}
+
+// 检查找不到 service 的 id 是否过期
+//
+//	id 属于之前的纪元，或者根本没有分配过时，返回 STALE_ID，否则原样返回 err
+func (data *Data) staleID(id int64, err error) error {
+	if err == nil {
+		return nil
+	}
+	if id <= 0 || epochOf(id) < atomic.LoadInt64(&data.epoch) || id > atomic.LoadInt64(&data.idMaker) {
+		return errorpb.ErrorStaleId("id %d does not belong to current epoch %d", id, atomic.LoadInt64(&data.epoch))
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+)
+
+// 新纪元大于之前分配过的全部纪元，即使时钟回拨
+func TestNewEpoch(t *testing.T) {
+	var (
+		data  = newTestData(t, nil)
+		now   = time.Now()
+		first = data.epoch
+	)
+	id := data.getID()
+	if epochOf(id) != first {
+		t.Fatalf("id %d in epoch %d, want %d", id, epochOf(id), first)
+	}
+	if epoch := data.newEpoch(now.Add(-time.Hour)); epoch != first+1 {
+		t.Errorf("epoch after clock went back = %d, want %d", epoch, first+1)
+	}
+	later := now.Add(time.Hour)
+	if epoch := data.newEpoch(later); epoch != int64(later.Sub(ID_EPOCH_BASE)/time.Millisecond) {
+		t.Errorf("epoch = %d, want the clock", epoch)
+	}
+	if next := data.getID(); next <= id || epochOf(next) != data.epoch {
+		t.Errorf("id %d after new epoch, previous %d", next, id)
+	}
+	// 序号用尽时进位到纪元上
+	data.idMaker = data.epoch<<ID_SEQ_BITS | (1<<ID_SEQ_BITS - 1)
+	if next := data.getID(); epochOf(next) != data.epoch+1 {
+		t.Errorf("id %d after sequence overflow in epoch %d, want %d", next, epochOf(next), data.epoch+1)
+	}
+}
+
+// 找不到 service 时，之前纪元的 id 与从未分配过的 id 返回 STALE_ID，当前纪元被删除的 id 视为 dropped
+func TestStaleID(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+		old  = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	)
+	data.newEpoch(time.Now())
+	removed := register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80})
+	if _, err := data.RemoveService("log", now, removed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.RemoveService("log", now, old.ID); err != nil {
+		t.Fatal(err)
+	}
+	register(t, data, "log", now, &Service{IP: "10.0.0.3", Port: 80})
+
+	tests := []struct {
+		name  string
+		id    int64
+		stale bool
+	}{
+		{"previous epoch", old.ID, true},
+		{"never allocated", data.idMaker + 1, true},
+		{"zero", 0, true},
+		{"removed in current epoch", removed.ID, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hb, err := data.Check(now, &HeartBeat{Topic: "log", ID: tt.id})
+			if tt.stale {
+				if !errorpb.IsStaleId(err) {
+					t.Errorf("heartbeat error = %v, want STALE_ID", err)
+				}
+				if err = data.Conform(now, "log", tt.id); !errorpb.IsStaleId(err) {
+					t.Errorf("conform error = %v, want STALE_ID", err)
+				}
+				return
+			}
+			if err != nil || hb.Status != HeartBeat_DROPPED {
+				t.Errorf("heartbeat = %v, %v, want dropped", hb, err)
+			}
+		})
+	}
+}
+
+// 重启后恢复的 service 属于之前的纪元，依旧有效
+func TestStaleIDRestored(t *testing.T) {
+	dir := t.TempDir()
+	data, cleanup := openTestData(t, dir)
+	now := time.Now().UnixNano()
+	s, err := data.AddService("log", now, &Service{IP: "10.0.0.1", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+
+	data, cleanup = openTestData(t, dir)
+	defer cleanup()
+	if epochOf(s.ID) >= data.epoch {
+		t.Fatalf("restored id %d not in a previous epoch", s.ID)
+	}
+	hb, err := data.Check(time.Now().UnixNano(), &HeartBeat{Topic: "log", ID: s.ID})
+	if err != nil || hb.Status == HeartBeat_DROPPED {
+		t.Errorf("heartbeat of restored service = %v, %v", hb, err)
+	}
+}
@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"Airfone/api/errorpb"
+)
+
+// 实例标识
+//
+//	同一个实例(topic + instance)重复注册时沿用原来的 id，刷新原有的 service，而不是再新建一个
+//	instance 由客户端指定，未指定时使用 ip:port
+//	思路: data 维护 map[topic]map[instance]id 的索引，服务发现为新注册的服务分配 id 时先查索引，
+//	之后 AddService 发现该 id 已经在主题中时，用新的注册信息刷新原有的 service
+//
+//	service 因超时被删除后，索引再保留一个 Lease.Dropped 的时间(由调度器的 FORGET_INSTANCE 任务清理)，
+//	客户端收到 dropped 后重新注册依旧得到原来的 id；主动注销则立即删除索引
+//
+//	幂等令牌(token): 客户端重试同一次注册时携带相同的令牌，
+//	与已有 service 的令牌相同时直接返回已有的 service，不再重新进行服务发现
+
+// 实例标识，未指定时使用 ip:port
+func instanceOf(s *Service) string {
+	if s.Instance != "" {
+		return s.Instance
+	}
+	return net.JoinHostPort(s.IP, strconv.Itoa(int(s.Port)))
+}
+
+// 为注册的 service 分配 id
+//
+//	同一实例已经注册过(或刚被删除)时返回原来的 id
+func (data *Data) claimID(topicName string, s *Service) int64 {
+	s.Instance = instanceOf(s)
+	data.instLock.Lock()
+	defer data.instLock.Unlock()
+	instances, ok := data.instances[topicName]
+	if !ok {
+		instances = make(map[string]int64)
+		data.instances[topicName] = instances
+	}
+	if id, ok := instances[s.Instance]; ok {
+		return id
+	}
+	id := data.getID()
+	instances[s.Instance] = id
+	return id
+}
+
+// 将 service 加入索引
+//
+//	从存储中恢复以及重放日志时调用
+func (data *Data) indexInstance(topicName string, s *Service) {
+	if s.Instance == "" {
+		s.Instance = instanceOf(s)
+	}
+	data.instLock.Lock()
+	defer data.instLock.Unlock()
+	instances, ok := data.instances[topicName]
+	if !ok {
+		instances = make(map[string]int64)
+		data.instances[topicName] = instances
+	}
+	instances[s.Instance] = s.ID
+}
+
+// 从索引中删除 id
+func (data *Data) unindexInstance(topicName string, id int64) {
+	data.instLock.Lock()
+	defer data.instLock.Unlock()
+	instances := data.instances[topicName]
+	for instance, i := range instances {
+		if i == id {
+			delete(instances, instance)
+			break
+		}
+	}
+	if len(instances) == 0 {
+		delete(data.instances, topicName)
+	}
+}
+
+// 删除主题的全部索引
+func (data *Data) unindexTopic(topicName string) {
+	data.instLock.Lock()
+	defer data.instLock.Unlock()
+	delete(data.instances, topicName)
+}
+
+// 获取同一实例的同一次注册
+//
+//	token 为空，或者与已有 service 的令牌、所有者不同时返回 false
+func (data *Data) Registered(topicName string, s *Service) (*Service, bool) {
+	if s.Token == "" {
+		return nil, false
+	}
+	data.instLock.Lock()
+	id, ok := data.instances[topicName][instanceOf(s)]
+	data.instLock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return nil, false
+	}
+	old, err := t.GetService(id)
+	if err != nil || old.Token != s.Token || old.Owner != s.Owner {
+		return nil, false
+	}
+	return old, true
+}
+
+// 同一实例重新注册，用新的注册信息刷新原有的 service
+//
+//	调用方持有主题读锁，lease 已经确定
+//	思路: 与 UpdateService 一致，从列表中取出原有的 service，覆盖它的属性后再放回，
+//	保持 service 指针不变，依赖它的消费者持有的心跳、状态地址依旧有效
+func (data *Data) refresh(now int64, t *Topic, serv *Service) (*Service, error) {
+	service, err := t.RemoveService(now, serv.ID)
+	if err != nil {
+		return nil, err
+	}
+	service.IP = serv.IP
+	service.Port = serv.Port
+	service.Schema = serv.Schema
+	service.Labels = serv.Labels
+	service.Version = serv.Version
+	service.Selector = serv.Selector
+	service.Weight = serv.Weight
+	service.Region = serv.Region
+	service.Zone = serv.Zone
+	service.Rack = serv.Rack
+	service.Lease = serv.Lease
+	service.Token = serv.Token
+	service.Owner = serv.Owner
+	service.Health = serv.Health
+	service.AllInstances = serv.AllInstances
+	// 重新注册的通常是重启后的进程，重新开始健康检查
+	atomic.StoreInt32(&service.unhealthy, 0)
+	atomic.StoreInt32(&service.failures, 0)
+	service.Status = serv.Status
+	if service.held {
+		service.Status = HeartBeat_PENDING
+	}
+	// 新的依赖在服务发现时已经绑定，这里释放旧的依赖，并清理不再依赖的 topic
+	data.release(service.ID, service.Rely)
+	data.unwait(service.ID, subtract(service.Depends, serv.Depends)...)
+	service.Rely = serv.Rely
+	service.Depends = serv.Depends
+	service.Requires = serv.Requires
+	service.changed = false
+	if service.Status == HeartBeat_PENDING {
+		return t.AddPendingService(now, service)
+	}
+	return t.AddRunningService(now, service)
+}
+
+// 检查 service 是否属于 owner
+//
+//	开启认证时，service 绑定到注册它的身份，同一实例重新注册以及更新、注销、心跳等操作只允许该身份
+//	owner 为空(未开启认证)或者 service 不存在(由之后的操作处理)时通过
+//	service 没有所有者时(开启认证之前注册，或从开启认证之前的快照、wal 恢复)，绑定到第一个操作它的身份并记录，
+//	之后其他身份同样不能操作它
+func (data *Data) CheckOwner(topicName string, id int64, owner string) error {
+	unowned, err := data.checkOwner(topicName, id, owner)
+	if err != nil || !unowned {
+		return err
+	}
+	defer data.hold()()
+	if err = data.writable(); err != nil {
+		return err
+	}
+	// 取得 hold 之前可能已被其他身份绑定
+	if unowned, err = data.checkOwner(topicName, id, owner); err != nil || !unowned {
+		return err
+	}
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return nil
+	}
+	s, err := t.GetService(id)
+	if err != nil {
+		return nil
+	}
+	s.Owner = owner
+	data.log.Warnf("service %s id: %d has no owner, bound to identity %s", topicName, id, owner)
+	return data.journalService(topicName, s)
+}
+
+// 检查 service 是否属于 owner，不修改 service
+//
+//	service 存在且没有所有者时 unowned 为 true，是否绑定由调用方决定
+func (data *Data) checkOwner(topicName string, id int64, owner string) (unowned bool, err error) {
+	if owner == "" {
+		return false, nil
+	}
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return false, nil
+	}
+	s, err := t.GetService(id)
+	if err != nil || s.Owner == owner {
+		return false, nil
+	}
+	if s.Owner == "" {
+		return true, nil
+	}
+	return false, errorpb.ErrorForbidden("service %s id %d is owned by another identity", topicName, id)
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+)
+
+// 同一实例重复注册沿用原来的 id，刷新原有的 service，消费者持有的依赖依旧有效
+func TestReregisterSameInstance(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		first    = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80, Weight: 1})
+		consumer = register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80}, "log")
+	)
+	again := register(t, data, "log", now+1, &Service{IP: "10.0.0.1", Port: 80, Weight: 5})
+	if again.ID != first.ID || again != first {
+		t.Fatalf("re-register got id %d, want the same service %d", again.ID, first.ID)
+	}
+	if first.Weight != 5 {
+		t.Errorf("weight = %d, want 5", first.Weight)
+	}
+	topic, _ := data.getTopic("log")
+	if n := len(topic.GetAllRunningService(now + 1)); n != 1 {
+		t.Errorf("%d services after re-register, want 1", n)
+	}
+	if consumer.Rely[0].ID != first.ID || *consumer.Rely[0].Keepalive != first.keepalive {
+		t.Errorf("consumer rely %+v no longer tracks provider %d", consumer.Rely[0], first.ID)
+	}
+
+	// 显式指定的实例标识优先于 ip:port
+	a := register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80, Instance: "pod-a"})
+	b := register(t, data, "log", now, &Service{IP: "10.0.0.3", Port: 80, Instance: "pod-a"})
+	if a.ID != b.ID || b.IP != "10.0.0.3" {
+		t.Errorf("instance pod-a registered as %d and %d (%s)", a.ID, b.ID, b.IP)
+	}
+	if c := register(t, data, "log", now, &Service{IP: "10.0.0.3", Port: 80}); c.ID == a.ID || c.ID == first.ID {
+		t.Errorf("another instance got existing id %d", c.ID)
+	}
+}
+
+// 超时删除后重新注册沿用原来的 id，主动注销后分配新的 id
+func TestReregisterAfterRemoval(t *testing.T) {
+	var (
+		data    = newTestData(t, nil)
+		now     = time.Now().UnixNano()
+		dropped = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+		logout  = register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80})
+	)
+	if err := data.Disconnect(now, "log", dropped.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	later := now + int64(time.Hour)
+	data.timeout(later, &Task{Topic: "log", ID: dropped.ID, Action: DROP_AFTER_PENDING})
+	if got := statusOf(data, "log", dropped.ID); got != HeartBeat_DROPPED {
+		t.Fatalf("status = %v, want dropped", got)
+	}
+	if s := register(t, data, "log", later, &Service{IP: "10.0.0.1", Port: 80}); s.ID != dropped.ID {
+		t.Errorf("re-register after drop got id %d, want %d", s.ID, dropped.ID)
+	}
+
+	if _, err := data.RemoveService("log", now, logout.ID); err != nil {
+		t.Fatal(err)
+	}
+	if s := register(t, data, "log", later, &Service{IP: "10.0.0.2", Port: 80}); s.ID == logout.ID {
+		t.Errorf("re-register after logout reused id %d", s.ID)
+	}
+}
+
+// 携带相同令牌重试注册时返回已有的 service；其他身份不能接管已注册的实例
+func TestRegisteredToken(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+		s    = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80, Token: "t1", Owner: "logsvc"})
+	)
+	tests := []struct {
+		name    string
+		service *Service
+		want    bool
+	}{
+		{"same token", &Service{IP: "10.0.0.1", Port: 80, Token: "t1", Owner: "logsvc"}, true},
+		{"no token", &Service{IP: "10.0.0.1", Port: 80, Owner: "logsvc"}, false},
+		{"another token", &Service{IP: "10.0.0.1", Port: 80, Token: "t2", Owner: "logsvc"}, false},
+		{"another owner", &Service{IP: "10.0.0.1", Port: 80, Token: "t1", Owner: "other"}, false},
+		{"another instance", &Service{IP: "10.0.0.2", Port: 80, Token: "t1", Owner: "logsvc"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := data.Registered("log", tt.service)
+			if ok != tt.want || (ok && got != s) {
+				t.Errorf("Registered = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+	if _, err := data.Discover(now, "log", &Service{IP: "10.0.0.1", Port: 80, Owner: "other"}, nil); !errorpb.IsForbidden(err) {
+		t.Errorf("register by another identity error = %v, want FORBIDDEN", err)
+	}
+}
+
+// 没有所有者的 service 绑定到第一个操作它的身份，绑定随 service 记录
+func TestCheckOwnerUnowned(t *testing.T) {
+	dir := t.TempDir()
+	data, cleanup := openTestData(t, dir)
+	now := time.Now().UnixNano()
+	s, err := data.AddService("log", now, &Service{IP: "10.0.0.1", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		owner   string
+		wantErr bool
+	}{
+		{"", false},
+		{"logsvc", false},
+		{"logsvc", false},
+		{"other", true},
+	}
+	for _, tt := range tests {
+		err = data.CheckOwner("log", s.ID, tt.owner)
+		if (tt.wantErr && !errorpb.IsForbidden(err)) || (!tt.wantErr && err != nil) {
+			t.Errorf("CheckOwner(%q) = %v, want forbidden %v", tt.owner, err, tt.wantErr)
+		}
+	}
+	cleanup()
+
+	data, cleanup = openTestData(t, dir)
+	defer cleanup()
+	if err = data.CheckOwner("log", s.ID, "other"); !errorpb.IsForbidden(err) {
+		t.Errorf("CheckOwner after restart = %v, want FORBIDDEN", err)
+	}
+}
@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+
+	"Airfone/api/errorpb"
+)
+
+// 标签选择器
+//
+//	service 注册时可以携带 key/value 标签，消费者声明依赖时可以在 topic 后附加标签选择器，
+//	如 log{env=prod,tier!=canary}，只选择标签匹配的提供者
+//	支持的条件: key=value(相等)、key!=value(不相等，没有该标签同样满足)、key(存在)、!key(不存在)，
+//	多个条件之间为且的关系，{} 与没有选择器等价
+//	选择器与版本约束一起作为依赖的条件，解析与筛选见 relies.go
+
+// 标签条件的运算符
+type LabelOperator string
+
+const (
+	LABEL_EQUAL      LabelOperator = "="  // 相等
+	LABEL_NOT_EQUAL  LabelOperator = "!=" // 不相等，没有该标签同样满足
+	LABEL_EXISTS     LabelOperator = ""   // 存在
+	LABEL_NOT_EXISTS LabelOperator = "!"  // 不存在
+)
+
+// 标签条件
+type LabelRequirement struct {
+	Key   string        `json:"key"`
+	Op    LabelOperator `json:"op,omitempty"`
+	Value string        `json:"value,omitempty"`
+}
+
+func (r *LabelRequirement) matches(labels map[string]string) bool {
+	v, ok := labels[r.Key]
+	switch r.Op {
+	case LABEL_EQUAL:
+		return ok && v == r.Value
+	case LABEL_NOT_EQUAL:
+		return !ok || v != r.Value
+	case LABEL_NOT_EXISTS:
+		return !ok
+	default:
+		return ok
+	}
+}
+
+func (r *LabelRequirement) String() string {
+	if r.Op == LABEL_NOT_EXISTS {
+		return "!" + r.Key
+	}
+	return r.Key + string(r.Op) + r.Value
+}
+
+// 标签选择器，全部条件满足才匹配，为空时匹配任意提供者
+type LabelSelector []*LabelRequirement
+
+// 标签是否满足选择器
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// 按条件排序后的文本形式，相同的选择器得到相同的结果
+func (s LabelSelector) String() string {
+	terms := make([]string, 0, len(s))
+	for _, r := range s {
+		terms = append(terms, r.String())
+	}
+	sort.Strings(terms)
+	return "{" + strings.Join(terms, ",") + "}"
+}
+
+// 解析一个条件，如 env=prod、tier!=canary、gpu、!gpu
+func parseRequirement(term string) (*LabelRequirement, bool) {
+	r := &LabelRequirement{Key: term, Op: LABEL_EXISTS}
+	if i := strings.Index(term, "!="); i >= 0 {
+		r.Key, r.Op, r.Value = term[:i], LABEL_NOT_EQUAL, term[i+2:]
+	} else if i = strings.IndexByte(term, '='); i >= 0 {
+		r.Key, r.Op, r.Value = term[:i], LABEL_EQUAL, term[i+1:]
+	} else if strings.HasPrefix(term, "!") {
+		r.Key, r.Op = term[1:], LABEL_NOT_EXISTS
+	}
+	r.Key, r.Value = strings.TrimSpace(r.Key), strings.TrimSpace(r.Value)
+	if !validLabel(r.Key) || strings.ContainsAny(r.Value, "{}=!,") {
+		return nil, false
+	}
+	return r, true
+}
+
+// 标签的 key 不能为空，也不能包含选择器中的符号与空白
+func validLabel(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "{}=!, \t\n")
+}
+
+// 校验 service 的标签
+func checkLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !validLabel(k) || strings.ContainsAny(v, "{}=!,") {
+			return errorpb.ErrorLabelInvalid("invalid label %s=%s", k, v)
+		}
+	}
+	return nil
+}
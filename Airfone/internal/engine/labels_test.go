@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"testing"
+
+	"Airfone/api/errorpb"
+)
+
+func TestParseRequirement(t *testing.T) {
+	tests := []struct {
+		term string
+		want *LabelRequirement
+	}{
+		{"env=prod", &LabelRequirement{Key: "env", Op: LABEL_EQUAL, Value: "prod"}},
+		{" env = prod ", &LabelRequirement{Key: "env", Op: LABEL_EQUAL, Value: "prod"}},
+		{"env=", &LabelRequirement{Key: "env", Op: LABEL_EQUAL}},
+		{"tier!=canary", &LabelRequirement{Key: "tier", Op: LABEL_NOT_EQUAL, Value: "canary"}},
+		{"gpu", &LabelRequirement{Key: "gpu", Op: LABEL_EXISTS}},
+		{"!gpu", &LabelRequirement{Key: "gpu", Op: LABEL_NOT_EXISTS}},
+		{"", nil},
+		{"=prod", nil},
+		{"!", nil},
+		{"!=canary", nil},
+		{"env==prod", nil},
+		{"env=pr!od", nil},
+		{"my key=1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.term, func(t *testing.T) {
+			got, ok := parseRequirement(tt.term)
+			if tt.want == nil {
+				if ok {
+					t.Fatalf("parseRequirement(%q) = %+v, want invalid", tt.term, got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("parseRequirement(%q) invalid", tt.term)
+			}
+			if *got != *tt.want {
+				t.Errorf("parseRequirement(%q) = %+v, want %+v", tt.term, got, tt.want)
+			}
+		})
+	}
+}
+
+// 依赖中的标签选择器，解析后按文本形式比较
+func TestParseRelySelector(t *testing.T) {
+	tests := []struct {
+		expr    string
+		name    string
+		want    string // 选择器的文本形式，没有条件时为空
+		invalid bool
+	}{
+		{expr: "log", name: "log"},
+		{expr: "log{}", name: "log"},
+		{expr: "log{ , }", name: "log"},
+		{expr: "log{env=prod}", name: "log", want: "{env=prod}"},
+		{expr: " log { tier!=canary, env=prod ,gpu,!spot } ", name: "log", want: "{!spot,env=prod,gpu,tier!=canary}"},
+		{expr: "infra/log{env=prod}", name: "infra/log", want: "{env=prod}"},
+		{expr: "log{env=prod", invalid: true},
+		{expr: "log{env=prod}x", invalid: true},
+		{expr: "log{=prod}", invalid: true},
+		{expr: "log{env=a{b}", invalid: true},
+		{expr: "{env=prod}", invalid: true},
+		{expr: "lo=g", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			name, req, err := parseRely(tt.expr)
+			if tt.invalid {
+				if !errorpb.IsLabelInvalid(err) {
+					t.Fatalf("parseRely(%q) error = %v, want LABEL_INVALID", tt.expr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRely(%q): %v", tt.expr, err)
+			}
+			if name != tt.name {
+				t.Errorf("name = %q, want %q", name, tt.name)
+			}
+			if got := req.String(); got != tt.want {
+				t.Errorf("selector = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "tier": "web", "gpu": ""}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"{}", true},
+		{"{env=prod}", true},
+		{"{env=test}", false},
+		{"{tier!=canary}", true},
+		{"{tier!=web}", false},
+		{"{zone!=a}", true},
+		{"{gpu}", true},
+		{"{spot}", false},
+		{"{!spot}", true},
+		{"{!gpu}", false},
+		{"{gpu=}", true},
+		{"{env=prod,tier=web,!spot}", true},
+		{"{env=prod,tier=api}", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			_, req, err := parseRely("log" + tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := req.Matches(labels, ""); got != tt.want {
+				t.Errorf("%s matches %v = %v, want %v", tt.selector, labels, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		valid  bool
+	}{
+		{"empty", nil, true},
+		{"plain", map[string]string{"env": "prod", "gpu": ""}, true},
+		{"empty key", map[string]string{"": "prod"}, false},
+		{"space in key", map[string]string{"my env": "prod"}, false},
+		{"separator in key", map[string]string{"env,tier": "prod"}, false},
+		{"operator in value", map[string]string{"env": "a=b"}, false},
+		{"brace in value", map[string]string{"env": "{prod}"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkLabels(tt.labels)
+			if tt.valid && err != nil {
+				t.Errorf("checkLabels(%v): %v", tt.labels, err)
+			}
+			if !tt.valid && !errorpb.IsLabelInvalid(err) {
+				t.Errorf("checkLabels(%v) error = %v, want LABEL_INVALID", tt.labels, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"Airfone/internal/conf"
+	"time"
+)
+
+// 租约
+//
+//	即 service 的心跳窗口，原本是 topic.go 中写死的 DURATION_* 常量，
+//	现在每个 service 都有自己的租约，注册时确定:
+//	请求中指定 > 主题属性 > 配置文件默认值 > DURATION_* 常量
+//	只指定了部分字段的租约，其余字段按默认租约的比例推算，
+//	最终再由配置文件中的上下限进行裁剪
+type Lease struct {
+	Heartbeat time.Duration // 客户端发送心跳的间隔
+	Valid     time.Duration // 超过该时间未心跳，即便在 running 队列中，也不纳入使用
+	Pending   time.Duration // 超过该时间未心跳，从 running 队列放到 pending 队列
+	Dropped   time.Duration // 超过该时间未心跳，从 pending 队列中删除
+}
+
+// 默认租约
+var DefaultLease = Lease{
+	Heartbeat: DURATION_HEARTBEAT,
+	Valid:     DURATION_VALID,
+	Pending:   DURATION_PENDING,
+	Dropped:   DURATION_DROPPED,
+}
+
+// 租约上下限，为 0 的字段不做限制
+type LeaseLimit struct {
+	Min Lease
+	Max Lease
+}
+
+// 是否没有指定任何字段
+func (l Lease) empty() bool {
+	return l.Heartbeat <= 0 && l.Valid <= 0 && l.Pending <= 0 && l.Dropped <= 0
+}
+
+// 补全租约
+//
+//	以第一个指定了的字段为基准，按默认租约的比例推算其余为 0 的字段
+//	例如只指定 heartbeat 为 10s，则得到 10s/15s/20s/30s
+func (l Lease) fill() Lease {
+	var base, def time.Duration
+	for _, pair := range [][2]time.Duration{
+		{l.Heartbeat, DefaultLease.Heartbeat},
+		{l.Valid, DefaultLease.Valid},
+		{l.Pending, DefaultLease.Pending},
+		{l.Dropped, DefaultLease.Dropped},
+	} {
+		if pair[0] > 0 {
+			base, def = pair[0], pair[1]
+			break
+		}
+	}
+	if base == 0 {
+		return DefaultLease
+	}
+	scale := func(d time.Duration) time.Duration {
+		return time.Duration(float64(d) * float64(base) / float64(def))
+	}
+	if l.Heartbeat <= 0 {
+		l.Heartbeat = scale(DefaultLease.Heartbeat)
+	}
+	if l.Valid <= 0 {
+		l.Valid = scale(DefaultLease.Valid)
+	}
+	if l.Pending <= 0 {
+		l.Pending = scale(DefaultLease.Pending)
+	}
+	if l.Dropped <= 0 {
+		l.Dropped = scale(DefaultLease.Dropped)
+	}
+	return l
+}
+
+// 按上下限裁剪租约
+//
+//	裁剪后保证 heartbeat <= valid <= pending <= dropped
+func (l Lease) clamp(limit LeaseLimit) Lease {
+	l.Heartbeat = clampDuration(l.Heartbeat, limit.Min.Heartbeat, limit.Max.Heartbeat)
+	l.Valid = clampDuration(l.Valid, limit.Min.Valid, limit.Max.Valid)
+	l.Pending = clampDuration(l.Pending, limit.Min.Pending, limit.Max.Pending)
+	l.Dropped = clampDuration(l.Dropped, limit.Min.Dropped, limit.Max.Dropped)
+	if l.Valid < l.Heartbeat {
+		l.Valid = l.Heartbeat
+	}
+	if l.Pending < l.Valid {
+		l.Pending = l.Valid
+	}
+	if l.Dropped < l.Pending {
+		l.Dropped = l.Pending
+	}
+	return l
+}
+
+func clampDuration(d, min, max time.Duration) time.Duration {
+	if min > 0 && d < min {
+		d = min
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// 从配置文件中读取租约，未配置的字段为 0
+func leaseFromConf(c *conf.Data_Lease) Lease {
+	return Lease{
+		Heartbeat: c.GetHeartbeat().AsDuration(),
+		Valid:     c.GetValid().AsDuration(),
+		Pending:   c.GetPending().AsDuration(),
+		Dropped:   c.GetDropped().AsDuration(),
+	}
+}
+
+// 为注册的 service 确定租约
+//
+//	请求中指定 > 主题属性 > 配置文件默认值 > DURATION_* 常量，最后按上下限裁剪
+func (data *Data) grantLease(topic *Topic, requested Lease) Lease {
+	var l = data.lease
+	if attr := topic.Attr(); attr.Lease != nil && !attr.Lease.empty() {
+		l = attr.Lease.fill()
+	}
+	if !requested.empty() {
+		l = requested.fill()
+	}
+	return l.clamp(data.leaseLimit)
+}
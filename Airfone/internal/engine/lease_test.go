@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"Airfone/internal/conf"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestLeaseFill(t *testing.T) {
+	s := time.Second
+	tests := []struct {
+		name  string
+		lease Lease
+		want  Lease
+	}{
+		{"empty", Lease{}, DefaultLease},
+		{"heartbeat only", Lease{Heartbeat: 10 * s}, Lease{10 * s, 15 * s, 20 * s, 30 * s}},
+		{"pending only", Lease{Pending: 8 * s}, Lease{4 * s, 6 * s, 8 * s, 12 * s}},
+		{"first field is the base", Lease{Valid: 6 * s, Dropped: 60 * s}, Lease{4 * s, 6 * s, 8 * s, 60 * s}},
+		{"full", Lease{1 * s, 2 * s, 3 * s, 4 * s}, Lease{1 * s, 2 * s, 3 * s, 4 * s}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.lease.fill(); got != tt.want {
+				t.Errorf("fill(%+v) = %+v, want %+v", tt.lease, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaseClamp(t *testing.T) {
+	var (
+		s     = time.Second
+		limit = LeaseLimit{
+			Min: Lease{Heartbeat: 1 * s, Pending: 3 * s},
+			Max: Lease{Heartbeat: 10 * s, Valid: 12 * s, Dropped: 60 * s},
+		}
+	)
+	tests := []struct {
+		name  string
+		lease Lease
+		limit LeaseLimit
+		want  Lease
+	}{
+		{"no limit", Lease{100 * s, 150 * s, 200 * s, 300 * s}, LeaseLimit{}, Lease{100 * s, 150 * s, 200 * s, 300 * s}},
+		{"within limit", Lease{2 * s, 3 * s, 4 * s, 6 * s}, limit, Lease{2 * s, 3 * s, 4 * s, 6 * s}},
+		{"below min", Lease{s / 2, s, 2 * s, 4 * s}, limit, Lease{1 * s, 1 * s, 3 * s, 4 * s}},
+		{"above max", Lease{100 * s, 150 * s, 200 * s, 300 * s}, limit, Lease{10 * s, 12 * s, 200 * s, 200 * s}},
+		{"keeps the order", Lease{8 * s, 9 * s, 3 * s, 3 * s}, LeaseLimit{Max: Lease{Heartbeat: 5 * s}}, Lease{5 * s, 9 * s, 9 * s, 9 * s}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.lease.clamp(tt.limit); got != tt.want {
+				t.Errorf("clamp(%+v) = %+v, want %+v", tt.lease, got, tt.want)
+			}
+		})
+	}
+}
+
+// 注册时确定租约: 请求中指定 > 主题属性 > 配置文件默认值，最后按上下限裁剪
+func TestGrantLease(t *testing.T) {
+	var (
+		s    = time.Second
+		data = newTestData(t, &conf.Data{
+			Lease:    &conf.Data_Lease{Heartbeat: durationpb.New(4 * s)},
+			LeaseMin: &conf.Data_Lease{Heartbeat: durationpb.New(2 * s)},
+			LeaseMax: &conf.Data_Lease{Dropped: durationpb.New(40 * s)},
+		})
+		now  = time.Now().UnixNano()
+		hour = Lease{Heartbeat: time.Hour}
+	)
+	if _, err := data.CreateTopic("slow", &TopicAttr{Lease: &Lease{Heartbeat: 10 * s}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		topic   string
+		request Lease
+		want    Lease
+	}{
+		{"log", Lease{}, Lease{4 * s, 6 * s, 8 * s, 12 * s}},
+		{"slow", Lease{}, Lease{10 * s, 15 * s, 20 * s, 30 * s}},
+		{"slow", Lease{Heartbeat: 6 * s}, Lease{6 * s, 9 * s, 12 * s, 18 * s}},
+		{"log", Lease{Heartbeat: s / 2}, Lease{2 * s, 2 * s, 2 * s, 2 * s}},
+		{"log", Lease{Heartbeat: 2 * s, Dropped: time.Hour}, Lease{2 * s, 3 * s, 4 * s, 40 * s}},
+		// 上限不能打破 heartbeat <= valid <= pending <= dropped
+		{"log", hour, Lease{time.Hour, 90 * time.Minute, 2 * time.Hour, 2 * time.Hour}},
+	}
+	for i, tt := range tests {
+		got := register(t, data, tt.topic, now, &Service{IP: "10.0.0.1", Port: uint16(80 + i), Lease: tt.request})
+		if got.Lease != tt.want {
+			t.Errorf("%s %+v: lease = %+v, want %+v", tt.topic, tt.request, got.Lease, tt.want)
+		}
+	}
+}
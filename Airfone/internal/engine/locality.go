@@ -0,0 +1,74 @@
+package engine
+
+import "fmt"
+
+// 就近分配的层级
+const (
+	LOCALITY_RACK   = "rack"   // 同一机架
+	LOCALITY_ZONE   = "zone"   // 同一可用区(机房)
+	LOCALITY_REGION = "region" // 同一地域
+	LOCALITY_GLOBAL = "global" // 不做限制
+)
+
+// 默认的回退层级: 同机房 -> 同地域 -> 全局
+var defaultLocalityTiers = []string{LOCALITY_ZONE, LOCALITY_REGION, LOCALITY_GLOBAL}
+
+// 校验配置的回退层级，为空时使用默认层级
+func checkLocalityTiers(tiers []string) ([]string, error) {
+	if len(tiers) == 0 {
+		return defaultLocalityTiers, nil
+	}
+	for _, tier := range tiers {
+		switch tier {
+		case LOCALITY_RACK, LOCALITY_ZONE, LOCALITY_REGION, LOCALITY_GLOBAL:
+		default:
+			return nil, fmt.Errorf("unknown locality tier: %q", tier)
+		}
+	}
+	return tiers, nil
+}
+
+// 判断两个服务在该层级上是否处于同一位置
+//
+//	消费者在该层级没有位置信息时认为不匹配，直接跳到下一层级
+func sameLocality(tier string, consumer, provider *Service) bool {
+	switch tier {
+	case LOCALITY_RACK:
+		return consumer.Rack != "" && consumer.Rack == provider.Rack &&
+			consumer.Zone == provider.Zone && consumer.Region == provider.Region
+	case LOCALITY_ZONE:
+		return consumer.Zone != "" && consumer.Zone == provider.Zone &&
+			consumer.Region == provider.Region
+	case LOCALITY_REGION:
+		return consumer.Region != "" && consumer.Region == provider.Region
+	case LOCALITY_GLOBAL:
+		return true
+	}
+	return false
+}
+
+// 就近筛选
+//
+//	按 tiers 的顺序逐层回退，返回第一个非空层级中的提供者
+//	若所有层级都没有可用的提供者，返回空，此时消费者会被置为 pending
+//	没有任何位置信息的消费者不受限制
+func filterByLocality(tiers []string, consumer *Service, list []*Service) []*Service {
+	if consumer.Region == "" && consumer.Zone == "" && consumer.Rack == "" {
+		return list
+	}
+	for _, tier := range tiers {
+		if tier == LOCALITY_GLOBAL {
+			return list
+		}
+		matched := make([]*Service, 0, len(list))
+		for _, s := range list {
+			if sameLocality(tier, consumer, s) {
+				matched = append(matched, s)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+	return nil
+}
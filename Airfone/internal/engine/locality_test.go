@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"Airfone/internal/conf"
+)
+
+func TestFilterByLocality(t *testing.T) {
+	var (
+		rack  = &Service{ID: 1, Region: "cn", Zone: "a", Rack: "r1"}
+		zone  = &Service{ID: 2, Region: "cn", Zone: "a", Rack: "r2"}
+		other = &Service{ID: 3, Region: "cn", Zone: "b"}
+		far   = &Service{ID: 4, Region: "us", Zone: "a"}
+	)
+	tests := []struct {
+		name     string
+		tiers    []string
+		consumer *Service
+		list     []*Service
+		want     []int64
+	}{
+		{"same zone first", defaultLocalityTiers, &Service{Region: "cn", Zone: "a"}, []*Service{rack, zone, other, far}, []int64{1, 2}},
+		{"zone name in another region", defaultLocalityTiers, &Service{Region: "us", Zone: "a"}, []*Service{rack, zone, far}, []int64{4}},
+		{"fall back to region", defaultLocalityTiers, &Service{Region: "cn", Zone: "c"}, []*Service{rack, other, far}, []int64{1, 3}},
+		{"fall back to global", defaultLocalityTiers, &Service{Region: "eu", Zone: "a"}, []*Service{other, far}, []int64{3, 4}},
+		{"no locality is unrestricted", []string{LOCALITY_ZONE}, &Service{}, []*Service{other, far}, []int64{3, 4}},
+		{"rack", []string{LOCALITY_RACK, LOCALITY_ZONE}, &Service{Region: "cn", Zone: "a", Rack: "r1"}, []*Service{rack, zone}, []int64{1}},
+		{"consumer without zone skips the tier", []string{LOCALITY_ZONE, LOCALITY_REGION}, &Service{Region: "cn"}, []*Service{rack, far}, []int64{1}},
+		{"no global tier", []string{LOCALITY_ZONE, LOCALITY_REGION}, &Service{Region: "eu", Zone: "a"}, []*Service{other, far}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterByLocality(tt.tiers, tt.consumer, tt.list)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d providers, want %v", len(got), tt.want)
+			}
+			for i, s := range got {
+				if s.ID != tt.want[i] {
+					t.Errorf("provider %d = %d, want %d", i, s.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckLocalityTiers(t *testing.T) {
+	if tiers, err := checkLocalityTiers(nil); err != nil || len(tiers) != len(defaultLocalityTiers) {
+		t.Errorf("default tiers = %v, %v", tiers, err)
+	}
+	if _, err := checkLocalityTiers([]string{LOCALITY_RACK, "planet"}); err == nil {
+		t.Error("unknown tier accepted")
+	}
+	if _, _, err := NewData(&conf.Data{LocalityTiers: []string{"planet"}}, nil); err == nil {
+		t.Error("data created with an unknown tier")
+	}
+}
+
+// 同机房的提供者恢复之前，消费者回退到其他机房；没有 global 层级时置为 pending
+func TestDiscoverLocality(t *testing.T) {
+	var (
+		data = newTestData(t, &conf.Data{LocalityTiers: []string{LOCALITY_ZONE, LOCALITY_REGION}})
+		now  = time.Now().UnixNano()
+		near = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80, Region: "cn", Zone: "a"})
+		_    = register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80, Region: "cn", Zone: "b"})
+		_    = register(t, data, "log", now, &Service{IP: "10.0.0.3", Port: 80, Region: "us", Zone: "a"})
+	)
+	for i := 0; i < 5; i++ {
+		s := register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80 + uint16(i), Region: "cn", Zone: "a"}, "log")
+		if s.Rely[0].ID != near.ID {
+			t.Fatalf("consumer in zone a got provider %d, want %d", s.Rely[0].ID, near.ID)
+		}
+	}
+	if _, err := data.RemoveService("log", now, near.ID); err != nil {
+		t.Fatal(err)
+	}
+	s := register(t, data, "common", now, &Service{IP: "10.0.1.2", Port: 80, Region: "cn", Zone: "a"}, "log")
+	if s.Status == HeartBeat_PENDING || s.Rely[0].IP != "10.0.0.2" {
+		t.Errorf("consumer got %v %+v, want the provider in the same region", s.Status, s.Rely)
+	}
+	s = register(t, data, "common", now, &Service{IP: "10.0.1.3", Port: 80, Region: "eu"}, "log")
+	if s.Status != HeartBeat_PENDING {
+		t.Errorf("consumer in another region = %v, want pending", s.Status)
+	}
+}
@@ -0,0 +1,119 @@
+package engine
+
+import "sort"
+
+// 查询
+//
+//	只读地列出主题中的 service，供不注册的调用方(定时任务、命令行工具、网关)查找提供者
+//	与 Discover 不同，查询不绑定依赖、不影响负载均衡，也不要求调用方是已注册的 service
+//	思路: 与 dump 一致，依次持有主题与列表的读锁，拷贝出符合条件的 service
+//	开启集群时 follower 直接返回本地的状态，心跳只发送给 leader，follower 上的心跳时间是最后一次复制的时间
+
+// 查询条件
+type LookupFilter struct {
+	Status    []HeartBeatType   // 只返回这些状态的 service，为空则不过滤
+	Schema    map[string]string // 元数据 title -> content，全部匹配才返回，content 为空表示只要求存在该 title
+	Namespace string            // 查询全部主题时只返回该命名空间中的主题，为空则不过滤
+}
+
+// 查询结果
+type Instance struct {
+	Topic     string   // 主题
+	Service   *Service // service 的拷贝，依赖中只保留主题、ip、端口与 id
+	Keepalive int64    // 最后心跳时间(纳秒)
+}
+
+// 查询一组主题中的 service
+//
+//	topics 为主题的限定名，为空时查询全部主题(可以按命名空间过滤)，不存在的主题被忽略
+//	结果按主题、id 排序
+func (data *Data) Lookup(topics []string, filter *LookupFilter) []*Instance {
+	var (
+		res    = make([]*Instance, 0)
+		ts     = make(map[string]*Topic)
+		status map[HeartBeatType]bool
+	)
+	if filter != nil && len(filter.Status) > 0 {
+		status = make(map[HeartBeatType]bool, len(filter.Status))
+		for _, s := range filter.Status {
+			status[s] = true
+		}
+	}
+	data.RLock()
+	if len(topics) == 0 {
+		for name, t := range data.topics {
+			if filter != nil && filter.Namespace != "" {
+				if ns, _ := SplitTopic(name); ns != filter.Namespace {
+					continue
+				}
+			}
+			ts[name] = t
+		}
+	} else {
+		for _, name := range topics {
+			if t, ok := data.topics[name]; ok {
+				ts[name] = t
+			}
+		}
+	}
+	data.RUnlock()
+
+	for name, t := range ts {
+		t.RLock()
+		for _, m := range []*ServiceMap{t.running, t.pending} {
+			m.RLock()
+			for _, s := range m.services {
+				if status != nil && !status[s.Status] {
+					continue
+				}
+				if filter != nil && !matchSchema(s.Schema, filter.Schema) {
+					continue
+				}
+				res = append(res, &Instance{
+					Topic:     name,
+					Service:   s.copy(),
+					Keepalive: s.keepalive,
+				})
+			}
+			m.RUnlock()
+		}
+		t.RUnlock()
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Topic != res[j].Topic {
+			return res[i].Topic < res[j].Topic
+		}
+		return res[i].Service.ID < res[j].Service.ID
+	})
+	return res
+}
+
+// 元数据是否满足条件
+func matchSchema(schema []*Schema, want map[string]string) bool {
+	for title, content := range want {
+		found := false
+		for _, s := range schema {
+			if s.Title == title && (content == "" || s.Content == content) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// 拷贝 service
+//
+//	调用方持有 service 所在列表的读锁，依赖中不保留指向其他 service 的地址
+func (s *Service) copy() *Service {
+	c := *s
+	c.Token = ""
+	c.Rely = make([]*Rely, 0, len(s.Rely))
+	for _, r := range s.Rely {
+		c.Rely = append(c.Rely, &Rely{Topic: r.Topic, IP: r.IP, ID: r.ID, Port: r.Port})
+	}
+	return &c
+}
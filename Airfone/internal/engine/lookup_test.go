@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// 按主题、状态、元数据与命名空间过滤，结果按主题、id 排序
+func TestLookupFilter(t *testing.T) {
+	var (
+		data    = newTestData(t, nil)
+		now     = time.Now().UnixNano()
+		prod    = []*Schema{{Title: "env", Content: "prod"}, {Title: "gpu"}}
+		log1    = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80, Schema: prod, Token: "secret"})
+		log2    = register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80, Schema: []*Schema{{Title: "env", Content: "test"}}})
+		common  = register(t, data, "common", now, &Service{IP: "10.0.0.3", Port: 80}, "log")
+		staging = register(t, data, "staging/log", now, &Service{IP: "10.0.0.4", Port: 80})
+	)
+	if err := data.Disconnect(now, "log", log2.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		topics []string
+		filter *LookupFilter
+		want   []int64
+	}{
+		{"all topics", nil, nil, []int64{common.ID, log1.ID, log2.ID, staging.ID}},
+		{"one topic", []string{"log"}, nil, []int64{log1.ID, log2.ID}},
+		{"missing topic is ignored", []string{"log", "nope"}, nil, []int64{log1.ID, log2.ID}},
+		{"running only", []string{"log"}, &LookupFilter{Status: []HeartBeatType{HeartBeat_RUNNING}}, []int64{log1.ID}},
+		{"pending only", nil, &LookupFilter{Status: []HeartBeatType{HeartBeat_PENDING}}, []int64{log2.ID}},
+		{"schema content", nil, &LookupFilter{Schema: map[string]string{"env": "prod"}}, []int64{log1.ID}},
+		{"schema title only", nil, &LookupFilter{Schema: map[string]string{"env": ""}}, []int64{log1.ID, log2.ID}},
+		{"all schema must match", nil, &LookupFilter{Schema: map[string]string{"env": "test", "gpu": ""}}, nil},
+		{"namespace", nil, &LookupFilter{Namespace: "staging"}, []int64{staging.ID}},
+		{"default namespace", nil, &LookupFilter{Namespace: NAMESPACE_DEFAULT}, []int64{common.ID, log1.ID, log2.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := data.Lookup(tt.topics, tt.filter)
+			if len(res) != len(tt.want) {
+				t.Fatalf("got %d instances, want %v", len(res), tt.want)
+			}
+			for i, inst := range res {
+				if inst.Service.ID != tt.want[i] {
+					t.Errorf("instance %d = %s %d, want %d", i, inst.Topic, inst.Service.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// 查询不影响负载均衡与心跳，返回的拷贝不泄露令牌与依赖的地址
+func TestLookupReadOnly(t *testing.T) {
+	var (
+		data     = newTestData(t, nil)
+		now      = time.Now().UnixNano()
+		provider = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80, Token: "secret"})
+		_        = register(t, data, "common", now, &Service{IP: "10.0.0.2", Port: 80}, "log")
+	)
+	res := data.Lookup([]string{"log", "common"}, nil)
+	if len(res) != 2 {
+		t.Fatalf("got %d instances, want 2", len(res))
+	}
+	if provider.load != 1 || provider.keepalive != now {
+		t.Errorf("lookup changed provider: load %d keepalive %d", provider.load, provider.keepalive)
+	}
+	for _, inst := range res {
+		if inst.Service.Token != "" {
+			t.Errorf("token of %d leaked", inst.Service.ID)
+		}
+		for _, r := range inst.Service.Rely {
+			if r.Keepalive != nil || r.Status != nil || r.ID != provider.ID {
+				t.Errorf("rely copy %+v", r)
+			}
+		}
+	}
+	res[1].Service.Weight = 99 // 按主题排序，log 在 common 之后
+	if provider.Weight == 99 {
+		t.Error("lookup returned the service itself")
+	}
+}
@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 监控指标
+//
+//	注册到 prometheus 的默认注册表，由 http 服务的 /metrics 导出(见 server/http.go)
+//	思路: 计数类的指标在状态变化的地方直接累加；各主题、各状态的 service 数不单独维护，
+//	在采集时通过 Topics 统计，与管理接口看到的一致
+//	1. 状态变化: 按原状态、新状态与原因计数，changed 视为 running
+//	2. 服务发现: 按消费者所在的主题与结果(changed/pending)计数
+//	3. 锁等待: data 与 topic 的读写锁在加锁时记录等待时间
+
+// 状态变化的原因，同时用于事件日志(见 events.go)
+type TransitionReason string
+
+const (
+	REASON_REGISTER   TransitionReason = "register"   // 注册或同一实例重新注册
+	REASON_UPDATE     TransitionReason = "update"     // 客户端更新
+	REASON_LOGOUT     TransitionReason = "logout"     // 客户端注销
+	REASON_HEARTBEAT  TransitionReason = "heartbeat"  // 心跳时依赖的变化
+	REASON_CONFORM    TransitionReason = "conform"    // 客户端确认依赖的变化
+	REASON_RELY       TransitionReason = "rely"       // 依赖在传播时被替换，状态不变，只出现在事件日志中
+	REASON_TIMEOUT    TransitionReason = "timeout"    // 心跳超时或 pending 超时
+	REASON_DEPENDENCY TransitionReason = "dependency" // 依赖的故障或恢复传播
+	REASON_DISCONNECT TransitionReason = "disconnect" // 会话断开
+	REASON_ADMIN      TransitionReason = "admin"      // 管理接口的驱逐、移动与清空
+	REASON_HEALTH     TransitionReason = "health"     // 主动健康检查失败或恢复
+)
+
+var (
+	metricTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "airfone",
+		Name:      "transitions_total",
+		Help:      "Service state transitions.",
+	}, []string{"from", "to", "reason"})
+
+	metricDiscover = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "airfone",
+		Name:      "discover_total",
+		Help:      "Dependency discovery outcomes by consumer topic.",
+	}, []string{"topic", "status"})
+
+	metricLockWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "airfone",
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent waiting for the data and topic locks.",
+		Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 10), // 1µs ~ 262ms
+	}, []string{"lock", "mode"})
+
+	// 加锁时直接使用，避免每次按标签查找
+	dataReadWait   = metricLockWait.WithLabelValues("data", "read")
+	dataWriteWait  = metricLockWait.WithLabelValues("data", "write")
+	topicReadWait  = metricLockWait.WithLabelValues("topic", "read")
+	topicWriteWait = metricLockWait.WithLabelValues("topic", "write")
+
+	metricInstances = prometheus.NewDesc("airfone_instances",
+		"Services per topic and state.", []string{"topic", "status"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(metricTransitions, metricDiscover, metricLockWait)
+}
+
+// 指标中的状态名，changed 视为 running
+func stateLabel(status HeartBeatType) string {
+	switch status {
+	case HeartBeat_RUNNING, HeartBeat_CHANGED:
+		return "running"
+	case HeartBeat_PENDING:
+		return "pending"
+	default:
+		return "dropped"
+	}
+}
+
+// 状态变化计数
+//
+//	只区分 running、pending 与 dropped，新注册的 service 视为从 dropped 变化，状态未变化时不计数
+func observeTransition(from, to HeartBeatType, reason TransitionReason) {
+	f, t := stateLabel(from), stateLabel(to)
+	if f == t {
+		return
+	}
+	metricTransitions.WithLabelValues(f, t, string(reason)).Inc()
+}
+
+// 记录服务发现的结果
+func observeDiscover(topicName string, status HeartBeatType) {
+	metricDiscover.WithLabelValues(topicName, stateLabel(status)).Inc()
+}
+
+// 各主题、各状态的 service 数
+//
+//	状态名见 stateLabel，采集时统计，data 关闭时注销
+type instanceCollector struct {
+	data *Data
+}
+
+func (c *instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metricInstances
+}
+
+func (c *instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.data.Topics() {
+		// 与状态变化的指标一致，changed 计入 running，各状态之和为主题中的 service 总数
+		for status, n := range map[string]int{"running": t.Running + t.Changed, "pending": t.Pending} {
+			ch <- prometheus.MustNewConstMetric(metricInstances, prometheus.GaugeValue, float64(n), t.Name, status)
+		}
+	}
+}
+
+// 记录等待时间的 data 锁
+type dataLock struct {
+	sync.RWMutex
+}
+
+func (l *dataLock) Lock()  { waitLock(dataWriteWait, l.RWMutex.Lock) }
+func (l *dataLock) RLock() { waitLock(dataReadWait, l.RWMutex.RLock) }
+
+// 记录等待时间的 topic 锁
+type topicLock struct {
+	sync.RWMutex
+}
+
+func (l *topicLock) Lock()  { waitLock(topicWriteWait, l.RWMutex.Lock) }
+func (l *topicLock) RLock() { waitLock(topicReadWait, l.RWMutex.RLock) }
+
+func waitLock(o prometheus.Observer, lock func()) {
+	start := time.Now()
+	lock()
+	o.Observe(time.Since(start).Seconds())
+}
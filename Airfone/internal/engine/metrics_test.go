@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// 状态变化计数的当前值，计数器为全局的，测试中比较前后的差值
+func transitions(from, to string, reason TransitionReason) float64 {
+	return testutil.ToFloat64(metricTransitions.WithLabelValues(from, to, string(reason)))
+}
+
+// 注册、超时与删除之后的各项指标
+func TestMetrics(t *testing.T) {
+	var (
+		data       = newTestData(t, nil)
+		now        = time.Now().UnixNano()
+		registered = transitions("dropped", "running", REASON_REGISTER)
+		waiting    = transitions("dropped", "pending", REASON_REGISTER)
+		expired    = transitions("running", "pending", REASON_TIMEOUT)
+		dropped    = transitions("pending", "dropped", REASON_TIMEOUT)
+		cascaded   = transitions("running", "pending", REASON_DEPENDENCY)
+		unresolved = testutil.ToFloat64(metricDiscover.WithLabelValues("audit", "pending"))
+		instances  = &instanceCollector{data: data}
+	)
+	provider := register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	other := register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80})
+	register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80}, "log")
+	// 依赖的主题没有提供者，发现结果为 pending
+	register(t, data, "audit", now, &Service{IP: "10.0.2.1", Port: 80}, "nope")
+
+	if got := transitions("dropped", "running", REASON_REGISTER) - registered; got != 3 {
+		t.Errorf("register transitions to running = %v, want 3", got)
+	}
+	if got := transitions("dropped", "pending", REASON_REGISTER) - waiting; got != 1 {
+		t.Errorf("register transitions to pending = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metricDiscover.WithLabelValues("audit", "pending")) - unresolved; got != 1 {
+		t.Errorf("pending discover outcomes = %v, want 1", got)
+	}
+	want := `
+# HELP airfone_instances Services per topic and state.
+# TYPE airfone_instances gauge
+airfone_instances{status="pending",topic="audit"} 1
+airfone_instances{status="pending",topic="common"} 0
+airfone_instances{status="pending",topic="log"} 0
+airfone_instances{status="running",topic="audit"} 0
+airfone_instances{status="running",topic="common"} 1
+airfone_instances{status="running",topic="log"} 2
+`
+	if err := testutil.CollectAndCompare(instances, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// 心跳超时移入 pending，另一个提供者仍可用，消费者不受影响
+	expire := now + int64(provider.Lease.Pending) + 1
+	if _, err := data.Check(expire, &HeartBeat{Topic: "log", ID: other.ID}); err != nil {
+		t.Fatal(err)
+	}
+	data.timeout(expire, &Task{Topic: "log", ID: provider.ID, Action: TURN_TO_PENDING})
+	if got := transitions("running", "pending", REASON_TIMEOUT) - expired; got != 1 {
+		t.Errorf("timeout transitions = %v, want 1", got)
+	}
+	if got := transitions("running", "pending", REASON_DEPENDENCY) - cascaded; got != 0 {
+		t.Errorf("dependency transitions = %v, want 0", got)
+	}
+	want = `
+# HELP airfone_instances Services per topic and state.
+# TYPE airfone_instances gauge
+airfone_instances{status="pending",topic="audit"} 1
+airfone_instances{status="pending",topic="common"} 0
+airfone_instances{status="pending",topic="log"} 1
+airfone_instances{status="running",topic="audit"} 0
+airfone_instances{status="running",topic="common"} 1
+airfone_instances{status="running",topic="log"} 1
+`
+	if err := testutil.CollectAndCompare(instances, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// pending 超时后删除
+	data.timeout(now+int64(provider.Lease.Dropped)+1, &Task{Topic: "log", ID: provider.ID, Action: DROP_AFTER_PENDING})
+	if got := transitions("pending", "dropped", REASON_TIMEOUT) - dropped; got != 1 {
+		t.Errorf("drop transitions = %v, want 1", got)
+	}
+	want = `
+# HELP airfone_instances Services per topic and state.
+# TYPE airfone_instances gauge
+airfone_instances{status="pending",topic="audit"} 1
+airfone_instances{status="pending",topic="common"} 0
+airfone_instances{status="pending",topic="log"} 0
+airfone_instances{status="running",topic="audit"} 0
+airfone_instances{status="running",topic="common"} 1
+airfone_instances{status="running",topic="log"} 1
+`
+	if err := testutil.CollectAndCompare(instances, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"strings"
+
+	"Airfone/api/errorpb"
+)
+
+// 命名空间
+//
+//	开发、测试、生产环境的 service 注册到同一个注册中心时，同名的 topic 会互相依赖，
+//	命名空间将它们隔离开: 每个 topic 属于一个命名空间，依赖默认只在自己的命名空间中查找
+//	思路: data 中的主题以限定名为 key，形如 命名空间/topic，默认命名空间的限定名就是 topic 本身，
+//	已有的数据、事件与持久化记录不受影响；索引、持久化、集群复制都以限定名为单位，不需要感知命名空间
+//	1. 请求中的命名空间与 topic 在进入 data 之前转换为限定名(Qualify)，topic 中不能包含 /
+//	2. 声明的依赖不带命名空间时属于消费者自己的命名空间；显式地写成 命名空间/topic 时可以跨命名空间依赖，
+//	   如 infra/log，默认命名空间写作 default/log
+//	3. 返回给客户端时，依赖的 topic 转换为相对于消费者命名空间的名称(Relative)，与声明时一致
+//	管理接口、事件与监控指标中的主题都是限定名
+
+const (
+	NAMESPACE_DEFAULT   = "default" // 默认命名空间，请求中不填时使用
+	NAMESPACE_SEPARATOR = "/"       // 限定名中命名空间与 topic 的分隔符
+)
+
+// 命名空间与 topic 转换为限定名
+//
+//	命名空间为空时使用默认命名空间，命名空间不合法或 topic 中包含 / 时返回 NAMESPACE_INVALID
+func Qualify(namespace, topic string) (string, error) {
+	namespace, err := CheckNamespace(namespace)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(topic, NAMESPACE_SEPARATOR) {
+		return "", errorpb.ErrorNamespaceInvalid("topic %q must not contain %q", topic, NAMESPACE_SEPARATOR)
+	}
+	if namespace == NAMESPACE_DEFAULT {
+		return topic, nil
+	}
+	return namespace + NAMESPACE_SEPARATOR + topic, nil
+}
+
+// 拆分限定名，返回命名空间与 topic
+func SplitTopic(name string) (string, string) {
+	if i := strings.Index(name, NAMESPACE_SEPARATOR); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return NAMESPACE_DEFAULT, name
+}
+
+// 限定名相对于命名空间的名称，同一命名空间中为 topic，否则为限定名
+func Relative(namespace, name string) string {
+	if namespace == "" {
+		namespace = NAMESPACE_DEFAULT
+	}
+	ns, topic := SplitTopic(name)
+	if ns == namespace {
+		return topic
+	}
+	return ns + NAMESPACE_SEPARATOR + topic
+}
+
+// 相对于命名空间的名称转换为限定名，与 Relative 相反
+//
+//	名称不带命名空间时属于 namespace，如依赖的 topic、监听与查询的主题
+func QualifyRelative(namespace, name string) (string, error) {
+	if i := strings.Index(name, NAMESPACE_SEPARATOR); i == 0 {
+		return "", errorpb.ErrorNamespaceInvalid("invalid rely: %q", name)
+	} else if i > 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+	return Qualify(namespace, name)
+}
+
+// 校验命名空间，为空时返回默认命名空间
+//
+//	命名空间不能包含分隔符、依赖语法中的符号与空白
+func CheckNamespace(namespace string) (string, error) {
+	if namespace == "" {
+		return NAMESPACE_DEFAULT, nil
+	}
+	if !validLabel(namespace) || strings.ContainsAny(namespace, NAMESPACE_SEPARATOR+"@") {
+		return "", errorpb.ErrorNamespaceInvalid("invalid namespace: %q", namespace)
+	}
+	return namespace, nil
+}
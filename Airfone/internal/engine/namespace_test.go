@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+)
+
+func TestQualify(t *testing.T) {
+	tests := []struct {
+		namespace string
+		topic     string
+		want      string // 为空表示不合法
+	}{
+		{"", "log", "log"},
+		{"default", "log", "log"},
+		{"staging", "log", "staging/log"},
+		{"staging", "a/log", ""},
+		{"sta ging", "log", ""},
+		{"a/b", "log", ""},
+		{"a@b", "log", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+" "+tt.topic, func(t *testing.T) {
+			got, err := Qualify(tt.namespace, tt.topic)
+			if tt.want == "" {
+				if !errorpb.IsNamespaceInvalid(err) {
+					t.Fatalf("Qualify = %q, %v, want NAMESPACE_INVALID", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("Qualify = %q, %v, want %q", got, err, tt.want)
+			}
+			// 限定名拆分后得到原来的命名空间与 topic
+			ns, topic := SplitTopic(got)
+			if want, _ := CheckNamespace(tt.namespace); ns != want || topic != tt.topic {
+				t.Errorf("SplitTopic(%q) = %q, %q", got, ns, topic)
+			}
+		})
+	}
+}
+
+// 依赖的名称相对于消费者的命名空间，Relative 与 QualifyRelative 互逆
+func TestRelative(t *testing.T) {
+	tests := []struct {
+		namespace string
+		name      string // 相对名称
+		qualified string // 限定名
+		relative  string // 转换回的相对名称
+	}{
+		{"", "log", "log", "log"},
+		{"default", "log", "log", "log"},
+		{"staging", "log", "staging/log", "log"},
+		{"staging", "infra/log", "infra/log", "infra/log"},
+		{"staging", "default/log", "log", "default/log"},
+		{"default", "default/log", "log", "log"},
+		{"", "staging/log", "staging/log", "staging/log"},
+		{"staging", "staging/log", "staging/log", "log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace+" "+tt.name, func(t *testing.T) {
+			got, err := QualifyRelative(tt.namespace, tt.name)
+			if err != nil || got != tt.qualified {
+				t.Fatalf("QualifyRelative = %q, %v, want %q", got, err, tt.qualified)
+			}
+			if rel := Relative(tt.namespace, got); rel != tt.relative {
+				t.Errorf("Relative(%q) = %q, want %q", got, rel, tt.relative)
+			}
+			if back, _ := QualifyRelative(tt.namespace, Relative(tt.namespace, got)); back != got {
+				t.Errorf("round trip of %q = %q", got, back)
+			}
+		})
+	}
+	for _, name := range []string{"/log", "a b/log", "infra/a/log"} {
+		if _, err := QualifyRelative("staging", name); !errorpb.IsNamespaceInvalid(err) {
+			t.Errorf("QualifyRelative(%q) error = %v, want NAMESPACE_INVALID", name, err)
+		}
+	}
+}
+
+// 依赖默认只在消费者自己的命名空间中查找，显式写出命名空间时跨命名空间依赖
+func TestNamespaceIsolation(t *testing.T) {
+	var (
+		data    = newTestData(t, nil)
+		now     = time.Now().UnixNano()
+		prod    = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+		staging = register(t, data, "staging/log", now, &Service{IP: "10.0.0.2", Port: 80})
+	)
+	tests := []struct {
+		name  string
+		topic string
+		rely  string
+		want  int64
+	}{
+		{"same namespace", "staging/common", "log", staging.ID},
+		{"default namespace", "staging/common", "default/log", prod.ID},
+		{"from default", "common", "log", prod.ID},
+		{"into another namespace", "common", "staging/log", staging.ID},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := register(t, data, tt.topic, now, &Service{IP: "10.0.1.1", Port: uint16(80 + i)}, tt.rely)
+			if len(s.Rely) != 1 || s.Rely[0].ID != tt.want {
+				t.Errorf("rely = %+v, want provider %d", s.Rely, tt.want)
+			}
+		})
+	}
+	s := register(t, data, "dev/common", now, &Service{IP: "10.0.1.2", Port: 80}, "log")
+	if s.Status != HeartBeat_PENDING || s.Depends[0] != "dev/log" {
+		t.Errorf("consumer in an empty namespace = %v %v, want pending on dev/log", s.Status, s.Depends)
+	}
+}
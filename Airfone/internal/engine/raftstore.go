@@ -0,0 +1,341 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// raft 日志与任期、投票信息的持久化
+//
+//	根据配置文件开启集群时使用，保存在 data.cluster.dir 中，节点重启后不会丢失任期与投票，也不会重新初始化集群
+//	1. raft.log: 只追加的日志文件，格式与 wal 相同，每行为 "crc32 json"(见 store.go)，
+//	   每条记录为写入一批日志，或删除一段日志(快照后压缩，或 follower 截断冲突的日志)
+//	   先写文件并落盘，再修改内存；删除的日志过多时重写整个文件
+//	2. raft.stable: 任期与投票信息，每次修改都先写临时文件再重命名
+//	日志同时保存在内存中，启动时重放 raft.log，遇到校验失败的行(写入一半时宕机)即截断
+
+const (
+	CLUSTER_RAFT_LOG    = "raft.log"    // raft 日志文件名
+	CLUSTER_RAFT_STABLE = "raft.stable" // 任期与投票信息文件名
+)
+
+// raft 日志文件中的记录
+type raftLogRecord struct {
+	Logs []*raft.Log `json:"logs,omitempty"` // 写入的日志
+	Min  uint64      `json:"min,omitempty"`  // 删除的日志范围 [min, max]
+	Max  uint64      `json:"max,omitempty"`
+}
+
+// 任期与投票信息
+type raftStable struct {
+	KV   map[string][]byte `json:"kv"`
+	Uint map[string]uint64 `json:"uint"`
+}
+
+func (st raftStable) clone() raftStable {
+	c := raftStable{KV: make(map[string][]byte, len(st.KV)+1), Uint: make(map[string]uint64, len(st.Uint)+1)}
+	for k, v := range st.KV {
+		c.KV[k] = v
+	}
+	for k, v := range st.Uint {
+		c.Uint[k] = v
+	}
+	return c
+}
+
+// 实现 raft.LogStore 与 raft.StableStore
+type raftStore struct {
+	sync.RWMutex
+	dir     string
+	file    *os.File             // raft.log
+	logs    map[uint64]*raft.Log // map[index]日志
+	first   uint64               // 第一条日志，没有日志时为 0
+	last    uint64               // 最后一条日志，没有日志时为 0
+	deleted int                  // 上次重写文件后删除的日志数
+	stable  raftStable
+}
+
+// 打开存储目录，重放日志并读取任期与投票信息
+func openRaftStore(dir string) (*raftStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &raftStore{
+		dir:    dir,
+		logs:   make(map[uint64]*raft.Log),
+		stable: raftStable{KV: make(map[string][]byte), Uint: make(map[string]uint64)},
+	}
+	b, err := os.ReadFile(filepath.Join(dir, CLUSTER_RAFT_STABLE))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(b, &s.stable); err != nil {
+			return nil, fmt.Errorf("broken raft stable store: %w", err)
+		}
+	}
+	if s.file, err = os.OpenFile(filepath.Join(dir, CLUSTER_RAFT_LOG), os.O_CREATE|os.O_RDWR, 0o644); err != nil {
+		return nil, err
+	}
+	if err = s.load(); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// 重放日志文件，截断写了一半的记录
+func (s *raftStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	var (
+		offset  int64
+		scanner = bufio.NewScanner(s.file)
+	)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		// 缺少换行符的最后一行同样是写了一半的记录
+		next := offset + int64(len(scanner.Bytes())) + 1
+		if next > info.Size() {
+			break
+		}
+		body, ok := unframe(scanner.Text())
+		if !ok {
+			break
+		}
+		var rec raftLogRecord
+		if err = json.Unmarshal(body, &rec); err != nil {
+			break
+		}
+		s.apply(&rec)
+		offset = next
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if err = s.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err = s.file.Seek(offset, 0)
+	return err
+}
+
+// 将一条记录应用到内存中
+func (s *raftStore) apply(rec *raftLogRecord) {
+	for _, l := range rec.Logs {
+		s.logs[l.Index] = l
+		if s.first == 0 || l.Index < s.first {
+			s.first = l.Index
+		}
+		if l.Index > s.last {
+			s.last = l.Index
+		}
+	}
+	if rec.Max == 0 {
+		return
+	}
+	for i := rec.Min; i <= rec.Max; i++ {
+		if _, ok := s.logs[i]; ok {
+			delete(s.logs, i)
+			s.deleted++
+		}
+	}
+	switch {
+	case len(s.logs) == 0:
+		s.first, s.last = 0, 0
+	case rec.Min <= s.first:
+		s.first = rec.Max + 1
+	case rec.Max >= s.last:
+		s.last = rec.Min - 1
+	}
+}
+
+// 写入一条记录并落盘
+func (s *raftStore) write(rec *raftLogRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(frame(b)); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// 重写日志文件，只保留现存的日志
+//
+//	先写临时文件再重命名，保证任何时刻磁盘上都有一份完整的日志
+func (s *raftStore) rewrite() error {
+	var (
+		name = filepath.Join(s.dir, CLUSTER_RAFT_LOG)
+		tmp  = name + ".tmp"
+		rec  = &raftLogRecord{Logs: make([]*raft.Log, 0, len(s.logs))}
+	)
+	for i := s.first; i <= s.last && s.first != 0; i++ {
+		if l, ok := s.logs[i]; ok {
+			rec.Logs = append(rec.Logs, l)
+		}
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(frame(b)); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file.Close()
+	s.file = f
+	s.deleted = 0
+	return nil
+}
+
+func (s *raftStore) FirstIndex() (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.first, nil
+}
+
+func (s *raftStore) LastIndex() (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.last, nil
+}
+
+func (s *raftStore) GetLog(index uint64, log *raft.Log) error {
+	s.RLock()
+	defer s.RUnlock()
+	l, ok := s.logs[index]
+	if !ok {
+		return raft.ErrLogNotFound
+	}
+	*log = *l
+	return nil
+}
+
+func (s *raftStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *raftStore) StoreLogs(logs []*raft.Log) error {
+	s.Lock()
+	defer s.Unlock()
+	rec := &raftLogRecord{Logs: make([]*raft.Log, 0, len(logs))}
+	for _, l := range logs {
+		copied := *l
+		rec.Logs = append(rec.Logs, &copied)
+	}
+	if err := s.write(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+	return nil
+}
+
+// 删除一段日志
+//
+//	快照之后 raft 删除旧的日志，删除的日志多于现存的日志时重写文件
+func (s *raftStore) DeleteRange(min, max uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	rec := &raftLogRecord{Min: min, Max: max}
+	if err := s.write(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+	if s.deleted > len(s.logs) {
+		return s.rewrite()
+	}
+	return nil
+}
+
+func (s *raftStore) Set(key []byte, val []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	stable := s.stable.clone()
+	stable.KV[string(key)] = val
+	return s.saveStable(stable)
+}
+
+// 与 raft.InmemStore 一致，不存在时返回 "not found"
+func (s *raftStore) Get(key []byte) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	val, ok := s.stable.KV[string(key)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return val, nil
+}
+
+func (s *raftStore) SetUint64(key []byte, val uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	stable := s.stable.clone()
+	stable.Uint[string(key)] = val
+	return s.saveStable(stable)
+}
+
+func (s *raftStore) GetUint64(key []byte) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.stable.Uint[string(key)], nil
+}
+
+// 写入任期与投票信息，成功后替换内存中的
+//
+//	先写临时文件再重命名
+func (s *raftStore) saveStable(stable raftStable) error {
+	b, err := json.Marshal(&stable)
+	if err != nil {
+		return err
+	}
+	var (
+		name = filepath.Join(s.dir, CLUSTER_RAFT_STABLE)
+		tmp  = name + ".tmp"
+	)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return err
+	}
+	s.stable = stable
+	return nil
+}
+
+func (s *raftStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestRaftStore(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		logs = func(from, to uint64) []*raft.Log {
+			var list []*raft.Log
+			for i := from; i <= to; i++ {
+				list = append(list, &raft.Log{Index: i, Term: 1, Data: []byte{byte(i)}})
+			}
+			return list
+		}
+	)
+	s, err := openRaftStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.StoreLogs(logs(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetUint64([]byte("CurrentTerm"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Set([]byte("LastVoteCand"), []byte("node1")); err != nil {
+		t.Fatal(err)
+	}
+	// 快照后压缩，以及 follower 截断冲突的日志
+	if err = s.DeleteRange(1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DeleteRange(9, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.StoreLog(&raft.Log{Index: 9, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// 模拟写了一半时宕机
+	f, err := os.OpenFile(filepath.Join(dir, CLUSTER_RAFT_LOG), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`0000abcd {"logs":[{"Index":10`)
+	f.Close()
+
+	for round := 0; round < 2; round++ {
+		if s, err = openRaftStore(dir); err != nil {
+			t.Fatal(err)
+		}
+		first, _ := s.FirstIndex()
+		last, _ := s.LastIndex()
+		if first != 4 || last != 9 {
+			t.Fatalf("round %d: index [%d, %d], want [4, 9]", round, first, last)
+		}
+		var l raft.Log
+		if err = s.GetLog(9, &l); err != nil || l.Term != 2 {
+			t.Fatalf("round %d: log 9 = %+v %v, want term 2", round, l, err)
+		}
+		if err = s.GetLog(3, &l); err != raft.ErrLogNotFound {
+			t.Fatalf("round %d: log 3: %v, want not found", round, err)
+		}
+		if term, _ := s.GetUint64([]byte("CurrentTerm")); term != 3 {
+			t.Fatalf("round %d: term %d, want 3", round, term)
+		}
+		if v, err := s.Get([]byte("LastVoteCand")); err != nil || string(v) != "node1" {
+			t.Fatalf("round %d: vote %q %v", round, v, err)
+		}
+		if _, err = s.Get([]byte("missing")); err == nil || err.Error() != "not found" {
+			t.Fatalf("round %d: missing key: %v", round, err)
+		}
+		// 截断之后可以继续写入
+		if err = s.StoreLog(&raft.Log{Index: 10, Term: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.DeleteRange(10, 10); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	// 删除的日志多于现存的日志时重写文件
+	if s, err = openRaftStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DeleteRange(4, 8); err != nil {
+		t.Fatal(err)
+	}
+	if s.deleted != 0 {
+		t.Fatalf("log file not rewritten, %d deleted", s.deleted)
+	}
+	if err = s.StoreLog(&raft.Log{Index: 10, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if s, err = openRaftStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if first, _ := s.FirstIndex(); first != 9 {
+		t.Fatalf("first index %d after rewrite, want 9", first)
+	}
+	if last, _ := s.LastIndex(); last != 10 {
+		t.Fatalf("last index %d after rewrite, want 10", last)
+	}
+}
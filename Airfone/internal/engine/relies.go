@@ -0,0 +1,205 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"Airfone/api/errorpb"
+)
+
+// 依赖的条件
+//
+//	消费者声明的依赖形如 topic@版本约束{标签选择器}，两部分都可以省略，如 log、log@^2.1、log{env=prod}、log@~2.1{env=prod}
+//	版本约束见 version.go，标签选择器见 labels.go
+//	思路: 声明依赖时解析，Depends 中只保留 topic 名，条件按 topic 记录在 Requires 中，
+//	等待索引、反向依赖索引等仍然以 topic 为单位
+//	1. 服务发现(discover)时先按条件过滤 running 列表，再就近筛选与负载均衡，
+//	   故障与恢复的传播都经过 discover，同样只会选择满足条件的提供者
+//	2. 提供者的标签或版本被修改后，依赖它的消费者在下次心跳时发现不再满足，与依赖故障一样重新选择
+//	3. 没有满足条件的提供者时，消费者 pending，原因记录在等待索引中，随注册与心跳的结果返回给客户端
+//	一个 topic 只能声明一次依赖，同一 topic 带有不同的版本约束时返回 VERSION_INVALID，带有不同的标签选择器时返回 LABEL_INVALID
+//	topic 可以带有命名空间，如 infra/log@^2，不带时属于消费者的命名空间，见 namespace.go
+
+// 依赖的条件，全部满足才会被选择
+type RelyRequirement struct {
+	Labels  LabelSelector      `json:"labels,omitempty"`  // 标签选择器
+	Version *VersionConstraint `json:"version,omitempty"` // 版本约束
+}
+
+// 提供者是否满足条件，条件为空时总是满足
+func (r *RelyRequirement) Matches(labels map[string]string, version string) bool {
+	if r == nil {
+		return true
+	}
+	return r.Labels.Matches(labels) && (r.Version == nil || r.Version.Matches(version))
+}
+
+// 文本形式，相同的条件得到相同的结果
+func (r *RelyRequirement) String() string {
+	var s string
+	if r == nil {
+		return s
+	}
+	if r.Version != nil {
+		s = "@" + r.Version.String()
+	}
+	if len(r.Labels) > 0 {
+		s += r.Labels.String()
+	}
+	return s
+}
+
+// 版本约束的文本形式，没有约束时为空
+func (r *RelyRequirement) version() string {
+	if r == nil || r.Version == nil {
+		return ""
+	}
+	return r.Version.String()
+}
+
+// 按条件筛选提供者
+//
+//	没有满足条件的提供者时返回原因，先按标签、再按版本筛选，原因为第一个筛空列表的条件
+func filterByRequirement(r *RelyRequirement, list []*Service) ([]*Service, string) {
+	if len(list) == 0 {
+		return list, "no running provider"
+	}
+	if r == nil {
+		return list, ""
+	}
+	if len(r.Labels) > 0 {
+		matched := make([]*Service, 0, len(list))
+		for _, s := range list {
+			if r.Labels.Matches(s.Labels) {
+				matched = append(matched, s)
+			}
+		}
+		if len(matched) == 0 {
+			return matched, "no running provider matches " + r.Labels.String()
+		}
+		list = matched
+	}
+	if r.Version != nil {
+		var (
+			matched  = make([]*Service, 0, len(list))
+			versions = make(map[string]struct{})
+		)
+		for _, s := range list {
+			if r.Version.Matches(s.Version) {
+				matched = append(matched, s)
+			} else if s.Version != "" {
+				versions[s.Version] = struct{}{}
+			}
+		}
+		if len(matched) == 0 {
+			return matched, fmt.Sprintf("no running provider satisfies %s (running: %s)", r.Version, joinVersions(versions))
+		}
+		list = matched
+	}
+	return list, ""
+}
+
+// 列出正在运行的版本，最多列出 5 个
+func joinVersions(versions map[string]struct{}) string {
+	if len(versions) == 0 {
+		return "no version"
+	}
+	list := make([]string, 0, len(versions))
+	for v := range versions {
+		list = append(list, v)
+	}
+	sort.Strings(list)
+	if len(list) > 5 {
+		list = append(list[:5], "...")
+	}
+	return strings.Join(list, ", ")
+}
+
+// 解析声明的依赖
+//
+//	返回依赖的 topic 限定名，以及带有条件的依赖 map[限定名]条件
+//	同一 topic 重复声明且条件相同时只保留一个，namespace 为消费者的命名空间
+func parseRelies(namespace string, relies []string) ([]string, map[string]*RelyRequirement, error) {
+	var (
+		depends  = make([]string, 0, len(relies))
+		requires map[string]*RelyRequirement
+		declared = make(map[string]*RelyRequirement, len(relies)) // map[topic]条件
+	)
+	for _, expr := range relies {
+		name, req, err := parseRely(expr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name, err = QualifyRelative(namespace, name); err != nil {
+			return nil, nil, err
+		}
+		if prev, ok := declared[name]; ok {
+			if prev.version() != req.version() {
+				return nil, nil, errorpb.ErrorVersionInvalid("topic %s is declared with different version constraints", name)
+			}
+			if prev.String() != req.String() {
+				return nil, nil, errorpb.ErrorLabelInvalid("topic %s is declared with different requirements", name)
+			}
+			continue
+		}
+		declared[name] = req
+		depends = append(depends, name)
+		if req != nil {
+			if requires == nil {
+				requires = make(map[string]*RelyRequirement)
+			}
+			requires[name] = req
+		}
+	}
+	return depends, requires, nil
+}
+
+// 声明的依赖中的 topic 限定名，供授权检查使用
+func RelyTopics(namespace string, relies []string) ([]string, error) {
+	depends, _, err := parseRelies(namespace, relies)
+	return depends, err
+}
+
+// 解析一个依赖，如 log@^2.1{env=prod,tier!=canary}，没有条件时返回空
+func parseRely(expr string) (string, *RelyRequirement, error) {
+	var (
+		req  = &RelyRequirement{}
+		head = strings.TrimSpace(expr)
+	)
+	if i := strings.IndexByte(head, '{'); i >= 0 {
+		if !strings.HasSuffix(head, "}") {
+			return "", nil, errorpb.ErrorLabelInvalid("invalid rely: %q", expr)
+		}
+		for _, term := range strings.Split(head[i+1:len(head)-1], ",") {
+			if term = strings.TrimSpace(term); term == "" {
+				continue
+			}
+			r, ok := parseRequirement(term)
+			if !ok {
+				return "", nil, errorpb.ErrorLabelInvalid("invalid label requirement %q in rely %q", term, expr)
+			}
+			req.Labels = append(req.Labels, r)
+		}
+		head = head[:i]
+	}
+	if i := strings.IndexByte(head, '@'); i >= 0 {
+		if strings.TrimSpace(head[i+1:]) == "" {
+			return "", nil, errorpb.ErrorVersionInvalid("empty version constraint in rely %q", expr)
+		}
+		c, err := parseConstraint(head[i+1:])
+		if err != nil {
+			return "", nil, err
+		}
+		req.Version = c
+		head = head[:i]
+	}
+	name := strings.TrimSpace(head)
+	if name == "" || strings.ContainsAny(name, "{}=!,@") {
+		return "", nil, errorpb.ErrorLabelInvalid("invalid rely: %q", expr)
+	}
+	if len(req.Labels) == 0 && req.Version == nil {
+		return name, nil, nil
+	}
+	return name, req, nil
+}
@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// 这个文件中存放的是延时任务的调度器
+//
+//	整个 data 只有一个调度器协程，所有 service 的过期时间都放在一个最小堆中，
+//	每个 service 至多只有一个任务，心跳时重置任务的到期时间，
+//	主题自身的任务(空闲回收)使用 id 0 作为标识，
+//	协程只在最早的任务到期时醒来，不再需要每个 topic 一个协程定期扫描全部 service
+
+// 延时任务类型
+type TaskAction int8
+
+const (
+	TURN_TO_PENDING    TaskAction = iota // 心跳超时，将 service 从 running 移动到 pending
+	DROP_AFTER_PENDING                   // pending 超时，将 service 删除
+	REMOVE_IDLE_TOPIC                    // 隐式创建的主题空闲超时，将主题删除
+	FORGET_INSTANCE                      // 超时被删除的 service 保留的实例索引到期，将索引删除
+	HEALTH_CHECK                         // 主动健康检查，只在 prober 中使用，见 health.go
+)
+
+// 任务的唯一标识
+type taskKey struct {
+	topic string
+	id    int64
+}
+
+// 延时任务
+type Task struct {
+	Topic    string     // service 所在主题
+	ID       int64      // service id，主题自身的任务为 0
+	Deadline int64      // 到期时间(纳秒)
+	Action   TaskAction // 到期后的行为
+	index    int        // 在堆中的下标
+}
+
+// 任务堆，按到期时间排序
+type taskHeap []*Task
+
+func (h taskHeap) Len() int           { return len(h) }
+func (h taskHeap) Less(i, j int) bool { return h[i].Deadline < h[j].Deadline }
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *taskHeap) Push(x any) {
+	t := x.(*Task)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *taskHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
+
+// 调度器
+type Scheduler struct {
+	sync.Mutex
+	tasks  taskHeap                    // 任务堆
+	index  map[taskKey]*Task           // map[topic+id]task
+	wake   chan struct{}               // 插入了更早的任务时唤醒协程
+	handle func(now int64, task *Task) // 任务到期后的处理函数，调用时不持有调度器的锁
+}
+
+func NewScheduler(handle func(now int64, task *Task)) *Scheduler {
+	return &Scheduler{
+		index:  make(map[taskKey]*Task),
+		wake:   make(chan struct{}, 1),
+		handle: handle,
+	}
+}
+
+// 设置 service 的任务
+//
+//	若 service 已有任务，则修改其到期时间与行为
+func (s *Scheduler) Reset(topicName string, id int64, deadline int64, action TaskAction) {
+	s.Lock()
+	key := taskKey{topic: topicName, id: id}
+	task, ok := s.index[key]
+	if ok {
+		task.Deadline = deadline
+		task.Action = action
+		heap.Fix(&s.tasks, task.index)
+	} else {
+		task = &Task{Topic: topicName, ID: id, Deadline: deadline, Action: action}
+		s.index[key] = task
+		heap.Push(&s.tasks, task)
+	}
+	earliest := task.index == 0
+	s.Unlock()
+	if earliest {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 添加 service 的任务
+//
+//	若 service 已有任务，则不做任何修改
+func (s *Scheduler) Add(topicName string, id int64, deadline int64, action TaskAction) {
+	s.Lock()
+	_, ok := s.index[taskKey{topic: topicName, id: id}]
+	s.Unlock()
+	if !ok {
+		s.Reset(topicName, id, deadline, action)
+	}
+}
+
+// 取消 service 的任务
+func (s *Scheduler) Cancel(topicName string, id int64) {
+	s.Lock()
+	defer s.Unlock()
+	key := taskKey{topic: topicName, id: id}
+	if task, ok := s.index[key]; ok {
+		heap.Remove(&s.tasks, task.index)
+		delete(s.index, key)
+	}
+}
+
+// 取出所有到期的任务，并返回下一个任务的到期时间(没有任务时返回 -1)
+func (s *Scheduler) due(now int64) ([]*Task, int64) {
+	s.Lock()
+	defer s.Unlock()
+	var tasks []*Task
+	for len(s.tasks) > 0 && s.tasks[0].Deadline <= now {
+		task := heap.Pop(&s.tasks).(*Task)
+		delete(s.index, taskKey{topic: task.Topic, id: task.ID})
+		tasks = append(tasks, task)
+	}
+	if len(s.tasks) == 0 {
+		return tasks, -1
+	}
+	return tasks, s.tasks[0].Deadline
+}
+
+// 调度协程
+//
+//	在最早的任务到期时醒来，处理所有到期任务，直到 end 被关闭
+func (s *Scheduler) Run(end <-chan struct{}) {
+	var timer = time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now := time.Now().UnixNano()
+		tasks, next := s.due(now)
+		for _, task := range tasks {
+			s.handle(now, task)
+		}
+		if len(tasks) > 0 {
+			continue
+		}
+
+		wait := time.Hour
+		if next >= 0 {
+			wait = time.Duration(next - now)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-end:
+			return
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 对调度器的一次操作
+type scheduleOp struct {
+	op       string // reset、add、cancel
+	topic    string
+	id       int64
+	deadline int64
+	action   TaskAction
+}
+
+func TestSchedulerDue(t *testing.T) {
+	tests := []struct {
+		name     string
+		ops      []scheduleOp
+		now      int64
+		wantDue  []taskKey
+		wantNext int64
+	}{
+		{
+			name:     "empty",
+			now:      100,
+			wantNext: -1,
+		},
+		{
+			name: "ordered by deadline",
+			ops: []scheduleOp{
+				{op: "reset", topic: "a", id: 1, deadline: 30},
+				{op: "reset", topic: "a", id: 2, deadline: 10},
+				{op: "reset", topic: "b", id: 1, deadline: 20},
+				{op: "reset", topic: "b", id: 2, deadline: 200},
+			},
+			now:      100,
+			wantDue:  []taskKey{{"a", 2}, {"b", 1}, {"a", 1}},
+			wantNext: 200,
+		},
+		{
+			name: "deadline equal to now is due",
+			ops: []scheduleOp{
+				{op: "reset", topic: "a", id: 1, deadline: 100},
+			},
+			now:      100,
+			wantDue:  []taskKey{{"a", 1}},
+			wantNext: -1,
+		},
+		{
+			name: "reset moves the deadline",
+			ops: []scheduleOp{
+				{op: "reset", topic: "a", id: 1, deadline: 10},
+				{op: "reset", topic: "a", id: 2, deadline: 20},
+				{op: "reset", topic: "a", id: 1, deadline: 300},
+			},
+			now:      100,
+			wantDue:  []taskKey{{"a", 2}},
+			wantNext: 300,
+		},
+		{
+			name: "add keeps the existing task",
+			ops: []scheduleOp{
+				{op: "reset", topic: "a", id: 1, deadline: 300},
+				{op: "add", topic: "a", id: 1, deadline: 10},
+				{op: "add", topic: "a", id: 2, deadline: 20},
+			},
+			now:      100,
+			wantDue:  []taskKey{{"a", 2}},
+			wantNext: 300,
+		},
+		{
+			name: "cancel removes the task",
+			ops: []scheduleOp{
+				{op: "reset", topic: "a", id: 1, deadline: 10},
+				{op: "reset", topic: "a", id: 2, deadline: 20},
+				{op: "reset", topic: "a", id: 3, deadline: 400},
+				{op: "cancel", topic: "a", id: 1},
+				{op: "cancel", topic: "a", id: 9},
+			},
+			now:      100,
+			wantDue:  []taskKey{{"a", 2}},
+			wantNext: 400,
+		},
+		{
+			name: "topic task uses id 0",
+			ops: []scheduleOp{
+				{op: "reset", topic: "a", id: 0, deadline: 10, action: REMOVE_IDLE_TOPIC},
+				{op: "reset", topic: "a", id: 1, deadline: 20},
+			},
+			now:      15,
+			wantDue:  []taskKey{{"a", 0}},
+			wantNext: 20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScheduler(nil)
+			for _, op := range tt.ops {
+				switch op.op {
+				case "reset":
+					s.Reset(op.topic, op.id, op.deadline, op.action)
+				case "add":
+					s.Add(op.topic, op.id, op.deadline, op.action)
+				case "cancel":
+					s.Cancel(op.topic, op.id)
+				}
+			}
+			tasks, next := s.due(tt.now)
+			var got []taskKey
+			for _, task := range tasks {
+				got = append(got, taskKey{topic: task.Topic, id: task.ID})
+			}
+			if !reflect.DeepEqual(got, tt.wantDue) {
+				t.Errorf("due = %v, want %v", got, tt.wantDue)
+			}
+			if next != tt.wantNext {
+				t.Errorf("next = %d, want %d", next, tt.wantNext)
+			}
+			// 取出的任务不再留在索引中
+			for _, key := range got {
+				if _, ok := s.index[key]; ok {
+					t.Errorf("task %v still indexed", key)
+				}
+			}
+		})
+	}
+}
+
+// 协程在更早的任务插入时醒来，并按到期顺序处理
+func TestSchedulerRun(t *testing.T) {
+	var (
+		handled = make(chan *Task, 2)
+		end     = make(chan struct{})
+		s       = NewScheduler(func(now int64, task *Task) { handled <- task })
+		start   = time.Now()
+	)
+	defer close(end)
+	s.Reset("a", 1, start.Add(time.Hour).UnixNano(), TURN_TO_PENDING)
+	go s.Run(end)
+	s.Reset("a", 2, start.Add(20*time.Millisecond).UnixNano(), DROP_AFTER_PENDING)
+	select {
+	case task := <-handled:
+		if task.ID != 2 || task.Action != DROP_AFTER_PENDING {
+			t.Fatalf("handled %+v, want task 2", task)
+		}
+		if time.Since(start) < 20*time.Millisecond {
+			t.Fatal("task handled before its deadline")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler did not wake up for the earlier task")
+	}
+	select {
+	case task := <-handled:
+		t.Fatalf("handled %+v before its deadline", task)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// 内置的负载均衡策略
+const (
+	SELECTOR_RANDOM          = "random"          // 随机
+	SELECTOR_ROUND_ROBIN     = "round_robin"     // 轮询
+	SELECTOR_WEIGHTED_RANDOM = "weighted_random" // 加权随机
+	SELECTOR_P2C             = "p2c"             // 两次随机选择，取被依赖数最少的一个
+	SELECTOR_CONSISTENT_HASH = "consistent_hash" // 一致性哈希，以消费者 topic+id 为 key
+)
+
+// 负载均衡选择器
+//
+//	一个 topic 往往有多个提供者，服务发现时由 Selector 决定选择哪一个交给消费者
+//	可以通过 RegisterSelector 注册自定义的选择器
+type Selector interface {
+	Name() string                                      // 选择器名称，即配置中使用的名字
+	Select(info *SelectInfo, list []*Service) *Service // 从 list 中选择一个，list 不为空
+}
+
+// 选择时的上下文信息
+type SelectInfo struct {
+	Topic    string // 被依赖的主题
+	Consumer string // 消费者所在主题
+	ID       int64  // 消费者 id
+}
+
+var (
+	selectorLock sync.RWMutex
+	selectors    = map[string]Selector{}
+)
+
+func init() {
+	RegisterSelector(&randomSelector{})
+	RegisterSelector(&roundRobinSelector{})
+	RegisterSelector(&weightedRandomSelector{})
+	RegisterSelector(&p2cSelector{})
+	RegisterSelector(&consistentHashSelector{})
+}
+
+// 注册一个选择器，同名选择器会被覆盖
+func RegisterSelector(s Selector) {
+	selectorLock.Lock()
+	defer selectorLock.Unlock()
+	selectors[s.Name()] = s
+}
+
+// 按主题保存状态的选择器，主题被删除时清理该主题的状态
+type topicForgetter interface {
+	forgetTopic(topic string)
+}
+
+// 主题被删除时调用，清理各选择器中该主题的状态
+func forgetTopic(topic string) {
+	selectorLock.RLock()
+	defer selectorLock.RUnlock()
+	for _, s := range selectors {
+		if f, ok := s.(topicForgetter); ok {
+			f.forgetTopic(topic)
+		}
+	}
+}
+
+// 通过名称获取选择器
+func GetSelector(name string) (Selector, bool) {
+	selectorLock.RLock()
+	defer selectorLock.RUnlock()
+	s, ok := selectors[name]
+	return s, ok
+}
+
+// 按 id 排序
+//
+//	running 列表来自 map 遍历，顺序是随机的，
+//	轮询等需要稳定顺序的策略在选择前先排序
+func sortByID(list []*Service) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+}
+
+// 获取权重，未设置权重时视为 1
+func weightOf(s *Service) uint32 {
+	if s.Weight == 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+// 随机
+type randomSelector struct{}
+
+func (*randomSelector) Name() string { return SELECTOR_RANDOM }
+
+func (*randomSelector) Select(info *SelectInfo, list []*Service) *Service {
+	return list[rand.Intn(len(list))]
+}
+
+// 轮询
+//
+//	每个 topic 维护一个计数器，主题被删除时随之删除
+type roundRobinSelector struct {
+	counters sync.Map // map[topic_name]*uint32
+}
+
+func (*roundRobinSelector) Name() string { return SELECTOR_ROUND_ROBIN }
+
+func (rr *roundRobinSelector) Select(info *SelectInfo, list []*Service) *Service {
+	v, _ := rr.counters.LoadOrStore(info.Topic, new(uint32))
+	next := atomic.AddUint32(v.(*uint32), 1)
+	sortByID(list)
+	return list[int(next%uint32(len(list)))]
+}
+
+func (rr *roundRobinSelector) forgetTopic(topic string) {
+	rr.counters.Delete(topic)
+}
+
+// 加权随机
+type weightedRandomSelector struct{}
+
+func (*weightedRandomSelector) Name() string { return SELECTOR_WEIGHTED_RANDOM }
+
+func (*weightedRandomSelector) Select(info *SelectInfo, list []*Service) *Service {
+	var total int64
+	for _, s := range list {
+		total += int64(weightOf(s))
+	}
+	n := rand.Int63n(total)
+	for _, s := range list {
+		if n -= int64(weightOf(s)); n < 0 {
+			return s
+		}
+	}
+	return list[len(list)-1]
+}
+
+// P2C (power of two choices)
+//
+//	随机挑选两个，取被依赖数较少的一个，相同时取权重较高的一个
+type p2cSelector struct{}
+
+func (*p2cSelector) Name() string { return SELECTOR_P2C }
+
+func (*p2cSelector) Select(info *SelectInfo, list []*Service) *Service {
+	if len(list) == 1 {
+		return list[0]
+	}
+	var (
+		i = rand.Intn(len(list))
+		j = rand.Intn(len(list) - 1)
+	)
+	if j >= i {
+		j++
+	}
+	a, b := list[i], list[j]
+	la, lb := atomic.LoadInt32(&a.load), atomic.LoadInt32(&b.load)
+	if la < lb || (la == lb && weightOf(a) >= weightOf(b)) {
+		return a
+	}
+	return b
+}
+
+// 一致性哈希
+//
+//	采用最高随机权重(rendezvous)哈希，以消费者 topic+id 为 key，
+//	对每个提供者计算 hash(key, 提供者 id)，取最大的一个，
+//	提供者增减时只有原本落在该提供者上的消费者会被重新分配
+type consistentHashSelector struct{}
+
+func (*consistentHashSelector) Name() string { return SELECTOR_CONSISTENT_HASH }
+
+func (*consistentHashSelector) Select(info *SelectInfo, list []*Service) *Service {
+	var (
+		key  = info.Consumer + "#" + strconv.FormatInt(info.ID, 10) + "/"
+		best *Service
+		max  uint64
+	)
+	for _, s := range list {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(strconv.FormatInt(s.ID, 10)))
+		if score := h.Sum64(); best == nil || score > max {
+			best, max = s, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+)
+
+// 提供者列表，id 从 1 开始
+func providers(n int) []*Service {
+	list := make([]*Service, n)
+	for i := range list {
+		list[i] = &Service{ID: int64(i + 1)}
+	}
+	return list
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	var (
+		s    = &roundRobinSelector{}
+		info = &SelectInfo{Topic: "log"}
+		seen = make(map[int64]int)
+	)
+	for i := 0; i < 9; i++ {
+		// 顺序与 running 列表的遍历顺序无关
+		list := providers(3)
+		list[0], list[2] = list[2], list[0]
+		seen[s.Select(info, list).ID]++
+	}
+	for id := int64(1); id <= 3; id++ {
+		if seen[id] != 3 {
+			t.Errorf("provider %d selected %d times, want 3", id, seen[id])
+		}
+	}
+}
+
+// 主题被删除时删除它的计数器
+func TestRoundRobinForget(t *testing.T) {
+	var (
+		data  = newTestData(t, nil)
+		s, _  = GetSelector(SELECTOR_ROUND_ROBIN)
+		rr    = s.(*roundRobinSelector)
+		topic = "default/round-robin-forget"
+	)
+	if _, err := data.CreateTopic(topic, &TopicAttr{}); err != nil {
+		t.Fatal(err)
+	}
+	rr.Select(&SelectInfo{Topic: topic}, providers(2))
+	if _, ok := rr.counters.Load(topic); !ok {
+		t.Fatal("no counter after select")
+	}
+	if err := data.RemoveTopic(topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rr.counters.Load(topic); ok {
+		t.Error("counter kept after the topic was removed")
+	}
+}
+
+func TestWeightedRandomSelector(t *testing.T) {
+	list := providers(2)
+	list[0].Weight = 0 // 视为 1
+	list[1].Weight = 99
+	var heavy int
+	for i := 0; i < 1000; i++ {
+		if (&weightedRandomSelector{}).Select(&SelectInfo{}, list) == list[1] {
+			heavy++
+		}
+	}
+	if heavy < 900 {
+		t.Errorf("weight 99 selected %d/1000 times", heavy)
+	}
+}
+
+func TestP2CSelector(t *testing.T) {
+	list := providers(2)
+	list[0].load = 5
+	list[1].load = 1
+	for i := 0; i < 20; i++ {
+		if got := (&p2cSelector{}).Select(&SelectInfo{}, list); got != list[1] {
+			t.Fatalf("p2c selected provider %d, want the least loaded", got.ID)
+		}
+	}
+	// 被依赖数相同时取权重较高的一个
+	list[0].load, list[0].Weight = 1, 3
+	if got := (&p2cSelector{}).Select(&SelectInfo{}, list); got != list[0] {
+		t.Errorf("p2c selected provider %d, want the heavier one", got.ID)
+	}
+}
+
+// 提供者减少时，只有原本落在被移除的提供者上的消费者被重新分配
+func TestConsistentHashSelector(t *testing.T) {
+	var (
+		s     = &consistentHashSelector{}
+		list  = providers(5)
+		picks = make(map[int64]int64)
+	)
+	for id := int64(1); id <= 50; id++ {
+		picks[id] = s.Select(&SelectInfo{Topic: "log", Consumer: "common", ID: id}, list).ID
+		if again := s.Select(&SelectInfo{Topic: "log", Consumer: "common", ID: id}, list).ID; again != picks[id] {
+			t.Fatalf("consumer %d moved from %d to %d", id, picks[id], again)
+		}
+	}
+	removed := list[2].ID
+	list = append(list[:2], list[3:]...)
+	for id, before := range picks {
+		after := s.Select(&SelectInfo{Topic: "log", Consumer: "common", ID: id}, list).ID
+		if before != removed && after != before {
+			t.Errorf("consumer %d moved from %d to %d", id, before, after)
+		}
+	}
+}
+
+// 优先级: 消费者指定 > topic 属性 > topic 配置 > 全局默认 > 随机
+func TestGetSelector(t *testing.T) {
+	data := newTestData(t, &conf.Data{Selector: &conf.Data_Selector{
+		Default: SELECTOR_P2C,
+		Topics:  map[string]string{"log": SELECTOR_ROUND_ROBIN, "common": SELECTOR_ROUND_ROBIN, "bad": "nope"},
+	}})
+	if _, err := data.CreateTopic("common", &TopicAttr{Selector: SELECTOR_CONSISTENT_HASH}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefer string
+		topic  string
+		want   string
+	}{
+		{SELECTOR_WEIGHTED_RANDOM, "common", SELECTOR_WEIGHTED_RANDOM},
+		{"", "common", SELECTOR_CONSISTENT_HASH},
+		{"", "log", SELECTOR_ROUND_ROBIN},
+		{"", "other", SELECTOR_P2C},
+		{"", "bad", SELECTOR_P2C},
+	}
+	for _, tt := range tests {
+		if got := data.getSelector(tt.prefer, tt.topic).Name(); got != tt.want {
+			t.Errorf("getSelector(%q, %q) = %s, want %s", tt.prefer, tt.topic, got, tt.want)
+		}
+	}
+	if got := newTestData(t, nil).getSelector("", "log").Name(); got != SELECTOR_RANDOM {
+		t.Errorf("fallback selector = %s, want %s", got, SELECTOR_RANDOM)
+	}
+}
+
+// 服务发现使用主题的策略，未知的策略在注册与创建主题时拒绝
+func TestDiscoverSelector(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+	)
+	if _, err := data.CreateTopic("log", &TopicAttr{Selector: SELECTOR_ROUND_ROBIN}); err != nil {
+		t.Fatal(err)
+	}
+	register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80})
+	a := register(t, data, "common", now, &Service{IP: "10.0.1.1", Port: 80}, "log")
+	b := register(t, data, "common", now, &Service{IP: "10.0.1.2", Port: 80}, "log")
+	if a.Rely[0].ID == b.Rely[0].ID {
+		t.Errorf("round robin assigned provider %d to both consumers", a.Rely[0].ID)
+	}
+
+	if _, err := data.Discover(now, "common", &Service{IP: "10.0.1.3", Port: 80, Selector: "nope"}, []string{"log"}); !errorpb.IsSelectorInvalid(err) {
+		t.Errorf("discover with unknown selector error = %v, want SELECTOR_INVALID", err)
+	}
+	if _, err := data.CreateTopic("other", &TopicAttr{Selector: "nope"}); !errorpb.IsSelectorInvalid(err) {
+		t.Errorf("create topic with unknown selector error = %v, want SELECTOR_INVALID", err)
+	}
+}
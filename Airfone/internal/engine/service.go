@@ -10,29 +10,56 @@ const (
 )
 
 type Service struct {
-	Rely      []*Rely       // 依赖项 map[topic_name]service
-	Schema    []*Schema     // 元数据
-	keepalive int64         // [内部属性]心跳时间(纳秒，time.Now().UnixNano())
-	IP        string        // ip
-	ID        int32         // 唯一标识符
-	Port      uint16        // 端口
-	Status    HeartBeatType // 服务状态, 这个字段通常在 topic 层被操纵，dropping 能够在 service_map 层赋值
+	Rely         []*Rely                     // 依赖项 map[topic_name]service
+	Depends      []string                    // 声明依赖的 topic 名，其中没有可用提供者的不会出现在 Rely 中
+	Schema       []*Schema                   // 元数据
+	Labels       map[string]string           // 标签，消费者可以通过标签选择器筛选提供者，见 labels.go
+	Version      string                      // 语义化版本，消费者可以通过版本约束筛选提供者，见 version.go
+	Requires     map[string]*RelyRequirement // 依赖的条件 map[依赖的topic]条件，没有条件的依赖不在其中，见 relies.go
+	Lease        Lease                       // 租约，注册时确定，为空则在注册时使用主题或服务端的默认值
+	keepalive    int64                       // [内部属性]心跳时间(纳秒，time.Now().UnixNano())
+	Selector     string                      // 作为消费者时指定的负载均衡策略，为空则使用 topic 配置
+	Region       string                      // 地域
+	Zone         string                      // 可用区(机房)
+	Rack         string                      // 机架
+	IP           string                      // ip
+	Instance     string                      // 实例标识，同一实例重复注册时沿用原来的 id，为空则使用 ip:port
+	Token        string                      // 幂等令牌，重试同一次注册时保持不变
+	Owner        string                      // 注册它的身份，开启认证时只允许该身份操作，见 instance.go
+	Health       *HealthCheck                // 主动健康检查，为空则不检查，见 health.go
+	AllInstances bool                        // 全量模式，除了分配的依赖，还返回依赖 topic 中全部可用的提供者，见 endpoints.go
+	ID           int64                       // 唯一标识符
+	load         int32                       // [内部属性]被依赖数，即有多少消费者选择了该服务
+	Weight       uint32                      // 权重，加权随机时使用，0 视为 1
+	Port         uint16                      // 端口
+	Status       HeartBeatType               // 服务状态, 这个字段通常在 topic 层被操纵，dropping 能够在 service_map 层赋值
+	changed      bool                        // [内部属性]依赖已在传播时被服务端替换，下次心跳时需要通知客户端
+	unhealthy    int32                       // [内部属性]健康检查连续失败，恢复之前保持 pending，探测协程原子地读写，1 为不健康
+	failures     int32                       // [内部属性]健康检查连续失败的次数，原子地读写
+	held         bool                        // [内部属性]被管理员置为 pending，管理员移回 running 之前保持 pending，随 service 持久化与复制
+	session      int64                       // [内部属性]当前会话的编号，见 Data.Connect，不持久化
 }
 
 type HeartBeat struct {
-	Rely   []*Rely       // 依赖
-	Topic  string        // 主题
-	ID     int32         // ID
-	Status HeartBeatType // 状态
+	Rely       []*Rely                // 依赖
+	Unresolved map[string]string      // 没有找到提供者的依赖 map[topic]原因
+	Instances  map[string][]*Endpoint // 全量模式下各依赖 topic 中全部可用的提供者 map[topic]提供者
+	Topic      string                 // 主题
+	ID         int64                  // ID
+	Status     HeartBeatType          // 状态
 }
 
 type Rely struct {
-	Keepalive *int64         // 心跳时间，取的是所依赖的服务的心跳地址，可以更简单的判断
-	Status    *HeartBeatType // 服务状态，也是取所依赖服务的状态的地址
-	Topic     string         // 主题
-	IP        string         // ip
-	ID        int32          // 唯一标识符
-	Port      uint16         // 端口
+	Keepalive *int64             // 心跳时间，取的是所依赖的服务的心跳地址，可以更简单的判断
+	Status    *HeartBeatType     // 服务状态，也是取所依赖服务的状态的地址
+	Load      *int32             // 被依赖数，也是取所依赖服务的被依赖数的地址
+	Lease     *Lease             // 租约，取所依赖服务的租约地址，用于判断依赖是否过期
+	Labels    *map[string]string // 标签，取所依赖服务的标签地址，用于判断依赖是否仍然满足条件
+	Version   *string            // 版本，取所依赖服务的版本地址，用于判断依赖是否仍然满足条件
+	Topic     string             // 主题
+	IP        string             // ip
+	ID        int64              // 唯一标识符
+	Port      uint16             // 端口
 }
 
 type Schema struct {
@@ -0,0 +1,698 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 持久化
+//
+//	data 中的全部状态都在内存里，重启后所有客户端都会收到 dropped 并同时重新注册
+//	这里为 data 提供一个嵌入式的持久化层，由两部分组成:
+//	1. wal.log: 只追加的预写日志，每次注册、更新、注销、状态变化都会追加一条记录
+//	2. snapshot.json: 定期生成的快照，生成快照后 wal 被清空
+//	启动时先读取快照，再重放 wal，重建 data，并将所有 service 的租约延长一个宽限期，
+//	客户端可以继续使用原来的 id 发送心跳
+//
+//	wal 的每一行为 "crc32 json"，重放时遇到校验失败的行(写入一半时宕机)即停止
+//
+//	写操作之间互斥(见 hold)，每条记录写入成功后才通知监听者；
+//	写入失败时，按已提交的状态(committed)将记录涉及的 service 或主题回滚，
+//	保证内存中的状态不会领先于 wal
+
+const (
+	STORE_WAL      = "wal.log"       // 预写日志文件名
+	STORE_SNAPSHOT = "snapshot.json" // 快照文件名
+)
+
+// wal 记录类型
+type walOp string
+
+const (
+	WAL_PUT          walOp = "put"          // 注册或更新 service，记录完整的 service
+	WAL_DELETE       walOp = "delete"       // 注销或删除 service
+	WAL_STATUS       walOp = "status"       // service 自身状态变化(running <-> pending)
+	WAL_TOPIC        walOp = "topic"        // 显式创建主题
+	WAL_REMOVE_TOPIC walOp = "remove_topic" // 移除主题
+)
+
+// wal 记录
+type walRecord struct {
+	Op      walOp          `json:"op"`
+	Topic   string         `json:"topic"`
+	ID      int64          `json:"id,omitempty"`
+	Status  HeartBeatType  `json:"status,omitempty"`
+	Held    bool           `json:"held,omitempty"` // 状态变化时 service 是否被管理员置为 pending
+	Service *serviceRecord `json:"service,omitempty"`
+	Attr    *TopicAttr     `json:"attr,omitempty"`
+}
+
+// 持久化的 service
+//
+//	内部属性(心跳时间，被依赖数等)不做持久化，恢复时重新计算
+type serviceRecord struct {
+	Topic        string                      `json:"topic"`
+	ID           int64                       `json:"id"`
+	IP           string                      `json:"ip"`
+	Port         uint16                      `json:"port"`
+	Instance     string                      `json:"instance,omitempty"`
+	Token        string                      `json:"token,omitempty"`
+	Owner        string                      `json:"owner,omitempty"`
+	Schema       []*Schema                   `json:"schema,omitempty"`
+	Labels       map[string]string           `json:"labels,omitempty"`
+	Version      string                      `json:"version,omitempty"`
+	Selector     string                      `json:"selector,omitempty"`
+	Weight       uint32                      `json:"weight,omitempty"`
+	Region       string                      `json:"region,omitempty"`
+	Zone         string                      `json:"zone,omitempty"`
+	Rack         string                      `json:"rack,omitempty"`
+	Lease        Lease                       `json:"lease"`
+	Depends      []string                    `json:"depends,omitempty"`
+	Requires     map[string]*RelyRequirement `json:"requires,omitempty"`
+	Relies       map[string]int64            `json:"relies,omitempty"` // map[依赖的topic]提供者id
+	Health       *HealthCheck                `json:"health,omitempty"`
+	AllInstances bool                        `json:"all_instances,omitempty"`
+	Status       HeartBeatType               `json:"status"`
+	Held         bool                        `json:"held,omitempty"`
+}
+
+// 持久化的主题，只记录显式创建的主题
+type topicRecord struct {
+	Name string     `json:"name"`
+	Attr *TopicAttr `json:"attr,omitempty"`
+}
+
+// 快照
+type snapshot struct {
+	IDMaker  int64            `json:"id_maker"`
+	Topics   []*topicRecord   `json:"topics"`
+	Services []*serviceRecord `json:"services"`
+}
+
+// 由快照与 wal 重建出的状态
+type storeState struct {
+	idMaker  int64
+	topics   map[string]*TopicAttr
+	services map[string]map[int64]*serviceRecord // map[topic]map[id]service
+}
+
+type store struct {
+	// 修改 data 的操作持有读锁，直到对应的 wal 记录写入为止
+	// 生成快照时持有写锁，保证快照与 wal 之间不会丢失或重复记录
+	sync.RWMutex
+
+	fileLock sync.Mutex // 保护 wal 文件的并发写入
+	dir      string     // 存储目录
+	sync     bool       // 每条记录写入后是否立即落盘
+	wal      *os.File   // 预写日志
+}
+
+func newServiceRecord(topicName string, s *Service) *serviceRecord {
+	r := &serviceRecord{
+		Topic:        topicName,
+		ID:           s.ID,
+		IP:           s.IP,
+		Port:         s.Port,
+		Instance:     s.Instance,
+		Token:        s.Token,
+		Owner:        s.Owner,
+		Schema:       s.Schema,
+		Labels:       s.Labels,
+		Version:      s.Version,
+		Selector:     s.Selector,
+		Weight:       s.Weight,
+		Region:       s.Region,
+		Zone:         s.Zone,
+		Rack:         s.Rack,
+		Lease:        s.Lease,
+		Depends:      s.Depends,
+		Requires:     s.Requires,
+		Health:       s.Health,
+		AllInstances: s.AllInstances,
+		Status:       s.Status,
+		Held:         s.held,
+	}
+	if len(s.Rely) > 0 {
+		r.Relies = make(map[string]int64, len(s.Rely))
+		for _, rely := range s.Rely {
+			r.Relies[rely.Topic] = rely.ID
+		}
+	}
+	return r
+}
+
+// 还原为 service，心跳时间由调用方设置
+func (r *serviceRecord) service() *Service {
+	return &Service{
+		Schema:       r.Schema,
+		Labels:       r.Labels,
+		Version:      r.Version,
+		Depends:      r.Depends,
+		Requires:     r.Requires,
+		Lease:        r.Lease,
+		Selector:     r.Selector,
+		Region:       r.Region,
+		Zone:         r.Zone,
+		Rack:         r.Rack,
+		IP:           r.IP,
+		Instance:     r.Instance,
+		Token:        r.Token,
+		Owner:        r.Owner,
+		ID:           r.ID,
+		Weight:       r.Weight,
+		Port:         r.Port,
+		Health:       r.Health,
+		AllInstances: r.AllInstances,
+		Status:       r.Status,
+		held:         r.Held,
+		Rely:         make([]*Rely, 0, len(r.Relies)),
+	}
+}
+
+// 打开存储目录，读取快照并重放 wal
+func openStore(dir string, sync bool) (*store, *storeState, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	s := &store{dir: dir, sync: sync}
+	state, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.wal, err = os.OpenFile(filepath.Join(dir, STORE_WAL), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, nil, err
+	}
+	return s, state, nil
+}
+
+// 读取快照并重放 wal
+func (s *store) load() (*storeState, error) {
+	var snap snapshot
+	b, err := os.ReadFile(filepath.Join(s.dir, STORE_SNAPSHOT))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(b, &snap); err != nil {
+			return nil, fmt.Errorf("broken snapshot: %w", err)
+		}
+	}
+	state := newStoreState(&snap)
+
+	f, err := os.Open(filepath.Join(s.dir, STORE_WAL))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		rec, ok := decodeRecord(scanner.Text())
+		if !ok {
+			// 写入一半时宕机，之后的记录全部作废
+			break
+		}
+		state.apply(rec)
+	}
+	return state, scanner.Err()
+}
+
+func newStoreState(snap *snapshot) *storeState {
+	state := &storeState{
+		idMaker:  snap.IDMaker,
+		topics:   make(map[string]*TopicAttr),
+		services: make(map[string]map[int64]*serviceRecord),
+	}
+	for _, t := range snap.Topics {
+		state.topics[t.Name] = t.Attr
+	}
+	for _, r := range snap.Services {
+		state.put(r)
+	}
+	return state
+}
+
+func (state *storeState) put(r *serviceRecord) {
+	services, ok := state.services[r.Topic]
+	if !ok {
+		services = make(map[int64]*serviceRecord)
+		state.services[r.Topic] = services
+	}
+	services[r.ID] = r
+	if r.ID > state.idMaker {
+		state.idMaker = r.ID
+	}
+}
+
+func (state *storeState) apply(rec *walRecord) {
+	switch rec.Op {
+	case WAL_PUT:
+		if rec.Service != nil {
+			state.put(rec.Service)
+		}
+	case WAL_DELETE:
+		delete(state.services[rec.Topic], rec.ID)
+	case WAL_STATUS:
+		if r, ok := state.services[rec.Topic][rec.ID]; ok {
+			r.Status = rec.Status
+			r.Held = rec.Held
+		}
+	case WAL_TOPIC:
+		state.topics[rec.Topic] = rec.Attr
+	case WAL_REMOVE_TOPIC:
+		delete(state.topics, rec.Topic)
+	}
+}
+
+// 导出为快照
+//
+//	复制每个 service 的记录，之后对状态的修改不会影响快照
+func (state *storeState) snapshot() *snapshot {
+	snap := &snapshot{
+		IDMaker:  state.idMaker,
+		Topics:   make([]*topicRecord, 0, len(state.topics)),
+		Services: make([]*serviceRecord, 0),
+	}
+	for name, attr := range state.topics {
+		snap.Topics = append(snap.Topics, &topicRecord{Name: name, Attr: attr})
+	}
+	for _, services := range state.services {
+		for _, r := range services {
+			copied := *r
+			snap.Services = append(snap.Services, &copied)
+		}
+	}
+	return snap
+}
+
+func encodeRecord(rec *walRecord) ([]byte, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return frame(b), nil
+}
+
+func decodeRecord(line string) (*walRecord, bool) {
+	body, ok := unframe(line)
+	if !ok {
+		return nil, false
+	}
+	var rec walRecord
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return nil, false
+	}
+	return &rec, true
+}
+
+// 为一条记录加上校验和，得到 "crc32 json\n" 形式的一行
+func frame(b []byte) []byte {
+	line := make([]byte, 0, len(b)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(b))...)
+	line = append(line, b...)
+	return append(line, '\n')
+}
+
+// 校验一行记录，返回其中的 json
+func unframe(line string) ([]byte, bool) {
+	sum, body, ok := strings.Cut(line, " ")
+	if !ok || fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body))) != sum {
+		return nil, false
+	}
+	return []byte(body), true
+}
+
+// 追加一条 wal 记录
+func (s *store) append(rec *walRecord) error {
+	line, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	if _, err = s.wal.Write(line); err != nil {
+		return err
+	}
+	if s.sync {
+		return s.wal.Sync()
+	}
+	return nil
+}
+
+// 写入快照并清空 wal
+//
+//	调用方需持有写锁
+//	先写临时文件再重命名，保证任何时刻磁盘上都有一份完整的快照
+func (s *store) writeSnapshot(snap *snapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, STORE_SNAPSHOT+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(s.dir, STORE_SNAPSHOT)); err != nil {
+		return err
+	}
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	if err = s.wal.Truncate(0); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+func (s *store) close() error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	return s.wal.Close()
+}
+
+// 开始一次写操作，返回释放函数
+//
+//	修改 data 的公开方法在入口处调用，直到全部记录写入后才释放
+//	写操作之间互斥: 故障与恢复传播会修改其他消费者的依赖(Rely)与 changed 标记，
+//	与该消费者自身的心跳不能同时进行；一条记录写入失败并回滚时，也不会有其他写操作基于未提交的状态做出修改
+//	开启持久化时同时持有存储的读锁，与快照互斥
+func (data *Data) hold() func() {
+	data.writeLock.Lock()
+	if data.store == nil {
+		return data.writeLock.Unlock
+	}
+	data.store.RLock()
+	return func() {
+		data.store.RUnlock()
+		data.writeLock.Unlock()
+	}
+}
+
+// 写入记录，成功后通知监听者，未开启持久化与集群时只做通知
+//
+//	集群模式下记录通过 raft 日志复制到其他节点，而不是写入本地 wal
+//	写入失败时将记录涉及的 service 或主题回滚到已提交的状态，并返回错误
+func (data *Data) journal(rec *walRecord) error {
+	var (
+		seq uint64
+		err error
+	)
+	switch {
+	case data.cluster != nil:
+		// 从快照恢复时产生的记录不需要复制，leader 上同样会产生这些记录
+		if atomic.LoadInt32(&data.cluster.restoring) == 1 {
+			break
+		}
+		seq, err = data.cluster.replicate(rec)
+	case data.store != nil:
+		if err = data.store.append(rec); err == nil {
+			data.applyLock.Lock()
+			data.committed.apply(rec)
+			data.applyLock.Unlock()
+		}
+	}
+	if err != nil {
+		data.log.Errorf("journal %s %s %d: %s", rec.Op, rec.Topic, rec.ID, err.Error())
+		data.applyLock.Lock()
+		if seq != 0 {
+			// 记录可能在之后被提交，届时在 fsm.Apply 中重新应用
+			data.cluster.abandoned[seq] = struct{}{}
+		}
+		data.rollback(time.Now().UnixNano(), rec)
+		data.applyLock.Unlock()
+		return err
+	}
+	data.notify(rec)
+	return nil
+}
+
+// 将记录涉及的 service 或主题回滚到已提交的状态
+//
+//	调用方需持有 applyLock
+//	service 在已提交的状态中存在时按其重放，保留原本的心跳时间；不存在时从 data 中删除
+//	主题在已提交的状态中为显式主题时恢复其属性，否则转为隐式主题，空闲后被回收
+func (data *Data) rollback(now int64, rec *walRecord) {
+	switch rec.Op {
+	case WAL_PUT, WAL_STATUS, WAL_DELETE:
+		id := rec.ID
+		if rec.Service != nil {
+			id = rec.Service.ID
+		}
+		t, err := data.getTopic(rec.Topic)
+		if r, ok := data.committed.services[rec.Topic][id]; ok {
+			var keepalive int64
+			if err == nil {
+				if s, err := t.GetService(id); err == nil {
+					keepalive = s.keepalive
+				}
+			}
+			data.replayService(now, r)
+			if keepalive == 0 {
+				return
+			}
+			if s, err := t.GetService(id); err == nil {
+				s.keepalive = keepalive
+				t.schedule(s)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		if s, err := t.RemoveService(now, id); err == nil {
+			data.forget(s)
+		}
+		data.unindexInstance(rec.Topic, id)
+		data.idle(now, t)
+	case WAL_TOPIC, WAL_REMOVE_TOPIC:
+		if attr, ok := data.committed.topics[rec.Topic]; ok {
+			data.replay(now, &walRecord{Op: WAL_TOPIC, Topic: rec.Topic, Attr: attr})
+			return
+		}
+		t, err := data.getTopic(rec.Topic)
+		if err != nil {
+			return
+		}
+		t.Lock()
+		t.implicit = true
+		t.attr = nil
+		t.Unlock()
+		data.idle(now, t)
+	}
+}
+
+// 记录 service 的完整状态
+func (data *Data) journalService(topicName string, s *Service) error {
+	return data.journal(&walRecord{Op: WAL_PUT, Topic: topicName, Service: newServiceRecord(topicName, s)})
+}
+
+// 记录 service 自身状态变化
+func (data *Data) journalStatus(topicName string, id int64, status HeartBeatType) error {
+	return data.journal(&walRecord{Op: WAL_STATUS, Topic: topicName, ID: id, Status: status})
+}
+
+// 生成快照
+//
+//	持有存储的写锁，此时没有任何修改 data 的操作在进行中
+//	快照写入后即为已提交的状态
+func (data *Data) snapshot() error {
+	if data.store == nil {
+		return nil
+	}
+	data.store.Lock()
+	defer data.store.Unlock()
+	snap := data.dump()
+	if err := data.store.writeSnapshot(snap); err != nil {
+		return err
+	}
+	data.applyLock.Lock()
+	data.committed = newStoreState(snap)
+	data.applyLock.Unlock()
+	return nil
+}
+
+// 导出 data 中的全部状态
+func (data *Data) dump() *snapshot {
+	snap := &snapshot{
+		IDMaker:  atomic.LoadInt64(&data.idMaker),
+		Topics:   make([]*topicRecord, 0),
+		Services: make([]*serviceRecord, 0),
+	}
+	data.RLock()
+	for name, t := range data.topics {
+		t.RLock()
+		if !t.implicit {
+			snap.Topics = append(snap.Topics, &topicRecord{Name: name, Attr: t.attr})
+		}
+		for _, m := range []*ServiceMap{t.running, t.pending} {
+			m.RLock()
+			for _, s := range m.services {
+				snap.Services = append(snap.Services, newServiceRecord(name, s))
+			}
+			m.RUnlock()
+		}
+		t.RUnlock()
+	}
+	data.RUnlock()
+	return snap
+}
+
+// 定期生成快照，直到 end 被关闭
+func (data *Data) snapshotLoop(interval time.Duration, end <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := data.snapshot(); err != nil {
+				data.log.Errorf("write snapshot: %s", err.Error())
+			}
+		case <-end:
+			return
+		}
+	}
+}
+
+// 从持久化的状态中重建 data
+//
+//	思路: 先创建显式主题，再将所有 service 放回原来的列表，心跳时间设置为 now + grace，
+//	即租约被延长了一个宽限期，客户端可以使用原来的 id 继续心跳
+//	之后为所有消费者重新绑定依赖，优先使用原来的提供者，不可用时重新选择，
+//	并标记 changed，下次心跳时客户端会收到全部依赖
+//	找不到依赖的消费者置为 pending，并向下传播
+func (data *Data) restore(now int64, state *storeState, grace int64) {
+	var (
+		names    = make([]string, 0, len(state.topics))
+		restored = make([]*serviceRecord, 0)
+		pended   = make([]*serviceRecord, 0)
+	)
+	for name := range state.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// 配置文件中的主题已经创建过了
+		if _, err := data.getTopic(name); err == nil {
+			continue
+		}
+		data.addTopic(name, state.topics[name])
+	}
+	for _, services := range state.services {
+		for _, r := range services {
+			restored = append(restored, r)
+		}
+	}
+	sort.Slice(restored, func(i, j int) bool { return restored[i].ID < restored[j].ID })
+	data.idMaker = state.idMaker
+
+	// 放回原来的列表
+	for _, r := range restored {
+		t, _ := data.getXTopic(r.Topic)
+		s := r.service()
+		if s.Status == HeartBeat_PENDING {
+			s, _ = t.AddPendingService(now, s)
+		} else {
+			s.Status = HeartBeat_RUNNING
+			s, _ = t.AddRunningService(now, s)
+		}
+		if s == nil {
+			continue
+		}
+		data.indexInstance(r.Topic, s)
+		s.keepalive = now + grace
+		t.schedule(s)
+	}
+
+	// 重新绑定依赖
+	for _, r := range restored {
+		if len(r.Depends) == 0 {
+			continue
+		}
+		t, err := data.getTopic(r.Topic)
+		if err != nil {
+			continue
+		}
+		c, err := t.GetService(r.ID)
+		if err != nil {
+			continue
+		}
+		if lost := data.rebind(r.Topic, c, r.Relies); len(lost) > 0 {
+			topics := make([]*innerTopic, 0, len(lost))
+			data.RLock()
+			for _, name := range lost {
+				topics = append(topics, &innerTopic{topicName: name, Topic: data.topics[name]})
+			}
+			data.RUnlock()
+			relyMap, status := data.discover(now, r.Topic, c, topics)
+			for _, rely := range relyMap {
+				c.Rely = append(c.Rely, rely)
+			}
+			if status == HeartBeat_PENDING && c.Status != HeartBeat_PENDING {
+				t.PendX(now, c.ID)
+				pended = append(pended, r)
+			}
+		}
+		c.changed = true
+	}
+	for _, r := range pended {
+		data.propagateFailure(now, r.Topic, r.ID)
+	}
+	data.log.Infof("restored %d topics, %d services", len(names), len(restored))
+}
+
+// 按记录的提供者 id 为消费者重新绑定依赖
+//
+//	释放消费者原有的依赖，返回记录的提供者已不可用(或不再满足条件)的 topic
+func (data *Data) rebind(topicName string, c *Service, relies map[string]int64) []string {
+	var lost = make([]string, 0)
+	data.release(c.ID, c.Rely)
+	c.Rely = make([]*Rely, 0, len(c.Depends))
+	for _, name := range c.Depends {
+		provider, ok := data.recordedProvider(name, relies[name])
+		if !ok || !c.Requires[name].Matches(provider.Labels, provider.Version) {
+			lost = append(lost, name)
+			continue
+		}
+		data.bind(topicName, c.ID, provider)
+		data.unwait(c.ID, name)
+		c.Rely = append(c.Rely, newRely(name, provider))
+	}
+	return lost
+}
+
+// 获取记录中消费者所使用的提供者，不可用时返回 false
+func (data *Data) recordedProvider(topicName string, id int64) (*Service, bool) {
+	if id == 0 {
+		return nil, false
+	}
+	t, err := data.getTopic(topicName)
+	if err != nil {
+		return nil, false
+	}
+	s, err := t.GetRunningService(id)
+	if err != nil || s.Status != HeartBeat_RUNNING {
+		return nil, false
+	}
+	return s, true
+}
@@ -0,0 +1,261 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"Airfone/internal/conf"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+// 编码一条 wal 记录
+func walLine(t *testing.T, rec *walRecord) string {
+	t.Helper()
+	b, err := encodeRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestStoreReplay(t *testing.T) {
+	var (
+		put = func(topic string, id int64) *walRecord {
+			return &walRecord{Op: WAL_PUT, Topic: topic, ID: id, Service: &serviceRecord{Topic: topic, ID: id, IP: "10.0.0.1", Port: 80, Status: HeartBeat_RUNNING}}
+		}
+		snap = `{"id_maker":10,"topics":[{"name":"log","attr":{"selector":"random"}}],"services":[{"topic":"log","id":3,"ip":"10.0.0.1","port":80,"lease":{},"status":1}]}`
+	)
+	tests := []struct {
+		name        string
+		snapshot    string
+		wal         func(t *testing.T) string
+		wantIDMaker int64
+		wantTopics  []string
+		wantIDs     map[string][]int64
+		wantStatus  map[int64]HeartBeatType
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:        "snapshot only",
+			snapshot:    snap,
+			wantIDMaker: 10,
+			wantTopics:  []string{"log"},
+			wantIDs:     map[string][]int64{"log": {3}},
+		},
+		{
+			name:     "wal after snapshot",
+			snapshot: snap,
+			wal: func(t *testing.T) string {
+				return walLine(t, put("log", 11)) +
+					walLine(t, put("common", 12)) +
+					walLine(t, &walRecord{Op: WAL_STATUS, Topic: "log", ID: 11, Status: HeartBeat_PENDING}) +
+					walLine(t, &walRecord{Op: WAL_DELETE, Topic: "log", ID: 3}) +
+					walLine(t, &walRecord{Op: WAL_TOPIC, Topic: "common", Attr: &TopicAttr{}}) +
+					walLine(t, &walRecord{Op: WAL_REMOVE_TOPIC, Topic: "log"})
+			},
+			wantIDMaker: 12,
+			wantTopics:  []string{"common"},
+			wantIDs:     map[string][]int64{"log": {11}, "common": {12}},
+			wantStatus:  map[int64]HeartBeatType{11: HeartBeat_PENDING, 12: HeartBeat_RUNNING},
+		},
+		{
+			name: "torn tail is dropped",
+			wal: func(t *testing.T) string {
+				line := walLine(t, put("log", 2))
+				return walLine(t, put("log", 1)) + line[:len(line)/2]
+			},
+			wantIDMaker: 1,
+			wantIDs:     map[string][]int64{"log": {1}},
+		},
+		{
+			name: "records after a bad checksum are dropped",
+			wal: func(t *testing.T) string {
+				return walLine(t, put("log", 1)) +
+					"00000000 " + walLine(t, put("log", 2))[9:] +
+					walLine(t, put("log", 3))
+			},
+			wantIDMaker: 1,
+			wantIDs:     map[string][]int64{"log": {1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.snapshot != "" {
+				if err := os.WriteFile(filepath.Join(dir, STORE_SNAPSHOT), []byte(tt.snapshot), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.wal != nil {
+				if err := os.WriteFile(filepath.Join(dir, STORE_WAL), []byte(tt.wal(t)), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, state, err := openStore(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+			if state.idMaker != tt.wantIDMaker {
+				t.Errorf("idMaker = %d, want %d", state.idMaker, tt.wantIDMaker)
+			}
+			if len(state.topics) != len(tt.wantTopics) {
+				t.Errorf("topics = %v, want %v", state.topics, tt.wantTopics)
+			}
+			for _, name := range tt.wantTopics {
+				if _, ok := state.topics[name]; !ok {
+					t.Errorf("topic %s not restored", name)
+				}
+			}
+			for topic, ids := range tt.wantIDs {
+				if len(state.services[topic]) != len(ids) {
+					t.Errorf("topic %s has %d services, want %v", topic, len(state.services[topic]), ids)
+				}
+				for _, id := range ids {
+					if _, ok := state.services[topic][id]; !ok {
+						t.Errorf("service %s %d not restored", topic, id)
+					}
+				}
+			}
+			for id, status := range tt.wantStatus {
+				for _, services := range state.services {
+					if r, ok := services[id]; ok && r.Status != status {
+						t.Errorf("service %d status = %v, want %v", id, r.Status, status)
+					}
+				}
+			}
+		})
+	}
+}
+
+// 打开以 dir 为存储目录的 data
+func openTestData(t *testing.T, dir string) (*Data, func()) {
+	t.Helper()
+	data, cleanup, err := NewData(&conf.Data{Store: &conf.Data_Store{Dir: dir}}, log.NewHelper(log.DefaultLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, cleanup
+}
+
+// 重启后从快照与 wal 恢复，id 不变且不会被重新分配
+func TestStoreRestart(t *testing.T) {
+	dir := t.TempDir()
+	data, cleanup := openTestData(t, dir)
+	now := time.Now().UnixNano()
+	kept, err := data.AddService("log", now, &Service{IP: "10.0.0.1", Port: 80, Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := data.AddService("log", now, &Service{IP: "10.0.0.2", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = data.UpdateService("log", now, &Service{ID: kept.ID, IP: "10.0.0.1", Port: 80, Weight: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = data.RemoveService("log", now, removed.ID); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+
+	data, cleanup = openTestData(t, dir)
+	defer cleanup()
+	topic, err := data.getTopic("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := topic.GetService(kept.ID)
+	if err != nil {
+		t.Fatalf("service %d not restored: %v", kept.ID, err)
+	}
+	if got.Weight != 7 {
+		t.Errorf("weight = %d, want 7", got.Weight)
+	}
+	if _, err = topic.GetService(removed.ID); err == nil {
+		t.Errorf("removed service %d restored", removed.ID)
+	}
+	added, err := data.AddService("log", time.Now().UnixNano(), &Service{IP: "10.0.0.3", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.ID <= removed.ID {
+		t.Errorf("new id %d not greater than restored id %d", added.ID, removed.ID)
+	}
+}
+
+// wal 写入失败时，内存中的修改回滚到已提交的状态
+func TestStoreRollback(t *testing.T) {
+	data, cleanup := openTestData(t, t.TempDir())
+	defer cleanup()
+	now := time.Now().UnixNano()
+	s, err := data.AddService("log", now, &Service{IP: "10.0.0.1", Port: 80, Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 关闭 wal 文件，之后的写入全部失败
+	data.store.wal.Close()
+
+	if _, err = data.UpdateService("log", now, &Service{ID: s.ID, IP: "10.0.0.1", Port: 80, Weight: 9}); err == nil {
+		t.Fatal("update succeeded without wal")
+	}
+	if _, err = data.AddService("log", now, &Service{IP: "10.0.0.2", Port: 80}); err == nil {
+		t.Fatal("register succeeded without wal")
+	}
+	if _, err = data.RemoveService("log", now, s.ID); err == nil {
+		t.Fatal("logout succeeded without wal")
+	}
+	if _, err = data.CreateTopic("common", &TopicAttr{}); err == nil {
+		t.Fatal("create topic succeeded without wal")
+	}
+
+	topic, err := data.getTopic("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := topic.GetService(s.ID)
+	if err != nil {
+		t.Fatalf("service %d lost after rollback: %v", s.ID, err)
+	}
+	if got.Weight != 1 {
+		t.Errorf("weight = %d after rollback, want 1", got.Weight)
+	}
+	if n := len(topic.running.services) + len(topic.pending.services); n != 1 {
+		t.Errorf("%d services after rollback, want 1", n)
+	}
+	if _, ok := data.instances["log"]["10.0.0.2:80"]; ok {
+		t.Error("instance index of the rolled back registration kept")
+	}
+	if c, err := data.getTopic("common"); err == nil && !c.implicit {
+		t.Error("topic created without wal is explicit")
+	}
+}
+
+// 心跳改变状态时写入失败返回错误，状态回滚
+func TestStoreRollbackCheck(t *testing.T) {
+	data, cleanup := openTestData(t, t.TempDir())
+	defer cleanup()
+	now := time.Now().UnixNano()
+	s, err := data.AddService("log", now, &Service{IP: "10.0.0.1", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expire := now + int64(s.Lease.Pending) + 1
+	data.timeout(expire, &Task{Topic: "log", ID: s.ID, Action: TURN_TO_PENDING})
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_PENDING {
+		t.Fatalf("status after timeout = %v, want pending", got)
+	}
+	data.store.wal.Close()
+
+	if _, err = data.Check(expire, &HeartBeat{Topic: "log", ID: s.ID}); err == nil {
+		t.Fatal("heartbeat succeeded without wal")
+	}
+	if got := statusOf(data, "log", s.ID); got != HeartBeat_PENDING {
+		t.Errorf("status after rollback = %v, want pending", got)
+	}
+}
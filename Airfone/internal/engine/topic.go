@@ -1,12 +1,12 @@
 package engine
 
 import (
-	"sync"
 	"time"
 
-	"github.com/go-kratos/kratos/v2/log"
+	"Airfone/api/errorpb"
 )
 
+// 默认的心跳窗口，service 实际使用的是注册时确定的租约(Lease)
 const (
 	DURATION_HEARTBEAT = 2 * time.Second // 心跳时间，每隔 DURATION_HEARTBEAT 轮询一次，客户端向服务器端发送一次心跳
 	DURATION_VALID     = 3 * time.Second // 有效时间，当客户端超过 DURATION_VALID 未向服务器端发送心跳，即便在 running 队列中，也不纳入使用
@@ -18,63 +18,90 @@ type Topic struct {
 	// 一般情况下，添加/修改/删除主题内单个service时，
 	// 又或者某个service心跳超时未联系，会使用 topic 写锁
 	// 在读取 topic 时上读锁，更新单个service的 keepalive 时也不需要上锁
-	sync.RWMutex
+	// 加锁的等待时间见 metrics.go
+	topicLock
 
-	running *ServiceMap // 正在运行的服务
-	pending *ServiceMap // 暂时无法联系的服务
+	name      string      // 主题名
+	attr      *TopicAttr  // 主题属性，隐式创建的主题为空
+	implicit  bool        // 是否为隐式创建(注册时自动创建)，隐式创建的主题空闲后会被回收
+	removed   bool        // 是否已被移除，持有旧指针的协程需要重新获取主题
+	running   *ServiceMap // 正在运行的服务
+	pending   *ServiceMap // 暂时无法联系的服务
+	scheduler *Scheduler  // 调度器，由 data 持有，所有 topic 共用
+	prober    *Scheduler  // 健康检查的调度器，由 data 持有，所有 topic 共用
 }
 
-func NewTopic(log *log.Helper) *Topic {
-	var (
-		topic = &Topic{
-			// current: now,
-			running: NewServiceMap(),
-			pending: NewServiceMap(),
-		}
-		ticker = time.NewTicker(DURATION_HEARTBEAT)
-	)
+// 主题属性
+//
+//	显式创建主题时设置
+type TopicAttr struct {
+	Selector string // 负载均衡策略，优先级高于配置文件中对该主题的配置
+	Lease    *Lease // 主题内 service 的默认租约，为空的字段使用服务端默认值
+}
 
-	// todo: 每个 topic 加一个协程，用于异步处理失效数据
-	// 如:
-	// 1.定期将心跳失联的 service 放到 pending 队列中
-	// 2.定期删除 pending 中过期的 service
-	//
-	// 每三秒执行一次，将 running 心跳间隔 DURATION_PENDING 以上的放入 pending
-	// 将 pending 心跳间隔 DURATION_DROPPED 以上的删除
-	go func() {
-		log.Info("-----------------开启一个 topic 的异步协程-----------------")
-		for {
-			<-ticker.C
-			log.Info("-----------------异步协程探测-----------------")
-			now := time.Now()
-			// 这里是处理 1
-			topic.Lock()
-			topic.running.Lock()
-			topic.pending.Lock()
-			if s, err := topic.running.BatchDeleteByCheckTime(now.UnixNano(), DURATION_PENDING); err != nil {
-				log.Errorf("schedule Error: %s", err.Error())
-			} else {
-				for _, s2 := range s {
-					s2.Status = HeartBeat_PENDING
-				}
-				if err = topic.pending.BatchAdd(now.UnixNano(), s); err != nil {
-					log.Errorf("schedule Error: %s", err.Error())
-				}
-			}
-			topic.Unlock()
-			topic.running.Unlock()
+// 新建主题
+//
+//	主题本身不再开启协程，心跳超时与 pending 超时都交给 data 的调度器处理:
+//	1. running 中心跳间隔 Lease.Pending 以上的放入 pending
+//	2. pending 中心跳间隔 Lease.Dropped 以上的删除
+func NewTopic(name string, scheduler, prober *Scheduler) *Topic {
+	return &Topic{
+		name:      name,
+		running:   NewServiceMap(),
+		pending:   NewServiceMap(),
+		scheduler: scheduler,
+		prober:    prober,
+	}
+}
 
-			// 处理 2
-			// todo
-			_, err := topic.pending.BatchDeleteByCheckTime(now.UnixNano(), DURATION_DROPPED)
-			if err != nil {
-				log.Error("schedule Error: %s", err.Error())
-			}
-			topic.pending.Unlock()
-		}
-	}()
+// 为 service 设置延时任务
+//
+//	running 中的 service 在心跳超时后移入 pending
+//	pending 中的 service 在 pending 超时后删除
+//	每次 service 进入列表或收到心跳时调用，以重置到期时间
+//	声明了健康检查的 service 还没有探测任务时添加，探测任务不随心跳重置
+func (t *Topic) schedule(s *Service) {
+	if s.Health != nil && t.prober != nil {
+		t.prober.Add(t.name, s.ID, s.keepalive+int64(s.Health.Interval), HEALTH_CHECK)
+	}
+	if t.scheduler == nil {
+		return
+	}
+	switch s.Status {
+	case HeartBeat_PENDING:
+		t.scheduler.Reset(t.name, s.ID, s.keepalive+int64(s.Lease.Dropped), DROP_AFTER_PENDING)
+	default:
+		t.scheduler.Reset(t.name, s.ID, s.keepalive+int64(s.Lease.Pending), TURN_TO_PENDING)
+	}
+}
 
-	return topic
+// 取消 service 的延时任务
+func (t *Topic) unschedule(id int64) {
+	if t.scheduler != nil {
+		t.scheduler.Cancel(t.name, id)
+	}
+	if t.prober != nil {
+		t.prober.Cancel(t.name, id)
+	}
+}
+
+// 获取主题属性，隐式创建的主题返回空属性
+func (t *Topic) Attr() TopicAttr {
+	t.RLock()
+	defer t.RUnlock()
+	if t.attr == nil {
+		return TopicAttr{}
+	}
+	return *t.attr
+}
+
+// 主题中是否已经没有任何 service
+func (t *Topic) Empty() bool {
+	t.running.RLock()
+	defer t.running.RUnlock()
+	t.pending.RLock()
+	defer t.pending.RUnlock()
+	return len(t.running.services) == 0 && len(t.pending.services) == 0
 }
 
 // 添加一个 Service 到 running 列表中
@@ -82,7 +109,11 @@ func (t *Topic) AddRunningService(now int64, service *Service) (*Service, error)
 	if service.Status != HeartBeat_CHANGED {
 		service.Status = HeartBeat_RUNNING
 	}
-	return t.running.Add(now, service)
+	if _, err := t.running.Add(now, service); err != nil {
+		return nil, err
+	}
+	t.schedule(service)
+	return service, nil
 }
 
 // 添加一个 Service 到 pending 列表中
@@ -90,11 +121,15 @@ func (t *Topic) AddRunningService(now int64, service *Service) (*Service, error)
 //	如果是将一个 running 队列中取出放入 pending 队列，应该使用 pend 方法，而不是使用该方法
 func (t *Topic) AddPendingService(now int64, service *Service) (*Service, error) {
 	service.Status = HeartBeat_PENDING
-	return t.pending.Add(now, service)
+	if _, err := t.pending.Add(now, service); err != nil {
+		return nil, err
+	}
+	t.schedule(service)
+	return service, nil
 }
 
 // 获取正在运行的 Service
-func (t *Topic) GetRunningService(id int32) (*Service, error) {
+func (t *Topic) GetRunningService(id int64) (*Service, error) {
 	return t.running.Get(id)
 }
 
@@ -102,19 +137,16 @@ func (t *Topic) GetRunningService(id int32) (*Service, error) {
 //
 //	running节点有俩要求:
 //	1. 状态为HeartBeat_RUNNING
-//	2. 心跳在有效期内(now - keepalive < DURATION_VALID)
+//	2. 心跳在有效期内(now - keepalive < Lease.Valid)
 //	注意 running 队列中有两种状态
 //	1. changed，等待客户端回应成功，一旦回应成功则状态变更为 running
 //	2. running，可用节点
 func (t *Topic) GetAllRunningService(now int64) []*Service {
 	t.running.RLock()
 	defer t.running.RUnlock()
-	var (
-		list  = make([]*Service, 0, len(t.running.services))
-		limit = now - int64(DURATION_VALID)
-	)
+	var list = make([]*Service, 0, len(t.running.services))
 	for _, s := range t.running.services {
-		if s.keepalive > limit && s.Status == HeartBeat_RUNNING {
+		if s.keepalive > now-int64(s.Lease.Valid) && s.Status == HeartBeat_RUNNING {
 			list = append(list, s)
 		}
 	}
@@ -122,12 +154,12 @@ func (t *Topic) GetAllRunningService(now int64) []*Service {
 }
 
 // 获取被 pending 的 Service
-func (t *Topic) GetPendingService(id int32) (*Service, error) {
+func (t *Topic) GetPendingService(id int64) (*Service, error) {
 	return t.pending.Get(id)
 }
 
 // 获取该 id 的 service, 无论他在哪个列表中
-func (t *Topic) GetService(id int32) (*Service, error) {
+func (t *Topic) GetService(id int64) (*Service, error) {
 	var (
 		serv *Service
 		err  error
@@ -141,27 +173,29 @@ func (t *Topic) GetService(id int32) (*Service, error) {
 }
 
 // 移除正在运行的 Service
-func (t *Topic) RemoveRunningService(now int64, id int32) (*Service, error) {
+func (t *Topic) RemoveRunningService(now int64, id int64) (*Service, error) {
 	s, err := t.running.Delete(now, id)
 	if err != nil {
 		return nil, err
 	}
 	s.Status = HeartBeat_DROPPED
+	t.unschedule(id)
 	return s, nil
 }
 
 // 移除阻塞的 Service
-func (t *Topic) RemovePendingService(now int64, id int32) (*Service, error) {
+func (t *Topic) RemovePendingService(now int64, id int64) (*Service, error) {
 	s, err := t.pending.Delete(now, id)
 	if err != nil {
 		return nil, err
 	}
 	s.Status = HeartBeat_DROPPED
+	t.unschedule(id)
 	return s, nil
 }
 
 // 移除该 id 的 service, 无论他在哪个列表中
-func (t *Topic) RemoveService(now int64, id int32) (*Service, error) {
+func (t *Topic) RemoveService(now int64, id int64) (*Service, error) {
 	var (
 		serv *Service
 		err  error
@@ -179,7 +213,7 @@ func (t *Topic) RemoveService(now int64, id int32) (*Service, error) {
 //	思路: 将 service 从 pending 队列中删除，
 //	再将其添加到 running 队列，若失败则重新将 service 加回到 pending 队列
 //	最终修改时间，返回
-func (t *Topic) Resurrect(now int64, id int32) (*Service, error) {
+func (t *Topic) Resurrect(now int64, id int64) (*Service, error) {
 	var (
 		service *Service
 		err     error
@@ -196,6 +230,7 @@ func (t *Topic) Resurrect(now int64, id int32) (*Service, error) {
 	if service, err = t.running.Add(now, service); err != nil {
 		return nil, err
 	}
+	t.schedule(service)
 	return service, nil
 }
 
@@ -203,7 +238,7 @@ func (t *Topic) Resurrect(now int64, id int32) (*Service, error) {
 //
 //	若原本 id 就在 running 队列，则不做任何操作
 //	若在 pending 队列则与 Resurrect 逻辑一致
-func (t *Topic) ResurrectX(now int64, id int32) (*Service, error) {
+func (t *Topic) ResurrectX(now int64, id int64) (*Service, error) {
 	var (
 		service *Service
 		err     error
@@ -217,6 +252,7 @@ func (t *Topic) ResurrectX(now int64, id int32) (*Service, error) {
 			service.Status = HeartBeat_RUNNING
 		}
 		service.keepalive = now
+		t.schedule(service)
 	}
 	return service, nil
 }
@@ -224,7 +260,7 @@ func (t *Topic) ResurrectX(now int64, id int32) (*Service, error) {
 // 待裁决
 //
 //	当长时间 Service 无响应时，将其从 running 转移到 pending
-func (t *Topic) Pend(now int64, id int32) error {
+func (t *Topic) Pend(now int64, id int64) error {
 	var (
 		service *Service
 		err     error
@@ -240,21 +276,76 @@ func (t *Topic) Pend(now int64, id int32) error {
 	if _, err = t.pending.Add(now, service); err != nil {
 		return err
 	}
+	t.schedule(service)
 	return nil
 }
 
 // 待裁决2
 //
-//	若原本 id 就在 pending 队列，则不做任何操作
+//	若原本 id 就在 pending 队列，则只重置它的延时任务(心跳时间可能已被更新)
 //	当长时间 Service 无响应时，将其从 running 转移到 pending
-func (t *Topic) PendX(now int64, id int32) error {
-	if _, err := t.pending.Get(id); err != nil {
+func (t *Topic) PendX(now int64, id int64) error {
+	service, err := t.pending.Get(id)
+	if err != nil {
 		return t.Pend(now, id)
 	}
+	t.schedule(service)
+	return nil
+}
+
+// 依赖故障或会话断开时移入 pending
+//
+//	与 PendX 不同的是保留原本的心跳时间，级联传播与会话断开都不能延长 service 的租约，
+//	service 自身已经失联时仍然从最后一次心跳开始计算 pending 超时
+func (t *Topic) Demote(id int64) error {
+	t.Lock()
+	defer t.Unlock()
+	t.running.Lock()
+	defer t.running.Unlock()
+	t.pending.Lock()
+	defer t.pending.Unlock()
+	if s, ok := t.pending.services[id]; ok {
+		t.schedule(s)
+		return nil
+	}
+	s, ok := t.running.services[id]
+	if !ok {
+		return errorpb.ErrorSearchInvalid("this service is not exist")
+	}
+	delete(t.running.services, id)
+	s.Status = HeartBeat_PENDING
+	t.pending.services[id] = s
+	t.schedule(s)
 	return nil
 }
 
-func (t *Topic) Conform(now int64, id int32) error {
+// 依赖恢复时移回 running
+//
+//	与 ResurrectX 不同的是保留原本的心跳时间，原本就在 running 中时不做任何操作
+func (t *Topic) Promote(id int64) (*Service, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.running.Lock()
+	defer t.running.Unlock()
+	t.pending.Lock()
+	defer t.pending.Unlock()
+	if s, ok := t.running.services[id]; ok {
+		return s, nil
+	}
+	s, ok := t.pending.services[id]
+	if !ok {
+		return nil, errorpb.ErrorSearchInvalid("this service is not exist")
+	}
+	delete(t.pending.services, id)
+	if s.Status != HeartBeat_CHANGED {
+		s.Status = HeartBeat_RUNNING
+	}
+	t.running.services[id] = s
+	t.schedule(s)
+	return s, nil
+}
+
+func (t *Topic) Conform(now int64, id int64) error {
 	var (
 		serv *Service
 		err  error
@@ -264,5 +355,53 @@ func (t *Topic) Conform(now int64, id int32) error {
 	}
 	serv.keepalive = now
 	serv.Status = HeartBeat_RUNNING
+	t.schedule(serv)
 	return nil
 }
+
+// 心跳超时
+//
+//	调度器中 TURN_TO_PENDING 任务到期时调用，将 service 从 running 移入 pending
+//	与 Pend 不同的是保留原本的心跳时间，pending 超时从最后一次心跳开始计算
+//	若在此期间收到了心跳，则只重置延时任务，返回 false
+func (t *Topic) Expire(now int64, id int64) (*Service, bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.running.Lock()
+	defer t.running.Unlock()
+	t.pending.Lock()
+	defer t.pending.Unlock()
+	s, ok := t.running.services[id]
+	if !ok {
+		return nil, false
+	}
+	if s.keepalive > now-int64(s.Lease.Pending) {
+		t.schedule(s)
+		return nil, false
+	}
+	delete(t.running.services, id)
+	s.Status = HeartBeat_PENDING
+	t.pending.services[id] = s
+	t.schedule(s)
+	return s, true
+}
+
+// pending 超时
+//
+//	调度器中 DROP_AFTER_PENDING 任务到期时调用，将 service 从 pending 中删除
+//	若在此期间收到了心跳，则只重置延时任务，返回 false
+func (t *Topic) Drop(now int64, id int64) (*Service, bool) {
+	t.pending.Lock()
+	defer t.pending.Unlock()
+	s, ok := t.pending.services[id]
+	if !ok {
+		return nil, false
+	}
+	if s.keepalive > now-int64(s.Lease.Dropped) {
+		t.schedule(s)
+		return nil, false
+	}
+	delete(t.pending.services, id)
+	s.Status = HeartBeat_DROPPED
+	return s, true
+}
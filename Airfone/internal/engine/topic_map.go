@@ -2,35 +2,86 @@ package engine
 
 import (
 	"Airfone/api/errorpb"
-	"fmt"
 )
 
 // TopicMap about
 //	这里面其实也全是 data 的方法，
 //	不过是私有方法，同时需要加锁，
 //	而 data.go 中则是调用这些私有方法，同时也不关心锁
+//
+//	主题的生命周期:
+//	1. 显式创建: 通过 CreateTopic 或配置文件创建，可以携带属性，不会因为空闲被回收，只能通过 RemoveTopic 移除
+//	2. 隐式创建: 服务注册时主题不存在则自动创建，主题变空之后，经过 idleTimeout 仍为空则被回收
 
 // 添加主题
 //
 //	加写锁
-func (tm *Data) addTopic(name string) (*Topic, error) {
+//	若主题已被隐式创建，则将其转为显式主题并设置属性
+func (tm *Data) addTopic(name string, attr *TopicAttr) (*Topic, error) {
 	tm.Lock()
 	defer tm.Unlock()
-	if _, ok := tm.topics[name]; ok {
-		return nil, errorpb.ErrorInsertAlreadyExist("this topic is already existed")
+	if topic, ok := tm.topics[name]; ok {
+		if !topic.implicit {
+			return nil, errorpb.ErrorInsertAlreadyExist("this topic is already existed")
+		}
+		topic.Lock()
+		topic.implicit = false
+		topic.attr = attr
+		topic.Unlock()
+		return topic, nil
 	}
-	topic := NewTopic(tm.log)
+	topic := NewTopic(name, tm.scheduler, tm.prober)
+	topic.attr = attr
 	tm.topics[name] = topic
 	return topic, nil
 }
 
 // 移除主题
 //
-//	加写锁
-func (tm *Data) removeTopic(name string) {
+//	加写锁，只有空的主题才能被移除
+//	移除后主题被标记为 removed，正在向该主题添加 service 的协程会重新获取主题
+func (tm *Data) removeTopic(name string, implicitOnly bool) error {
 	tm.Lock()
 	defer tm.Unlock()
+	topic, ok := tm.topics[name]
+	if !ok {
+		return errorpb.ErrorDeleteInvalid("no such a name for topic")
+	}
+	topic.Lock()
+	defer topic.Unlock()
+	if implicitOnly && !topic.implicit {
+		return errorpb.ErrorDeleteInvalid("topic %s is not created implicitly", name)
+	}
+	if !topic.Empty() {
+		return errorpb.ErrorTopicNotEmpty("topic %s still has services", name)
+	}
+	topic.removed = true
 	delete(tm.topics, name)
+	tm.scheduler.Cancel(name, 0)
+	tm.unindexTopic(name)
+	forgetTopic(name)
+	return nil
+}
+
+// 回收空闲主题
+//
+//	调度器中 REMOVE_IDLE_TOPIC 任务到期时调用
+//	只回收隐式创建的主题，期间若有新的 service 加入或主题被显式创建则不做任何操作
+func (tm *Data) reapTopic(name string) {
+	if err := tm.removeTopic(name, true); err == nil {
+		tm.log.Infof("topic %s has been idle for %s, removed", name, tm.idleTimeout)
+		tm.journal(&walRecord{Op: WAL_REMOVE_TOPIC, Topic: name})
+	}
+}
+
+// 主题变空时，为隐式创建的主题设置回收任务
+func (tm *Data) idle(now int64, topic *Topic) {
+	topic.RLock()
+	implicit := topic.implicit
+	topic.RUnlock()
+	if implicit && topic.Empty() {
+		tm.scheduler.Reset(topic.name, 0, now+int64(tm.idleTimeout), REMOVE_IDLE_TOPIC)
+	}
 }
 
 // 获取主题
@@ -49,7 +100,7 @@ func (tm *Data) getTopic(name string) (*Topic, error) {
 	return topic, nil
 }
 
-// 获取主题，若主题不存在则创建主题
+// 获取主题，若主题不存在则隐式创建主题
 //
 //	加写锁
 func (tm *Data) getXTopic(name string) (*Topic, error) {
@@ -60,8 +111,9 @@ func (tm *Data) getXTopic(name string) (*Topic, error) {
 	tm.Lock()
 	defer tm.Unlock()
 	if topic, ok = tm.topics[name]; !ok {
-		fmt.Println("-----------------", name, "-----------------")
-		topic = NewTopic(tm.log)
+		tm.log.Infof("topic %s created implicitly", name)
+		topic = NewTopic(name, tm.scheduler, tm.prober)
+		topic.implicit = true
 		tm.topics[name] = topic
 	}
 	return topic, nil
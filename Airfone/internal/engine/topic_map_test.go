@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/conf"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// 隐式创建的主题变空之后经过 idleTimeout 被回收，期间有 service 加入则不回收
+func TestIdleTopicReaped(t *testing.T) {
+	var (
+		data = newTestData(t, &conf.Data{TopicIdleTimeout: durationpb.New(20 * time.Millisecond)})
+		now  = time.Now().UnixNano()
+		s    = register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	)
+	if _, err := data.RemoveService("log", now, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := data.getTopic("log"); errorpb.IsSearchInvalid(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle topic not reaped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// 回收任务到期之前重新加入 service
+	s = register(t, data, "common", time.Now().UnixNano(), &Service{IP: "10.0.0.1", Port: 80})
+	if _, err := data.RemoveService("common", time.Now().UnixNano(), s.ID); err != nil {
+		t.Fatal(err)
+	}
+	register(t, data, "common", time.Now().UnixNano(), &Service{IP: "10.0.0.2", Port: 80})
+	time.Sleep(60 * time.Millisecond)
+	if _, err := data.getTopic("common"); err != nil {
+		t.Errorf("topic with a service reaped: %v", err)
+	}
+}
+
+// 显式创建的主题不会被回收，只能在为空时移除
+func TestExplicitTopic(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+	)
+	if _, err := data.CreateTopic("log", &TopicAttr{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.CreateTopic("log", nil); !errorpb.IsInsertAlreadyExist(err) {
+		t.Errorf("create existing topic error = %v, want INSERT_ALREADY_EXIST", err)
+	}
+	s := register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	if err := data.RemoveTopic("log"); !errorpb.IsTopicNotEmpty(err) {
+		t.Errorf("remove non-empty topic error = %v, want TOPIC_NOT_EMPTY", err)
+	}
+	if _, err := data.RemoveService("log", now, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	data.reapTopic("log")
+	if _, err := data.getTopic("log"); err != nil {
+		t.Fatalf("explicit topic reaped: %v", err)
+	}
+	if err := data.RemoveTopic("log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.RemoveTopic("log"); !errorpb.IsDeleteInvalid(err) {
+		t.Errorf("remove missing topic error = %v, want DELETE_INVALID", err)
+	}
+
+	// 隐式创建的主题被显式创建后转为显式主题
+	s = register(t, data, "common", now, &Service{IP: "10.0.0.1", Port: 80})
+	if _, err := data.CreateTopic("common", &TopicAttr{Selector: SELECTOR_P2C}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.RemoveService("common", now, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	data.reapTopic("common")
+	topic, err := data.getTopic("common")
+	if err != nil {
+		t.Fatalf("converted topic reaped: %v", err)
+	}
+	if topic.Attr().Selector != SELECTOR_P2C {
+		t.Errorf("selector = %q, want %q", topic.Attr().Selector, SELECTOR_P2C)
+	}
+}
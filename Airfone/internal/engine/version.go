@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"strconv"
+	"strings"
+
+	"Airfone/api/errorpb"
+)
+
+// 版本约束
+//
+//	提供者注册时可以携带语义化版本(如 2.1.3、v2.1.3-rc.1)，消费者声明依赖时可以在 topic 后附加版本约束，
+//	如 log@^2.1，只选择版本满足约束的提供者，避免不兼容的发布一次性影响全部消费者
+//	支持的约束:
+//	1. ^2.1.3: 主版本号不变，>=2.1.3 <3.0.0；主版本号为 0 时次版本号不变，^0.2.1 即 >=0.2.1 <0.3.0
+//	2. ~2.1.3: 次版本号不变，>=2.1.3 <2.2.0；~2 即 >=2.0.0 <3.0.0
+//	3. >=、>、<=、<、= 与不带运算符的版本，缺少的部分视为通配，如 2.1 即 >=2.1.0 <2.2.0，>2.1 即 >=2.2.0
+//	4. * 或 x 表示任意版本
+//	以空格或逗号分隔的条件之间为且，|| 分隔的条件之间为或，如 >=1.4 <2 || ^3
+//	没有版本的提供者不满足任何非通配的约束
+//	预发布版本按语义化版本的规则排序，低于对应的正式版本；与 npm 一致，预发布版本只有在约束中的某个条件
+//	同样是预发布版本且主、次、修订号相同时才可能满足，如 ^2.1 不满足 3.0.0-rc.1 与 2.2.0-rc.1，>=3.0.0-rc.1 满足 3.0.0-rc.2
+
+// 语义化版本
+type semver struct {
+	Major, Minor, Patch uint64
+	Pre                 []string // 预发布标识，如 rc.1 拆分为 [rc 1]
+}
+
+// 解析版本，允许 v 前缀，忽略构建信息(+ 之后的部分)
+func parseVersion(s string) (*semver, error) {
+	v, n, err := parsePartial(s)
+	if err != nil {
+		return nil, err
+	}
+	// 提供者的版本不能带有通配
+	if n == 0 || strings.ContainsAny(strings.SplitN(s, "-", 2)[0], "xX*") {
+		return nil, errorpb.ErrorVersionInvalid("invalid version: %q", s)
+	}
+	return v, nil
+}
+
+// 解析可能缺少次版本号、修订号的版本，返回给出的部分数(0~3)，x、X、* 视为缺少
+func parsePartial(s string) (*semver, int, error) {
+	var (
+		v   = &semver{}
+		raw = s
+	)
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		if s[i+1:] == "" {
+			return nil, 0, errorpb.ErrorVersionInvalid("invalid version: %q", raw)
+		}
+		v.Pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return nil, 0, errorpb.ErrorVersionInvalid("invalid version: %q", raw)
+	}
+	n := 0
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			continue
+		}
+		if n < i {
+			// 通配之后只能是通配，如 2.x.x
+			return nil, 0, errorpb.ErrorVersionInvalid("invalid version: %q", raw)
+		}
+		num, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return nil, 0, errorpb.ErrorVersionInvalid("invalid version: %q", raw)
+		}
+		switch i {
+		case 0:
+			v.Major = num
+		case 1:
+			v.Minor = num
+		case 2:
+			v.Patch = num
+		}
+		n++
+	}
+	if v.Pre != nil && n < 3 {
+		return nil, 0, errorpb.ErrorVersionInvalid("invalid version: %q", raw)
+	}
+	return v, n, nil
+}
+
+func (v *semver) String() string {
+	s := strconv.FormatUint(v.Major, 10) + "." + strconv.FormatUint(v.Minor, 10) + "." + strconv.FormatUint(v.Patch, 10)
+	if len(v.Pre) > 0 {
+		s += "-" + strings.Join(v.Pre, ".")
+	}
+	return s
+}
+
+// 比较两个版本，返回 -1、0 或 1
+func (v *semver) compare(o *semver) int {
+	for _, d := range [][2]uint64{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if d[0] != d[1] {
+			return cmpUint(d[0], d[1])
+		}
+	}
+	// 正式版本高于预发布版本
+	switch {
+	case len(v.Pre) == 0 && len(o.Pre) == 0:
+		return 0
+	case len(v.Pre) == 0:
+		return 1
+	case len(o.Pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Pre) && i < len(o.Pre); i++ {
+		if c := comparePre(v.Pre[i], o.Pre[i]); c != 0 {
+			return c
+		}
+	}
+	return cmpUint(uint64(len(v.Pre)), uint64(len(o.Pre)))
+}
+
+// 比较预发布标识，数字标识按数值比较且低于非数字标识
+func comparePre(a, b string) int {
+	na, ea := strconv.ParseUint(a, 10, 64)
+	nb, eb := strconv.ParseUint(b, 10, 64)
+	switch {
+	case ea == nil && eb == nil:
+		return cmpUint(na, nb)
+	case ea == nil:
+		return -1
+	case eb == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func cmpUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// 单个比较条件
+type comparator struct {
+	op string // >=、>、<=、<、=
+	v  *semver
+}
+
+func (c *comparator) matches(v *semver) bool {
+	r := v.compare(c.v)
+	switch c.op {
+	case ">=":
+		return r >= 0
+	case ">":
+		return r > 0
+	case "<=":
+		return r <= 0
+	case "<":
+		return r < 0
+	}
+	return r == 0
+}
+
+// 版本约束，以文本形式持久化
+type VersionConstraint struct {
+	raw  string
+	alts [][]*comparator // 或的关系，每一项中的条件之间为且，为空表示任意版本
+}
+
+// 解析版本约束
+func parseConstraint(s string) (*VersionConstraint, error) {
+	c := &VersionConstraint{raw: strings.TrimSpace(s)}
+	for _, alt := range strings.Split(c.raw, "||") {
+		var cmps = make([]*comparator, 0, 2)
+		for _, term := range strings.FieldsFunc(alt, func(r rune) bool { return r == ' ' || r == ',' }) {
+			parsed, err := parseComparator(term)
+			if err != nil {
+				return nil, err
+			}
+			cmps = append(cmps, parsed...)
+		}
+		if len(cmps) == 0 && strings.TrimSpace(alt) == "" && c.raw != "" {
+			return nil, errorpb.ErrorVersionInvalid("invalid version constraint: %q", s)
+		}
+		c.alts = append(c.alts, cmps)
+	}
+	return c, nil
+}
+
+// 将一个条件展开为比较条件，如 ^2.1 展开为 >=2.1.0 <3.0.0
+func parseComparator(term string) ([]*comparator, error) {
+	var op string
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(term, prefix) {
+			op, term = prefix, term[len(prefix):]
+			break
+		}
+	}
+	if term == "" {
+		return nil, errorpb.ErrorVersionInvalid("invalid version constraint: %q", op)
+	}
+	v, n, err := parsePartial(term)
+	if err != nil {
+		return nil, errorpb.ErrorVersionInvalid("invalid version constraint: %q", op+term)
+	}
+	if n == 0 {
+		// 通配，> 与 < 没有版本满足
+		if op == ">" || op == "<" {
+			return []*comparator{{op: "<", v: &semver{}}}, nil
+		}
+		return nil, nil
+	}
+	lower := &comparator{op: ">=", v: v}
+	switch op {
+	case "^":
+		switch {
+		case v.Major > 0 || n == 1:
+			return []*comparator{lower, {op: "<", v: &semver{Major: v.Major + 1}}}, nil
+		case v.Minor > 0 || n == 2:
+			return []*comparator{lower, {op: "<", v: &semver{Minor: v.Minor + 1}}}, nil
+		}
+		return []*comparator{lower, {op: "<", v: &semver{Patch: v.Patch + 1}}}, nil
+	case "~":
+		if n == 1 {
+			return []*comparator{lower, {op: "<", v: &semver{Major: v.Major + 1}}}, nil
+		}
+		return []*comparator{lower, {op: "<", v: &semver{Major: v.Major, Minor: v.Minor + 1}}}, nil
+	case ">", "<=":
+		if n < 3 {
+			// 缺少的部分为通配，>2.1 即 >=2.2.0，<=2.1 即 <2.2.0
+			next := bump(v, n)
+			if op == ">" {
+				return []*comparator{{op: ">=", v: next}}, nil
+			}
+			return []*comparator{{op: "<", v: next}}, nil
+		}
+		return []*comparator{{op: op, v: v}}, nil
+	case ">=", "<":
+		return []*comparator{{op: op, v: v}}, nil
+	}
+	// = 与不带运算符的版本
+	if n < 3 {
+		return []*comparator{lower, {op: "<", v: bump(v, n)}}, nil
+	}
+	return []*comparator{{op: "=", v: v}}, nil
+}
+
+// 给出 n 个部分的版本的下一个版本，如 2.1 的下一个版本为 2.2.0
+func bump(v *semver, n int) *semver {
+	if n == 1 {
+		return &semver{Major: v.Major + 1}
+	}
+	return &semver{Major: v.Major, Minor: v.Minor + 1}
+}
+
+// 版本是否满足约束
+//
+//	version 为空或无法解析时只满足通配的约束
+func (c *VersionConstraint) Matches(version string) bool {
+	v, err := parseVersion(version)
+	for _, alt := range c.alts {
+		if len(alt) == 0 {
+			return true
+		}
+		if err != nil {
+			continue
+		}
+		ok := len(v.Pre) == 0 || allowPre(alt, v)
+		for _, cmp := range alt {
+			if !ok {
+				break
+			}
+			ok = cmp.matches(v)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 预发布版本是否可以参与比较，需要有条件是相同主、次、修订号的预发布版本
+func allowPre(alt []*comparator, v *semver) bool {
+	for _, cmp := range alt {
+		if len(cmp.v.Pre) > 0 && cmp.v.Major == v.Major && cmp.v.Minor == v.Minor && cmp.v.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *VersionConstraint) String() string {
+	return c.raw
+}
+
+func (c *VersionConstraint) MarshalText() ([]byte, error) {
+	return []byte(c.raw), nil
+}
+
+func (c *VersionConstraint) UnmarshalText(b []byte) error {
+	parsed, err := parseConstraint(string(b))
+	if err != nil {
+		return err
+	}
+	*c = *parsed
+	return nil
+}
@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"testing"
+
+	"Airfone/api/errorpb"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string // 规范化后的文本形式，为空表示不合法
+	}{
+		{"2.1.3", "2.1.3"},
+		{"v2.1.3", "2.1.3"},
+		{" 2.1.3 ", "2.1.3"},
+		{"2.1.3+build.7", "2.1.3"},
+		{"2.1.3-rc.1", "2.1.3-rc.1"},
+		{"v2.1.3-rc.1+build", "2.1.3-rc.1"},
+		{"2.1.3-x", "2.1.3-x"},
+		{"2", "2.0.0"},
+		{"2.1", "2.1.0"},
+		{"", ""},
+		{"v", ""},
+		{"2.x", ""},
+		{"*", ""},
+		{"2.1.3.4", ""},
+		{"2.1-rc.1", ""},
+		{"2.1.3-", ""},
+		{"a.b.c", ""},
+		{"-1.0.0", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			v, err := parseVersion(tt.version)
+			if tt.want == "" {
+				if !errorpb.IsVersionInvalid(err) {
+					t.Fatalf("parseVersion(%q) = %v, %v, want VERSION_INVALID", tt.version, v, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVersion(%q): %v", tt.version, err)
+			}
+			if got := v.String(); got != tt.want {
+				t.Errorf("parseVersion(%q) = %s, want %s", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+// 按语义化版本规范中的例子排序
+func TestVersionCompare(t *testing.T) {
+	ordered := []string{
+		"0.9.9",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.1.0",
+		"1.10.0",
+		"2.0.0",
+	}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			va, _ := parseVersion(a)
+			vb, _ := parseVersion(b)
+			want := cmpUint(uint64(i), uint64(j))
+			if got := va.compare(vb); got != want {
+				t.Errorf("compare(%s, %s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestVersionConstraintMatches(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		// ^
+		{"^2.1.3", "2.1.3", true},
+		{"^2.1.3", "2.9.0", true},
+		{"^2.1.3", "2.1.2", false},
+		{"^2.1.3", "3.0.0", false},
+		{"^2.1", "2.1.0", true},
+		{"^2", "2.99.99", true},
+		{"^0.2.1", "0.2.9", true},
+		{"^0.2.1", "0.3.0", false},
+		{"^0.0.3", "0.0.3", true},
+		{"^0.0.3", "0.0.4", false},
+		{"^0", "0.9.0", true},
+		{"^0", "1.0.0", false},
+		// ~
+		{"~2.1.3", "2.1.9", true},
+		{"~2.1.3", "2.2.0", false},
+		{"~2", "2.9.0", true},
+		{"~2", "3.0.0", false},
+		// 比较运算符与部分版本
+		{">=2.1", "2.1.0", true},
+		{">=2.1", "2.0.9", false},
+		{">2.1", "2.1.9", false},
+		{">2.1", "2.2.0", true},
+		{">2.1.3", "2.1.4", true},
+		{"<=2.1", "2.1.9", true},
+		{"<=2.1", "2.2.0", false},
+		{"<2.1", "2.0.9", true},
+		{"<2.1", "2.1.0", false},
+		{"=2.1.3", "2.1.3", true},
+		{"=2.1.3", "2.1.4", false},
+		{"2.1", "2.1.7", true},
+		{"2.1", "2.2.0", false},
+		{"2.x", "2.5.1", true},
+		{"2.x", "3.0.0", false},
+		{"v2.1.3", "2.1.3", true},
+		// 通配
+		{"*", "1.0.0", true},
+		{"x", "", true},
+		{"*", "not-a-version", true},
+		{">*", "1.0.0", false},
+		// 且与或
+		{">=1.4 <2", "1.5.0", true},
+		{">=1.4 <2", "2.0.0", false},
+		{">=1.4,<2", "1.3.0", false},
+		{">=1.4 <2 || ^3", "3.2.0", true},
+		{">=1.4 <2 || ^3", "2.5.0", false},
+		// 没有版本或版本不合法的提供者
+		{"^2", "", false},
+		{"^2", "latest", false},
+		// 预发布版本
+		{"^2.1", "2.2.0-rc.1", false},
+		{"^2.1", "3.0.0-rc.1", false},
+		{">=3.0.0-rc.1", "3.0.0-rc.2", true},
+		{">=3.0.0-rc.1", "3.0.0", true},
+		{">=3.0.0-rc.1", "3.0.1-rc.1", false},
+		{"^2.1.3-rc.1", "2.1.3-rc.2", true},
+		{"^2.1.3-rc.1", "2.1.3-beta", false},
+		{"^2.1.3-rc.1", "2.1.4-rc.1", false},
+		{"^2.1.3-rc.1", "2.5.0", true},
+		{"^2 || >=3.0.0-rc.1", "3.0.0-rc.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint+" "+tt.version, func(t *testing.T) {
+			c, err := parseConstraint(tt.constraint)
+			if err != nil {
+				t.Fatalf("parseConstraint(%q): %v", tt.constraint, err)
+			}
+			if got := c.Matches(tt.version); got != tt.want {
+				t.Errorf("%q matches %q = %v, want %v", tt.constraint, tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConstraintInvalid(t *testing.T) {
+	for _, constraint := range []string{
+		">=",
+		"^",
+		"^a",
+		"~2.x.1",
+		"1.2.3.4",
+		"2.1-rc.1",
+		">=1 ||",
+		"|| ^2",
+		">=1 || || ^2",
+	} {
+		t.Run(constraint, func(t *testing.T) {
+			if _, err := parseConstraint(constraint); !errorpb.IsVersionInvalid(err) {
+				t.Errorf("parseConstraint(%q) error = %v, want VERSION_INVALID", constraint, err)
+			}
+		})
+	}
+}
+
+// 约束以文本形式持久化，恢复后行为不变
+func TestVersionConstraintText(t *testing.T) {
+	c, err := parseConstraint(" >=1.4 <2 || ^3 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored VersionConstraint
+	if err = restored.UnmarshalText(b); err != nil {
+		t.Fatal(err)
+	}
+	if restored.String() != ">=1.4 <2 || ^3" {
+		t.Errorf("restored = %q", restored.String())
+	}
+	for _, version := range []string{"1.4.0", "2.0.0", "3.1.0"} {
+		if restored.Matches(version) != c.Matches(version) {
+			t.Errorf("restored constraint differs on %s", version)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// 监听
+//
+//	消费者不再只能通过心跳轮询得知依赖的变化，可以监听一组主题，在 data 修改它们时立即收到事件
+//	思路: 所有修改 data 的操作都会写一条 wal 记录(见 store.go)，follower 也会重放同样的记录，
+//	因此在写记录(journal)与重放记录(replay)时将记录转换为事件，分配递增的 revision，
+//	放入环形的历史记录中，再推送给监听了该主题的 watcher
+//
+//	断线重连时携带最后收到的 revision，仍在历史记录中则补发之后的事件，
+//	否则(太旧，或来自其他节点、重启之前)先推送 RESET，再推送当前全部 service，最后以 SYNCED 结束
+//	revision 只在一个节点的一次运行中有效，起始值为启动时距 ID_EPOCH_BASE 的毫秒数左移 22 位，
+//	不同节点、不同次运行的 revision 几乎不会重叠，重叠之外的 revision 都会触发 RESET
+const (
+	WATCH_HISTORY = 4096 // 保留的历史事件数
+	WATCH_BUFFER  = 256  // 每个 watcher 的事件缓冲，缓冲满时断开该 watcher，由客户端从最后的 revision 重新监听
+)
+
+// 事件类型
+type WatchEventType uint8
+
+const (
+	WATCH_PUT    WatchEventType = iota // service 注册或属性变化，携带完整的 service
+	WATCH_DELETE                       // service 被删除(注销或超时)
+	WATCH_STATUS                       // service 状态变化(running/pending)
+	WATCH_RESET                        // 无法从请求的 revision 继续，客户端需要清空该主题的本地状态
+	WATCH_SYNCED                       // 当前全部 service 已经推送完毕，之后都是实时事件
+)
+
+// 事件
+//
+//	RESET 与全量推送的 PUT 事件 revision 为 0，客户端只记录不为 0 的 revision
+type WatchEvent struct {
+	Revision int64          // 版本
+	Type     WatchEventType // 类型
+	Topic    string         // 主题
+	ID       int64          // service id
+	Status   HeartBeatType  // 状态
+	Service  *Service       // PUT 事件中的 service，是一份拷贝
+}
+
+// 监听者
+type Watcher struct {
+	lock    sync.Mutex
+	hub     *watchHub
+	topics  map[string]bool  // 监听的主题
+	events  chan *WatchEvent // 推送给调用方的事件
+	syncing bool             // 正在推送全量 service，期间的实时事件先暂存
+	pending []*WatchEvent    // 全量推送期间暂存的实时事件
+	closed  bool
+}
+
+type watchHub struct {
+	sync.Mutex
+	revision int64                 // 最后分配的 revision
+	history  []*WatchEvent         // 环形历史记录
+	next     int                   // 下一个事件在 history 中的位置
+	watchers map[*Watcher]struct{} // 全部 watcher
+}
+
+func newWatchHub(now time.Time) *watchHub {
+	return &watchHub{
+		revision: int64(now.Sub(ID_EPOCH_BASE)/time.Millisecond) << ID_SEQ_BITS,
+		history:  make([]*WatchEvent, 0, WATCH_HISTORY),
+		watchers: make(map[*Watcher]struct{}),
+	}
+}
+
+// 历史记录中最早的 revision
+func (h *watchHub) oldest() int64 {
+	if len(h.history) < WATCH_HISTORY {
+		return h.revision - int64(len(h.history)) + 1
+	}
+	return h.history[h.next].Revision
+}
+
+// 分配 revision，记录并推送事件
+func (h *watchHub) publish(ev *WatchEvent) {
+	h.Lock()
+	defer h.Unlock()
+	h.revision++
+	ev.Revision = h.revision
+	if len(h.history) < WATCH_HISTORY {
+		h.history = append(h.history, ev)
+	} else {
+		h.history[h.next] = ev
+		h.next = (h.next + 1) % WATCH_HISTORY
+	}
+	for w := range h.watchers {
+		if w.topics[ev.Topic] {
+			w.send(ev)
+		}
+	}
+}
+
+// 丢弃历史记录，并断开全部 watcher
+//
+//	data 的状态被整体替换(从 raft 快照恢复)时调用，客户端重连后会收到 RESET 与全量 service
+func (h *watchHub) reset() {
+	h.Lock()
+	defer h.Unlock()
+	h.history = h.history[:0]
+	h.next = 0
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		w.lock.Lock()
+		w.close()
+		w.lock.Unlock()
+	}
+}
+
+// 将记录转换为事件并推送
+func (data *Data) notify(rec *walRecord) {
+	var ev = &WatchEvent{Topic: rec.Topic, ID: rec.ID, Status: rec.Status}
+	switch rec.Op {
+	case WAL_PUT:
+		if rec.Service == nil {
+			return
+		}
+		ev.Type = WATCH_PUT
+		ev.ID = rec.Service.ID
+		ev.Status = rec.Service.Status
+		ev.Service = rec.Service.service()
+		for topic, id := range rec.Service.Relies {
+			ev.Service.Rely = append(ev.Service.Rely, &Rely{Topic: topic, ID: id})
+		}
+	case WAL_DELETE:
+		ev.Type = WATCH_DELETE
+		ev.Status = HeartBeat_DROPPED
+	case WAL_STATUS:
+		ev.Type = WATCH_STATUS
+	default:
+		return
+	}
+	data.watch.publish(ev)
+}
+
+// 监听一组主题
+//
+//	revision 为最后收到的 revision，为 0 则先推送当前全部 service，小于 0 则只推送之后的事件
+func (data *Data) Watch(topics []string, revision int64) *Watcher {
+	var (
+		h       = data.watch
+		backlog = make([]*WatchEvent, 0)
+		w       = &Watcher{
+			hub:    h,
+			topics: make(map[string]bool, len(topics)),
+		}
+	)
+	for _, t := range topics {
+		w.topics[t] = true
+	}
+	h.Lock()
+	if revision < 0 {
+		// 只需要之后的事件
+	} else if revision > 0 && revision >= h.oldest()-1 && revision <= h.revision {
+		for i := 0; i < len(h.history); i++ {
+			ev := h.history[(h.next+i)%len(h.history)]
+			if ev.Revision > revision && w.topics[ev.Topic] {
+				backlog = append(backlog, ev)
+			}
+		}
+	} else {
+		w.syncing = true
+	}
+	w.events = make(chan *WatchEvent, WATCH_BUFFER+len(backlog))
+	for _, ev := range backlog {
+		w.events <- ev
+	}
+	h.watchers[w] = struct{}{}
+	synced := h.revision
+	h.Unlock()
+
+	if w.syncing {
+		data.sync(w, revision > 0, synced)
+	}
+	return w
+}
+
+// 全量推送
+//
+//	在 hub 锁之外读取 data，期间的实时事件暂存在 pending 中，推送完全量 service 后再补发
+func (data *Data) sync(w *Watcher, reset bool, revision int64) {
+	var events = make([]*WatchEvent, 0)
+	for topic := range w.topics {
+		if reset {
+			events = append(events, &WatchEvent{Type: WATCH_RESET, Topic: topic})
+		}
+		t, err := data.getTopic(topic)
+		if err != nil {
+			continue
+		}
+		for _, m := range []*ServiceMap{t.running, t.pending} {
+			m.RLock()
+			for _, s := range m.services {
+				r := newServiceRecord(topic, s)
+				events = append(events, &WatchEvent{
+					Type:    WATCH_PUT,
+					Topic:   topic,
+					ID:      s.ID,
+					Status:  r.Status,
+					Service: r.service(),
+				})
+			}
+			m.RUnlock()
+		}
+	}
+	events = append(events, &WatchEvent{Revision: revision, Type: WATCH_SYNCED})
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	// 全量推送的事件数不受缓冲限制，与暂存的事件一起放入新的通道
+	var events2 = make(chan *WatchEvent, WATCH_BUFFER+len(events)+len(w.pending))
+	for _, ev := range events {
+		events2 <- ev
+	}
+	for _, ev := range w.pending {
+		events2 <- ev
+	}
+	w.events = events2
+	w.pending = nil
+	w.syncing = false
+}
+
+// 推送事件，缓冲满时断开
+//
+//	调用方持有 hub 锁
+func (w *Watcher) send(ev *WatchEvent) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	if w.syncing {
+		w.pending = append(w.pending, ev)
+		return
+	}
+	select {
+	case w.events <- ev:
+	default:
+		delete(w.hub.watchers, w)
+		w.close()
+	}
+}
+
+// 调用方持有 w.lock
+func (w *Watcher) close() {
+	if !w.closed {
+		w.closed = true
+		close(w.events)
+	}
+}
+
+// 事件通道
+//
+//	通道被关闭表示 watcher 被断开(消费过慢，或 data 的状态被整体替换)，需要从最后的 revision 重新监听
+func (w *Watcher) Events() <-chan *WatchEvent {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.events
+}
+
+// 停止监听
+func (w *Watcher) Close() {
+	w.hub.Lock()
+	defer w.hub.Unlock()
+	delete(w.hub.watchers, w)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.close()
+}
+
+// 历史事件
+//
+//	返回历史记录中 revision 大于 after 的事件(最多 limit 个)，以及当前的 revision
+//	不需要持续监听的调用方(如监控页面)通过轮询获取变化，after 已经不在历史记录中时从最早的事件开始
+func (data *Data) History(after int64, limit int) ([]*WatchEvent, int64) {
+	var (
+		h      = data.watch
+		events = make([]*WatchEvent, 0)
+	)
+	h.Lock()
+	defer h.Unlock()
+	for i := 0; i < len(h.history) && len(events) < limit; i++ {
+		ev := h.history[(h.next+i)%len(h.history)]
+		if ev.Revision > after {
+			events = append(events, ev)
+		}
+	}
+	return events, h.revision
+}
@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// 取出通道中已有的事件
+func drain(w *Watcher) []*WatchEvent {
+	var events []*WatchEvent
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+func eventTypes(events []*WatchEvent) []WatchEventType {
+	types := make([]WatchEventType, len(events))
+	for i, ev := range events {
+		types[i] = ev.Type
+	}
+	return types
+}
+
+func equalTypes(a, b []WatchEventType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 从最后收到的 revision 继续监听，只补发之后的、监听的主题中的事件
+func TestWatchResume(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+		w    = data.Watch([]string{"log"}, -1)
+	)
+	defer w.Close()
+	a := register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	events := drain(w)
+	if len(events) != 1 || events[0].Type != WATCH_PUT || events[0].ID != a.ID {
+		t.Fatalf("events = %v, want the put of %d", eventTypes(events), a.ID)
+	}
+	last := events[0].Revision
+
+	register(t, data, "common", now, &Service{IP: "10.0.0.2", Port: 80})
+	if err := data.Disconnect(now, "log", a.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.RemoveService("log", now, a.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := data.Watch([]string{"log"}, last)
+	defer resumed.Close()
+	events = drain(resumed)
+	if got := eventTypes(events); !equalTypes(got, []WatchEventType{WATCH_STATUS, WATCH_DELETE}) {
+		t.Fatalf("resumed events = %v, want status and delete", got)
+	}
+	if events[0].Status != HeartBeat_PENDING || events[0].Revision <= last || events[1].Revision <= events[0].Revision {
+		t.Errorf("resumed events %+v %+v", events[0], events[1])
+	}
+	// 与实时推送的事件一致
+	if live := drain(w); len(live) != 2 || live[0].Revision != events[0].Revision || live[1].Revision != events[1].Revision {
+		t.Errorf("live events %v differ from resumed ones", eventTypes(live))
+	}
+	if events = drain(data.Watch([]string{"log"}, events[1].Revision)); len(events) != 0 {
+		t.Errorf("watch from the latest revision got %v", eventTypes(events))
+	}
+}
+
+// 无法从请求的 revision 继续时，先 RESET 再推送当前全部 service，以 SYNCED 结束
+func TestWatchSync(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+	)
+	register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	register(t, data, "log", now, &Service{IP: "10.0.0.2", Port: 80})
+	current := data.watch.revision
+	tests := []struct {
+		name     string
+		revision int64
+		want     []WatchEventType
+	}{
+		{"from scratch", 0, []WatchEventType{WATCH_PUT, WATCH_PUT, WATCH_SYNCED}},
+		{"unknown revision", current + 100, []WatchEventType{WATCH_RESET, WATCH_PUT, WATCH_PUT, WATCH_SYNCED}},
+		{"another run", 1, []WatchEventType{WATCH_RESET, WATCH_PUT, WATCH_PUT, WATCH_SYNCED}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := data.Watch([]string{"log"}, tt.revision)
+			defer w.Close()
+			events := drain(w)
+			if got := eventTypes(events); !equalTypes(got, tt.want) {
+				t.Fatalf("events = %v, want %v", got, tt.want)
+			}
+			if synced := events[len(events)-1]; synced.Revision != current {
+				t.Errorf("synced revision = %d, want %d", synced.Revision, current)
+			}
+		})
+	}
+}
+
+// 消费过慢的 watcher 被断开
+func TestWatchSlowConsumer(t *testing.T) {
+	var (
+		data = newTestData(t, nil)
+		now  = time.Now().UnixNano()
+		w    = data.Watch([]string{"log"}, -1)
+	)
+	defer w.Close()
+	s := register(t, data, "log", now, &Service{IP: "10.0.0.1", Port: 80})
+	for i := 0; i < WATCH_BUFFER; i++ {
+		if _, err := data.UpdateService("log", now, &Service{ID: s.ID, Weight: uint32(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events := drain(w); len(events) != WATCH_BUFFER {
+		t.Errorf("got %d events, want %d", len(events), WATCH_BUFFER)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Error("slow watcher not closed")
+	}
+}
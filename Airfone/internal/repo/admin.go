@@ -0,0 +1,64 @@
+package repo
+
+import (
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type adminRepo struct {
+	data *engine.Data
+	log  *log.Helper
+}
+
+// NewAdminRepo .
+func NewAdminRepo(data *engine.Data, logger *log.Helper) irepo.AdminRepo {
+	return &adminRepo{
+		data: data,
+		log:  logger,
+	}
+}
+
+func (repo *adminRepo) Topics(ctx context.Context) ([]*irepo.TopicInfo, error) {
+	var (
+		topics = repo.data.Topics()
+		res    = make([]*irepo.TopicInfo, len(topics))
+	)
+	for i, t := range topics {
+		res[i] = &irepo.TopicInfo{TopicInfo: t}
+	}
+	return res, nil
+}
+
+func (repo *adminRepo) Graph(ctx context.Context) ([]*irepo.TopicEdge, error) {
+	var (
+		edges = repo.data.Graph()
+		res   = make([]*irepo.TopicEdge, len(edges))
+	)
+	for i, e := range edges {
+		res[i] = &irepo.TopicEdge{TopicEdge: e}
+	}
+	return res, nil
+}
+
+func (repo *adminRepo) Describe(ctx context.Context, topic string, id int64) (*irepo.Instance, int32, error) {
+	instance, load, err := repo.data.Describe(topic, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &irepo.Instance{Instance: instance}, load, nil
+}
+
+func (repo *adminRepo) Evict(ctx context.Context, now int64, topic string, id int64) error {
+	return repo.data.Evict(now, topic, id)
+}
+
+func (repo *adminRepo) Move(ctx context.Context, now int64, topic string, id int64, status engine.HeartBeatType) error {
+	return repo.data.Move(now, topic, id, status)
+}
+
+func (repo *adminRepo) Flush(ctx context.Context, now int64, topic string) (int, error) {
+	return repo.data.Flush(now, topic)
+}
@@ -0,0 +1,26 @@
+package repo
+
+import (
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type clusterRepo struct {
+	data *engine.Data
+	log  *log.Helper
+}
+
+// NewClusterRepo .
+func NewClusterRepo(data *engine.Data, logger *log.Helper) irepo.ClusterRepo {
+	return &clusterRepo{
+		data: data,
+		log:  logger,
+	}
+}
+
+func (repo *clusterRepo) Leader(ctx context.Context) (string, bool) {
+	return repo.data.Leader()
+}
@@ -0,0 +1,33 @@
+package repo
+
+import (
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type discoverRepo struct {
+	data *engine.Data
+	log  *log.Helper
+}
+
+// NewDiscoverRepo .
+func NewDiscoverRepo(data *engine.Data, logger *log.Helper) irepo.DiscoverRepo {
+	return &discoverRepo{
+		data: data,
+		log:  logger,
+	}
+}
+
+func (repo *discoverRepo) Discover(ctx context.Context, topics []string, filter *irepo.DiscoverFilter) ([]*irepo.Instance, error) {
+	var (
+		instances = repo.data.Lookup(topics, filter.LookupFilter)
+		res       = make([]*irepo.Instance, len(instances))
+	)
+	for i, instance := range instances {
+		res[i] = &irepo.Instance{Instance: instance}
+	}
+	return res, nil
+}
@@ -0,0 +1,33 @@
+package repo
+
+import (
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type eventRepo struct {
+	data *engine.Data
+	log  *log.Helper
+}
+
+// NewEventRepo .
+func NewEventRepo(data *engine.Data, logger *log.Helper) irepo.EventRepo {
+	return &eventRepo{
+		data: data,
+		log:  logger,
+	}
+}
+
+func (repo *eventRepo) ListEvents(ctx context.Context, filter *irepo.EventFilter) ([]*irepo.Event, error) {
+	var (
+		events = repo.data.Events(filter.EventFilter)
+		res    = make([]*irepo.Event, len(events))
+	)
+	for i, ev := range events {
+		res[i] = &irepo.Event{Event: ev}
+	}
+	return res, nil
+}
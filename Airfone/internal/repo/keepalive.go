@@ -33,3 +33,23 @@ func (repo *keepAliveRepo) KeepAlive(ctx context.Context, now int64, hb *irepo.H
 func (repo *keepAliveRepo) Conform(ctx context.Context, now int64, hb *irepo.HeartBeat) error {
 	return repo.data.Conform(now, hb.Topic, hb.ID)
 }
+
+func (repo *keepAliveRepo) Connect(ctx context.Context, hb *irepo.HeartBeat) int64 {
+	return repo.data.Connect(hb.Topic, hb.ID)
+}
+
+func (repo *keepAliveRepo) Disconnect(ctx context.Context, now int64, hb *irepo.HeartBeat) error {
+	return repo.data.Disconnect(now, hb.Topic, hb.ID, hb.Session)
+}
+
+func (repo *keepAliveRepo) State(ctx context.Context, now int64, hb *irepo.HeartBeat) *irepo.HeartBeat {
+	return &irepo.HeartBeat{HeartBeat: repo.data.State(now, hb.Topic, hb.ID)}
+}
+
+func (repo *keepAliveRepo) Endpoints(ctx context.Context, now int64, hb *irepo.HeartBeat) (*irepo.HeartBeat, bool) {
+	hb2 := repo.data.Endpoints(now, hb.Topic, hb.ID)
+	if hb2 == nil {
+		return nil, false
+	}
+	return &irepo.HeartBeat{HeartBeat: hb2}, true
+}
@@ -21,22 +21,30 @@ func NewRegisterRepo(data *engine.Data, logger *log.Helper) irepo.RegisterRepo {
 	}
 }
 
-// 服务注册
-func (repo *registerRepo) Register(ctx context.Context, now int64, service *irepo.Service) (*irepo.Service, error) {
-	if s, err := repo.data.AddService(service.Topic, now, service.Service); err != nil {
+// 发现依赖并注册
+func (repo *registerRepo) Register(ctx context.Context, now int64, service *irepo.Service, relies []string) (*irepo.Service, error) {
+	if s, err := repo.data.Register(now, service.Topic, service.Service, relies); err != nil {
 		return nil, err
 	} else {
 		service.Service = s
+		service.Unresolved = repo.data.Unresolved(s.ID, s.Depends)
+		if hb := repo.data.Endpoints(now, service.Topic, s.ID); hb != nil {
+			service.Instances = hb.Instances
+		}
 		return service, nil
 	}
 }
 
 // 服务更新
-func (repo *registerRepo) Update(ctx context.Context, now int64, service *irepo.Service) (*irepo.Service, error) {
-	if s, err := repo.data.UpdateService(service.Topic, now, service.Service); err != nil {
+func (repo *registerRepo) Update(ctx context.Context, now int64, service *irepo.Service, relies []string) (*irepo.Service, error) {
+	if s, err := repo.data.Update(now, service.Topic, service.Service, relies); err != nil {
 		return nil, err
 	} else {
 		service.Service = s
+		service.Unresolved = repo.data.Unresolved(s.ID, s.Depends)
+		if hb := repo.data.Endpoints(now, service.Topic, s.ID); hb != nil {
+			service.Instances = hb.Instances
+		}
 		return service, nil
 	}
 
@@ -48,12 +56,15 @@ func (repo *registerRepo) Logout(ctx context.Context, now int64, service *irepo.
 	return err
 }
 
-// 服务发现
-func (repo *registerRepo) Discover(ctx context.Context, now int64, service *irepo.Service, relies []string) (*irepo.Service, error) {
-	if s, err := repo.data.Discover(now, service.Service, relies); err != nil {
-		return nil, err
-	} else {
-		service.Service = s
-		return service, nil
+// 获取同一实例的同一次注册
+func (repo *registerRepo) Registered(ctx context.Context, service *irepo.Service) (*irepo.Service, bool) {
+	if s, ok := repo.data.Registered(service.Topic, service.Service); ok {
+		return &irepo.Service{Service: s}, true
 	}
+	return nil, false
+}
+
+// 检查服务是否属于 service.Owner
+func (repo *registerRepo) CheckOwner(ctx context.Context, service *irepo.Service) error {
+	return repo.data.CheckOwner(service.Topic, service.ID, service.Owner)
 }
@@ -0,0 +1,37 @@
+package repo
+
+import (
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+type watchRepo struct {
+	data *engine.Data
+	log  *log.Helper
+}
+
+// NewWatchRepo .
+func NewWatchRepo(data *engine.Data, logger *log.Helper) irepo.WatchRepo {
+	return &watchRepo{
+		data: data,
+		log:  logger,
+	}
+}
+
+func (repo *watchRepo) Watch(ctx context.Context, topics []string, revision int64) *irepo.Watcher {
+	return &irepo.Watcher{Watcher: repo.data.Watch(topics, revision)}
+}
+
+func (repo *watchRepo) History(ctx context.Context, after int64, limit int) ([]*irepo.WatchEvent, int64) {
+	var (
+		events, revision = repo.data.History(after, limit)
+		res              = make([]*irepo.WatchEvent, len(events))
+	)
+	for i, ev := range events {
+		res[i] = &irepo.WatchEvent{WatchEvent: ev}
+	}
+	return res, revision
+}
@@ -5,4 +5,9 @@ import "github.com/google/wire"
 var ProviderSet = wire.NewSet(
 	NewRegisterRepo,
 	NewkeepAliveRepoRepo,
+	NewClusterRepo,
+	NewWatchRepo,
+	NewDiscoverRepo,
+	NewAdminRepo,
+	NewEventRepo,
 )
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	pb "Airfone/api/airfone"
+	"Airfone/api/errorpb"
+	"Airfone/internal/auth"
+	"Airfone/internal/conf"
+	"Airfone/internal/service"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/middleware/recovery"
+	"github.com/go-kratos/kratos/v2/transport"
+	"github.com/go-kratos/kratos/v2/transport/grpc"
+)
+
+// 管理接口的 grpc 服务
+//
+//	与对外的 grpc 服务监听在不同的端口上，普通客户端只知道对外的端口，
+//	配置了令牌时还需要携带 authorization: Bearer <token>，
+//	开启认证时也可以携带身份的凭证，只能管理策略中 admin 的主题(见 service/admin.go)
+//	开启 TLS 时与对外服务使用相同的配置，此时也可以以客户端证书认证身份；未开启 TLS 时只接受 authorization 头
+//	未配置监听地址时不开启，Server 为 nil
+type AdminServer struct {
+	*grpc.Server
+}
+
+// NewAdminServer new an admin gRPC server.
+func NewAdminServer(c *conf.Server, logger *log.Helper,
+	t *auth.TLS,
+	admin *service.AdminService,
+) *AdminServer {
+	if c.Admin.GetAddr() == "" {
+		return &AdminServer{}
+	}
+	var opts = []grpc.ServerOption{
+		grpc.Middleware(
+			recovery.Recovery(),
+			adminAuth(c.Admin.Token, auth.New(c.Auth), t.Server != nil),
+		),
+		grpc.Address(c.Admin.Addr),
+	}
+	if c.Admin.Network != "" {
+		opts = append(opts, grpc.Network(c.Admin.Network))
+	}
+	if c.Admin.Timeout != nil {
+		opts = append(opts, grpc.Timeout(c.Admin.Timeout.AsDuration()))
+	}
+	if t.Server != nil {
+		opts = append(opts, grpc.TLSConfig(t.Server))
+	}
+	srv := grpc.NewServer(opts...)
+	pb.RegisterAdminServer(srv, admin)
+	return &AdminServer{Server: srv}
+}
+
+// 校验令牌
+//
+//	管理令牌可以管理全部主题，ctx 中不放入身份；否则在开启认证时认证身份的凭证
+//	certs 为 false(未开启 TLS)时不以客户端证书认证，必须携带 authorization 头
+//	token 为空且未开启认证时不校验
+func adminAuth(token string, a *auth.Authenticator, certs bool) middleware.Middleware {
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			if token == "" && a == nil {
+				return handler(ctx, req)
+			}
+			tr, ok := transport.FromServerContext(ctx)
+			if !ok {
+				return nil, errorpb.ErrorUnauthorized("missing transport")
+			}
+			if token != "" && authorized(token, tr.RequestHeader().Get("authorization")) {
+				return handler(ctx, req)
+			}
+			if a == nil {
+				return nil, errorpb.ErrorUnauthorized("invalid admin token")
+			}
+			if !certs && tr.RequestHeader().Get("authorization") == "" {
+				return nil, errorpb.ErrorUnauthorized("missing credential")
+			}
+			ctx, err := authenticate(ctx, a, nil)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}
+	}
+}
+
+// authorization 头中是否携带了正确的令牌
+func authorized(token, header string) bool {
+	got := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+
+	"Airfone/internal/auth"
+	"Airfone/internal/conf"
+
+	"github.com/go-kratos/kratos/v2/transport"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// 只携带请求头的 transport
+type testTransport struct {
+	header http.Header
+}
+
+func (tr *testTransport) Kind() transport.Kind            { return transport.KindGRPC }
+func (tr *testTransport) Endpoint() string                { return "" }
+func (tr *testTransport) Operation() string               { return "" }
+func (tr *testTransport) RequestHeader() transport.Header { return headerCarrier(tr.header) }
+func (tr *testTransport) ReplyHeader() transport.Header   { return headerCarrier(http.Header{}) }
+
+type headerCarrier http.Header
+
+func (hc headerCarrier) Get(key string) string { return http.Header(hc).Get(key) }
+func (hc headerCarrier) Set(key, value string) { http.Header(hc).Set(key, value) }
+func (hc headerCarrier) Keys() []string        { return nil }
+
+func TestAdminAuth(t *testing.T) {
+	a := auth.New(&conf.Server_Auth{Identities: []*conf.Server_Auth_Identity{
+		{Name: "logsvc", Admin: []string{"log"}},
+		{Name: "other", Token: "tother", Admin: []string{"common"}},
+	}})
+	cert := &x509.Certificate{DNSNames: []string{"logsvc"}}
+	tests := []struct {
+		name     string
+		header   string
+		cert     bool
+		certs    bool
+		wantErr  bool
+		wantName string
+	}{
+		{"admin token", "Bearer secret", false, false, false, ""},
+		{"identity token", "Bearer tother", false, false, false, "other"},
+		{"invalid token", "Bearer nope", false, false, true, ""},
+		{"certificate with tls", "", true, true, false, "logsvc"},
+		{"certificate without tls", "", true, false, true, ""},
+		{"no credential", "", false, true, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set("authorization", tt.header)
+			}
+			ctx := transport.NewServerContext(context.Background(), &testTransport{header: header})
+			if tt.cert {
+				ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{
+					State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+				}})
+			}
+			var name string
+			_, err := adminAuth("secret", a, tt.certs)(func(ctx context.Context, req interface{}) (interface{}, error) {
+				if id, ok := auth.FromContext(ctx); ok {
+					name = id.Name
+				}
+				return nil, nil
+			})(ctx, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if name != tt.wantName {
+				t.Errorf("identity = %q, want %q", name, tt.wantName)
+			}
+		})
+	}
+}
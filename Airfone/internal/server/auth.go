@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/auth"
+
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+	"github.com/go-kratos/kratos/v2/transport/grpc"
+	"github.com/go-kratos/kratos/v2/transport/http"
+	stdgrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// 认证
+//
+//	对外的 grpc 与 http 服务共用，从 authorization 头中认证调用方，将身份放入 ctx，授权由 service 完成
+//	流式接口(Watch、Session)不经过中间件，通过 grpc 的拦截器认证
+//	认证器为空(未开启认证)时不校验，但仍然丢弃不是集群节点携带的转发头(见 auth.Nodes)
+func authn(a *auth.Authenticator, n *auth.Nodes) middleware.Middleware {
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			ctx, err := authenticate(ctx, a, n)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}
+	}
+}
+
+// 流式接口的认证
+func authnStream(a *auth.Authenticator, n *auth.Nodes) stdgrpc.StreamServerInterceptor {
+	return func(srv interface{}, ss stdgrpc.ServerStream, info *stdgrpc.StreamServerInfo, handler stdgrpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), a, n)
+		if err != nil {
+			return err
+		}
+		return handler(srv, grpc.NewWrappedStream(ctx, ss))
+	}
+}
+
+// 认证 ctx 中的 authorization 头，返回带有身份的 ctx
+//
+//	没有携带 authorization 头时，使用集群节点转发的身份名，或者认证通过校验的客户端证书(见 auth/tls.go)
+func authenticate(ctx context.Context, a *auth.Authenticator, n *auth.Nodes) (context.Context, error) {
+	ctx, name := forwarded(ctx, n)
+	if a == nil {
+		return ctx, nil
+	}
+	tr, ok := transport.FromServerContext(ctx)
+	if !ok {
+		return nil, errorpb.ErrorUnauthorized("missing transport")
+	}
+	var (
+		header = tr.RequestHeader().Get("authorization")
+		cert   = peerCert(ctx)
+		id     *auth.Identity
+		err    error
+	)
+	switch {
+	case header != "":
+		id, err = a.Authenticate(header)
+	case name != "":
+		id, err = a.Lookup(name)
+	case cert != nil:
+		id, err = a.AuthenticateCert(cert)
+	default:
+		id, err = a.Authenticate(header)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewContext(ctx, id), nil
+}
+
+// 处理转发头
+//
+//	只有集群节点可以携带转发标记与身份名，其他调用方携带时从 metadata 中删除，返回的 ctx 中只保留可信的转发头
+//	身份名只接受以证书证明的节点，返回为空表示没有可信的身份名
+func forwarded(ctx context.Context, n *auth.Nodes) (context.Context, string) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(auth.FORWARDED_KEY))+len(md.Get(auth.IDENTITY_KEY)) == 0 {
+		return ctx, ""
+	}
+	var (
+		byCert bool
+		node   bool
+		name   string
+	)
+	if cert := peerCert(ctx); cert != nil {
+		byCert = n.Cert(cert)
+		node = byCert
+	} else if p, ok := peer.FromContext(ctx); ok {
+		node = n.Addr(p.Addr)
+	}
+	md = md.Copy()
+	if byCert {
+		if names := md.Get(auth.IDENTITY_KEY); len(names) > 0 {
+			name = names[0]
+		}
+	} else {
+		delete(md, auth.IDENTITY_KEY)
+	}
+	if !node {
+		delete(md, auth.FORWARDED_KEY)
+	}
+	return metadata.NewIncomingContext(ctx, md), name
+}
+
+// 调用方通过校验的客户端证书，没有时返回 nil
+func peerCert(ctx context.Context) *x509.Certificate {
+	var state *tls.ConnectionState
+	if r, ok := http.RequestFromServerContext(ctx); ok {
+		state = r.TLS
+	} else if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"Airfone/internal/auth"
+	"Airfone/internal/conf"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestForwarded(t *testing.T) {
+	nodes := auth.NewNodes(&conf.Data{Cluster: &conf.Data_Cluster{Peers: []*conf.Data_Cluster_Peer{
+		{Id: "node0", GrpcAddr: "10.0.0.1:9000"},
+		{Id: "node1", GrpcAddr: "node1.airfone.local:9000"},
+	}}})
+	var (
+		nodeCert   = &x509.Certificate{DNSNames: []string{"node1.airfone.local"}}
+		clientCert = &x509.Certificate{DNSNames: []string{"logsvc"}}
+		nodeAddr   = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+		otherAddr  = &net.TCPAddr{IP: net.ParseIP("10.0.0.9"), Port: 40000}
+	)
+	withCert := func(cert *x509.Certificate) credentials.AuthInfo {
+		return credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}}
+	}
+	tests := []struct {
+		name          string
+		peer          *peer.Peer
+		wantForwarded bool
+		wantName      string
+	}{
+		{"node certificate", &peer.Peer{Addr: otherAddr, AuthInfo: withCert(nodeCert)}, true, "logsvc"},
+		{"client certificate", &peer.Peer{Addr: nodeAddr, AuthInfo: withCert(clientCert)}, false, ""},
+		{"node address without tls", &peer.Peer{Addr: nodeAddr}, true, ""},
+		{"other address without tls", &peer.Peer{Addr: otherAddr}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+				auth.FORWARDED_KEY, "1",
+				auth.IDENTITY_KEY, "logsvc",
+			))
+			ctx, name := forwarded(peer.NewContext(ctx, tt.peer), nodes)
+			md, _ := metadata.FromIncomingContext(ctx)
+			if got := len(md.Get(auth.FORWARDED_KEY)) > 0; got != tt.wantForwarded {
+				t.Errorf("forwarded kept = %v, want %v", got, tt.wantForwarded)
+			}
+			if name != tt.wantName {
+				t.Errorf("identity = %q, want %q", name, tt.wantName)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	stdhttp "net/http"
+
+	"Airfone/internal/auth"
+	"Airfone/internal/conf"
+	"Airfone/internal/service"
+
+	"github.com/go-kratos/kratos/v2/transport/http"
+)
+
+// 注册监控页面
+//
+//	查看接口与 rpc 使用相同的认证(见 viewer)，开启认证时只返回身份有权限依赖的主题(见 service/dashboard.go)
+//	修改接口需要携带与管理接口相同的令牌，未配置令牌(server.admin.token)时页面只读
+func registerDashboard(srv *http.Server, c *conf.Server, a *auth.Authenticator, dashboard *service.DashboardService) {
+	var (
+		token = c.Admin.GetToken()
+		get   = func(h stdhttp.HandlerFunc) stdhttp.HandlerFunc {
+			return method(stdhttp.MethodGet, viewer(token, a, h))
+		}
+		admin = func(h stdhttp.HandlerFunc) stdhttp.HandlerFunc {
+			return method(stdhttp.MethodPost, func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+				if token == "" {
+					stdhttp.Error(w, "admin actions are disabled, configure server.admin.token to enable them", stdhttp.StatusForbidden)
+					return
+				}
+				if !authorized(token, r.Header.Get("Authorization")) {
+					stdhttp.Error(w, "invalid admin token", stdhttp.StatusUnauthorized)
+					return
+				}
+				h(w, r)
+			})
+		}
+	)
+	srv.HandleFunc("/dashboard/api/topics", get(dashboard.Topics))
+	srv.HandleFunc("/dashboard/api/instances", get(dashboard.Instances))
+	srv.HandleFunc("/dashboard/api/graph", get(dashboard.Graph))
+	srv.HandleFunc("/dashboard/api/events", get(dashboard.Events))
+	srv.HandleFunc("/dashboard/api/evict", admin(dashboard.Evict))
+	srv.HandleFunc("/dashboard/api/move", admin(dashboard.Move))
+	srv.HandleFunc("/dashboard/api/flush", admin(dashboard.Flush))
+	srv.HandlePrefix("/dashboard/", dashboard.Index())
+}
+
+// 查看接口的认证
+//
+//	这些接口直接注册在 http 服务上，不经过 kratos 的中间件，需要单独认证
+//	携带管理令牌时可以查看全部主题，ctx 中不放入身份；否则在开启认证时认证身份的凭证，将身份放入 ctx
+//	未开启认证时不校验
+func viewer(token string, a *auth.Authenticator, h stdhttp.HandlerFunc) stdhttp.HandlerFunc {
+	return func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		if a == nil || (token != "" && authorized(token, r.Header.Get("Authorization"))) {
+			h(w, r)
+			return
+		}
+		ctx, err := authenticate(r.Context(), a, nil)
+		if err != nil {
+			errorEncoder(w, r, err)
+			return
+		}
+		h(w, r.WithContext(ctx))
+	}
+}
+
+func method(m string, h stdhttp.HandlerFunc) stdhttp.HandlerFunc {
+	return func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		if r.Method != m {
+			stdhttp.Error(w, "method not allowed", stdhttp.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
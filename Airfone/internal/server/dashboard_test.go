@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	stdhttp "net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	pb "Airfone/api/airfone"
+	"Airfone/internal/conf"
+)
+
+// 开启认证的监控页面: viewer 只能依赖 log，管理令牌可以查看全部主题并执行修改操作
+func newTestDashboard(t *testing.T) (*testServices, stdhttp.Handler) {
+	t.Helper()
+	return newTestHTTP(t, &conf.Server{
+		Admin: &conf.Server_Admin{Token: "admin-token"},
+		Auth: &conf.Server_Auth{Identities: []*conf.Server_Auth_Identity{
+			{Name: "viewer", Token: "viewer-token", Depend: []string{"log"}},
+		}},
+	})
+}
+
+// 返回的主题名
+func topicNames(t *testing.T, body []byte) []string {
+	t.Helper()
+	var topics []struct{ Name string }
+	if err := json.Unmarshal(body, &topics); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = topic.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 页面与查看接口的渲染
+func TestDashboardRender(t *testing.T) {
+	s, h := newTestHTTP(t, &conf.Server{})
+	res, err := s.airfone.Register(context.Background(), &pb.RegisterRequest{
+		Topic: "log", Ip: "10.0.0.1", Port: 80,
+		Schema: []*pb.Schema{{Title: "proto", Content: "grpc"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.airfone.Register(context.Background(), &pb.RegisterRequest{Topic: "common", Ip: "10.0.1.1", Port: 80, Relies: []string{"log"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(h, stdhttp.MethodGet, "/dashboard/", "", "")
+	if w.Code != stdhttp.StatusOK || !strings.Contains(w.Body.String(), "<title>Airfone</title>") {
+		t.Errorf("index = %d %.80q", w.Code, w.Body.String())
+	}
+
+	w = serve(h, stdhttp.MethodGet, "/dashboard/api/topics", "", "")
+	if got := topicNames(t, w.Body.Bytes()); w.Code != stdhttp.StatusOK || len(got) != 2 || got[0] != "common" || got[1] != "log" {
+		t.Errorf("topics = %d %v", w.Code, got)
+	}
+
+	w = serve(h, stdhttp.MethodGet, "/dashboard/api/instances?topic=log", "", "")
+	var instances []struct {
+		ID     string
+		IP     string
+		Status string
+		Age    int64
+		Schema map[string]string
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &instances); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("instances = %s", w.Body.String())
+	}
+	in := instances[0]
+	if in.ID != strconv.FormatInt(res.Service.Id, 10) || in.IP != "10.0.0.1" || in.Status != "running" || in.Age < 0 || in.Schema["proto"] != "grpc" {
+		t.Errorf("instance = %+v", in)
+	}
+
+	w = serve(h, stdhttp.MethodGet, "/dashboard/api/graph", "", "")
+	var edges []struct{ From, To string }
+	if err = json.Unmarshal(w.Body.Bytes(), &edges); err != nil {
+		t.Fatal(err)
+	}
+	if len(edges) != 1 || edges[0].From != "common" || edges[0].To != "log" {
+		t.Errorf("graph = %s", w.Body.String())
+	}
+
+	w = serve(h, stdhttp.MethodGet, "/dashboard/api/events?after=0", "", "")
+	var events struct {
+		Revision string
+		Events   []struct{ Type, Topic, Status string }
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Events) == 0 || events.Revision == "" {
+		t.Errorf("events = %s", w.Body.String())
+	}
+
+	if w = serve(h, stdhttp.MethodPost, "/dashboard/api/topics", "", ""); w.Code != stdhttp.StatusMethodNotAllowed {
+		t.Errorf("post topics = %d, want 405", w.Code)
+	}
+}
+
+// 查看接口按身份过滤主题，修改操作只接受管理令牌
+func TestDashboardViewer(t *testing.T) {
+	s, h := newTestDashboard(t)
+	var ids = make(map[string]int64)
+	for _, topic := range []string{"log", "common"} {
+		res, err := s.airfone.Register(context.Background(), &pb.RegisterRequest{Topic: topic, Ip: "10.0.0.1", Port: 80})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[topic] = res.Service.Id
+	}
+	tests := []struct {
+		name  string
+		token string
+		code  int
+		want  []string
+	}{
+		{"no credential", "", stdhttp.StatusUnauthorized, nil},
+		{"invalid credential", "nope", stdhttp.StatusUnauthorized, nil},
+		{"viewer", "viewer-token", stdhttp.StatusOK, []string{"log"}},
+		{"admin token", "admin-token", stdhttp.StatusOK, []string{"common", "log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, stdhttp.MethodGet, "/dashboard/api/topics", tt.token, "")
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if tt.code != stdhttp.StatusOK {
+				return
+			}
+			got := topicNames(t, w.Body.Bytes())
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("topics = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	evict := func(token, topic string, id int64) int {
+		body := `{"topic":"` + topic + `","id":"` + strconv.FormatInt(id, 10) + `"}`
+		return serve(h, stdhttp.MethodPost, "/dashboard/api/evict", token, body).Code
+	}
+	if code := evict("viewer-token", "log", ids["log"]); code != stdhttp.StatusUnauthorized {
+		t.Errorf("evict with viewer token = %d, want 401", code)
+	}
+	if code := evict("admin-token", "log", ids["log"]); code != stdhttp.StatusOK {
+		t.Errorf("evict with admin token = %d, want 200", code)
+	}
+	if code := evict("admin-token", "log", ids["log"]); code != stdhttp.StatusNotFound {
+		t.Errorf("evict twice = %d, want 404", code)
+	}
+	if w := serve(h, stdhttp.MethodGet, "/dashboard/api/instances", "viewer-token", ""); strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("instances after evict = %s", w.Body.String())
+	}
+}
+
+// 未配置管理令牌时页面只读
+func TestDashboardReadOnly(t *testing.T) {
+	_, h := newTestHTTP(t, &conf.Server{})
+	if w := serve(h, stdhttp.MethodPost, "/dashboard/api/flush", "", `{"topic":"log"}`); w.Code != stdhttp.StatusForbidden {
+		t.Errorf("flush without admin token = %d, want 403", w.Code)
+	}
+}
@@ -1,24 +1,40 @@
 package server
 
 import (
+	"runtime"
+
 	pb "Airfone/api/airfone"
+	"Airfone/internal/auth"
 	"Airfone/internal/conf"
 	"Airfone/internal/service"
 
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-kratos/kratos/v2/middleware/recovery"
 	"github.com/go-kratos/kratos/v2/transport/grpc"
+	stdgrpc "google.golang.org/grpc"
 )
 
 // NewGRPCServer new a gRPC server.
 func NewGRPCServer(c *conf.Server, logger *log.Helper,
+	t *auth.TLS,
+	n *auth.Nodes,
 	airfone *service.AirfoneService,
 ) *grpc.Server {
-	var opts = []grpc.ServerOption{
-		grpc.Middleware(
-			recovery.Recovery(),
-		),
-	}
+	var (
+		a    = auth.New(c.Auth)
+		opts = []grpc.ServerOption{
+			grpc.Middleware(
+				recovery.Recovery(),
+				metrics(),
+				authn(a, n),
+			),
+			grpc.StreamInterceptor(
+				recoveryStream(logger),
+				metricsStream(),
+				authnStream(a, n),
+			),
+		}
+	)
 	if c.Grpc.Network != "" {
 		opts = append(opts, grpc.Network(c.Grpc.Network))
 	}
@@ -28,8 +44,28 @@ func NewGRPCServer(c *conf.Server, logger *log.Helper,
 	if c.Grpc.Timeout != nil {
 		opts = append(opts, grpc.Timeout(c.Grpc.Timeout.AsDuration()))
 	}
+	if t.Server != nil {
+		opts = append(opts, grpc.TLSConfig(t.Server))
+	}
 	srv := grpc.NewServer(opts...)
 	// v1.RegisterGreeterServer(srv, greeter)
 	pb.RegisterAirfoneServer(srv, airfone)
 	return srv
 }
+
+// 流式接口的 panic 恢复
+//
+//	recovery 中间件只作用于一元调用，长连接的 Watch、Session 中的 panic 同样不能使整个进程退出
+func recoveryStream(logger *log.Helper) stdgrpc.StreamServerInterceptor {
+	return func(srv interface{}, ss stdgrpc.ServerStream, info *stdgrpc.StreamServerInfo, handler stdgrpc.StreamHandler) (err error) {
+		defer func() {
+			if rerr := recover(); rerr != nil {
+				buf := make([]byte, 64<<10)
+				buf = buf[:runtime.Stack(buf, false)]
+				logger.Errorf("%s: %v\n%s", info.FullMethod, rerr, buf)
+				err = recovery.ErrUnknownRequest
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
@@ -1,24 +1,38 @@
 package server
 
 import (
-	// v1 "Airfone/api/helloworld/v1"
+	stdhttp "net/http"
+
+	pb "Airfone/api/airfone"
+	"Airfone/api/errorpb"
+	"Airfone/internal/auth"
 	"Airfone/internal/conf"
-	// "Airfone/internal/service"
+	"Airfone/internal/service"
 
+	"github.com/go-kratos/kratos/v2/errors"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-kratos/kratos/v2/middleware/recovery"
 	"github.com/go-kratos/kratos/v2/transport/http"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // NewHTTPServer new an HTTP server.
 func NewHTTPServer(c *conf.Server, logger *log.Helper,
-	// greeter *service.GreeterService,
+	t *auth.TLS,
+	airfone *service.AirfoneService,
+	dashboard *service.DashboardService,
 ) *http.Server {
-	var opts = []http.ServerOption{
-		http.Middleware(
-			recovery.Recovery(),
-		),
-	}
+	var (
+		a    = auth.New(c.Auth)
+		opts = []http.ServerOption{
+			http.ErrorEncoder(errorEncoder),
+			http.Middleware(
+				recovery.Recovery(),
+				metrics(),
+				authn(a, nil),
+			),
+		}
+	)
 	if c.Http.Network != "" {
 		opts = append(opts, http.Network(c.Http.Network))
 	}
@@ -28,7 +42,34 @@ func NewHTTPServer(c *conf.Server, logger *log.Helper,
 	if c.Http.Timeout != nil {
 		opts = append(opts, http.Timeout(c.Http.Timeout.AsDuration()))
 	}
+	if t.Server != nil {
+		opts = append(opts, http.TLSConfig(t.Server))
+	}
 	srv := http.NewServer(opts...)
-	// v1.RegisterGreeterHTTPServer(srv, greeter)
+	// Watch 与 Session 是流式 RPC，只能通过 grpc 调用
+	pb.RegisterAirfoneHTTPServer(srv, airfone)
+	registerDashboard(srv, c, a, dashboard)
+	srv.Handle("/metrics", viewer(c.Admin.GetToken(), a, func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		// 指标无法按主题过滤，只允许依赖全部主题的身份查看
+		if id, ok := auth.FromContext(r.Context()); ok && !id.AllowedAll(auth.ACTION_DEPEND) {
+			errorEncoder(w, r, errorpb.ErrorForbidden("identity %s is not allowed to depend on all topics", id.Name))
+			return
+		}
+		promhttp.Handler().ServeHTTP(w, r)
+	}))
 	return srv
 }
+
+// 与 http.DefaultErrorEncoder 相同，只是状态码由 service.HTTPStatus 决定
+func errorEncoder(w stdhttp.ResponseWriter, r *stdhttp.Request, err error) {
+	se := errors.FromError(err)
+	codec, _ := http.CodecForRequest(r, "Accept")
+	body, err := codec.Marshal(se)
+	if err != nil {
+		w.WriteHeader(stdhttp.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/"+codec.Name())
+	w.WriteHeader(service.HTTPStatus(se))
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/auth"
+	"Airfone/internal/biz"
+	"Airfone/internal/conf"
+	"Airfone/internal/engine"
+	"Airfone/internal/repo"
+	"Airfone/internal/service"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+// 组装好的服务
+type testServices struct {
+	log       *log.Helper
+	tls       *auth.TLS
+	airfone   *service.AirfoneService
+	dashboard *service.DashboardService
+}
+
+// 与 wire 生成的代码相同，组装单节点的服务，测试结束时关闭
+func newTestServices(t *testing.T, c *conf.Server) *testServices {
+	t.Helper()
+	helper := log.NewHelper(log.DefaultLogger)
+	data, cleanup, err := engine.NewData(&conf.Data{}, helper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	tlsConf, err := auth.NewTLS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd, cleanup2 := service.NewForwarder(biz.NewClusterUsecase(repo.NewClusterRepo(data, helper), helper), tlsConf)
+	t.Cleanup(cleanup2)
+	var (
+		wuc = biz.NewWatchUsecase(repo.NewWatchRepo(data, helper), helper)
+		duc = biz.NewDiscoverUsecase(repo.NewDiscoverRepo(data, helper), helper)
+		auc = biz.NewAdminUsecase(repo.NewAdminRepo(data, helper), helper)
+	)
+	return &testServices{
+		log: helper,
+		tls: tlsConf,
+		airfone: service.NewAirfoneService(
+			biz.NewKeepAliveUsecase(repo.NewkeepAliveRepoRepo(data, helper), helper),
+			biz.NewRegisterUsecase(repo.NewRegisterRepo(data, helper), helper),
+			wuc, duc,
+			biz.NewEventUsecase(repo.NewEventRepo(data, helper), helper),
+			fwd, helper,
+		),
+		dashboard: service.NewDashboardService(auc, duc, wuc),
+	}
+}
+
+// 组装对外的 http 服务，不监听端口，直接处理请求
+func newTestHTTP(t *testing.T, c *conf.Server) (*testServices, stdhttp.Handler) {
+	t.Helper()
+	if c.Http == nil {
+		c.Http = &conf.Server_HTTP{}
+	}
+	s := newTestServices(t, c)
+	return s, NewHTTPServer(c, s.log, s.tls, s.airfone, s.dashboard)
+}
+
+// 发送请求，token 不为空时携带 authorization 头
+func serve(h stdhttp.Handler, method, target, token, body string) *httptest.ResponseRecorder {
+	var r = httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// errorpb 的错误码转换为对应的 http 状态码，响应体保留原本的错误码与原因
+func TestErrorEncoder(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"not found", errorpb.ErrorSearchInvalid("no such topic"), stdhttp.StatusNotFound},
+		{"topic not empty", errorpb.ErrorTopicNotEmpty("log"), stdhttp.StatusConflict},
+		{"stale id", errorpb.ErrorStaleId("1"), stdhttp.StatusConflict},
+		{"not leader", errorpb.ErrorNotLeader("node1"), stdhttp.StatusServiceUnavailable},
+		{"unauthorized", errorpb.ErrorUnauthorized("missing credential"), stdhttp.StatusUnauthorized},
+		{"forbidden", errorpb.ErrorForbidden("logsvc"), stdhttp.StatusForbidden},
+		{"selector invalid", errorpb.ErrorSelectorInvalid("nope"), stdhttp.StatusBadRequest},
+		{"label invalid", errorpb.ErrorLabelInvalid("env="), stdhttp.StatusBadRequest},
+		{"version invalid", errorpb.ErrorVersionInvalid(">=x"), stdhttp.StatusBadRequest},
+		{"namespace invalid", errorpb.ErrorNamespaceInvalid("a/b"), stdhttp.StatusBadRequest},
+		{"watch lagged", errorpb.ErrorWatchLagged("slow"), stdhttp.StatusGone},
+		{"default", errorpb.ErrorDefault("oops"), stdhttp.StatusInternalServerError},
+		{"http status", errors.BadRequest("CODEC", "bad body"), stdhttp.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				w  = httptest.NewRecorder()
+				r  = httptest.NewRequest(stdhttp.MethodGet, "/v1/discover", nil)
+				se = errors.FromError(tt.err)
+			)
+			errorEncoder(w, r, tt.err)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			var body errors.Error
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != se.Code || body.Reason != se.Reason {
+				t.Errorf("body = %d %s, want %d %s", body.Code, body.Reason, se.Code, se.Reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	stdgrpc "google.golang.org/grpc"
+)
+
+// rpc 的监控指标
+//
+//	对外的 grpc 与 http 服务共用，按接口(operation)与错误码统计请求数与耗时，
+//	http 调用与 grpc 调用的 operation 相同，错误码为 kratos 错误的 code，成功为 200
+//	流式接口(Watch、Session)不经过中间件，由拦截器在流结束时统计请求数；流的持续时间取决于客户端，不统计耗时
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "airfone",
+		Name:      "rpc_requests_total",
+		Help:      "RPC requests by operation and code.",
+	}, []string{"kind", "operation", "code"})
+
+	metricLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "airfone",
+		Name:      "rpc_duration_seconds",
+		Help:      "RPC latencies by operation.",
+		Buckets:   prometheus.ExponentialBuckets(1e-4, 4, 9), // 100µs ~ 6.5s
+	}, []string{"kind", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(metricRequests, metricLatency)
+}
+
+// 统计请求数与耗时
+func metrics() middleware.Middleware {
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			var kind, operation string
+			if tr, ok := transport.FromServerContext(ctx); ok {
+				kind, operation = tr.Kind().String(), tr.Operation()
+			}
+			start := time.Now()
+			reply, err := handler(ctx, req)
+			code := 200
+			if err != nil {
+				code = int(errors.FromError(err).Code)
+			}
+			metricRequests.WithLabelValues(kind, operation, strconv.Itoa(code)).Inc()
+			metricLatency.WithLabelValues(kind, operation).Observe(time.Since(start).Seconds())
+			return reply, err
+		}
+	}
+}
+
+// 统计流式接口的请求数，流结束时按错误码计数
+func metricsStream() stdgrpc.StreamServerInterceptor {
+	return func(srv interface{}, ss stdgrpc.ServerStream, info *stdgrpc.StreamServerInfo, handler stdgrpc.StreamHandler) error {
+		err := handler(srv, ss)
+		code := 200
+		if err != nil {
+			code = int(errors.FromError(err).Code)
+		}
+		metricRequests.WithLabelValues(transport.KindGRPC.String(), info.FullMethod, strconv.Itoa(code)).Inc()
+		return err
+	}
+}
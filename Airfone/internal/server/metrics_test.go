@@ -0,0 +1,97 @@
+package server
+
+import (
+	stdhttp "net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	pb "Airfone/api/airfone"
+	"Airfone/internal/conf"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	stdgrpc "google.golang.org/grpc"
+)
+
+// 通过 http 注册后的请求计数与 /metrics 中的指标
+func TestMetricsEndpoint(t *testing.T) {
+	_, h := newTestHTTP(t, &conf.Server{
+		Auth: &conf.Server_Auth{Identities: []*conf.Server_Auth_Identity{
+			{Name: "ops", Token: "ops-token", Depend: []string{"*"}},
+			{Name: "logsvc", Token: "log-token", Register: []string{"log"}, Depend: []string{"log"}},
+		}},
+	})
+	var (
+		requests = metricRequests.WithLabelValues("http", pb.OperationAirfoneRegister, "200")
+		before   = testutil.ToFloat64(requests)
+	)
+	if w := serve(h, stdhttp.MethodPost, "/v1/register", "log-token", `{"topic":"log","ip":"10.0.0.1","port":80}`); w.Code != stdhttp.StatusOK {
+		t.Fatalf("register = %d %s", w.Code, w.Body.String())
+	}
+	if got := testutil.ToFloat64(requests) - before; got != 1 {
+		t.Errorf("register requests = %v, want 1", got)
+	}
+
+	w := serve(h, stdhttp.MethodGet, "/metrics", "ops-token", "")
+	if w.Code != stdhttp.StatusOK {
+		t.Fatalf("metrics = %d %s", w.Code, w.Body.String())
+	}
+	for _, line := range []string{
+		`airfone_instances{status="running",topic="log"} 1`,
+		`airfone_instances{status="pending",topic="log"} 0`,
+		`airfone_rpc_requests_total{code="200",kind="http",operation="/api.airfone.Airfone/Register"}`,
+		`airfone_rpc_duration_seconds_count{kind="http",operation="/api.airfone.Airfone/Register"}`,
+		`airfone_transitions_total{from="dropped",reason="register",to="running"}`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("metrics without %s", line)
+		}
+	}
+
+	// 指标无法按主题过滤，只能依赖部分主题的身份不能查看
+	if w = serve(h, stdhttp.MethodGet, "/metrics", "log-token", ""); w.Code != stdhttp.StatusForbidden {
+		t.Errorf("metrics with partial identity = %d, want 403", w.Code)
+	}
+	if w = serve(h, stdhttp.MethodGet, "/metrics", "", ""); w.Code != stdhttp.StatusUnauthorized {
+		t.Errorf("metrics without credential = %d, want 401", w.Code)
+	}
+}
+
+// 流结束时按错误码计数，流式接口中的 panic 被恢复为错误
+func TestStreamInterceptors(t *testing.T) {
+	var (
+		info    = &stdgrpc.StreamServerInfo{FullMethod: "/api.airfone.Airfone/Session", IsServerStream: true}
+		metrics = metricsStream()
+	)
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"ok", nil, 200},
+		{"error", errors.Forbidden("FORBIDDEN", "nope"), 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				requests = metricRequests.WithLabelValues("grpc", info.FullMethod, strconv.Itoa(tt.code))
+				before   = testutil.ToFloat64(requests)
+			)
+			err := metrics(nil, nil, info, func(interface{}, stdgrpc.ServerStream) error { return tt.err })
+			if err != tt.err {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if got := testutil.ToFloat64(requests) - before; got != 1 {
+				t.Errorf("requests with code %d = %v, want 1", tt.code, got)
+			}
+		})
+	}
+
+	recovery := recoveryStream(log.NewHelper(log.DefaultLogger))
+	err := recovery(nil, nil, info, func(interface{}, stdgrpc.ServerStream) error { panic("boom") })
+	if se := errors.FromError(err); se.Code != stdhttp.StatusInternalServerError {
+		t.Errorf("recovered error = %v, want 500", err)
+	}
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"Airfone/internal/auth"
+
 	"github.com/google/wire"
 )
 
 // ProviderSet is server providers.
-var ProviderSet = wire.NewSet(NewGRPCServer, NewHTTPServer)
+var ProviderSet = wire.NewSet(auth.NewTLS, auth.NewNodes, NewGRPCServer, NewHTTPServer, NewAdminServer)
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "Airfone/api/airfone"
+	"Airfone/api/errorpb"
+	"Airfone/internal/auth"
+	"Airfone/internal/conf"
+
+	stdgrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// 测试时生成的证书
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// 签发证书，parent 为空时生成自签名的 CA
+func newTestCert(t *testing.T, parent *testCert, name string, dns ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dns,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// 写入 PEM 文件，返回证书与私钥的路径
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	b, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		certFile = filepath.Join(dir, name+".crt")
+		keyFile  = filepath.Join(dir, name+".key")
+	)
+	if err = os.WriteFile(certFile, c.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// 组装对外的 grpc 服务并开始监听，返回监听地址
+func startGRPC(t *testing.T, c *conf.Server) string {
+	t.Helper()
+	s := newTestServices(t, c)
+	srv := NewGRPCServer(c, s.log, s.tls, auth.NewNodes(&conf.Data{}), s.airfone)
+	endpoint, err := srv.Endpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Start(context.Background()) }()
+	t.Cleanup(func() { _ = srv.Stop(context.Background()) })
+	return endpoint.Host
+}
+
+// 以真实的证书握手: 要求客户端证书时拒绝不出示证书的客户端，证书中的 SAN 对应同名的身份
+func TestMutualTLS(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		ca     = newTestCert(t, nil, "airfone ca")
+		other  = newTestCert(t, nil, "other ca")
+		server = newTestCert(t, ca, "airfone", "localhost")
+		client = newTestCert(t, ca, "logsvc", "logsvc")
+		stray  = newTestCert(t, ca, "stray", "stray")
+		forged = newTestCert(t, other, "logsvc", "logsvc")
+	)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := server.write(t, dir, "server")
+	addr := startGRPC(t, &conf.Server{
+		Grpc: &conf.Server_GRPC{Addr: "127.0.0.1:0"},
+		Auth: &conf.Server_Auth{Identities: []*conf.Server_Auth_Identity{
+			{Name: "logsvc", Register: []string{"log"}},
+		}},
+		Tls: &conf.Server_TLS{CertFile: certFile, KeyFile: keyFile, ClientCaFile: caFile, RequireClientCert: true},
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	register := func(t *testing.T, cert *testCert, topic string) error {
+		t.Helper()
+		cfg := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := stdgrpc.DialContext(ctx, addr, stdgrpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = pb.NewAirfoneClient(conn).Register(ctx, &pb.RegisterRequest{Topic: topic, Ip: "10.0.0.1", Port: 80})
+		return err
+	}
+
+	tests := []struct {
+		name  string
+		cert  *testCert
+		topic string
+		check func(error) bool
+	}{
+		{"identity from san", client, "log", func(err error) bool { return err == nil }},
+		{"policy of the san identity", client, "common", errorpb.IsForbidden},
+		{"san without identity", stray, "log", errorpb.IsUnauthorized},
+		{"no client certificate", nil, "log", func(err error) bool { return err != nil && !errorpb.IsUnauthorized(err) }},
+		{"certificate of another ca", forged, "log", func(err error) bool { return err != nil && !errorpb.IsUnauthorized(err) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := register(t, tt.cert, tt.topic); !tt.check(err) {
+				t.Errorf("register %s: unexpected error %v", tt.topic, err)
+			}
+		})
+	}
+}
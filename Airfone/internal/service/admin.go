@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	pb "Airfone/api/airfone"
+	"Airfone/internal/auth"
+	"Airfone/internal/biz"
+	"Airfone/internal/biz/irepo"
+)
+
+// 管理接口
+//
+//	只在单独的端口上提供(见 server/admin.go)，普通客户端无法调用
+//	开启集群时修改操作只能在 leader 上执行，follower 返回 NOT_LEADER，metadata 中携带 leader 的地址
+//	以身份的凭证(而不是管理令牌)调用时，只能管理策略中 admin 的主题，列出主题时只返回这些主题
+type AdminService struct {
+	pb.UnimplementedAdminServer
+	auc *biz.AdminUsecase
+}
+
+func NewAdminService(auc *biz.AdminUsecase) *AdminService {
+	return &AdminService{
+		auc: auc,
+	}
+}
+
+func (s *AdminService) ListTopics(ctx context.Context, req *pb.ListTopicsRequest) (*pb.ListTopicsResponse, error) {
+	topics, err := s.auc.Topics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response := &pb.ListTopicsResponse{
+		Topics: make([]*pb.TopicInfo, 0, len(topics)),
+	}
+	for _, t := range topics {
+		if auth.Authorize(ctx, auth.ACTION_ADMIN, t.Name) == nil {
+			response.Topics = append(response.Topics, t.ToProto())
+		}
+	}
+	return response, nil
+}
+
+func (s *AdminService) Describe(ctx context.Context, req *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	if err := auth.Authorize(ctx, auth.ACTION_ADMIN, req.Topic); err != nil {
+		return nil, err
+	}
+	instance, load, err := s.auc.Describe(ctx, req.Topic, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DescribeResponse{
+		Instance: instance.ToProto(time.Now().UnixNano()),
+		Load:     load,
+	}, nil
+}
+
+func (s *AdminService) Evict(ctx context.Context, req *pb.EvictRequest) (*pb.EvictResponse, error) {
+	if err := auth.Authorize(ctx, auth.ACTION_ADMIN, req.Topic); err != nil {
+		return nil, err
+	}
+	if err := s.auc.Evict(ctx, req.Topic, req.Id); err != nil {
+		return nil, err
+	}
+	return &pb.EvictResponse{}, nil
+}
+
+func (s *AdminService) Move(ctx context.Context, req *pb.MoveRequest) (*pb.MoveResponse, error) {
+	if err := auth.Authorize(ctx, auth.ACTION_ADMIN, req.Topic); err != nil {
+		return nil, err
+	}
+	if err := s.auc.Move(ctx, req.Topic, req.Id, irepo.StatusFromProto(req.Status)); err != nil {
+		return nil, err
+	}
+	return &pb.MoveResponse{}, nil
+}
+
+func (s *AdminService) Flush(ctx context.Context, req *pb.FlushRequest) (*pb.FlushResponse, error) {
+	if err := auth.Authorize(ctx, auth.ACTION_ADMIN, req.Topic); err != nil {
+		return nil, err
+	}
+	n, err := s.auc.Flush(ctx, req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.FlushResponse{Evicted: int32(n)}, nil
+}
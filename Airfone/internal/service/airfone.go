@@ -3,27 +3,46 @@ package service
 import (
 	"context"
 	"fmt"
+	"time"
 
 	pb "Airfone/api/airfone"
+	"Airfone/internal/auth"
 	"Airfone/internal/biz"
 	"Airfone/internal/biz/irepo"
 	"Airfone/internal/engine"
+
+	"github.com/go-kratos/kratos/v2/log"
 )
 
 type AirfoneService struct {
 	pb.UnimplementedAirfoneServer
 	kuc *biz.KeepAliveUsecase
 	ruc *biz.RegisterUsecase
+	wuc *biz.WatchUsecase
+	duc *biz.DiscoverUsecase
+	euc *biz.EventUsecase
+	fwd *Forwarder
+	log *log.Helper
 }
 
-func NewAirfoneService(kuc *biz.KeepAliveUsecase, ruc *biz.RegisterUsecase) *AirfoneService {
+func NewAirfoneService(kuc *biz.KeepAliveUsecase, ruc *biz.RegisterUsecase, wuc *biz.WatchUsecase, duc *biz.DiscoverUsecase, euc *biz.EventUsecase, fwd *Forwarder, logger *log.Helper) *AirfoneService {
 	return &AirfoneService{
 		kuc: kuc,
 		ruc: ruc,
+		wuc: wuc,
+		duc: duc,
+		euc: euc,
+		fwd: fwd,
+		log: logger,
 	}
 }
 
 func (s *AirfoneService) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	if leader, fctx, err := s.fwd.leader(ctx); err != nil {
+		return nil, err
+	} else if leader != nil {
+		return leader.Register(fctx, req)
+	}
 	var (
 		service = &irepo.Service{
 			Service: &engine.Service{},
@@ -31,6 +50,7 @@ func (s *AirfoneService) Register(ctx context.Context, req *pb.RegisterRequest)
 		relies   = req.Relies
 		schema   = make([]*engine.Schema, len(req.Schema))
 		response = &pb.RegisterResponse{}
+		err      error
 	)
 	for i, s2 := range req.Schema {
 		schema[i] = &engine.Schema{
@@ -38,10 +58,33 @@ func (s *AirfoneService) Register(ctx context.Context, req *pb.RegisterRequest)
 			Content: s2.Content,
 		}
 	}
-	service.Topic = req.Topic
+	if service.Topic, err = engine.Qualify(req.Namespace, req.Topic); err != nil {
+		return nil, err
+	}
 	service.IP = req.Ip
 	service.Port = uint16(req.Port)
 	service.Schema = schema
+	service.Selector = req.Selector
+	service.Region = req.Region
+	service.Zone = req.Zone
+	service.Rack = req.Rack
+	service.Lease = irepo.LeaseFromProto(req.Lease)
+	service.Instance = req.Instance
+	service.Token = req.Token
+	service.Health = irepo.HealthCheckFromProto(req.Health)
+	service.Labels = req.Labels
+	service.Version = req.Version
+	service.AllInstances = req.AllInstances
+	if req.Weight > 0 {
+		service.Weight = uint32(req.Weight)
+	}
+	if err = auth.Authorize(ctx, auth.ACTION_REGISTER, service.Topic); err != nil {
+		return nil, err
+	}
+	if err = authorizeRelies(ctx, service.Topic, relies); err != nil {
+		return nil, err
+	}
+	service.Owner = owner(ctx)
 
 	s2, err := s.ruc.Register(ctx, service, relies)
 	if err != nil {
@@ -54,6 +97,11 @@ func (s *AirfoneService) Register(ctx context.Context, req *pb.RegisterRequest)
 }
 
 func (s *AirfoneService) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	if leader, fctx, err := s.fwd.leader(ctx); err != nil {
+		return nil, err
+	} else if leader != nil {
+		return leader.Update(fctx, req)
+	}
 	var (
 		service = &irepo.Service{
 			Service: &engine.Service{},
@@ -63,9 +111,19 @@ func (s *AirfoneService) Update(ctx context.Context, req *pb.UpdateRequest) (*pb
 		err      error
 	)
 	service.ID = req.Id
-	service.Topic = req.Topic
+	if service.Topic, err = engine.Qualify(req.Namespace, req.Topic); err != nil {
+		return nil, err
+	}
 	service.IP = req.Ip
 	service.Port = uint16(req.Port)
+	service.Selector = req.Selector
+	service.Region = req.Region
+	service.Zone = req.Zone
+	service.Rack = req.Rack
+	service.Version = req.Version
+	if req.Weight > 0 {
+		service.Weight = uint32(req.Weight)
+	}
 	if req.NeedSchema {
 		for i, s2 := range req.Schema {
 			schema[i] = &engine.Schema{
@@ -75,7 +133,20 @@ func (s *AirfoneService) Update(ctx context.Context, req *pb.UpdateRequest) (*pb
 		}
 		service.Schema = schema
 	}
+	if req.NeedLabels {
+		// 清空标签时同样需要非空的 map，为空表示不修改
+		service.Labels = make(map[string]string, len(req.Labels))
+		for k, v := range req.Labels {
+			service.Labels[k] = v
+		}
+	}
+	if err = s.authorizeInstance(ctx, service.Topic, service.ID); err != nil {
+		return nil, err
+	}
 	if req.NeedRelies {
+		if err = authorizeRelies(ctx, service.Topic, req.Relies); err != nil {
+			return nil, err
+		}
 		if len(req.Relies) == 0 {
 			service, err = s.ruc.Update(ctx, service, make([]string, 0))
 		} else {
@@ -94,14 +165,24 @@ func (s *AirfoneService) Update(ctx context.Context, req *pb.UpdateRequest) (*pb
 }
 
 func (s *AirfoneService) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	if leader, fctx, err := s.fwd.leader(ctx); err != nil {
+		return nil, err
+	} else if leader != nil {
+		return leader.Logout(fctx, req)
+	}
 	var (
 		serv = &irepo.Service{
 			Service: &engine.Service{},
 		}
 		err error
 	)
-	serv.Topic = req.Topic
+	if serv.Topic, err = engine.Qualify(req.Namespace, req.Topic); err != nil {
+		return nil, err
+	}
 	serv.ID = req.Id
+	if err = s.authorizeInstance(ctx, serv.Topic, serv.ID); err != nil {
+		return nil, err
+	}
 	if err = s.ruc.Logout(ctx, serv); err != nil {
 		return nil, err
 	}
@@ -110,6 +191,11 @@ func (s *AirfoneService) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb
 }
 
 func (s *AirfoneService) KeepAlive(ctx context.Context, req *pb.KeepAliveRequest) (*pb.KeepAliveResponse, error) {
+	if leader, fctx, err := s.fwd.leader(ctx); err != nil {
+		return nil, err
+	} else if leader != nil {
+		return leader.KeepAlive(fctx, req)
+	}
 	var (
 		hb = &irepo.HeartBeat{
 			HeartBeat: &engine.HeartBeat{},
@@ -118,7 +204,12 @@ func (s *AirfoneService) KeepAlive(ctx context.Context, req *pb.KeepAliveRequest
 		err error
 	)
 	hb.ID = req.Id
-	hb.Topic = req.Topic
+	if hb.Topic, err = engine.Qualify(req.Namespace, req.Topic); err != nil {
+		return nil, err
+	}
+	if err = s.authorizeInstance(ctx, hb.Topic, hb.ID); err != nil {
+		return nil, err
+	}
 
 	if hb, err = s.kuc.KeepAlive(ctx, hb); err != nil {
 		return nil, err
@@ -129,6 +220,11 @@ func (s *AirfoneService) KeepAlive(ctx context.Context, req *pb.KeepAliveRequest
 }
 
 func (s *AirfoneService) Conform(ctx context.Context, req *pb.ConformRequest) (*pb.ConformResponse, error) {
+	if leader, fctx, err := s.fwd.leader(ctx); err != nil {
+		return nil, err
+	} else if leader != nil {
+		return leader.Conform(fctx, req)
+	}
 	var (
 		hb = &irepo.HeartBeat{
 			HeartBeat: &engine.HeartBeat{},
@@ -136,10 +232,112 @@ func (s *AirfoneService) Conform(ctx context.Context, req *pb.ConformRequest) (*
 		err error
 	)
 	hb.ID = req.Id
-	hb.Topic = req.Topic
+	if hb.Topic, err = engine.Qualify(req.Namespace, req.Topic); err != nil {
+		return nil, err
+	}
+	if err = s.authorizeInstance(ctx, hb.Topic, hb.ID); err != nil {
+		return nil, err
+	}
 	if err = s.kuc.Conform(ctx, hb); err != nil {
 		return nil, err
 	}
 	fmt.Printf("服务 %v id: %v 服务运行确认\n", hb.Topic, hb.ID)
 	return &pb.ConformResponse{}, nil
 }
+
+// 监听
+//
+//	读操作，由当前节点直接处理，不需要转发给 leader
+func (s *AirfoneService) Watch(req *pb.WatchRequest, stream pb.Airfone_WatchServer) error {
+	var (
+		ctx    = stream.Context()
+		topics = make([]string, len(req.Topics))
+		err    error
+	)
+	for i, name := range req.Topics {
+		if topics[i], err = engine.QualifyRelative(req.Namespace, name); err != nil {
+			return err
+		}
+	}
+	if err = auth.Authorize(ctx, auth.ACTION_DEPEND, topics...); err != nil {
+		return err
+	}
+	w := s.wuc.Watch(ctx, topics, req.Revision)
+	defer w.Close()
+	for {
+		ev, err := w.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if ev == nil {
+			return nil
+		}
+		if err = stream.Send(ev.ToProto(req.Namespace)); err != nil {
+			return err
+		}
+	}
+}
+
+// 查询
+//
+//	读操作，由当前节点直接处理，不需要转发给 leader，调用方也不需要注册
+func (s *AirfoneService) Discover(ctx context.Context, req *pb.DiscoverRequest) (*pb.DiscoverResponse, error) {
+	var (
+		now      = time.Now().UnixNano()
+		response = &pb.DiscoverResponse{}
+		topics   = make([]string, len(req.Topics))
+		filter   = irepo.DiscoverFilterFromProto(req)
+		err      error
+	)
+	for i, name := range req.Topics {
+		if topics[i], err = engine.QualifyRelative(req.Namespace, name); err != nil {
+			return nil, err
+		}
+	}
+	if err = auth.Authorize(ctx, auth.ACTION_DEPEND, topics...); err != nil {
+		return nil, err
+	}
+	// 未指定主题时只查询自己的命名空间
+	if filter.Namespace, err = engine.CheckNamespace(req.Namespace); err != nil {
+		return nil, err
+	}
+	instances, err := s.duc.Discover(ctx, topics, filter)
+	if err != nil {
+		return nil, err
+	}
+	// 未指定主题时只返回有权限依赖的主题
+	id, authed := auth.FromContext(ctx)
+	response.Instances = make([]*pb.Discover, 0, len(instances))
+	for _, instance := range instances {
+		if authed && !id.Allowed(auth.ACTION_DEPEND, instance.Topic) {
+			continue
+		}
+		response.Instances = append(response.Instances, instance.ToProto(now))
+	}
+	return response, nil
+}
+
+// 查询状态变化的事件
+//
+//	事件只记录在做出状态变化的 leader 上，follower 转发给 leader
+func (s *AirfoneService) ListEvents(ctx context.Context, req *pb.ListEventsRequest) (*pb.ListEventsResponse, error) {
+	if leader, fctx, err := s.fwd.leader(ctx); err != nil {
+		return nil, err
+	} else if leader != nil {
+		return leader.ListEvents(fctx, req)
+	}
+	events, err := s.euc.ListEvents(ctx, irepo.EventFilterFromProto(req))
+	if err != nil {
+		return nil, err
+	}
+	// 只返回有权限依赖的主题的事件
+	id, authed := auth.FromContext(ctx)
+	response := &pb.ListEventsResponse{Events: make([]*pb.Event, 0, len(events))}
+	for _, ev := range events {
+		if authed && !id.Allowed(auth.ACTION_DEPEND, ev.Topic) {
+			continue
+		}
+		response.Events = append(response.Events, ev.ToProto())
+	}
+	return response, nil
+}
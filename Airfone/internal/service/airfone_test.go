@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "Airfone/api/airfone"
+	"Airfone/api/errorpb"
+	"Airfone/internal/auth"
+	"Airfone/internal/biz"
+	"Airfone/internal/conf"
+	"Airfone/internal/engine"
+	"Airfone/internal/repo"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+// 与 wire 生成的代码相同，组装单节点(自己就是 leader)的 AirfoneService
+func newTestService(t *testing.T) *AirfoneService {
+	t.Helper()
+	helper := log.NewHelper(log.DefaultLogger)
+	data, cleanup, err := engine.NewData(&conf.Data{}, helper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	tlsConf, err := auth.NewTLS(&conf.Server{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd, cleanup2 := NewForwarder(biz.NewClusterUsecase(repo.NewClusterRepo(data, helper), helper), tlsConf)
+	t.Cleanup(cleanup2)
+	return NewAirfoneService(
+		biz.NewKeepAliveUsecase(repo.NewkeepAliveRepoRepo(data, helper), helper),
+		biz.NewRegisterUsecase(repo.NewRegisterRepo(data, helper), helper),
+		biz.NewWatchUsecase(repo.NewWatchRepo(data, helper), helper),
+		biz.NewDiscoverUsecase(repo.NewDiscoverRepo(data, helper), helper),
+		biz.NewEventUsecase(repo.NewEventRepo(data, helper), helper),
+		fwd, helper,
+	)
+}
+
+// 注册并返回 service
+func registerService(t *testing.T, s *AirfoneService, req *pb.RegisterRequest) *pb.Service {
+	t.Helper()
+	res, err := s.Register(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Service
+}
+
+// 按条件查询事件，时间为毫秒，只返回有权限依赖的主题的事件
+func TestListEvents(t *testing.T) {
+	var (
+		s      = newTestService(t)
+		start  = time.Now().UnixMilli()
+		logSvc = registerService(t, s, &pb.RegisterRequest{Topic: "log", Ip: "10.0.0.1", Port: 80})
+		common = registerService(t, s, &pb.RegisterRequest{Topic: "common", Ip: "10.0.0.2", Port: 80})
+	)
+	if _, err := s.Logout(context.Background(), &pb.LogoutRequest{Topic: "common", Id: common.Id}); err != nil {
+		t.Fatal(err)
+	}
+	viewer := auth.NewContext(context.Background(), &auth.Identity{Name: "viewer", Depend: []string{"log"}})
+	tests := []struct {
+		name string
+		ctx  context.Context
+		req  *pb.ListEventsRequest
+		want []string // 主题与原因
+	}{
+		{"all", context.Background(), &pb.ListEventsRequest{}, []string{"log register", "common register", "common logout"}},
+		{"topic", context.Background(), &pb.ListEventsRequest{Topic: "common"}, []string{"common register", "common logout"}},
+		{"id", context.Background(), &pb.ListEventsRequest{Id: logSvc.Id}, []string{"log register"}},
+		{"instance", context.Background(), &pb.ListEventsRequest{Instance: "10.0.0.2:80"}, []string{"common register", "common logout"}},
+		{"limit", context.Background(), &pb.ListEventsRequest{Limit: 1}, []string{"common logout"}},
+		{"since in milliseconds", context.Background(), &pb.ListEventsRequest{Since: start}, []string{"log register", "common register", "common logout"}},
+		{"until in milliseconds", context.Background(), &pb.ListEventsRequest{Until: start}, []string{}},
+		{"future", context.Background(), &pb.ListEventsRequest{Since: start + time.Hour.Milliseconds()}, []string{}},
+		{"only allowed topics", viewer, &pb.ListEventsRequest{}, []string{"log register"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := s.ListEvents(tt.ctx, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(res.Events))
+			for i, ev := range res.Events {
+				got[i] = ev.Topic + " " + ev.Reason
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+	res, err := s.ListEvents(context.Background(), &pb.ListEventsRequest{Id: logSvc.Id})
+	if err != nil || len(res.Events) != 1 {
+		t.Fatalf("list events of %d = %v, %v", logSvc.Id, res, err)
+	}
+	ev := res.Events[0]
+	if ev.Instance != "10.0.0.1:80" || ev.From != pb.HeartBeatType_HeartBeat_DROPPED || ev.To != pb.HeartBeatType_HeartBeat_RUNNING {
+		t.Errorf("register event = %v", ev)
+	}
+	if ev.Time < start || ev.Time > time.Now().UnixMilli() {
+		t.Errorf("event time %d is not in milliseconds since %d", ev.Time, start)
+	}
+}
+
+// 开启认证之前注册的服务绑定到第一个操作它的身份，其他身份不能再操作
+func TestAuthorizeUnowned(t *testing.T) {
+	var (
+		s        = newTestService(t)
+		provider = registerService(t, s, &pb.RegisterRequest{Topic: "log", Ip: "10.0.0.1", Port: 80})
+		logSvc   = auth.NewContext(context.Background(), &auth.Identity{Name: "logsvc", Register: []string{"log"}})
+		other    = auth.NewContext(context.Background(), &auth.Identity{Name: "other", Register: []string{"log"}})
+		nobody   = auth.NewContext(context.Background(), &auth.Identity{Name: "nobody"})
+	)
+	// 没有注册为该主题的权限时不会绑定
+	if _, err := s.KeepAlive(nobody, &pb.KeepAliveRequest{Topic: "log", Id: provider.Id}); !errorpb.IsForbidden(err) {
+		t.Fatalf("heartbeat without permission = %v, want FORBIDDEN", err)
+	}
+	if _, err := s.KeepAlive(logSvc, &pb.KeepAliveRequest{Topic: "log", Id: provider.Id}); err != nil {
+		t.Fatalf("heartbeat of the first identity = %v", err)
+	}
+	if _, err := s.Logout(other, &pb.LogoutRequest{Topic: "log", Id: provider.Id}); !errorpb.IsForbidden(err) {
+		t.Errorf("logout by another identity = %v, want FORBIDDEN", err)
+	}
+	if _, err := s.Logout(logSvc, &pb.LogoutRequest{Topic: "log", Id: provider.Id}); err != nil {
+		t.Errorf("logout by the bound identity = %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+
+	"Airfone/internal/auth"
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+)
+
+// 授权
+//
+//	认证在 server 的中间件中完成，身份放在 ctx 中(见 internal/auth)，这里在 topic 转换为限定名之后按请求的语义授权:
+//	1. 注册: 注册为该主题的权限，以及声明的每个依赖的权限，注册的服务绑定到当前身份
+//	2. 更新、注销、心跳、确认与会话: 注册为该主题的权限，且服务属于当前身份，没有所有者的服务绑定到当前身份
+//	3. 监听、查询与事件: 依赖这些主题的权限，未指定主题时只返回有权限的主题
+//	未开启认证时 ctx 中没有身份，全部放行
+
+// 当前身份名，未开启认证时为空
+func owner(ctx context.Context) string {
+	if id, ok := auth.FromContext(ctx); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// 检查声明的依赖，topic 为消费者的限定名
+func authorizeRelies(ctx context.Context, topic string, relies []string) error {
+	if _, ok := auth.FromContext(ctx); !ok {
+		return nil
+	}
+	namespace, _ := engine.SplitTopic(topic)
+	names, err := engine.RelyTopics(namespace, relies)
+	if err != nil {
+		return err
+	}
+	return auth.Authorize(ctx, auth.ACTION_DEPEND, names...)
+}
+
+// 检查对一个服务的操作，服务需要属于当前身份
+func (s *AirfoneService) authorizeInstance(ctx context.Context, topic string, id int64) error {
+	if err := auth.Authorize(ctx, auth.ACTION_REGISTER, topic); err != nil {
+		return err
+	}
+	return s.ruc.CheckOwner(ctx, &irepo.Service{
+		Service: &engine.Service{ID: id, Owner: owner(ctx)},
+		Topic:   topic,
+	})
+}
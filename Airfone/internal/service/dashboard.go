@@ -0,0 +1,328 @@
+package service
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"Airfone/api/errorpb"
+	"Airfone/internal/auth"
+	"Airfone/internal/biz"
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+
+	"github.com/go-kratos/kratos/v2/errors"
+)
+
+// 监控页面的静态文件
+//
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// 监控页面每次最多返回的事件数
+const DASHBOARD_EVENTS = 200
+
+// 监控页面
+//
+//	嵌入在 http 服务中的只读页面(/dashboard/)，展示主题、service、心跳时间、主题之间的依赖以及实时的状态变化
+//	思路: 页面定时轮询 /dashboard/api/ 下的 JSON 接口，状态变化从监听的历史事件中按 revision 增量获取，
+//	不需要与服务端保持长连接
+//	查看接口与 rpc 使用相同的认证，开启认证时只返回身份有权限依赖的主题，与 Discover、ListEvents 一致
+//	驱逐、移动、清空等修改操作需要携带管理令牌(见 server/dashboard.go)，未配置令牌时不可用
+type DashboardService struct {
+	auc *biz.AdminUsecase
+	duc *biz.DiscoverUsecase
+	wuc *biz.WatchUsecase
+}
+
+func NewDashboardService(auc *biz.AdminUsecase, duc *biz.DiscoverUsecase, wuc *biz.WatchUsecase) *DashboardService {
+	return &DashboardService{
+		auc: auc,
+		duc: duc,
+		wuc: wuc,
+	}
+}
+
+type dashboardRely struct {
+	Topic string `json:"topic"`
+	ID    string `json:"id"`
+	IP    string `json:"ip"`
+	Port  uint16 `json:"port"`
+}
+
+type dashboardInstance struct {
+	Topic    string            `json:"topic"`
+	ID       string            `json:"id"` // id 与 revision 超出 js 的整数精度，以字符串返回
+	Instance string            `json:"instance"`
+	IP       string            `json:"ip"`
+	Port     uint16            `json:"port"`
+	Status   string            `json:"status"`
+	Age      int64             `json:"age"` // 距最后一次心跳的时间(毫秒)
+	Depends  []string          `json:"depends"`
+	Relies   []*dashboardRely  `json:"relies"`
+	Schema   map[string]string `json:"schema"`
+}
+
+type dashboardEvent struct {
+	Revision string `json:"revision"`
+	Type     string `json:"type"`
+	Topic    string `json:"topic"`
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+}
+
+var (
+	dashboardStatus = map[engine.HeartBeatType]string{
+		engine.HeartBeat_RUNNING: "running",
+		engine.HeartBeat_CHANGED: "changed",
+		engine.HeartBeat_PENDING: "pending",
+		engine.HeartBeat_DROPPED: "dropped",
+	}
+	dashboardEventType = map[engine.WatchEventType]string{
+		engine.WATCH_PUT:    "put",
+		engine.WATCH_DELETE: "delete",
+		engine.WATCH_STATUS: "status",
+	}
+)
+
+// 页面
+func (s *DashboardService) Index() http.Handler {
+	sub, _ := fs.Sub(dashboardFS, "dashboard")
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(sub)))
+}
+
+// 主题概况
+func (s *DashboardService) Topics(w http.ResponseWriter, r *http.Request) {
+	topics, err := s.auc.Topics(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var res = make([]*engine.TopicInfo, 0, len(topics))
+	for _, t := range topics {
+		if auth.Authorize(r.Context(), auth.ACTION_DEPEND, t.Name) == nil {
+			res = append(res, t.TopicInfo)
+		}
+	}
+	writeJSON(w, res)
+}
+
+// 主题中的 service
+//
+//	topic 为空时返回全部主题
+func (s *DashboardService) Instances(w http.ResponseWriter, r *http.Request) {
+	var topics []string
+	if topic := r.URL.Query().Get("topic"); topic != "" {
+		topics = []string{topic}
+	}
+	instances, err := s.duc.Discover(r.Context(), topics, &irepo.DiscoverFilter{})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var (
+		now = time.Now().UnixNano()
+		res = make([]*dashboardInstance, 0, len(instances))
+	)
+	for _, in := range instances {
+		if auth.Authorize(r.Context(), auth.ACTION_DEPEND, in.Topic) != nil {
+			continue
+		}
+		d := &dashboardInstance{
+			Topic:    in.Topic,
+			ID:       strconv.FormatInt(in.Service.ID, 10),
+			Instance: in.Service.Instance,
+			IP:       in.Service.IP,
+			Port:     in.Service.Port,
+			Status:   dashboardStatus[in.Service.Status],
+			Age:      (now - in.Keepalive) / int64(time.Millisecond),
+			Depends:  in.Service.Depends,
+			Relies:   make([]*dashboardRely, 0, len(in.Service.Rely)),
+			Schema:   make(map[string]string, len(in.Service.Schema)),
+		}
+		for _, rely := range in.Service.Rely {
+			if auth.Authorize(r.Context(), auth.ACTION_DEPEND, rely.Topic) != nil {
+				continue
+			}
+			d.Relies = append(d.Relies, &dashboardRely{
+				Topic: rely.Topic,
+				ID:    strconv.FormatInt(rely.ID, 10),
+				IP:    rely.IP,
+				Port:  rely.Port,
+			})
+		}
+		for _, schema := range in.Service.Schema {
+			d.Schema[schema.Title] = schema.Content
+		}
+		res = append(res, d)
+	}
+	writeJSON(w, res)
+}
+
+// 主题之间的依赖关系
+func (s *DashboardService) Graph(w http.ResponseWriter, r *http.Request) {
+	edges, err := s.auc.Graph(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var res = make([]*engine.TopicEdge, 0, len(edges))
+	for _, e := range edges {
+		if auth.Authorize(r.Context(), auth.ACTION_DEPEND, e.From, e.To) == nil {
+			res = append(res, e.TopicEdge)
+		}
+	}
+	writeJSON(w, res)
+}
+
+// 状态变化
+//
+//	返回 revision 大于 after 的事件，after 为空时只返回当前的 revision
+func (s *DashboardService) Events(w http.ResponseWriter, r *http.Request) {
+	var limit = DASHBOARD_EVENTS
+	after, err := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		after, limit = -1, 0
+	}
+	events, revision := s.wuc.History(r.Context(), after, limit)
+	var res = struct {
+		Revision string            `json:"revision"`
+		Events   []*dashboardEvent `json:"events"`
+	}{
+		Revision: strconv.FormatInt(revision, 10),
+		Events:   make([]*dashboardEvent, 0, len(events)),
+	}
+	for _, ev := range events {
+		if auth.Authorize(r.Context(), auth.ACTION_DEPEND, ev.Topic) != nil {
+			continue
+		}
+		res.Events = append(res.Events, &dashboardEvent{
+			Revision: strconv.FormatInt(ev.Revision, 10),
+			Type:     dashboardEventType[ev.Type],
+			Topic:    ev.Topic,
+			ID:       strconv.FormatInt(ev.ID, 10),
+			Status:   dashboardStatus[ev.Status],
+		})
+	}
+	writeJSON(w, res)
+}
+
+// 修改操作的请求
+type dashboardAction struct {
+	Topic  string `json:"topic"`
+	ID     string `json:"id"`
+	Status string `json:"status"` // 移动的目标状态，running 或 pending
+}
+
+func readAction(r *http.Request) (*dashboardAction, int64, error) {
+	var action = new(dashboardAction)
+	if err := json.NewDecoder(r.Body).Decode(action); err != nil {
+		return nil, 0, errors.BadRequest("BAD_REQUEST", err.Error())
+	}
+	if action.ID == "" {
+		return action, 0, nil
+	}
+	id, err := strconv.ParseInt(action.ID, 10, 64)
+	if err != nil {
+		return nil, 0, errors.BadRequest("BAD_REQUEST", err.Error())
+	}
+	return action, id, nil
+}
+
+// 驱逐
+func (s *DashboardService) Evict(w http.ResponseWriter, r *http.Request) {
+	action, id, err := readAction(r)
+	if err == nil {
+		err = s.auc.Evict(r.Context(), action.Topic, id)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, struct{}{})
+}
+
+// 移动
+func (s *DashboardService) Move(w http.ResponseWriter, r *http.Request) {
+	action, id, err := readAction(r)
+	if err == nil {
+		status := engine.HeartBeat_RUNNING
+		if action.Status == dashboardStatus[engine.HeartBeat_PENDING] {
+			status = engine.HeartBeat_PENDING
+		}
+		err = s.auc.Move(r.Context(), action.Topic, id, status)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, struct{}{})
+}
+
+// 清空
+func (s *DashboardService) Flush(w http.ResponseWriter, r *http.Request) {
+	var n int
+	action, _, err := readAction(r)
+	if err == nil {
+		n, err = s.auc.Flush(r.Context(), action.Topic)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, struct {
+		Evicted int `json:"evicted"`
+	}{n})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// 与 kratos 的错误响应格式一致，状态码见 HTTPStatus
+func writeError(w http.ResponseWriter, err error) {
+	e := errors.FromError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(HTTPStatus(e))
+	json.NewEncoder(w).Encode(e)
+}
+
+// 错误码对应的 http 状态码
+//
+//	errorpb 的错误码不是 http 状态码(如 UNAUTHORIZED 为 108，SELECTOR_INVALID 为 201)，
+//	直接作为状态码返回时客户端会把失败当作成功，这里按错误原因转换，响应体中仍是原本的错误码
+//	http 服务(server/http.go)与监控页面共用
+var httpStatus = map[string]int{
+	errorpb.ErrorReason_SEARCH_INVALID.String():       http.StatusNotFound,
+	errorpb.ErrorReason_UPDATE_INVALID.String():       http.StatusNotFound,
+	errorpb.ErrorReason_DELETE_INVALID.String():       http.StatusNotFound,
+	errorpb.ErrorReason_INSERT_ALREADY_EXIST.String(): http.StatusConflict,
+	errorpb.ErrorReason_TOPIC_NOT_EMPTY.String():      http.StatusConflict,
+	errorpb.ErrorReason_NOT_LEADER.String():           http.StatusServiceUnavailable,
+	errorpb.ErrorReason_STALE_ID.String():             http.StatusConflict,
+	errorpb.ErrorReason_UNAUTHORIZED.String():         http.StatusUnauthorized,
+	errorpb.ErrorReason_FORBIDDEN.String():            http.StatusForbidden,
+	errorpb.ErrorReason_SELECTOR_INVALID.String():     http.StatusBadRequest,
+	errorpb.ErrorReason_HEALTH_CHECK_INVALID.String(): http.StatusBadRequest,
+	errorpb.ErrorReason_LABEL_INVALID.String():        http.StatusBadRequest,
+	errorpb.ErrorReason_VERSION_INVALID.String():      http.StatusBadRequest,
+	errorpb.ErrorReason_NAMESPACE_INVALID.String():    http.StatusBadRequest,
+	errorpb.ErrorReason_WATCH_LAGGED.String():         http.StatusGone,
+}
+
+// 获取错误的 http 状态码
+//
+//	未列出的错误原因沿用错误码，错误码不是错误的状态码(4xx、5xx)时视为 500
+func HTTPStatus(se *errors.Error) int {
+	if code, ok := httpStatus[se.Reason]; ok {
+		return code
+	}
+	if se.Code >= 400 && se.Code < 600 {
+		return int(se.Code)
+	}
+	return http.StatusInternalServerError
+}
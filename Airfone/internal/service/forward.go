@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"sync"
+
+	pb "Airfone/api/airfone"
+	"Airfone/api/errorpb"
+	"Airfone/internal/auth"
+	"Airfone/internal/biz"
+
+	"github.com/go-kratos/kratos/v2/transport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// 写请求转发
+//
+//	开启集群时只有 leader 能处理写请求(注册，更新，注销，心跳，确认)
+//	思路: follower 收到写请求后，通过 grpc 转发给 leader，并把 leader 的响应原样返回
+//	与 leader 的连接按地址缓存，leader 变化后使用新的连接
+//	开启 TLS 时以本节点的证书连接 leader(见 auth/tls.go)，以客户端证书认证的调用方由 leader 按转发的身份名认证(见 auth.Nodes)
+type Forwarder struct {
+	cuc   *biz.ClusterUsecase
+	tls   *tls.Config
+	lock  sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func NewForwarder(cuc *biz.ClusterUsecase, t *auth.TLS) (*Forwarder, func()) {
+	f := &Forwarder{
+		cuc:   cuc,
+		tls:   t.Client,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+	return f, f.close
+}
+
+// 获取 leader 的客户端
+//
+//	当前节点就是 leader，或者请求已经被其他节点转发过时，返回 nil，由当前节点处理，避免 leader 切换期间在节点之间来回转发
+//	转发标记只有来自集群节点时才会保留(见 server/auth.go)
+//	没有 leader 时(选举中)返回 NOT_LEADER 错误
+//	调用方的 authorization 头原样转发，由 leader 重新认证；以客户端证书认证时转发认证出的身份名
+func (f *Forwarder) leader(ctx context.Context) (pb.AirfoneClient, context.Context, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(auth.FORWARDED_KEY)) > 0 {
+		return nil, ctx, nil
+	}
+	addr, isLeader := f.cuc.Leader(ctx)
+	if isLeader {
+		return nil, ctx, nil
+	}
+	if addr == "" {
+		return nil, ctx, errorpb.ErrorNotLeader("no leader elected")
+	}
+	conn, err := f.conn(addr)
+	if err != nil {
+		return nil, ctx, err
+	}
+	var (
+		kv    = []string{auth.FORWARDED_KEY, "1"}
+		token string
+	)
+	if tr, ok := transport.FromServerContext(ctx); ok {
+		token = tr.RequestHeader().Get("authorization")
+	}
+	if token != "" {
+		kv = append(kv, "authorization", token)
+	} else if id, ok := auth.FromContext(ctx); ok {
+		kv = append(kv, auth.IDENTITY_KEY, id.Name)
+	}
+	return pb.NewAirfoneClient(conn), metadata.AppendToOutgoingContext(ctx, kv...), nil
+}
+
+func (f *Forwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if conn, ok := f.conns[addr]; ok {
+		return conn, nil
+	}
+	security := grpc.WithTransportCredentials(insecure.NewCredentials())
+	if f.tls != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(f.tls))
+	}
+	conn, err := grpc.Dial(addr, security)
+	if err != nil {
+		return nil, err
+	}
+	f.conns[addr] = conn
+	return conn, nil
+}
+
+func (f *Forwarder) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for addr, conn := range f.conns {
+		conn.Close()
+		delete(f.conns, addr)
+	}
+}
+
+// 转发会话
+//
+//	follower 与 leader 建立一条会话，双向原样转发消息，任意一方结束时整条会话结束
+func (f *Forwarder) session(ctx context.Context, leader pb.AirfoneClient, first *pb.SessionRequest, stream pb.Airfone_SessionServer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	up, err := leader.Session(ctx)
+	if err != nil {
+		return err
+	}
+	if err = up.Send(first); err != nil {
+		return err
+	}
+	// 客户端 -> leader
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					up.CloseSend()
+				} else {
+					cancel()
+				}
+				return
+			}
+			if err = up.Send(req); err != nil {
+				return
+			}
+		}
+	}()
+	// leader -> 客户端
+	for {
+		res, err := up.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
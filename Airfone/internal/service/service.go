@@ -23,4 +23,7 @@ import "github.com/google/wire"
 // ProviderSet is service providers.
 var ProviderSet = wire.NewSet(
 	NewAirfoneService,
+	NewForwarder,
+	NewAdminService,
+	NewDashboardService,
 )
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	pb "Airfone/api/airfone"
+	"Airfone/internal/biz/irepo"
+	"Airfone/internal/engine"
+)
+
+// 会话
+//
+//	思路: 第一条消息确定会话所属的服务，之后
+//	1. 客户端的心跳与 KeepAlive 一致，回复当前状态；确认与 Conform 一致，不回复
+//	2. 监听服务所在的主题，服务自身被修改(依赖被替换、状态变化、被删除)时，读取当前的状态与依赖，
+//	   不是 running 时推送给客户端，客户端不必等到下一次心跳；推送不刷新心跳时间也不改变状态，
+//	   超时或管理员置为的 pending 不会被撤销，只有客户端的心跳才会续期
+//	3. 会话断开时立即将服务置为 pending，客户端已经重连(有了更新的会话)时不做任何操作
+//	4. 全量模式下同时监听依赖的主题，依赖的主题发生变化时推送当前的依赖与全部提供者，
+//	   推送不刷新心跳时间；服务自身被修改后依赖的主题可能改变，重新确定监听的主题
+//	follower 收到会话后，将整条会话转发给 leader
+func (s *AirfoneService) Session(stream pb.Airfone_SessionServer) error {
+	var (
+		ctx  = stream.Context()
+		reqs = make(chan *pb.SessionRequest)
+		errs = make(chan error, 1)
+	)
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if leader, fctx, err := s.fwd.leader(ctx); err != nil {
+		return err
+	} else if leader != nil {
+		return s.fwd.session(fctx, leader, first, stream)
+	}
+
+	// 接收协程
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	topic, err := engine.Qualify(first.Namespace, first.Topic)
+	if err != nil {
+		return err
+	}
+	// 在断开时置为 pending 之前检查，避免断开别人的服务
+	if err = s.authorizeInstance(ctx, topic, first.Id); err != nil {
+		return err
+	}
+	var (
+		hb = &irepo.HeartBeat{
+			HeartBeat: &engine.HeartBeat{
+				Topic: topic,
+				ID:    first.Id,
+			},
+		}
+		topics = []string{topic}
+		w      = s.wuc.Watch(ctx, topics, -1)
+	)
+	// 客户端重连后旧的会话可能稍后才断开，断开时只处理当前的会话
+	hb.Session = s.kuc.Connect(ctx, hb)
+	defer func() {
+		w.Close()
+		// 会话断开，不必等到心跳超时
+		if err := s.kuc.Disconnect(context.Background(), hb); err != nil {
+			s.log.Errorf("session %s id: %d disconnect: %s", hb.Topic, hb.ID, err.Error())
+		}
+		fmt.Printf("服务 %v id: %v 会话断开\n", hb.Topic, hb.ID)
+	}()
+	fmt.Printf("服务 %v id: %v 会话建立\n", hb.Topic, hb.ID)
+
+	if err = s.handleSession(ctx, stream, hb, first); err != nil {
+		return err
+	}
+	if t := s.sessionTopics(ctx, hb); !equalTopics(t, topics) {
+		topics = t
+		w.Close()
+		w = s.wuc.Watch(ctx, topics, -1)
+	}
+	for {
+		select {
+		case req := <-reqs:
+			if err = s.handleSession(ctx, stream, hb, req); err != nil {
+				return err
+			}
+		case err = <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events():
+			if !ok {
+				// 消费过慢被断开，重新监听，并检查一次期间可能错过的变化
+				w = s.wuc.Watch(ctx, topics, -1)
+				if err = s.pushEndpoints(ctx, stream, hb); err != nil {
+					return err
+				}
+			} else if ev.Topic != hb.Topic || ev.ID != hb.ID {
+				// 依赖的主题发生变化
+				if relied(topics, ev.Topic) {
+					if err = s.pushEndpoints(ctx, stream, hb); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err = s.pushSession(ctx, stream, hb); err != nil {
+				return err
+			}
+			if t := s.sessionTopics(ctx, hb); !equalTopics(t, topics) {
+				topics = t
+				w.Close()
+				w = s.wuc.Watch(ctx, topics, -1)
+			}
+		}
+	}
+}
+
+// 处理客户端的消息
+func (s *AirfoneService) handleSession(ctx context.Context, stream pb.Airfone_SessionServer, hb *irepo.HeartBeat, req *pb.SessionRequest) error {
+	switch req.Type {
+	case pb.SessionRequestType_SESSION_CONFORM:
+		if err := s.kuc.Conform(ctx, hb); err != nil {
+			return err
+		}
+		fmt.Printf("服务 %v id: %v 服务运行确认\n", hb.Topic, hb.ID)
+	default:
+		res, err := s.kuc.KeepAlive(ctx, &irepo.HeartBeat{
+			HeartBeat: &engine.HeartBeat{Topic: hb.Topic, ID: hb.ID},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("服务 %v id: %v 心跳检测\n", hb.Topic, hb.ID)
+		return stream.Send(&pb.SessionResponse{Keepalive: res.ToProto()})
+	}
+	return nil
+}
+
+// 服务自身被修改时，读取当前的状态与依赖，不是 running 时推送给客户端
+func (s *AirfoneService) pushSession(ctx context.Context, stream pb.Airfone_SessionServer, hb *irepo.HeartBeat) error {
+	res := s.kuc.State(ctx, hb)
+	if res.Status == engine.HeartBeat_RUNNING {
+		return nil
+	}
+	fmt.Printf("服务 %v id: %v 推送状态 %v\n", hb.Topic, hb.ID, res.Status)
+	return stream.Send(&pb.SessionResponse{Keepalive: res.ToProto()})
+}
+
+// 依赖的主题发生变化时，全量模式下推送当前的依赖与全部提供者
+func (s *AirfoneService) pushEndpoints(ctx context.Context, stream pb.Airfone_SessionServer, hb *irepo.HeartBeat) error {
+	res, ok := s.kuc.Endpoints(ctx, hb)
+	if !ok {
+		return nil
+	}
+	fmt.Printf("服务 %v id: %v 推送全部依赖\n", hb.Topic, hb.ID)
+	return stream.Send(&pb.SessionResponse{Keepalive: res.ToProto()})
+}
+
+// 会话监听的主题: 第一个为服务所在的主题，全量模式下之后为依赖的主题
+func (s *AirfoneService) sessionTopics(ctx context.Context, hb *irepo.HeartBeat) []string {
+	topics := []string{hb.Topic}
+	if res, ok := s.kuc.Endpoints(ctx, hb); ok {
+		for name := range res.Instances {
+			topics = append(topics, name)
+		}
+		sort.Strings(topics[1:])
+	}
+	return topics
+}
+
+// 是否为依赖的主题
+func relied(topics []string, name string) bool {
+	for _, t := range topics[1:] {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+func equalTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
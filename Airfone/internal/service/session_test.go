@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	pb "Airfone/api/airfone"
+
+	"google.golang.org/grpc"
+)
+
+// 内存中的会话流，reqs 关闭时 Recv 返回 io.EOF
+type testSessionStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs chan *pb.SessionRequest
+	resp chan *pb.SessionResponse
+}
+
+func (s *testSessionStream) Context() context.Context { return s.ctx }
+
+func (s *testSessionStream) Send(res *pb.SessionResponse) error {
+	s.resp <- res
+	return nil
+}
+
+func (s *testSessionStream) Recv() (*pb.SessionRequest, error) {
+	select {
+	case req, ok := <-s.reqs:
+		if !ok {
+			return nil, io.EOF
+		}
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// 建立会话并发送第一条心跳，返回会话流与会话结束时的错误
+func openSession(t *testing.T, s *AirfoneService, topic string, id int64) (*testSessionStream, chan error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream := &testSessionStream{
+		ctx:  ctx,
+		reqs: make(chan *pb.SessionRequest, 1),
+		resp: make(chan *pb.SessionResponse, 16),
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Session(stream) }()
+	stream.reqs <- &pb.SessionRequest{Topic: topic, Id: id}
+	if res := stream.next(t); res.Keepalive.Status != pb.HeartBeatType_HeartBeat_RUNNING {
+		t.Fatalf("first heartbeat = %v, want running", res.Keepalive)
+	}
+	return stream, done
+}
+
+// 心跳并等待回复，回复之后会话已经按当前的依赖监听
+func (s *testSessionStream) heartbeat(t *testing.T) *pb.SessionResponse {
+	t.Helper()
+	s.reqs <- &pb.SessionRequest{Type: pb.SessionRequestType_SESSION_HEARTBEAT}
+	return s.next(t)
+}
+
+func (s *testSessionStream) next(t *testing.T) *pb.SessionResponse {
+	t.Helper()
+	select {
+	case res := <-s.resp:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response from session")
+	}
+	return nil
+}
+
+// service 最近的一个事件
+func lastEvent(t *testing.T, s *AirfoneService, topic string, id int64) *pb.Event {
+	t.Helper()
+	res, err := s.ListEvents(context.Background(), &pb.ListEventsRequest{Topic: topic, Id: id, Limit: 1})
+	if err != nil || len(res.Events) != 1 {
+		t.Fatalf("list events of %s id: %d = %v, %v", topic, id, res, err)
+	}
+	return res.Events[0]
+}
+
+// 会话断开时立即将服务置为 pending，并传播给依赖它的消费者
+func TestSessionDisconnect(t *testing.T) {
+	var (
+		s        = newTestService(t)
+		provider = registerService(t, s, &pb.RegisterRequest{Topic: "log", Ip: "10.0.0.1", Port: 80})
+		consumer = registerService(t, s, &pb.RegisterRequest{Topic: "common", Ip: "10.0.1.1", Port: 80, Relies: []string{"log"}})
+	)
+	stream, done := openSession(t, s, "log", provider.Id)
+	close(stream.reqs)
+	if err := <-done; err != nil {
+		t.Fatalf("session closed with %v", err)
+	}
+	if ev := lastEvent(t, s, "log", provider.Id); ev.Reason != "disconnect" || ev.To != pb.HeartBeatType_HeartBeat_PENDING {
+		t.Errorf("provider event = %v, want disconnect to pending", ev)
+	}
+	if ev := lastEvent(t, s, "common", consumer.Id); ev.Reason != "dependency" || ev.To != pb.HeartBeatType_HeartBeat_PENDING {
+		t.Errorf("consumer event = %v, want dependency to pending", ev)
+	}
+}
+
+// 客户端重连之后旧的会话才断开，不影响新的会话
+func TestSessionReconnect(t *testing.T) {
+	var (
+		s        = newTestService(t)
+		provider = registerService(t, s, &pb.RegisterRequest{Topic: "log", Ip: "10.0.0.1", Port: 80})
+	)
+	stale, staleDone := openSession(t, s, "log", provider.Id)
+	current, done := openSession(t, s, "log", provider.Id)
+	close(stale.reqs)
+	if err := <-staleDone; err != nil {
+		t.Fatalf("stale session closed with %v", err)
+	}
+	if ev := lastEvent(t, s, "log", provider.Id); ev.Reason == "disconnect" {
+		t.Errorf("stale session demoted the provider: %v", ev)
+	}
+	if res := current.heartbeat(t); res.Keepalive.Status != pb.HeartBeatType_HeartBeat_RUNNING {
+		t.Errorf("heartbeat on the current session = %v, want running", res.Keepalive)
+	}
+	close(current.reqs)
+	if err := <-done; err != nil {
+		t.Fatalf("session closed with %v", err)
+	}
+	if ev := lastEvent(t, s, "log", provider.Id); ev.Reason != "disconnect" || ev.To != pb.HeartBeatType_HeartBeat_PENDING {
+		t.Errorf("provider event = %v, want disconnect to pending", ev)
+	}
+}
+
+// 服务自身的状态变化时推送当前状态，不必等到下一次心跳
+func TestSessionPushState(t *testing.T) {
+	var (
+		s        = newTestService(t)
+		provider = registerService(t, s, &pb.RegisterRequest{Topic: "log", Ip: "10.0.0.1", Port: 80})
+		consumer = registerService(t, s, &pb.RegisterRequest{Topic: "common", Ip: "10.0.1.1", Port: 80, Relies: []string{"log"}})
+	)
+	stream, _ := openSession(t, s, "common", consumer.Id)
+	if _, err := s.Logout(context.Background(), &pb.LogoutRequest{Topic: "log", Id: provider.Id}); err != nil {
+		t.Fatal(err)
+	}
+	res := stream.next(t)
+	if res.Keepalive.Status != pb.HeartBeatType_HeartBeat_PENDING || res.Keepalive.Unresolved["log"] == "" {
+		t.Fatalf("pushed %v, want pending with log unresolved", res.Keepalive)
+	}
+	// 提供者恢复后推送新的依赖
+	again := registerService(t, s, &pb.RegisterRequest{Topic: "log", Ip: "10.0.0.2", Port: 80})
+	res = stream.next(t)
+	if res.Keepalive.Status != pb.HeartBeatType_HeartBeat_CHANGED || len(res.Keepalive.Relies) != 1 || res.Keepalive.Relies[0].Id != again.Id {
+		t.Fatalf("pushed %v, want changed to id %d", res.Keepalive, again.Id)
+	}
+}
+
+// 全量模式下依赖的主题发生变化时推送全部提供者
+func TestSessionPushEndpoints(t *testing.T) {
+	var (
+		s        = newTestService(t)
+		_        = registerService(t, s, &pb.RegisterRequest{Topic: "log", Ip: "10.0.0.1", Port: 80})
+		consumer = registerService(t, s, &pb.RegisterRequest{Topic: "common", Ip: "10.0.1.1", Port: 80, Relies: []string{"log"}, AllInstances: true})
+	)
+	stream, _ := openSession(t, s, "common", consumer.Id)
+	stream.heartbeat(t)
+	registerService(t, s, &pb.RegisterRequest{Topic: "log", Ip: "10.0.0.2", Port: 80})
+	res := stream.next(t)
+	if len(res.Keepalive.Relies) != 1 || len(res.Keepalive.Relies[0].Instances) != 2 {
+		t.Fatalf("pushed %v, want both log providers", res.Keepalive)
+	}
+}
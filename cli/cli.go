@@ -2,14 +2,20 @@ package cli
 
 import (
 	pb "cli/api/airfone"
+	"cli/api/errorpb"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// 服务端的默认租约，实际使用的是注册时服务端返回的租约(client.Lease)，
+// 仅在服务端未返回租约时作为兜底
 const (
 	DURATION_HEARTBEAT = 2 * time.Second // 心跳时间，每隔 DURATION_HEARTBEAT 轮询一次，客户端向服务器端发送一次心跳
 	DURATION_VALID     = 3 * time.Second // 有效时间，当客户端超过 DURATION_VALID 未向服务器端发送心跳，即便在 running 队列中，也不纳入使用
@@ -17,12 +23,33 @@ const (
 	DURATION_DROPPED   = 6 * time.Second // dropping时间，若 pending队列中 service心跳 与当前时间相差 DURATION_DROPPED 则认为失联，将其状态置为 dropping 并删除
 )
 
+// 注册请求超时或注册中心暂时不可用时的重试，重试时携带相同的幂等令牌
+const (
+	REGISTER_RETRY   = 3                      // 最多尝试的次数
+	REGISTER_BACKOFF = 200 * time.Millisecond // 第 n 次重试前等待 n * REGISTER_BACKOFF
+)
+
+// 监听断开后，重新监听前的等待时间
+const WATCH_BACKOFF = time.Second
+
 type Config struct {
-	Schema []*pb.Schema // 元数据
-	Relies []string     // 依赖的 topic 名
-	Topic  string       // 自己的主题
-	IP     string       // ip
-	Port   int32        // 端口
+	Schema       []*pb.Schema      // 元数据
+	Relies       []string          // 依赖的 topic 名，可以附加版本约束与标签选择器，如 log@^2.1{env=prod,tier!=canary}
+	Topic        string            // 自己的主题
+	IP           string            // ip
+	Port         int32             // 端口
+	Selector     string            // 负载均衡策略，为空则使用服务端配置
+	Weight       int32             // 权重，加权随机时使用
+	Region       string            // 地域
+	Zone         string            // 可用区(机房)
+	Rack         string            // 机架
+	Lease        *pb.Lease         // 请求的租约(毫秒)，为空则使用服务端默认值，服务端会将其裁剪到允许的范围内
+	Instance     string            // 实例标识，同一实例重复注册时沿用原来的 id，为空则使用 ip:port
+	Health       *pb.HealthCheck   // 主动健康检查(毫秒)，为空则只依靠心跳判断存活
+	Labels       map[string]string // 标签，供消费者通过标签选择器筛选
+	Version      string            // 语义化版本，如 2.1.3，供消费者通过版本约束筛选
+	AllInstances bool              // 全量模式，返回各依赖 topic 中全部可用的提供者，通过 Pick 在客户端做负载均衡
+	Namespace    string            // 命名空间，为空则为 default，依赖默认只在该命名空间中查找，跨命名空间时写作 infra/log
 }
 
 type client struct {
@@ -31,33 +58,56 @@ type client struct {
 	ctx    context.Context
 	cancel chan struct{}
 
-	Relies map[string]*pb.Rely // 依赖
-	Schema []*pb.Schema        // 元数据信息
-	Topic  string              // 服务名称
-	Ip     string              // ip地址
-	Prot   int32               // 端口
-	Id     int32               // id 号
-	Status pb.HeartBeatType    // 服务状态
+	Relies     map[string]*pb.Rely // 依赖
+	Schema     []*pb.Schema        // 元数据信息
+	Topic      string              // 服务名称
+	Namespace  string              // 命名空间，Watch 与 Discover 也在该命名空间中查询
+	Ip         string              // ip地址
+	Prot       int32               // 端口
+	Id         int64               // id 号
+	Status     pb.HeartBeatType    // 服务状态
+	Selector   string              // 负载均衡策略
+	Weight     int32               // 权重
+	Region     string              // 地域
+	Zone       string              // 可用区(机房)
+	Rack       string              // 机架
+	Lease      *pb.Lease           // 服务端授予的租约
+	Instance   string              // 实例标识
+	Labels     map[string]string   // 标签
+	Version    string              // 语义化版本
+	Unresolved map[string]string   // 状态为 pending 时，没有找到提供者的依赖及原因
+	request    *pb.Lease           // 注册时请求的租约，重新注册时沿用
+	health     *pb.HealthCheck     // 注册时声明的健康检查，重新注册时沿用
+	depends    []string            // 依赖的 topic 名，重新注册时沿用(Relies 中只有已经找到提供者的依赖)
+	all        bool                // 全量模式，重新注册时沿用
+	pool       *balancer           // 各依赖的提供者，见 pick.go
 }
 
 // 新建一个客户端
 //
-//	url 为注册中心的 ip + port
-func NewCli(url string) (*client, error) {
+//	url 为注册中心的 ip + port，opts 见 option.go
+func NewCli(url string, opts ...Option) (*client, error) {
 	var (
 		client   = new(client)
-		security grpc.DialOption
+		o        = new(options)
+		dialOpts []grpc.DialOption
 		conn     *grpc.ClientConn
 		err      error
 	)
-	security = grpc.WithTransportCredentials(insecure.NewCredentials())
-	if conn, err = grpc.Dial(url, security); err != nil {
+	for _, opt := range opts {
+		opt(o)
+	}
+	if dialOpts, err = o.dialOptions(); err != nil {
+		return nil, err
+	}
+	if conn, err = grpc.Dial(url, dialOpts...); err != nil {
 		return nil, err
 	}
 
 	cli := pb.NewAirfoneClient(conn)
 	client.conn = conn
 	client.proto = cli
+	client.pool = newBalancer()
 	return client, nil
 }
 
@@ -69,14 +119,31 @@ func (cli *client) Register(cfg *Config) error {
 	)
 	cli.cancel = cancel
 	cli.ctx = ctx
+	cli.request = cfg.Lease
+	cli.depends = cfg.Relies
+	cli.health = cfg.Health
+	cli.all = cfg.AllInstances
 
 	// 进行服务注册
-	res, err := cli.proto.Register(ctx, &pb.RegisterRequest{
-		Schema: cfg.Schema,
-		Relies: cfg.Relies,
-		Topic:  cfg.Topic,
-		Ip:     cfg.IP,
-		Port:   cfg.Port,
+	cli.Namespace = cfg.Namespace
+	res, err := cli.register(ctx, &pb.RegisterRequest{
+		Namespace:    cfg.Namespace,
+		Schema:       cfg.Schema,
+		Relies:       cfg.Relies,
+		Topic:        cfg.Topic,
+		Ip:           cfg.IP,
+		Port:         cfg.Port,
+		Selector:     cfg.Selector,
+		Weight:       cfg.Weight,
+		Region:       cfg.Region,
+		Zone:         cfg.Zone,
+		Rack:         cfg.Rack,
+		Lease:        cfg.Lease,
+		Instance:     cfg.Instance,
+		Health:       cfg.Health,
+		Labels:       cfg.Labels,
+		Version:      cfg.Version,
+		AllInstances: cfg.AllInstances,
 	})
 	if err != nil {
 		cancelFunc()
@@ -87,8 +154,9 @@ func (cli *client) Register(cfg *Config) error {
 	// 如果状态为 changed 则需要更新依赖服务，重新向服务端发送确认信息，确保服务可用
 	if cli.Status == pb.HeartBeatType_HeartBeat_CHANGED {
 		if _, err = cli.proto.Conform(ctx, &pb.ConformRequest{
-			Topic: cli.Topic,
-			Id:    cli.Id,
+			Namespace: cli.Namespace,
+			Topic:     cli.Topic,
+			Id:        cli.Id,
 		}); err != nil {
 			cancelFunc()
 			return nil
@@ -104,87 +172,253 @@ func (cli *client) Register(cfg *Config) error {
 // 心跳
 //
 //	被动的，在注册的时候自动启动，注销的时候自动删除
+//	优先通过会话(Session)发送心跳与确认，注册中心会在依赖或状态变化时主动推送，不必等到下一次心跳；
+//	会话断开后在下一次心跳时重新建立，注册中心不支持会话时退回到单次的 KeepAlive/Conform 调用
 func (cli *client) keepalive(cancel func()) {
 	var (
-		ticker = time.NewTicker(DURATION_HEARTBEAT)
+		heartbeat = cli.heartbeat()
+		ticker    = time.NewTicker(heartbeat)
+		sess      *session
+		unary     bool // 注册中心不支持会话
 	)
+	defer func() {
+		ticker.Stop()
+		if sess != nil {
+			sess.close()
+		}
+	}()
 	for {
+		var (
+			res *pb.Keepalive
+			err error
+		)
 		select {
 		case <-ticker.C:
 			// 心跳检测
-			res, err := cli.proto.KeepAlive(cli.ctx, &pb.KeepAliveRequest{
-				Topic: cli.Topic,
-				Id:    cli.Id,
-			})
-			if err != nil {
+			if !unary {
+				if sess == nil {
+					sess, err = cli.session()
+				} else {
+					err = sess.send(pb.SessionRequestType_SESSION_HEARTBEAT)
+				}
+				if err != nil {
+					fmt.Println(err)
+					sess.close()
+					sess = nil
+				}
+				// 响应由会话返回
+				continue
+			}
+			var r *pb.KeepAliveResponse
+			if r, err = cli.proto.KeepAlive(cli.ctx, &pb.KeepAliveRequest{
+				Namespace: cli.Namespace,
+				Topic:     cli.Topic,
+				Id:        cli.Id,
+			}); err == nil {
+				res = r.Keepalive
+			}
+		case res = <-sess.recv():
+		case err = <-sess.fail():
+			sess.close()
+			sess = nil
+			if status.Code(err) == codes.Unimplemented {
+				fmt.Println("心跳: 注册中心不支持会话")
+				unary = true
+				continue
+			}
+		case <-cli.cancel:
+			cancel()
+			return
+		}
+		if err != nil {
+			if !errorpb.IsStaleId(err) {
 				fmt.Println(err)
 				continue
 			}
-			switch res.Keepalive.Status {
-			case pb.HeartBeatType_HeartBeat_PENDING:
-				fmt.Println("心跳: 服务暂停")
-			case pb.HeartBeatType_HeartBeat_CHANGED:
-				// 若心跳状态为 changed, 则需要再次确认
-				fmt.Println("心跳: 服务变更")
-				cli.updateRelies(res.Keepalive.Relies)
-				_, err := cli.proto.Conform(cli.ctx, &pb.ConformRequest{
-					Topic: cli.Topic,
-					Id:    cli.Id,
-				})
-				if err != nil {
+			// id 属于注册中心之前的纪元(注册中心重启过)，与 dropped 一样需要重新注册
+			res = &pb.Keepalive{Status: pb.HeartBeatType_HeartBeat_DROPPED}
+		}
+		cli.Unresolved = res.Unresolved
+		// 全量模式下每次都返回全部依赖与全部提供者
+		if cli.all && res.Status != pb.HeartBeatType_HeartBeat_DROPPED {
+			cli.setRelies(res.Relies)
+		}
+		switch res.Status {
+		case pb.HeartBeatType_HeartBeat_PENDING:
+			fmt.Println("心跳: 服务暂停")
+			for topic, reason := range res.Unresolved {
+				fmt.Printf("心跳: 依赖 %s 不可用: %s\n", topic, reason)
+			}
+		case pb.HeartBeatType_HeartBeat_CHANGED:
+			// 若心跳状态为 changed, 则需要再次确认
+			fmt.Println("心跳: 服务变更")
+			cli.updateRelies(res.Relies)
+			if err = cli.conform(sess); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			cli.Status = pb.HeartBeatType_HeartBeat_RUNNING
+		case pb.HeartBeatType_HeartBeat_DROPPED:
+			// 若心跳状态为 dropped, 则需要重新注册
+			// 携带原来的实例标识，注册中心会沿用原来的 id
+			var res *pb.RegisterResponse
+			if res, err = cli.register(cli.ctx, &pb.RegisterRequest{
+				Namespace:    cli.Namespace,
+				Schema:       cli.Schema,
+				Relies:       cli.depends,
+				Topic:        cli.Topic,
+				Ip:           cli.Ip,
+				Port:         cli.Prot,
+				Selector:     cli.Selector,
+				Weight:       cli.Weight,
+				Region:       cli.Region,
+				Zone:         cli.Zone,
+				Rack:         cli.Rack,
+				Lease:        cli.request,
+				Instance:     cli.Instance,
+				Health:       cli.health,
+				Labels:       cli.Labels,
+				Version:      cli.Version,
+				AllInstances: cli.all,
+			}); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			cli.fromService(res.Service)
+			// 得到了新的 id，原来的会话已经失效，下一次心跳时重新建立
+			if sess != nil && sess.id != cli.Id {
+				sess.close()
+				sess = nil
+			}
+			// 重新注册后服务端授予的租约可能发生变化
+			if h := cli.heartbeat(); h != heartbeat {
+				heartbeat = h
+				ticker.Reset(heartbeat)
+			}
+			// 如果状态为 changed 则需要更新依赖服务，重新向服务端发送确认信息，确保服务可用
+			if cli.Status == pb.HeartBeatType_HeartBeat_CHANGED {
+				if err = cli.conform(sess); err != nil {
 					fmt.Println(err)
 					continue
 				}
 				cli.Status = pb.HeartBeatType_HeartBeat_RUNNING
-			case pb.HeartBeatType_HeartBeat_DROPPED:
-				// todo
-				// 若心跳状态为 dropped, 则需要重新注册
-				var (
-					relies = make([]string, 0, len(cli.Relies))
-					res    *pb.RegisterResponse
-				)
-				for _, r := range cli.Relies {
-					relies = append(relies, r.Topic)
-				}
-				if res, err = cli.proto.Register(cli.ctx, &pb.RegisterRequest{
-					Schema: cli.Schema,
-					Relies: relies,
-					Topic:  cli.Topic,
-					Ip:     cli.Ip,
-					Port:   cli.Prot,
-				}); err != nil {
-					fmt.Println(err)
-					continue
-				}
-				cli.fromService(res.Service)
-				// 如果状态为 changed 则需要更新依赖服务，重新向服务端发送确认信息，确保服务可用
-				if cli.Status == pb.HeartBeatType_HeartBeat_CHANGED {
-					if _, err = cli.proto.Conform(cli.ctx, &pb.ConformRequest{
-						Topic: cli.Topic,
-						Id:    cli.Id,
-					}); err != nil {
-						fmt.Println(err)
-						continue
-					}
-					cli.Status = pb.HeartBeatType_HeartBeat_RUNNING
-				}
 			}
-		case <-cli.cancel:
-			cancel()
-			return
 		}
 	}
 }
 
+// 确认
+//
+//	会话可用时通过会话发送，否则使用单次调用
+func (cli *client) conform(sess *session) error {
+	if sess != nil {
+		return sess.send(pb.SessionRequestType_SESSION_CONFORM)
+	}
+	_, err := cli.proto.Conform(cli.ctx, &pb.ConformRequest{
+		Namespace: cli.Namespace,
+		Topic:     cli.Topic,
+		Id:        cli.Id,
+	})
+	return err
+}
+
+// 会话
+//
+//	注册中心在会话断开时立即将服务置为 pending，因此同一个 id 只保持一条会话
+type session struct {
+	stream    pb.Airfone_SessionClient
+	cancel    context.CancelFunc
+	namespace string
+	topic     string
+	id        int64
+	res       chan *pb.Keepalive // 心跳的响应以及注册中心的推送
+	err       chan error         // 会话断开的原因
+}
+
+// 建立会话，并发送第一次心跳
+func (cli *client) session() (*session, error) {
+	ctx, cancel := context.WithCancel(cli.ctx)
+	stream, err := cli.proto.Session(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	sess := &session{
+		stream:    stream,
+		cancel:    cancel,
+		namespace: cli.Namespace,
+		topic:     cli.Topic,
+		id:        cli.Id,
+		res:       make(chan *pb.Keepalive),
+		err:       make(chan error, 1),
+	}
+	if err = sess.send(pb.SessionRequestType_SESSION_HEARTBEAT); err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				sess.err <- err
+				return
+			}
+			select {
+			case sess.res <- res.Keepalive:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sess, nil
+}
+
+func (sess *session) send(typ pb.SessionRequestType) error {
+	return sess.stream.Send(&pb.SessionRequest{
+		Namespace: sess.namespace,
+		Topic:     sess.topic,
+		Id:        sess.id,
+		Type:      typ,
+	})
+}
+
+// 会话为 nil 时返回 nil 通道，select 时不会被选中
+func (sess *session) recv() <-chan *pb.Keepalive {
+	if sess == nil {
+		return nil
+	}
+	return sess.res
+}
+
+func (sess *session) fail() <-chan error {
+	if sess == nil {
+		return nil
+	}
+	return sess.err
+}
+
+func (sess *session) close() {
+	if sess != nil {
+		sess.cancel()
+	}
+}
+
 // 只需要填写需要修改的配置项
 //
-//	当需要将元数据或依赖从 n 个修改为 0 个
-//	传入 make([]string,0) 或 make([]*pb.Schema,0)
+//	当需要将元数据、依赖或标签从 n 个修改为 0 个
+//	传入 make([]string,0)、make([]*pb.Schema,0) 或 make(map[string]string)
 type UpdateConfig struct {
-	Schema []*pb.Schema // 元数据
-	Relies []string     // 依赖的 topic 名
-	IP     string       // ip
-	Port   int32        // 端口
+	Schema   []*pb.Schema      // 元数据
+	Relies   []string          // 依赖的 topic 名，可以附加版本约束与标签选择器
+	Labels   map[string]string // 标签
+	Version  string            // 语义化版本
+	IP       string            // ip
+	Port     int32             // 端口
+	Selector string            // 负载均衡策略
+	Weight   int32             // 权重
+	Region   string            // 地域
+	Zone     string            // 可用区(机房)
+	Rack     string            // 机架
 }
 
 // 主动更新
@@ -196,20 +430,32 @@ func (cli *client) Update(cfg *UpdateConfig) error {
 	)
 	req.Id = cli.Id
 	req.Topic = cli.Topic
+	req.Namespace = cli.Namespace
 	if cfg.IP != "" {
 		req.Ip = cfg.IP
 	}
 	if cfg.Port != 0 {
 		req.Port = cfg.Port
 	}
+	req.Selector = cfg.Selector
+	req.Weight = cfg.Weight
+	req.Region = cfg.Region
+	req.Zone = cfg.Zone
+	req.Rack = cfg.Rack
+	req.Version = cfg.Version
 	if cfg.Relies != nil {
 		req.NeedRelies = true
 		req.Relies = cfg.Relies
+		cli.depends = cfg.Relies
 	}
 	if cfg.Schema != nil {
 		req.NeedSchema = true
 		req.Schema = cfg.Schema
 	}
+	if cfg.Labels != nil {
+		req.NeedLabels = true
+		req.Labels = cfg.Labels
+	}
 	if res, err = cli.proto.Update(cli.ctx, req); err != nil {
 		return err
 	}
@@ -224,8 +470,9 @@ func (cli *client) Update(cfg *UpdateConfig) error {
 		// todo
 		fmt.Println("更新: 服务变更")
 		if _, err = cli.proto.Conform(cli.ctx, &pb.ConformRequest{
-			Topic: cli.Topic,
-			Id:    cli.Id,
+			Namespace: cli.Namespace,
+			Topic:     cli.Topic,
+			Id:        cli.Id,
 		}); err != nil {
 			return err
 		}
@@ -236,8 +483,9 @@ func (cli *client) Update(cfg *UpdateConfig) error {
 // 注销
 func (cli *client) Logout() error {
 	if _, err := cli.proto.Logout(cli.ctx, &pb.LogoutRequest{
-		Topic: cli.Topic,
-		Id:    cli.Id,
+		Namespace: cli.Namespace,
+		Topic:     cli.Topic,
+		Id:        cli.Id,
 	}); err != nil {
 		return err
 	}
@@ -255,11 +503,60 @@ func (cli *client) fromService(serv *pb.Service) {
 	cli.Ip = serv.Ip
 	cli.Prot = serv.Prot
 	cli.Topic = serv.Topic
+	cli.Namespace = serv.Namespace
 	cli.Status = serv.Status
 	cli.Schema = serv.Schema
+	cli.Selector = serv.Selector
+	cli.Weight = serv.Weight
+	cli.Region = serv.Region
+	cli.Zone = serv.Zone
+	cli.Rack = serv.Rack
+	cli.Lease = serv.Lease
+	cli.Instance = serv.Instance
+	cli.Labels = serv.Labels
+	cli.Version = serv.Version
+	cli.Unresolved = serv.Unresolved
 	cli.setRelies(serv.Relies)
 }
 
+// 发送注册请求
+//
+//	为这次注册生成幂等令牌，超时或注册中心暂时不可用时携带相同的令牌重试，
+//	注册中心收到重复的请求时直接返回已有的服务，不会注册出两个服务
+func (cli *client) register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	var (
+		token = make([]byte, 16)
+		res   *pb.RegisterResponse
+		err   error
+	)
+	if _, err = rand.Read(token); err != nil {
+		return nil, err
+	}
+	req.Token = hex.EncodeToString(token)
+	for i := 0; i < REGISTER_RETRY; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * REGISTER_BACKOFF)
+		}
+		if res, err = cli.proto.Register(ctx, req); err == nil {
+			return res, nil
+		}
+		if code := status.Code(err); code != codes.Unavailable && code != codes.DeadlineExceeded {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// 心跳间隔
+//
+//	使用服务端授予的租约，服务端未返回时使用默认值
+func (cli *client) heartbeat() time.Duration {
+	if cli.Lease.GetHeartbeat() > 0 {
+		return time.Duration(cli.Lease.GetHeartbeat()) * time.Millisecond
+	}
+	return DURATION_HEARTBEAT
+}
+
 // 更新 Relies
 //
 //	以前存在的依赖不会受到印象
@@ -267,6 +564,7 @@ func (cli *client) updateRelies(rely []*pb.Rely) {
 	for _, r := range rely {
 		cli.Relies[r.Topic] = r
 	}
+	cli.pool.update(rely)
 }
 
 // 设置 Relies
@@ -280,4 +578,76 @@ func (cli *client) setRelies(rely []*pb.Rely) {
 		newRelies[r.Topic] = r
 	}
 	cli.Relies = newRelies
+	cli.pool.set(rely)
+}
+
+// 监听
+//
+//	监听一组主题，主题中的服务注册、删除、状态变化时回调 fn，直到 ctx 结束
+//	主题属于 cli.Namespace，其他命名空间的主题写作 命名空间/topic
+//	连接断开(或服务端因消费过慢断开)后，从最后收到的 revision 重新监听，服务端会补发期间的事件，
+//	无法补发时先收到 WATCH_RESET，再收到当前全部服务，最后是 WATCH_SYNCED
+func (cli *client) Watch(ctx context.Context, topics []string, fn func(*pb.WatchEvent)) error {
+	var revision int64
+	for {
+		stream, err := cli.proto.Watch(ctx, &pb.WatchRequest{
+			Namespace: cli.Namespace,
+			Topics:    topics,
+			Revision:  revision,
+		})
+		for err == nil {
+			var ev *pb.WatchEvent
+			if ev, err = stream.Recv(); err == nil {
+				if ev.Revision != 0 {
+					revision = ev.Revision
+				}
+				fn(ev)
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fmt.Println(err)
+		select {
+		case <-time.After(WATCH_BACKOFF):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// 查询
+//
+//	列出主题中的服务，不需要先注册，topics 为空时查询 cli.Namespace 中的全部主题
+//	其他命名空间的主题写作 命名空间/topic
+//	status 为空时不按状态过滤
+func (cli *client) Discover(ctx context.Context, topics []string, status ...pb.HeartBeatType) ([]*pb.Discover, error) {
+	res, err := cli.proto.Discover(ctx, &pb.DiscoverRequest{
+		Namespace: cli.Namespace,
+		Topics:    topics,
+		Status:    status,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Instances, nil
+}
+
+// 查询状态变化的事件
+//
+//	按主题、id 与时间范围过滤，为空的条件不过滤，since/until 为零值时不限制
+//	主题为限定名，默认命名空间以外的主题写作 命名空间/topic
+func (cli *client) Events(ctx context.Context, topic string, id int64, since, until time.Time) ([]*pb.Event, error) {
+	req := &pb.ListEventsRequest{Topic: topic, Id: id}
+	if !since.IsZero() {
+		req.Since = since.UnixMilli()
+	}
+	if !until.IsZero() {
+		req.Until = until.UnixMilli()
+	}
+	res, err := cli.proto.ListEvents(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Events, nil
 }
@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// 客户端的选项
+type Option func(o *options)
+
+type options struct {
+	token    string      // 注册中心开启认证时的凭证
+	tls      *tls.Config // 连接注册中心的 TLS 配置，为空且没有证书文件时不使用 TLS
+	caFile   string      // 校验注册中心证书的 CA，为空则使用系统的根证书
+	certFile string      // 客户端证书，mTLS 时使用
+	keyFile  string      // 客户端私钥
+}
+
+// 认证使用的 API 令牌或 JWT，每个请求都通过 authorization 头携带
+//
+//	注册的服务绑定到该凭证的身份，之后的更新、注销、心跳、确认与会话需要使用同一身份
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// 通过 TLS 连接注册中心，证书均为 PEM 文件
+//
+//	caFile 为空时使用系统的根证书校验注册中心；certFile 与 keyFile 不为空时出示客户端证书(mTLS)，
+//	注册中心开启认证时，证书中的 SAN 对应的身份可以代替令牌
+func WithTLS(caFile, certFile, keyFile string) Option {
+	return func(o *options) {
+		o.caFile = caFile
+		o.certFile = certFile
+		o.keyFile = keyFile
+		if o.tls == nil {
+			o.tls = &tls.Config{}
+		}
+	}
+}
+
+// 使用自定义的 TLS 配置连接注册中心，如指定 ServerName 或者从内存中加载证书
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg.Clone()
+	}
+}
+
+// 根据选项生成连接参数
+func (o *options) dialOptions() ([]grpc.DialOption, error) {
+	security, err := o.security()
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.DialOption{security}
+	if o.token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredential(o.token)))
+	}
+	return opts, nil
+}
+
+// 传输层的安全配置，未指定 TLS 时不加密
+func (o *options) security() (grpc.DialOption, error) {
+	if o.tls == nil {
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+	cfg := o.tls
+	if o.caFile != "" {
+		b, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("load ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("load ca: no certificate in %s", o.caFile)
+		}
+	}
+	if o.certFile != "" || o.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
+
+// 令牌凭证
+type tokenCredential string
+
+func (t tokenCredential) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredential) RequireTransportSecurity() bool {
+	return false
+}
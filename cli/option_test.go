@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "cli/api/airfone"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// 签发证书并写入 dir，parent 为空时生成自签名的 CA，返回证书、私钥与证书文件、私钥文件的路径
+func issue(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		certFile = filepath.Join(dir, name+".crt")
+		keyFile  = filepath.Join(dir, name+".key")
+	)
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+// 记录客户端证书的注册中心
+type tlsServer struct {
+	pb.UnimplementedAirfoneServer
+	names chan []string
+}
+
+func (s *tlsServer) Discover(ctx context.Context, req *pb.DiscoverRequest) (*pb.DiscoverResponse, error) {
+	var names []string
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			names = info.State.VerifiedChains[0][0].DNSNames
+		}
+	}
+	s.names <- names
+	return &pb.DiscoverResponse{}, nil
+}
+
+// WithTLS 以 CA 校验注册中心的证书，并出示客户端证书；要求客户端证书时不出示证书的连接被拒绝
+func TestWithTLS(t *testing.T) {
+	var (
+		dir                        = t.TempDir()
+		ca, caKey, caFile, _       = issue(t, dir, "ca", nil, nil)
+		_, _, serverFile, serverKF = issue(t, dir, "localhost", ca, caKey)
+		_, _, clientFile, clientKF = issue(t, dir, "logsvc", ca, caKey)
+		srv                        = &tlsServer{names: make(chan []string, 1)}
+	)
+	cert, err := tls.LoadX509KeyPair(serverFile, serverKF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+	pb.RegisterAirfoneServer(gs, srv)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = gs.Serve(lis) }()
+	defer gs.Stop()
+
+	discover := func(opts ...Option) error {
+		t.Helper()
+		cli, err := NewCli(lis.Addr().String(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = cli.Discover(ctx, nil)
+		return err
+	}
+
+	if err := discover(WithTLS(caFile, clientFile, clientKF)); err != nil {
+		t.Fatalf("discover with client certificate: %v", err)
+	}
+	if names := <-srv.names; len(names) != 1 || names[0] != "logsvc" {
+		t.Errorf("client certificate names = %v, want [logsvc]", names)
+	}
+	if err := discover(WithTLS(caFile, "", "")); err == nil {
+		t.Error("discover without client certificate succeeded")
+	}
+	if err := discover(); err == nil {
+		t.Error("discover without tls succeeded")
+	}
+	if _, err := NewCli(lis.Addr().String(), WithTLS(filepath.Join(dir, "missing.crt"), "", "")); err == nil {
+		t.Error("missing ca file accepted")
+	}
+}
@@ -0,0 +1,152 @@
+package cli
+
+import (
+	pb "cli/api/airfone"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 客户端负载均衡
+//
+//	全量模式(Config.AllInstances)下，注册、心跳与会话推送的结果中携带每个依赖 topic 中全部可用的提供者，
+//	Pick 在其中按权重随机选择一个，优先选择同一可用区、其次同一地域的提供者
+//	调用提供者失败时通过 Fail 在本地剔除，EJECT_DURATION 之后自动恢复，不必等到注册中心发现它不可用；
+//	全部提供者都被剔除时忽略剔除，避免因为误判而完全不可用
+//	不是全量模式时，Pick 返回注册中心分配的依赖
+const EJECT_DURATION = 10 * time.Second
+
+// 没有可用的提供者
+var ErrNoEndpoint = errors.New("no available endpoint")
+
+// 各依赖 topic 的提供者与本地剔除的记录
+type balancer struct {
+	sync.Mutex
+	endpoints map[string][]*pb.Endpoint // map[topic]提供者
+	ejected   map[int64]time.Time       // map[id]恢复时间
+	rand      *rand.Rand
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		endpoints: make(map[string][]*pb.Endpoint),
+		ejected:   make(map[int64]time.Time),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// 依赖中的提供者，不是全量模式时只有分配的提供者
+func endpointsOf(r *pb.Rely) []*pb.Endpoint {
+	if len(r.Instances) > 0 {
+		return r.Instances
+	}
+	return []*pb.Endpoint{{Id: r.Id, Ip: r.Ip, Port: r.Port}}
+}
+
+// 清空以前全部的提供者，重新获取当前依赖中的提供者
+func (b *balancer) set(rely []*pb.Rely) {
+	b.Lock()
+	defer b.Unlock()
+	b.endpoints = make(map[string][]*pb.Endpoint, len(rely))
+	for _, r := range rely {
+		b.endpoints[r.Topic] = endpointsOf(r)
+	}
+}
+
+// 只更新这些依赖中的提供者
+func (b *balancer) update(rely []*pb.Rely) {
+	b.Lock()
+	defer b.Unlock()
+	for _, r := range rely {
+		b.endpoints[r.Topic] = endpointsOf(r)
+	}
+}
+
+// 选择一个提供者
+//
+//	先排除被剔除的，全部被剔除时不排除；再按同一可用区、同一地域依次缩小范围；最后按权重随机
+func (b *balancer) pick(topic, region, zone string) (*pb.Endpoint, error) {
+	b.Lock()
+	defer b.Unlock()
+	var (
+		list      = b.endpoints[topic]
+		now       = time.Now()
+		available = make([]*pb.Endpoint, 0, len(list))
+	)
+	if len(list) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	for _, e := range list {
+		if until, ok := b.ejected[e.Id]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(b.ejected, e.Id)
+		}
+		available = append(available, e)
+	}
+	if len(available) == 0 {
+		available = list
+	}
+	if zone != "" {
+		available = prefer(available, func(e *pb.Endpoint) bool { return e.Region == region && e.Zone == zone })
+	}
+	if region != "" {
+		available = prefer(available, func(e *pb.Endpoint) bool { return e.Region == region })
+	}
+
+	var total int64
+	for _, e := range available {
+		total += weightOf(e)
+	}
+	n := b.rand.Int63n(total)
+	for _, e := range available {
+		if n -= weightOf(e); n < 0 {
+			return e, nil
+		}
+	}
+	return available[len(available)-1], nil
+}
+
+// 剔除提供者
+func (b *balancer) eject(id int64) {
+	b.Lock()
+	defer b.Unlock()
+	b.ejected[id] = time.Now().Add(EJECT_DURATION)
+}
+
+// 满足条件的提供者，没有时返回原来的列表
+func prefer(list []*pb.Endpoint, fn func(*pb.Endpoint) bool) []*pb.Endpoint {
+	res := make([]*pb.Endpoint, 0, len(list))
+	for _, e := range list {
+		if fn(e) {
+			res = append(res, e)
+		}
+	}
+	if len(res) == 0 {
+		return list
+	}
+	return res
+}
+
+// 权重，不填视为 1
+func weightOf(e *pb.Endpoint) int64 {
+	if e.Weight > 0 {
+		return int64(e.Weight)
+	}
+	return 1
+}
+
+// 选择依赖 topic 的一个提供者
+//
+//	全量模式下在全部可用的提供者中做负载均衡，否则返回注册中心分配的提供者
+//	没有可用的提供者时返回 ErrNoEndpoint
+func (cli *client) Pick(topic string) (*pb.Endpoint, error) {
+	return cli.pool.pick(topic, cli.Region, cli.Zone)
+}
+
+// 调用提供者失败，在本地剔除它 EJECT_DURATION
+func (cli *client) Fail(id int64) {
+	cli.pool.eject(id)
+}
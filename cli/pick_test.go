@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pb "cli/api/airfone"
+)
+
+// 全量模式下的依赖
+func testBalancer(instances ...*pb.Endpoint) *balancer {
+	b := newBalancer()
+	b.set([]*pb.Rely{{Topic: "log", Id: instances[0].Id, Ip: instances[0].Ip, Port: instances[0].Port, Instances: instances}})
+	return b
+}
+
+// 多次选择得到的提供者
+func picked(t *testing.T, b *balancer, region, zone string) map[int64]int {
+	t.Helper()
+	seen := make(map[int64]int)
+	for i := 0; i < 200; i++ {
+		e, err := b.pick("log", region, zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[e.Id]++
+	}
+	return seen
+}
+
+// 剔除的提供者在恢复之前不会被选择，全部被剔除时忽略剔除
+func TestPickEjected(t *testing.T) {
+	b := testBalancer(&pb.Endpoint{Id: 1}, &pb.Endpoint{Id: 2}, &pb.Endpoint{Id: 3})
+	b.eject(1)
+	b.eject(2)
+	if seen := picked(t, b, "", ""); len(seen) != 1 || seen[3] == 0 {
+		t.Errorf("picked %v, want only 3", seen)
+	}
+	b.eject(3)
+	if seen := picked(t, b, "", ""); len(seen) != 3 {
+		t.Errorf("picked %v with all ejected, want all", seen)
+	}
+
+	// 到期后恢复
+	b.ejected[1] = time.Now().Add(-time.Second)
+	b.ejected[2] = time.Now().Add(time.Minute)
+	b.ejected[3] = time.Now().Add(time.Minute)
+	if seen := picked(t, b, "", ""); len(seen) != 1 || seen[1] == 0 {
+		t.Errorf("picked %v, want only the recovered 1", seen)
+	}
+	if _, ok := b.ejected[1]; ok {
+		t.Error("expired ejection kept")
+	}
+}
+
+// 优先选择同一可用区，其次同一地域的提供者，被剔除后回退
+func TestPickLocality(t *testing.T) {
+	b := testBalancer(
+		&pb.Endpoint{Id: 1, Region: "cn", Zone: "a"},
+		&pb.Endpoint{Id: 2, Region: "cn", Zone: "b"},
+		&pb.Endpoint{Id: 3, Region: "us", Zone: "a"},
+	)
+	tests := []struct {
+		name   string
+		region string
+		zone   string
+		want   []int64
+	}{
+		{"same zone", "cn", "a", []int64{1}},
+		{"zone name in another region", "us", "a", []int64{3}},
+		{"same region", "cn", "c", []int64{1, 2}},
+		{"no match", "eu", "a", []int64{1, 2, 3}},
+		{"no locality", "", "", []int64{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := picked(t, b, tt.region, tt.zone)
+			if len(seen) != len(tt.want) {
+				t.Fatalf("picked %v, want %v", seen, tt.want)
+			}
+			for _, id := range tt.want {
+				if seen[id] == 0 {
+					t.Errorf("picked %v, want %v", seen, tt.want)
+				}
+			}
+		})
+	}
+	b.eject(1)
+	if seen := picked(t, b, "cn", "a"); len(seen) != 1 || seen[2] == 0 {
+		t.Errorf("picked %v after ejecting the zone, want the region", seen)
+	}
+}
+
+func TestPickWeight(t *testing.T) {
+	b := testBalancer(&pb.Endpoint{Id: 1}, &pb.Endpoint{Id: 2, Weight: 99})
+	if seen := picked(t, b, "", ""); seen[2] < 170 {
+		t.Errorf("weight 99 picked %d/200 times", seen[2])
+	}
+}
+
+// 不是全量模式时返回分配的依赖；更新只替换给出的依赖
+func TestPickAssigned(t *testing.T) {
+	b := newBalancer()
+	b.set([]*pb.Rely{{Topic: "log", Id: 7, Ip: "10.0.0.7", Port: 80}, {Topic: "common", Id: 8}})
+	if e, err := b.pick("log", "", ""); err != nil || e.Id != 7 || e.Ip != "10.0.0.7" {
+		t.Errorf("pick = %v, %v, want the assigned provider", e, err)
+	}
+	b.update([]*pb.Rely{{Topic: "log", Id: 9}})
+	if e, _ := b.pick("log", "", ""); e.Id != 9 {
+		t.Errorf("pick after update = %d, want 9", e.Id)
+	}
+	if e, _ := b.pick("common", "", ""); e.Id != 8 {
+		t.Errorf("pick of untouched rely = %d, want 8", e.Id)
+	}
+	if _, err := b.pick("nope", "", ""); !errors.Is(err, ErrNoEndpoint) {
+		t.Errorf("pick of unknown topic error = %v, want ErrNoEndpoint", err)
+	}
+	b.set(nil)
+	if _, err := b.pick("log", "", ""); !errors.Is(err, ErrNoEndpoint) {
+		t.Errorf("pick after reset error = %v, want ErrNoEndpoint", err)
+	}
+}